@@ -0,0 +1,325 @@
+// Package cassette records HTTP exchanges into a file and replays them later.
+//
+// It is meant for reproducing problems with a specific Fritz!Box or CardDAV server: a run is recorded at the
+// user's site and replayed locally without any network access.
+// Credentials, digest nonces and session IDs are redacted before the exchanges are stored.
+package cassette
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Cassette stores HTTP exchanges. It is safe for concurrent use.
+//
+// A recording cassette passes all requests to the wrapped transports and records them.
+// A replaying cassette answers requests with the recorded responses and never accesses the network.
+type Cassette struct {
+	mutex        sync.Mutex
+	interactions []*Interaction
+	path         string
+	replay       bool
+}
+
+// Interaction is a recorded HTTP exchange.
+type Interaction struct {
+	// Error is the message of the error returned by the transport instead of a response.
+	Error    string    `json:"error,omitempty"`
+	Request  Request   `json:"request"`
+	Response *Response `json:"response,omitempty"`
+
+	used bool
+}
+
+// Request is a recorded HTTP request.
+type Request struct {
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+}
+
+// Response is a recorded HTTP response.
+type Response struct {
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	Status       string      `json:"status"`
+	StatusCode   int         `json:"statusCode"`
+}
+
+// transport records or replays the requests sent via a transport.
+type transport struct {
+	cassette  *Cassette
+	transport http.RoundTripper
+}
+
+const (
+	base64Encoding = "base64"
+	redacted       = "REDACTED"
+	// redactedSID is a valid session ID which is used instead of the real ones.
+	redactedSID = "0000000000000000"
+)
+
+var (
+	digestParams = regexp.MustCompile(`\b(nonce|nextnonce|cnonce|response|rspauth|username|opaque)="[^"]*"`)
+	// sessionIDs matches the session IDs of the Fritz!Box web interface in URLs, forms, SOAP responses and
+	// multipart bodies.
+	sessionIDs = regexp.MustCompile(`(\bsid=|name="sid"\r\n\r\n)[0-9a-fA-F]+`)
+	// headers maps the redacted headers to functions redacting their values.
+	headers = map[string]func(string) string{
+		"Authentication-Info": redactDigest,
+		"Authorization":       redactAuthorization,
+		"Cookie":              redactAll,
+		"Proxy-Authorization": redactAuthorization,
+		"Set-Cookie":          redactAll,
+		"Www-Authenticate":    redactDigest,
+	}
+)
+
+// NewRecorder creates a cassette which records all exchanges.
+// They are written to the file at path by Save. The file is created immediately to detect errors early.
+func NewRecorder(path string) (*Cassette, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return &Cassette{path: path}, nil
+}
+
+// Load reads the cassette at path for replaying its exchanges.
+func Load(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{path: path, replay: true}
+	if err := json.Unmarshal(data, &c.interactions); err != nil {
+		return nil, fmt.Errorf("cannot parse cassette %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Save writes the recorded exchanges to the file of the cassette.
+// It does nothing if the cassette replays exchanges.
+func (c *Cassette) Save() error {
+	if c.replay {
+		return nil
+	}
+	c.mutex.Lock()
+	data, err := json.MarshalIndent(c.interactions, "", "  ")
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, append(data, '\n'), 0600)
+}
+
+// Transport returns a transport which records the exchanges performed via base or replays them.
+// A nil base means http.DefaultTransport.
+// Several transports (e.g. with different TLS configurations) may share one cassette.
+func (c *Cassette) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{cassette: c, transport: base}
+}
+
+// Unused returns the recorded exchanges which have not been replayed.
+// It returns nil if the cassette records exchanges.
+func (c *Cassette) Unused() []*Interaction {
+	if !c.replay {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var unused []*Interaction
+	for _, i := range c.interactions {
+		if !i.used {
+			unused = append(unused, i)
+		}
+	}
+	return unused
+}
+
+// RoundTrip is part of the http.RoundTripper interface.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	request, body, err := newRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.cassette.replay {
+		return t.cassette.replayExchange(req, request)
+	}
+
+	if req.Body != nil {
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	interaction := &Interaction{Request: *request}
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		interaction.Error = err.Error()
+	} else {
+		if interaction.Response, err = newResponse(resp); err != nil {
+			return nil, err
+		}
+	}
+	t.cassette.mutex.Lock()
+	t.cassette.interactions = append(t.cassette.interactions, interaction)
+	t.cassette.mutex.Unlock()
+	return resp, err
+}
+
+// replayExchange returns the first unused recorded response for a request with the same method, URL and body.
+// If there is none, the body is ignored because it may contain random parts (e.g. multipart boundaries).
+func (c *Cassette) replayExchange(req *http.Request, request *Request) (*http.Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	interaction := c.find(request, true)
+	if interaction == nil {
+		interaction = c.find(request, false)
+	}
+	if interaction == nil {
+		return nil, fmt.Errorf("cassette %s contains no response for %s %s", c.path, request.Method, request.URL)
+	}
+	interaction.used = true
+
+	if interaction.Error != "" {
+		return nil, errors.New(interaction.Error)
+	}
+	recorded := interaction.Response
+	body, err := decodeBody(recorded.Body, recorded.BodyEncoding)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Header:        recorded.Header.Clone(),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Status:        recorded.Status,
+		StatusCode:    recorded.StatusCode,
+	}, nil
+}
+
+func (c *Cassette) find(request *Request, sameBody bool) *Interaction {
+	for _, i := range c.interactions {
+		if i.used || i.Request.Method != request.Method || i.Request.URL != request.URL {
+			continue
+		}
+		if !sameBody || i.Request.Body == request.Body && i.Request.BodyEncoding == request.BodyEncoding {
+			return i
+		}
+	}
+	return nil
+}
+
+func newRequest(req *http.Request) (*Request, []byte, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, nil, err
+		}
+		_ = req.Body.Close()
+	}
+	request := &Request{
+		Header: redactHeader(req.Header),
+		Method: req.Method,
+		URL:    redactSessionIDs(req.URL.String()),
+	}
+	request.Body, request.BodyEncoding = encodeBody(body)
+	return request, body, nil
+}
+
+// newResponse records resp and replaces its body with a buffered copy.
+func newResponse(resp *http.Response) (*Response, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	response := &Response{
+		Header:     redactHeader(resp.Header),
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+	}
+	response.Body, response.BodyEncoding = encodeBody(body)
+	return response, nil
+}
+
+func decodeBody(body, encoding string) ([]byte, error) {
+	if encoding == base64Encoding {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+// encodeBody returns the body as string. Binary bodies (e.g. photos) are base64 encoded.
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return redactSessionIDs(string(body)), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), base64Encoding
+}
+
+func redactAll(string) string {
+	return redacted
+}
+
+// redactAuthorization keeps the scheme of an authorization header and redacts the credentials.
+func redactAuthorization(value string) string {
+	if strings.HasPrefix(value, "Digest ") {
+		return redactDigest(value)
+	}
+	if i := strings.Index(value, " "); i >= 0 {
+		return value[:i+1] + redacted
+	}
+	return redacted
+}
+
+// redactDigest redacts the nonces and credentials of a digest authentication header but keeps it parsable.
+func redactDigest(value string) string {
+	return digestParams.ReplaceAllString(value, `$1="`+redacted+`"`)
+}
+
+func redactHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	result := http.Header{}
+	for name, values := range header {
+		redact := headers[http.CanonicalHeaderKey(name)]
+		for _, value := range values {
+			if redact != nil {
+				value = redact(value)
+			}
+			result.Add(name, value)
+		}
+	}
+	return result
+}
+
+func redactSessionIDs(s string) string {
+	return sessionIDs.ReplaceAllString(s, "${1}"+redactedSID)
+}
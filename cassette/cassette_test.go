@@ -0,0 +1,230 @@
+package cassette
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testNonce  = "4F3A8C1D2E5B6A79"
+	testSID    = "a1b2c3d4e5f60718"
+	testCookie = "session=c0ffee"
+)
+
+func TestRecordRedactsSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("WWW-Authenticate",
+			`Digest realm="F!Box SOAP-Auth", nonce="`+testNonce+`", algorithm=MD5, qop="auth", opaque="0pa9ue"`)
+		w.Header().Set("Authentication-Info", `nextnonce="`+testNonce+`"`)
+		w.Header().Set("Set-Cookie", testCookie)
+		_, _ = w.Write([]byte("<NewX_AVM-DE_UrlSID>sid=" + testSID + "</NewX_AVM-DE_UrlSID>"))
+	}))
+	defer server.Close()
+	path := filepath.Join(tempDir(t), "cassette.json")
+	tape, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := tape.Transport(nil)
+
+	req := newTestRequest(t, http.MethodPost, server.URL+"/nas/api/data.lua?sid="+testSID,
+		"--boundary\r\nContent-Disposition: form-data; name=\"sid\"\r\n\r\n"+testSID+"\r\n--boundary--\r\n")
+	req.Header.Set("Authorization", `Digest username="admin", realm="F!Box SOAP-Auth", nonce="`+testNonce+
+		`", uri="/upnp/control/x_contact", response="0123456789abcdef0123456789abcdef", qop=auth, nc=00000001, `+
+		`cnonce="deadbeef"`)
+	req.Header.Set("Cookie", testCookie)
+	roundTrip(t, transport, req)
+	basic := newTestRequest(t, http.MethodGet, server.URL+"/carddav/", "")
+	basic.SetBasicAuth("admin", "secret")
+	roundTrip(t, transport, basic)
+	if err := tape.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{testNonce, testSID, testCookie, "admin", "0123456789abcdef0123456789abcdef",
+		"deadbeef", "0pa9ue", "YWRtaW46c2VjcmV0"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("the cassette contains the secret %q:\n%s", secret, data)
+		}
+	}
+	for _, kept := range []string{`Digest username=\"REDACTED\"`, `realm=\"F!Box SOAP-Auth\"`, "nc=00000001",
+		"Basic REDACTED", "sid=" + redactedSID, `name=\"sid\"\r\n\r\n` + redactedSID} {
+		if !bytes.Contains(data, []byte(kept)) {
+			t.Errorf("expected the cassette to contain %q:\n%s", kept, data)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(tempDir(t), "cassette.json")
+	responses := map[string][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		key := req.URL.Path + " " + string(body)
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(responses[key][0]))
+		responses[key] = responses[key][1:]
+	}))
+	responses["/count "] = []string{"1", "2"}
+	responses["/upnp a"] = []string{"A"}
+	responses["/upnp b"] = []string{"B"}
+	responses["/photo "] = []string{"\xff\xd8\xff\xe0binary"}
+
+	tape, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := tape.Transport(nil)
+	for _, r := range []struct{ method, path, body string }{
+		{http.MethodGet, "/count?sid=" + testSID, ""},
+		{http.MethodGet, "/count?sid=" + testSID, ""},
+		{http.MethodPost, "/upnp", "a"},
+		{http.MethodPost, "/upnp", "b"},
+		{http.MethodGet, "/photo", ""},
+	} {
+		roundTrip(t, transport, newTestRequest(t, r.method, server.URL+r.path, r.body))
+	}
+	server.Close()
+	// the connection is refused now
+	if _, err := transport.RoundTrip(newTestRequest(t, http.MethodGet, server.URL+"/gone", "")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := tape.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tape, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport = tape.Transport(nil)
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "matching body", method: http.MethodPost, path: "/upnp", body: "b", want: "B"},
+		{name: "first of repeated requests", method: http.MethodGet, path: "/count?sid=" + testSID, want: "1"},
+		{name: "other session ID", method: http.MethodGet, path: "/count?sid=0123456789abcdef", want: "2"},
+		{name: "repeated request exhausted", method: http.MethodGet, path: "/count?sid=" + testSID, wantErr: true},
+		{name: "binary body", method: http.MethodGet, path: "/photo", want: "\xff\xd8\xff\xe0binary"},
+		{name: "recorded error", method: http.MethodGet, path: "/gone", wantErr: true},
+		{name: "other method", method: http.MethodGet, path: "/upnp", wantErr: true},
+		{name: "unknown URL", method: http.MethodGet, path: "/unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		resp, err := transport.RoundTrip(newTestRequest(t, tt.method, server.URL+tt.path, tt.body))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != tt.want || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("%s: expected %q, got %d %q (%v)", tt.name, tt.want, resp.StatusCode, body, resp.Header)
+		}
+	}
+
+	unused := tape.Unused()
+	if len(unused) != 1 || unused[0].Request.URL != server.URL+"/upnp" || unused[0].Request.Body != "a" {
+		t.Errorf("expected the request with body “a” to be unused, got %v", unused)
+	}
+	// a request with another body gets the remaining response for the URL, e.g. for random multipart boundaries
+	resp, err := transport.RoundTrip(newTestRequest(t, http.MethodPost, server.URL+"/upnp", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "A" {
+		t.Errorf("expected the remaining response, got %q", body)
+	}
+}
+
+func TestReplayDoesNotAccessTheNetwork(t *testing.T) {
+	path := filepath.Join(tempDir(t), "cassette.json")
+	if err := ioutil.WriteFile(path, []byte("[]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tape, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := false
+	base := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		used = true
+		return nil, errors.New("network access")
+	})
+	_, err = tape.Transport(base).RoundTrip(newTestRequest(t, http.MethodGet, "http://fritz.box/tr64desc.xml", ""))
+	if err == nil || !strings.Contains(err.Error(), "contains no response for GET http://fritz.box/tr64desc.xml") {
+		t.Errorf("expected an error about the missing response, got %v", err)
+	}
+	if used {
+		t.Error("a replaying cassette must not use the network")
+	}
+	if err := tape.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "[]" {
+		t.Errorf("a replaying cassette must not be overwritten, got %q", data)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func newTestRequest(t *testing.T, method, url, body string) *http.Request {
+	t.Helper()
+	var req *http.Request
+	var err error
+	if body == "" {
+		req, err = http.NewRequest(method, url, nil)
+	} else {
+		req, err = http.NewRequest(method, url, strings.NewReader(body))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func roundTrip(t *testing.T, transport http.RoundTripper, req *http.Request) {
+	t.Helper()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli"
 
+	"github.com/toaster/fritz_sync/cassette"
+	"github.com/toaster/fritz_sync/retry"
 	"github.com/toaster/fritz_sync/sync"
 	"github.com/toaster/fritz_sync/sync/carddav"
 	"github.com/toaster/fritz_sync/sync/fritzbox"
+	"github.com/toaster/fritz_sync/tr064"
 )
 
 func main() {
@@ -42,7 +50,7 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  "fritz_storage_name, fs",
-			Usage: "`NAME` of the Fritz!Box storage for pictures",
+			Usage: "`NAME` of the Fritz!Box storage for pictures; detected from the existing pictures if omitted",
 		},
 		cli.StringFlag{
 			Name:  "fritz_user, fu",
@@ -56,58 +64,351 @@ func main() {
 			Name:  "fritz_sync_id_key, s",
 			Usage: "`KEY` under which source IDs are being stored in the Fritz!Box",
 		},
+		cli.IntFlag{
+			Name:  "fritz_image_width",
+			Usage: "`WIDTH` in pixels of the contact photos on the Fritz!Box handsets",
+			Value: fritzbox.DefaultImageOptions.Width,
+		},
+		cli.IntFlag{
+			Name:  "fritz_image_height",
+			Usage: "`HEIGHT` in pixels of the contact photos on the Fritz!Box handsets",
+			Value: fritzbox.DefaultImageOptions.Height,
+		},
+		cli.IntFlag{
+			Name:  "fritz_image_max_bytes",
+			Usage: "maximum `SIZE` in bytes of a contact photo on the Fritz!Box",
+			Value: fritzbox.DefaultImageOptions.MaxBytes,
+		},
+		cli.StringFlag{
+			Name:  "fritz_image_transport",
+			Usage: "`TRANSPORT` for photo transfers: auto (FTP if available, HTTP otherwise), ftp or http",
+			Value: "auto",
+		},
+		cli.BoolFlag{
+			Name:  "fritz_https",
+			Usage: "use HTTPS for TR-064 even if the Fritz!Box URL is a plain HTTP URL",
+		},
+		cli.StringFlag{
+			Name:  "fritz_fingerprint",
+			Usage: "SHA-256 `FINGERPRINT` of the Fritz!Box's self-signed certificate to trust for HTTPS and FTP via TLS",
+		},
+		cli.StringFlag{
+			Name:  "fritz_trust_store",
+			Usage: "`FILE` storing the certificate fingerprints of Fritz!Boxes which are trusted on first use",
+		},
+		cli.StringFlag{
+			Name:  "fritz_web_url",
+			Usage: "`URL` of the Fritz!Box web interface for photo transfers via HTTP (defaults to the Fritz!Box host)",
+		},
+		cli.StringFlag{
+			Name:  "fritz_ftp_tls",
+			Usage: "`MODE` of FTP encryption for photo transfers: off, explicit (falls back to plain FTP for failing uploads) or required",
+			Value: "off",
+		},
+		cli.StringFlag{
+			Name:  "fritz_ftp_fingerprint",
+			Usage: "SHA-256 `FINGERPRINT` of the Fritz!Box's self-signed certificate to trust for FTP via TLS",
+		},
+		cli.IntFlag{
+			Name:  "fritz_ftp_connections",
+			Usage: "maximum `AMOUNT` of parallel FTP connections for photo transfers",
+			Value: 1,
+		},
+		cli.DurationFlag{
+			Name:  "request_timeout",
+			Usage: "maximum `DURATION` of a single request to the Fritz!Box or the CardDAV server (0 for no limit)",
+			Value: 30 * time.Second,
+		},
+		cli.IntFlag{
+			Name:  "retry_attempts",
+			Usage: "maximum `AMOUNT` of attempts for requests failing with transient errors (1 disables retries)",
+			Value: retry.DefaultPolicy.Attempts,
+		},
+		cli.DurationFlag{
+			Name:  "run_timeout",
+			Usage: "maximum `DURATION` of the whole run (0 for no limit)",
+		},
+		cli.StringFlag{
+			Name:  "record",
+			Usage: "record all HTTP requests (without credentials) into the cassette `FILE`; photo transfers default to HTTP, FTP is not recorded",
+		},
+		cli.StringFlag{
+			Name:  "replay",
+			Usage: "answer all HTTP requests from the cassette `FILE` instead of accessing the network; photos are transferred via HTTP",
+		},
 	}
-	app.Action = func(ctx *cli.Context) error {
-		boxURL := ctx.String("fritz_url")
-		phonebookName := ctx.String("fritz_phonebook")
-		fritzUser := ctx.String("fritz_user")
-		fritzPass := ctx.String("fritz_password")
-		syncIDKey := ctx.String("fritz_sync_id_key")
-		storageName := ctx.String("fritz_storage_name")
+	app.Action = syncContacts
+	app.Commands = []cli.Command{
+		{
+			Name:  "gc-images",
+			Usage: "remove contact photos from the Fritz!Box storage which are not used by any phonebook",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "only report the unused photos",
+				},
+			},
+			Action: collectGarbageImages,
+		},
+		{
+			Name:  "discover",
+			Usage: "search for Fritz!Boxes in the local network",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "timeout, t",
+					Usage: "`DURATION` to wait for answers",
+					Value: 3 * time.Second,
+				},
+			},
+			Action: discover,
+		},
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-		ocABooks := ctx.StringSlice("carddav_url")
-		ocUser := ctx.String("carddav_user")
-		ocPass := ctx.String("carddav_password")
+func syncContacts(ctx *cli.Context) error {
+	phonebookName := ctx.String("fritz_phonebook")
+	syncIDKey := ctx.String("fritz_sync_id_key")
 
-		if boxURL == "" {
-			return errors.New("you have to specify the Fritz!Box URL")
-		}
-		if phonebookName == "" {
-			return errors.New("you have to specify the Fritz!Box phonebook name")
-		}
-		if fritzUser == "" {
-			return errors.New("you have to specify the Fritz!Box user")
-		}
-		if fritzPass == "" {
-			return errors.New("you have to specify the Fritz!Box password")
-		}
-		if syncIDKey == "" {
-			return errors.New("you have to specify the Fritz!Box sync ID key")
-		}
-		if len(ocABooks) == 0 {
-			return errors.New("you have to specify at least one CardDAV addressbook URL")
-		}
-		if ocUser == "" {
-			return errors.New("you have to specify the CardDAV user")
-		}
-		if ocPass == "" {
-			return errors.New("you have to specify the CardDAV password")
+	ocABooks := ctx.StringSlice("carddav_url")
+	ocUser := ctx.String("carddav_user")
+	ocPass := ctx.String("carddav_password")
+
+	if phonebookName == "" {
+		return errors.New("you have to specify the Fritz!Box phonebook name")
+	}
+	if syncIDKey == "" {
+		return errors.New("you have to specify the Fritz!Box sync ID key")
+	}
+	if len(ocABooks) == 0 {
+		return errors.New("you have to specify at least one CardDAV addressbook URL")
+	}
+	if ocUser == "" {
+		return errors.New("you have to specify the CardDAV user")
+	}
+	if ocPass == "" {
+		return errors.New("you have to specify the CardDAV password")
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	runCtx, cancel := newRunContext(ctx, logger)
+	defer cancel()
+	retryPolicy := newRetryPolicy(ctx, logger)
+	defer logRetries(logger, retryPolicy)
+	tape, err := newCassette(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeCassette(logger, tape)
+	fritzAdapter, err := newFritzAdapter(runCtx, ctx, phonebookName, syncIDKey, logger, retryPolicy, tape)
+	if err != nil {
+		return err
+	}
+	defer fritzAdapter.Close()
+	var ocAdapters []sync.Reader
+	for _, ocABook := range ocABooks {
+		ocAdapter := carddav.NewAdapter(ocABook, ocUser, ocPass)
+		ocAdapter.SetRetryPolicy(retryPolicy)
+		ocAdapter.SetTimeout(ctx.GlobalDuration("request_timeout"))
+		if tape != nil {
+			ocAdapter.SetTransport(tape.Transport(nil))
 		}
+		ocAdapters = append(ocAdapters, ocAdapter)
+	}
 
-		fritzAdapter, err := fritzbox.NewAdapter(boxURL, phonebookName, fritzUser, fritzPass, storageName, syncIDKey)
-		if err != nil {
-			return err
+	return sync.Sync(runCtx, ocAdapters, fritzAdapter, ctx.StringSlice("carddav_category"), logger)
+}
+
+func collectGarbageImages(ctx *cli.Context) error {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	runCtx, cancel := newRunContext(ctx, logger)
+	defer cancel()
+	retryPolicy := newRetryPolicy(ctx, logger)
+	defer logRetries(logger, retryPolicy)
+	tape, err := newCassette(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeCassette(logger, tape)
+	fritzAdapter, err := newFritzAdapter(runCtx, ctx, "", "", logger, retryPolicy, tape)
+	if err != nil {
+		return err
+	}
+	defer fritzAdapter.Close()
+
+	dryRun := ctx.Bool("dry-run")
+	orphans, err := fritzAdapter.DeleteOrphanedImages(runCtx, dryRun)
+	for _, orphan := range orphans {
+		if dryRun {
+			logger.Println("Unused:", orphan)
+		} else {
+			logger.Println("Deleted:", orphan)
 		}
-		var ocAdapters []sync.Reader
-		for _, ocABook := range ocABooks {
-			ocAdapters = append(ocAdapters, carddav.NewAdapter(ocABook, ocUser, ocPass))
+	}
+	if err != nil {
+		return err
+	}
+	logger.Println("Amount of unused photos:", len(orphans))
+	return nil
+}
+
+func discover(ctx *cli.Context) error {
+	devices, err := tr064.Discover(context.Background(), ctx.Duration("timeout"))
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return errors.New("no Fritz!Box found")
+	}
+	for _, device := range devices {
+		desc := device.Description
+		fmt.Printf("%s\t%s\t%s\t%s\n", desc.Device.Name, desc.SystemVersion.Display, desc.Device.FriendlyName,
+			device.BaseURL)
+	}
+	return nil
+}
+
+// newRunContext returns a context which is cancelled when the run timeout is exceeded.
+// The context carries a stop channel (see sync.WithStop) which is closed when the process receives SIGINT or
+// SIGTERM; requests in progress are finished and the run stops before the next contact.
+// A second signal terminates the process immediately.
+func newRunContext(ctx *cli.Context, logger *log.Logger) (context.Context, context.CancelFunc) {
+	runCtx := context.Background()
+	cancelTimeout := func() {}
+	if timeout := ctx.GlobalDuration("run_timeout"); timeout > 0 {
+		runCtx, cancelTimeout = context.WithTimeout(runCtx, timeout)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			if logger != nil {
+				logger.Printf("Received %v, stopping after the current contact…", sig)
+			}
+			close(stop)
+		case <-done:
 		}
+	}()
+	cancel := func() {
+		close(done)
+		cancelTimeout()
+	}
+	return sync.WithStop(runCtx, stop), cancel
+}
 
-		return sync.Sync(ocAdapters, fritzAdapter, ctx.StringSlice("carddav_category"),
-			log.New(os.Stdout, "", log.LstdFlags))
+// newRetryPolicy returns the retry policy configured by the command line which logs and counts all retries.
+func newRetryPolicy(ctx *cli.Context, logger *log.Logger) retry.Policy {
+	policy := retry.DefaultPolicy
+	policy.Attempts = ctx.GlobalInt("retry_attempts")
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
 	}
-	err := app.Run(os.Args)
+	policy.Log = logger
+	policy.Stats = &retry.Stats{}
+	return policy
+}
+
+func logRetries(logger *log.Logger, policy retry.Policy) {
+	if total := policy.Stats.Total(); total > 0 {
+		logger.Printf("Retried %d failed requests (%s)", total, policy.Stats)
+	}
+}
+
+// newCassette returns the cassette for recording or replaying the HTTP requests
+// or nil if neither is requested.
+func newCassette(ctx *cli.Context) (*cassette.Cassette, error) {
+	record := ctx.GlobalString("record")
+	replay := ctx.GlobalString("replay")
+	switch {
+	case record != "" && replay != "":
+		return nil, errors.New("you cannot record and replay at the same time")
+	case record != "":
+		return cassette.NewRecorder(record)
+	case replay != "":
+		return cassette.Load(replay)
+	}
+	return nil, nil
+}
+
+// closeCassette saves a recording cassette and reports the exchanges of a replaying cassette which were not
+// requested.
+func closeCassette(logger *log.Logger, tape *cassette.Cassette) {
+	if tape == nil {
+		return
+	}
+	if err := tape.Save(); err != nil {
+		logger.Println("Cannot save cassette:", err)
+	}
+	for _, interaction := range tape.Unused() {
+		logger.Printf("Unused recorded request: %s %s", interaction.Request.Method, interaction.Request.URL)
+	}
+}
+
+func newFritzAdapter(runCtx context.Context, ctx *cli.Context, phonebookName, syncIDKey string, logger *log.Logger,
+	retryPolicy retry.Policy, tape *cassette.Cassette) (*fritzbox.Adapter, error) {
+	boxURL := ctx.GlobalString("fritz_url")
+	fritzUser := ctx.GlobalString("fritz_user")
+	fritzPass := ctx.GlobalString("fritz_password")
+	storageName := ctx.GlobalString("fritz_storage_name")
+
+	if boxURL == "" {
+		return nil, errors.New("you have to specify the Fritz!Box URL")
+	}
+	if fritzUser == "" {
+		return nil, errors.New("you have to specify the Fritz!Box user")
+	}
+	if fritzPass == "" {
+		return nil, errors.New("you have to specify the Fritz!Box password")
+	}
+
+	ftpSecurity, err := fritzbox.ParseFTPSecurity(ctx.GlobalString("fritz_ftp_tls"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	imageTransport, err := fritzbox.ParseImageTransport(ctx.GlobalString("fritz_image_transport"))
+	if err != nil {
+		return nil, err
+	}
+	if tape != nil {
+		// FTP transfers bypass the cassette
+		switch {
+		case imageTransport == fritzbox.AutoTransport:
+			imageTransport = fritzbox.HTTPTransport
+		case imageTransport == fritzbox.FTPTransport && ctx.GlobalString("replay") != "":
+			return nil, errors.New("photo transfers via FTP cannot be replayed, use --fritz_image_transport http")
+		}
+	}
+
+	opts := fritzbox.Options{
+		FTPCertFingerprint: ctx.GlobalString("fritz_ftp_fingerprint"),
+		FTPConnections:     ctx.GlobalInt("fritz_ftp_connections"),
+		FTPSecurity:        ftpSecurity,
+		HTTPS:              ctx.GlobalBool("fritz_https"),
+		Image: fritzbox.ImageOptions{
+			Width:    ctx.GlobalInt("fritz_image_width"),
+			Height:   ctx.GlobalInt("fritz_image_height"),
+			MaxBytes: ctx.GlobalInt("fritz_image_max_bytes"),
+		},
+		ImageTransport: imageTransport,
+		Log:            logger,
+		Retry:          retryPolicy,
+		Timeout:        ctx.GlobalDuration("request_timeout"),
+		TLS: tr064.TLSOptions{
+			Fingerprint: ctx.GlobalString("fritz_fingerprint"),
+			TrustStore:  ctx.GlobalString("fritz_trust_store"),
+		},
+		WebURL: ctx.GlobalString("fritz_web_url"),
+	}
+	if tape != nil {
+		opts.WrapTransport = tape.Transport
 	}
+	return fritzbox.NewAdapter(runCtx, boxURL, phonebookName, fritzUser, fritzPass, storageName, syncIDKey, opts)
 }
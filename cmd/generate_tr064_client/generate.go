@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// goType describes how an SCPD data type is represented in Go.
+type goType struct {
+	// Name is the Go type.
+	Name string
+	// Soap is the suffix of the soap.Marshal… and soap.Unmarshal… functions converting the type
+	// or empty if the value is passed as string.
+	Soap string
+	// Zero is the zero value literal of the type.
+	Zero string
+}
+
+// goTypes maps the SCPD data types to Go types. Unknown types are passed as strings.
+var goTypes = map[string]goType{
+	"bin.base64":  {"[]byte", "BinBase64", "nil"},
+	"bin.hex":     {"[]byte", "BinHex", "nil"},
+	"boolean":     {"bool", "Boolean", "false"},
+	"char":        {"rune", "Char", "0"},
+	"date":        {"time.Time", "Date", "time.Time{}"},
+	"dateTime":    {"time.Time", "DateTime", "time.Time{}"},
+	"dateTime.tz": {"time.Time", "DateTimeTz", "time.Time{}"},
+	"fixed.14.4":  {"float64", "Fixed14_4", "0"},
+	"float":       {"float64", "R8", "0"},
+	"i1":          {"int8", "I1", "0"},
+	"i2":          {"int16", "I2", "0"},
+	"i4":          {"int32", "I4", "0"},
+	"int":         {"int64", "Int", "0"},
+	"number":      {"float64", "R8", "0"},
+	"r4":          {"float32", "R4", "0"},
+	"r8":          {"float64", "R8", "0"},
+	"string":      {"string", "", `""`},
+	"ui1":         {"uint8", "Ui1", "0"},
+	"ui2":         {"uint16", "Ui2", "0"},
+	"ui4":         {"uint32", "Ui4", "0"},
+	"ui8":         {"uint64", "Ui8", "0"},
+}
+
+// reservedParams are identifiers used by the generated methods which must not be used as parameter names.
+var reservedParams = map[string]bool{"c": true, "ctx": true, "err": true, "request": true, "response": true,
+	"result": true}
+
+type argument struct {
+	// Field is the name of the argument as exported Go identifier.
+	Field string
+	// Name is the SOAP name of the argument.
+	Name string
+	// Param is the name of the argument as Go parameter.
+	Param string
+	Type  goType
+}
+
+type actionMethod struct {
+	In     []argument
+	Method string
+	Name   string
+	Out    []argument
+}
+
+type enumValue struct {
+	Const string
+	Value string
+}
+
+type enum struct {
+	Name     string
+	Type     string
+	Values   []enumValue
+	Variable string
+}
+
+type clientFile struct {
+	Actions     []actionMethod
+	Enums       []enum
+	Imports     []string
+	Package     string
+	ServiceName string
+	ServiceType string
+	Source      string
+}
+
+var clientTemplate = template.Must(template.New("client").Parse(`// Code generated by generate_tr064_client from {{.Source}}; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+{{if .}}	"{{.}}"{{end}}
+{{- end}}
+)
+
+// ServiceType is the type of the {{.ServiceName}} service.
+const ServiceType = "{{.ServiceType}}"
+
+// Client performs the actions of the {{.ServiceName}} service.
+type Client struct {
+	adapter *tr064.Adapter
+}
+{{range .Enums}}
+// {{.Name}} is a value of the {{.Variable}} state variable.
+type {{.Name}} {{.Type}}
+
+// The allowed values of {{.Name}}.
+const (
+{{- $enum := .Name}}
+{{- range .Values}}
+	{{.Const}} {{$enum}} = "{{.Value}}"
+{{- end}}
+)
+{{end}}
+// New creates a Client which performs the actions via adapter.
+func New(adapter *tr064.Adapter) *Client {
+	return &Client{adapter: adapter}
+}
+
+// Connect creates a Client for the {{.ServiceName}} service of the device accessed by client.
+func Connect(client *tr064.Client) (*Client, error) {
+	adapter, err := client.Service(ServiceType)
+	if err != nil {
+		return nil, err
+	}
+	return New(adapter), nil
+}
+{{range .Actions}}{{$action := .}}
+{{- if gt (len .Out) 1}}
+// {{.Method}}Result contains the out arguments of the {{.Name}} action.
+type {{.Method}}Result struct {
+{{- range .Out}}
+	{{.Field}} {{.Type.Name}}
+{{- end}}
+}
+{{end}}
+// {{.Method}} performs the {{.Name}} action.
+func (c *Client) {{.Method}}(ctx context.Context{{range .In}}, {{.Param}} {{.Type.Name}}{{end}}) (
+{{- if eq (len .Out) 1}}{{(index .Out 0).Type.Name}}, {{else if gt (len .Out) 1}}*{{.Method}}Result, {{end}}error) {
+{{- if .In}}
+	request := struct {
+{{- range .In}}
+		{{.Field}} string ` + "`soap:\"{{.Name}}\"`" + `
+{{- end}}
+	}{}
+{{- end}}
+{{- range .In}}
+{{- if .Type.Soap}}
+	{
+		value, err := soap.Marshal{{.Type.Soap}}({{.Param}})
+		if err != nil {
+			return {{template "zero" $action}}fmt.Errorf("{{$action.Name}}: invalid {{.Name}}: %v", err)
+		}
+		request.{{.Field}} = value
+	}
+{{- else}}
+	request.{{.Field}} = {{template "string" .}}
+{{- end}}
+{{- end}}
+{{- if .Out}}
+	response := struct {
+{{- range .Out}}
+		{{.Field}} string ` + "`xml:\"{{.Name}}\"`" + `
+{{- end}}
+	}{}
+{{- end}}
+{{- if eq (len .Out) 0}}
+	return c.adapter.Perform(ctx, ServiceType, "{{.Name}}", {{if .In}}&request{{else}}nil{{end}}, nil)
+{{- else}}
+	if err := c.adapter.Perform(ctx, ServiceType, "{{.Name}}", {{if .In}}&request{{else}}nil{{end}}, &response); err != nil {
+		return {{template "zero" .}}err
+	}
+{{- end}}
+{{- if eq (len .Out) 1}}
+{{- with index .Out 0}}
+{{- if .Type.Soap}}
+	result, err := soap.Unmarshal{{.Type.Soap}}(response.{{.Field}})
+	if err != nil {
+		return {{.Type.Zero}}, fmt.Errorf("{{$action.Name}}: invalid {{.Name}}: %v", err)
+	}
+	return result, nil
+{{- else}}
+	return {{template "convert" .}}, nil
+{{- end}}
+{{- end}}
+{{- else if gt (len .Out) 1}}
+	result := &{{.Method}}Result{}
+{{- range .Out}}
+{{- if .Type.Soap}}
+	{
+		value, err := soap.Unmarshal{{.Type.Soap}}(response.{{.Field}})
+		if err != nil {
+			return nil, fmt.Errorf("{{$action.Name}}: invalid {{.Name}}: %v", err)
+		}
+		result.{{.Field}} = value
+	}
+{{- else}}
+	result.{{.Field}} = {{template "convert" .}}
+{{- end}}
+{{- end}}
+	return result, nil
+{{- end}}
+}
+{{end}}
+{{- define "string"}}{{if eq .Type.Name "string"}}{{.Param}}{{else}}string({{.Param}}){{end}}{{end}}
+{{- define "convert"}}{{if eq .Type.Name "string"}}response.{{.Field}}{{else}}{{.Type.Name}}(response.{{.Field}}){{end}}{{end}}
+{{- define "zero"}}{{if eq (len .Out) 1}}{{(index .Out 0).Type.Zero}}, {{else if gt (len .Out) 1}}nil, {{end}}{{end}}
+`))
+
+// generate generates the Go source code of a client for the service described by scpd.
+func generate(pkg, serviceType, source string, scpd *tr064.SCPD) ([]byte, error) {
+	file := clientFile{
+		Package:     pkg,
+		ServiceName: strings.TrimPrefix(serviceType, "urn:dslforum-org:service:"),
+		ServiceType: serviceType,
+		Source:      source,
+	}
+
+	types := map[string]goType{}
+	reserved := "a generated declaration"
+	usedNames := map[string]string{"Client": reserved, "Connect": reserved, "New": reserved, "ServiceType": reserved}
+	claim := func(name, owner string) error {
+		if other, ok := usedNames[name]; ok {
+			return fmt.Errorf("%s and %s are both mapped to the Go identifier %s", other, owner, name)
+		}
+		usedNames[name] = owner
+		return nil
+	}
+	for _, variable := range scpd.ServiceStateSpecs {
+		t, ok := goTypes[variable.DataType]
+		if !ok {
+			t = goTypes["string"]
+		}
+		if len(variable.AllowedValues) > 0 && t.Name == "string" {
+			e := enum{Name: identifier(variable.Name), Type: t.Name, Variable: variable.Name}
+			if err := claim(e.Name, "state variable "+variable.Name); err != nil {
+				return nil, err
+			}
+			for _, value := range variable.AllowedValues {
+				c := enumValue{Const: e.Name + identifier(value), Value: value}
+				if err := claim(c.Const, "value "+value+" of "+variable.Name); err != nil {
+					return nil, err
+				}
+				e.Values = append(e.Values, c)
+			}
+			file.Enums = append(file.Enums, e)
+			t = goType{Name: e.Name, Zero: `""`}
+		}
+		types[variable.Name] = t
+	}
+
+	for _, a := range scpd.Actions {
+		method := actionMethod{Method: identifier(a.Name), Name: a.Name}
+		if err := claim(method.Method, "action "+a.Name); err != nil {
+			return nil, err
+		}
+		fields := map[string]string{}
+		for _, arg := range a.Arguments {
+			t, ok := types[arg.StateVariable]
+			if !ok {
+				return nil, fmt.Errorf("argument %s of action %s refers to the unknown state variable %s",
+					arg.Name, a.Name, arg.StateVariable)
+			}
+			field := identifier(strings.TrimPrefix(arg.Name, "New"))
+			if other, ok := fields[field]; ok {
+				return nil, fmt.Errorf("arguments %s and %s of action %s are both mapped to the Go identifier %s",
+					other, arg.Name, a.Name, field)
+			}
+			fields[field] = arg.Name
+			converted := argument{Field: field, Name: arg.Name, Param: parameter(field), Type: t}
+			if arg.Direction == "in" {
+				method.In = append(method.In, converted)
+			} else {
+				method.Out = append(method.Out, converted)
+			}
+		}
+		if len(method.Out) > 1 {
+			if err := claim(method.Method+"Result", "result of action "+a.Name); err != nil {
+				return nil, err
+			}
+		}
+		file.Actions = append(file.Actions, method)
+	}
+	file.Imports = imports(file.Actions)
+
+	var buf bytes.Buffer
+	if err := clientTemplate.Execute(&buf, file); err != nil {
+		return nil, err
+	}
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid code: %v\n%s", err, buf.String())
+	}
+	return code, nil
+}
+
+// identifier converts an SCPD name into an exported Go identifier, e.g. “X_AVM-DE_GetHostListPath” into
+// “GetHostListPath”.
+func identifier(name string) string {
+	name = strings.TrimPrefix(name, "X_AVM-DE_")
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	id := b.String()
+	if id == "" || unicode.IsDigit([]rune(id)[0]) {
+		id = "V" + id
+	}
+	return id
+}
+
+// imports returns the packages needed by the generated code.
+func imports(actions []actionMethod) []string {
+	pkgs := []string{"context"}
+	needsSoap := false
+	needsTime := false
+	for _, a := range actions {
+		for _, arg := range append(append([]argument(nil), a.In...), a.Out...) {
+			needsSoap = needsSoap || arg.Type.Soap != ""
+			needsTime = needsTime || arg.Type.Name == "time.Time"
+		}
+	}
+	if needsSoap {
+		pkgs = append(pkgs, "fmt")
+	}
+	if needsTime {
+		pkgs = append(pkgs, "time")
+	}
+	pkgs = append(pkgs, "")
+	if needsSoap {
+		pkgs = append(pkgs, "github.com/huin/goupnp/soap")
+		pkgs = append(pkgs, "")
+	}
+	return append(pkgs, "github.com/toaster/fritz_sync/tr064")
+}
+
+// parameter converts an exported Go identifier into a parameter name, e.g. “MACAddress” into “macAddress”.
+func parameter(field string) string {
+	runes := []rune(field)
+	for i := range runes {
+		if !unicode.IsUpper(runes[i]) {
+			break
+		}
+		// keep the first letter of the next word in an acronym like “MACAddress” upper case
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	param := string(runes)
+	if token.Lookup(param).IsKeyword() || reservedParams[param] {
+		param += "Arg"
+	}
+	return param
+}
@@ -0,0 +1,105 @@
+// Command generate_tr064_client generates a typed Go client for a TR-064 service from its SCPD.
+//
+// It is meant to be used with go generate, e.g.:
+//
+//	//go:generate go run ../../cmd/generate_tr064_client -s urn:dslforum-org:service:Hosts:1 -f hostsSCPD.xml -o client.go
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Usage = "generate a typed TR-064 service client"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "service, s",
+			Usage: "`TYPE` of the service, e.g. urn:dslforum-org:service:Hosts:1",
+		},
+		cli.StringFlag{
+			Name:  "scpd_file, f",
+			Usage: "`FILE` containing the SCPD of the service",
+		},
+		cli.StringFlag{
+			Name:  "base_url, b",
+			Usage: "`URL` of a TR-064 provider to fetch the SCPD from (instead of --scpd_file)",
+		},
+		cli.StringFlag{
+			Name:  "package, p",
+			Usage: "`NAME` of the generated package (default: the package of the current directory)",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "`FILE` to write the client to (default: stdout)",
+		},
+	}
+	app.Action = func(ctx *cli.Context) error {
+		serviceType := ctx.String("service")
+		scpdFile := ctx.String("scpd_file")
+		baseURL := ctx.String("base_url")
+		pkg := ctx.String("package")
+		output := ctx.String("output")
+
+		if serviceType == "" {
+			return errors.New("you have to specify the service type")
+		}
+		if (scpdFile == "") == (baseURL == "") {
+			return errors.New("you have to specify either the SCPD file or the base URL")
+		}
+		if pkg == "" {
+			pkg = os.Getenv("GOPACKAGE")
+		}
+		if pkg == "" {
+			return errors.New("you have to specify the package")
+		}
+
+		var scpd *tr064.SCPD
+		source := scpdFile
+		if scpdFile != "" {
+			data, err := ioutil.ReadFile(scpdFile)
+			if err != nil {
+				return err
+			}
+			scpd = &tr064.SCPD{}
+			if err := xml.Unmarshal(data, scpd); err != nil {
+				return fmt.Errorf("cannot parse %s: %v", scpdFile, err)
+			}
+			source = filepath.Base(scpdFile)
+		} else {
+			client, err := tr064.NewClient(context.Background(), baseURL, "", "", tr064.ClientOptions{})
+			if err != nil {
+				return err
+			}
+			if scpd, err = client.SCPD(context.Background(), serviceType); err != nil {
+				return err
+			}
+			source = client.FindService(serviceType).ScpdURL
+		}
+
+		code, err := generate(pkg, serviceType, source, scpd)
+		if err != nil {
+			return err
+		}
+		if output == "" {
+			_, err = os.Stdout.Write(code)
+			return err
+		}
+		return ioutil.WriteFile(output, code, 0644)
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -53,7 +54,7 @@ func main() {
 
 		adapter := carddav.NewAdapter(url, user, pass)
 
-		contacts, err := adapter.ReadAll(readCategories)
+		contacts, err := adapter.ReadAll(context.Background(), readCategories)
 		if err != nil {
 			return fmt.Errorf("read failed: %v", err)
 		}
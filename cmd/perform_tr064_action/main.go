@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"text/tabwriter"
 
-	"github.com/huin/goupnp/soap"
 	"github.com/urfave/cli"
 
 	"github.com/toaster/fritz_sync/tr064"
@@ -18,11 +21,11 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "base_url, b",
-			Usage: "`URL` of the TR064 provider",
+			Usage: "`URL` of the TR064 provider, e.g. http://fritz.box:49000",
 		},
 		cli.StringFlag{
-			Name:  "control_url, c",
-			Usage: "service control `URL`",
+			Name:  "service, s",
+			Usage: "`TYPE` or ID of the service, e.g. urn:dslforum-org:service:DeviceInfo:1",
 		},
 		cli.StringFlag{
 			Name:  "user, u",
@@ -32,10 +35,6 @@ func main() {
 			Name:  "password, p",
 			Usage: "`PASSWORD`",
 		},
-		cli.StringFlag{
-			Name:  "namespace, n",
-			Usage: "`NAMESPACE`",
-		},
 		cli.StringFlag{
 			Name:  "action, a",
 			Usage: "`ACTION`",
@@ -44,21 +43,26 @@ func main() {
 			Name:  "params, x",
 			Usage: "`PARAMS` is a key/value list of action parameters",
 		},
+		cli.StringFlag{
+			Name:  "format, f",
+			Value: "table",
+			Usage: "`FORMAT` of the output: “table” or “json”",
+		},
 	}
 	app.Action = func(ctx *cli.Context) error {
 		baseURL := ctx.String("base_url")
-		ctrlURL := ctx.String("control_url")
+		serviceType := ctx.String("service")
 		user := ctx.String("user")
 		pass := ctx.String("password")
 		action := ctx.String("action")
-		ns := ctx.String("namespace")
 		paramPairs := ctx.StringSlice("params")
+		format := ctx.String("format")
 
 		if baseURL == "" {
 			return errors.New("you have to specify the base URL")
 		}
-		if ctrlURL == "" {
-			return errors.New("you have to specify the control URL")
+		if serviceType == "" {
+			return errors.New("you have to specify the service")
 		}
 		if user == "" {
 			return errors.New("you have to specify the user")
@@ -69,28 +73,88 @@ func main() {
 		if action == "" {
 			return errors.New("you have to specify the action")
 		}
+		if len(paramPairs)%2 != 0 {
+			return fmt.Errorf("the parameter %s has no value", paramPairs[len(paramPairs)-1])
+		}
+		if format != "table" && format != "json" {
+			return fmt.Errorf("unknown output format “%s”", format)
+		}
 
-		adapter, err := tr064.NewAdapter(baseURL, ctrlURL, user, pass)
+		client, err := tr064.NewClient(context.Background(), baseURL, user, pass, tr064.ClientOptions{})
+		if err != nil {
+			return err
+		}
+		scpd, err := client.SCPD(context.Background(), serviceType)
 		if err != nil {
 			return err
 		}
+		if _, err := scpd.Arguments(action, "in"); err != nil {
+			return fmt.Errorf("%v (available actions: %s)", err, strings.Join(scpd.ActionNames(), ", "))
+		}
 
-		params := map[string]string{}
+		values := map[string]string{}
 		for i := 0; i+1 < len(paramPairs); i += 2 {
-			params[paramPairs[i]] = paramPairs[i+1]
+			values[paramPairs[i]] = paramPairs[i+1]
+		}
+		params, err := scpd.PrepareArguments(action, values)
+		if err != nil {
+			return err
 		}
-		result := tr064.UnknownXML{}
-		if err := adapter.Perform(ns, action, params, &result); err != nil {
-			if serr, ok := err.(*soap.SOAPFaultError); ok {
-				fmt.Println("oops", serr.FaultCode, serr.FaultString, string(serr.Detail.Raw))
-			}
+		outSpecs, err := scpd.Arguments(action, "out")
+		if err != nil {
 			return err
 		}
-		fmt.Println("Output:", result)
-		return nil
+
+		adapter, err := client.Service(serviceType)
+		if err != nil {
+			return err
+		}
+		service := client.FindService(serviceType)
+		var result tr064.ArgumentValues
+		if err := adapter.Perform(context.Background(), service.Type, action, params, &result); err != nil {
+			return err
+		}
+
+		if format == "json" {
+			return printJSON(result, outSpecs)
+		}
+		return printTable(result, outSpecs)
 	}
 	err := app.Run(os.Args)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// decode converts an out argument value into its Go representation.
+// Values which do not match the data type stated by the SCPD are kept as strings.
+func decode(value tr064.ArgumentValue, specs []tr064.ArgumentSpec) interface{} {
+	for _, spec := range specs {
+		if spec.Name != value.Name {
+			continue
+		}
+		if decoded, err := spec.Decode(value.Value); err == nil {
+			return decoded
+		}
+	}
+	return value.Value
+}
+
+func printJSON(result tr064.ArgumentValues, specs []tr064.ArgumentSpec) error {
+	values := map[string]interface{}{}
+	for _, value := range result {
+		values[value.Name] = decode(value, specs)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(values)
+}
+
+func printTable(result tr064.ArgumentValues, specs []tr064.ArgumentSpec) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, value := range result {
+		fmt.Fprintf(w, "%s\t%v\n", value.Name, decode(value, specs))
+	}
+	return w.Flush()
+}
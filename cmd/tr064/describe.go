@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// apiDocument describes the complete TR064 API of a device.
+// Actions and state variables are sorted by name so that documents of different firmware versions can be diffed.
+type apiDocument struct {
+	Device        deviceDoc    `json:"device"`
+	SpecVersion   string       `json:"specVersion"`
+	SystemVersion string       `json:"systemVersion"`
+	Unknown       []unknownDoc `json:"unknown,omitempty"`
+}
+
+type deviceDoc struct {
+	Devices      []deviceDoc  `json:"devices,omitempty"`
+	FriendlyName string       `json:"friendlyName"`
+	Manufacturer string       `json:"manufacturer"`
+	Model        string       `json:"model"`
+	Services     []serviceDoc `json:"services,omitempty"`
+	Type         string       `json:"type"`
+	Unknown      []unknownDoc `json:"unknown,omitempty"`
+}
+
+type serviceDoc struct {
+	Actions        []actionDoc        `json:"actions,omitempty"`
+	ControlURL     string             `json:"controlURL"`
+	Error          string             `json:"error,omitempty"`
+	EventSubURL    string             `json:"eventSubURL"`
+	ID             string             `json:"id"`
+	SCPDUnknown    []unknownDoc       `json:"scpdUnknown,omitempty"`
+	SCPDURL        string             `json:"scpdURL"`
+	StateVariables []stateVariableDoc `json:"stateVariables,omitempty"`
+	Type           string             `json:"type"`
+	Unknown        []unknownDoc       `json:"unknown,omitempty"`
+}
+
+type actionDoc struct {
+	Arguments []argumentDoc `json:"arguments,omitempty"`
+	Name      string        `json:"name"`
+	Unknown   []unknownDoc  `json:"unknown,omitempty"`
+}
+
+type argumentDoc struct {
+	AllowedValues []string     `json:"allowedValues,omitempty"`
+	DataType      string       `json:"dataType"`
+	Direction     string       `json:"direction"`
+	Name          string       `json:"name"`
+	StateVariable string       `json:"stateVariable"`
+	Unknown       []unknownDoc `json:"unknown,omitempty"`
+}
+
+type stateVariableDoc struct {
+	AllowedValues []string     `json:"allowedValues,omitempty"`
+	DataType      string       `json:"dataType"`
+	DefaultValue  string       `json:"defaultValue,omitempty"`
+	Name          string       `json:"name"`
+	Unknown       []unknownDoc `json:"unknown,omitempty"`
+}
+
+// unknownDoc is an XML element which is not covered by the TR064 structs.
+type unknownDoc struct {
+	Element string `json:"element"`
+	Inner   string `json:"inner"`
+}
+
+func describe(ctx *cli.Context) error {
+	format := ctx.String("format")
+	if format != "markdown" && format != "json" {
+		return fmt.Errorf("unknown output format “%s”", format)
+	}
+	client, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	doc := newAPIDocument(context.Background(), client)
+
+	out := io.Writer(os.Stdout)
+	if path := ctx.String("output"); path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	if format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(doc)
+	}
+	return writeMarkdown(out, doc)
+}
+
+// newAPIDocument walks the description and the SCPDs of all services of the device.
+// Services whose SCPD cannot be fetched are documented with the error.
+func newAPIDocument(ctx context.Context, client *tr064.Client) *apiDocument {
+	desc := client.Description()
+	return &apiDocument{
+		Device:        newDeviceDoc(ctx, client, &desc.Device),
+		SpecVersion:   fmt.Sprintf("%d.%d", desc.SpecVersion.Major, desc.SpecVersion.Minor),
+		SystemVersion: desc.SystemVersion.Display,
+		Unknown:       unknownDocs(desc.Unknown, desc.SpecVersion.Unknown, desc.SystemVersion.Unknown),
+	}
+}
+
+func newDeviceDoc(ctx context.Context, client *tr064.Client, device *tr064.Device) deviceDoc {
+	doc := deviceDoc{
+		FriendlyName: device.FriendlyName,
+		Manufacturer: device.Manufacturer,
+		Model:        device.Name,
+		Type:         device.Type,
+		Unknown:      unknownDocs(device.Unknown),
+	}
+	for _, service := range device.Services {
+		doc.Services = append(doc.Services, newServiceDoc(ctx, client, service))
+	}
+	for i := range device.Devices {
+		doc.Devices = append(doc.Devices, newDeviceDoc(ctx, client, &device.Devices[i]))
+	}
+	return doc
+}
+
+func newServiceDoc(ctx context.Context, client *tr064.Client, service tr064.Service) serviceDoc {
+	doc := serviceDoc{
+		ControlURL:  service.ControlURL,
+		EventSubURL: service.EventSubURL,
+		ID:          service.ID,
+		SCPDURL:     service.ScpdURL,
+		Type:        service.Type,
+		Unknown:     unknownDocs(service.Unknown),
+	}
+	// the ID is unique whereas several devices may provide services of the same type
+	scpd, err := client.SCPD(ctx, service.ID)
+	if err != nil {
+		doc.Error = err.Error()
+		return doc
+	}
+	doc.SCPDUnknown = unknownDocs(scpd.Unknown, scpd.SpecVersion.Unknown)
+
+	variables := map[string]stateVariableDoc{}
+	for _, variable := range scpd.ServiceStateSpecs {
+		v := stateVariableDoc{
+			AllowedValues: variable.AllowedValues,
+			DataType:      variable.DataType,
+			DefaultValue:  variable.DefaultValue,
+			Name:          variable.Name,
+			Unknown:       unknownDocs(variable.Unknown),
+		}
+		variables[v.Name] = v
+		doc.StateVariables = append(doc.StateVariables, v)
+	}
+	sort.Slice(doc.StateVariables, func(i, j int) bool {
+		return doc.StateVariables[i].Name < doc.StateVariables[j].Name
+	})
+
+	for _, action := range scpd.Actions {
+		a := actionDoc{Name: action.Name, Unknown: unknownDocs(action.Unknown)}
+		for _, arg := range action.Arguments {
+			variable := variables[arg.StateVariable]
+			a.Arguments = append(a.Arguments, argumentDoc{
+				AllowedValues: variable.AllowedValues,
+				DataType:      variable.DataType,
+				Direction:     arg.Direction,
+				Name:          arg.Name,
+				StateVariable: arg.StateVariable,
+				Unknown:       unknownDocs(arg.Unknown),
+			})
+		}
+		doc.Actions = append(doc.Actions, a)
+	}
+	sort.Slice(doc.Actions, func(i, j int) bool { return doc.Actions[i].Name < doc.Actions[j].Name })
+	return doc
+}
+
+func unknownDocs(lists ...[]tr064.UnknownXML) []unknownDoc {
+	var docs []unknownDoc
+	for _, unknown := range lists {
+		for _, u := range unknown {
+			docs = append(docs, unknownDoc{Element: u.XMLName.Local, Inner: strings.TrimSpace(u.Inner)})
+		}
+	}
+	return docs
+}
+
+func writeMarkdown(w io.Writer, doc *apiDocument) error {
+	m := &markdownWriter{w: w}
+	m.printf("# %s (%s)\n\n", doc.Device.FriendlyName, doc.SystemVersion)
+	m.printf("- Model: %s\n", doc.Device.Model)
+	m.printf("- Manufacturer: %s\n", doc.Device.Manufacturer)
+	m.printf("- TR-064 specification: %s\n", doc.SpecVersion)
+	m.unknown(doc.Unknown)
+	m.device(&doc.Device, 2)
+	return m.err
+}
+
+// markdownWriter renders an apiDocument as Markdown and remembers the first write error.
+type markdownWriter struct {
+	err error
+	w   io.Writer
+}
+
+func (m *markdownWriter) device(device *deviceDoc, level int) {
+	m.printf("\n%s Device %s\n\n", strings.Repeat("#", level), device.Type)
+	m.printf("- Name: %s\n", device.FriendlyName)
+	m.unknown(device.Unknown)
+	for i := range device.Services {
+		m.service(&device.Services[i], level+1)
+	}
+	for i := range device.Devices {
+		m.device(&device.Devices[i], level+1)
+	}
+}
+
+func (m *markdownWriter) printf(format string, args ...interface{}) {
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.w, format, args...)
+	}
+}
+
+func (m *markdownWriter) service(service *serviceDoc, level int) {
+	heading := strings.Repeat("#", level)
+	m.printf("\n%s Service %s\n\n", heading, service.Type)
+	m.printf("- ID: %s\n", service.ID)
+	m.printf("- Control URL: %s\n", service.ControlURL)
+	m.printf("- Event URL: %s\n", service.EventSubURL)
+	m.printf("- SCPD URL: %s\n", service.SCPDURL)
+	m.unknown(service.Unknown)
+	m.unknown(service.SCPDUnknown)
+	if service.Error != "" {
+		m.printf("- Error: %s\n", service.Error)
+		return
+	}
+
+	for _, action := range service.Actions {
+		m.printf("\n%s# %s\n\n", heading, action.Name)
+		m.unknown(action.Unknown)
+		if len(action.Arguments) == 0 {
+			m.printf("No arguments.\n")
+			continue
+		}
+		m.printf("| Direction | Argument | State variable | Type | Allowed values |\n")
+		m.printf("|---|---|---|---|---|\n")
+		for _, arg := range action.Arguments {
+			m.printf("| %s | %s | %s | %s | %s |\n", arg.Direction, arg.Name, arg.StateVariable, arg.DataType,
+				strings.Join(arg.AllowedValues, ", "))
+		}
+	}
+
+	if len(service.StateVariables) > 0 {
+		m.printf("\n%s# State variables\n\n", heading)
+		m.printf("| Name | Type | Default | Allowed values |\n")
+		m.printf("|---|---|---|---|\n")
+		for _, variable := range service.StateVariables {
+			m.printf("| %s | %s | %s | %s |\n", variable.Name, variable.DataType, variable.DefaultValue,
+				strings.Join(variable.AllowedValues, ", "))
+		}
+	}
+}
+
+func (m *markdownWriter) unknown(unknown []unknownDoc) {
+	for _, u := range unknown {
+		m.printf("- Unknown element `%s`: `%s`\n", u.Element, strings.Join(strings.Fields(u.Inner), " "))
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned by readLine when the input is cancelled with Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines from a terminal with a history (arrow keys) and tab completion.
+// If the input is not a terminal, lines are read without any editing support.
+type lineEditor struct {
+	// complete returns the candidates for the last word of line.
+	complete func(line string) []string
+	history  []string
+	in       *os.File
+	out      io.Writer
+	reader   *bufio.Reader
+}
+
+func newLineEditor(in *os.File, out io.Writer, complete func(string) []string) *lineEditor {
+	return &lineEditor{complete: complete, in: in, out: out, reader: bufio.NewReader(in)}
+}
+
+// addHistory appends line to the history unless it repeats the last entry.
+func (e *lineEditor) addHistory(line string) {
+	if line == "" || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+}
+
+// readLine prints prompt and reads a line.
+// It returns io.EOF at the end of the input (or Ctrl-D on an empty line) and errInterrupted on Ctrl-C.
+func (e *lineEditor) readLine(prompt string, completion bool) (string, error) {
+	state, err := makeRaw(e.in.Fd())
+	if err != nil {
+		return e.readPlainLine(prompt)
+	}
+	defer restoreTerminal(e.in.Fd(), state)
+
+	var line []byte
+	historyIndex := len(e.history)
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r\x1b[K%s%s", prompt, line)
+	}
+	redraw()
+	for {
+		b, err := e.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+		case 8, 127: // backspace
+			if len(line) > 0 {
+				_, size := utf8.DecodeLastRune(line)
+				line = line[:len(line)-size]
+				redraw()
+			}
+		case 21: // Ctrl-U
+			line = line[:0]
+			redraw()
+		case '\t':
+			if completion && e.complete != nil {
+				line = e.completeLine(line, prompt)
+				redraw()
+			}
+		case 27: // escape sequence
+			sequence, err := e.readEscapeSequence()
+			if err != nil {
+				return "", err
+			}
+			switch sequence {
+			case "[A": // up
+				if historyIndex > 0 {
+					historyIndex--
+					line = []byte(e.history[historyIndex])
+					redraw()
+				}
+			case "[B": // down
+				if historyIndex < len(e.history) {
+					historyIndex++
+					line = line[:0]
+					if historyIndex < len(e.history) {
+						line = []byte(e.history[historyIndex])
+					}
+					redraw()
+				}
+			}
+		default:
+			if b >= 32 {
+				line = append(line, b)
+				if utf8.FullRune(line[len(line)-1-lastRuneStart(line):]) {
+					redraw()
+				}
+			}
+		}
+	}
+}
+
+// completeLine completes the last word of line.
+// If there are several candidates, they are printed and the word is extended to their common prefix.
+func (e *lineEditor) completeLine(line []byte, prompt string) []byte {
+	text := string(line)
+	word := text[strings.LastIndex(text, " ")+1:]
+	var candidates []string
+	for _, candidate := range e.complete(text) {
+		if strings.HasPrefix(candidate, word) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return line
+	case 1:
+		completed := text[:len(text)-len(word)] + candidates[0]
+		if !strings.HasSuffix(completed, "=") {
+			completed += " "
+		}
+		return []byte(completed)
+	}
+
+	sort.Strings(candidates)
+	prefix := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(word) {
+		return []byte(text[:len(text)-len(word)] + prefix)
+	}
+	fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+	return line
+}
+
+// readEscapeSequence reads the rest of an escape sequence like “ESC [ A” (cursor up).
+func (e *lineEditor) readEscapeSequence() (string, error) {
+	var sequence []byte
+	for {
+		b, err := e.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		sequence = append(sequence, b)
+		if len(sequence) > 1 && (b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b == '~') || len(sequence) > 8 {
+			return string(sequence), nil
+		}
+		if len(sequence) == 1 && b != '[' && b != 'O' {
+			return string(sequence), nil
+		}
+	}
+}
+
+func (e *lineEditor) readPlainLine(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	line, err := e.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// lastRuneStart returns the offset of the start of the last (possibly incomplete) UTF-8 sequence from the end
+// of b.
+func lastRuneStart(b []byte) int {
+	for i := 0; i < utf8.UTFMax && i < len(b); i++ {
+		if utf8.RuneStart(b[len(b)-1-i]) {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Usage = "explore TR064 devices"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "base_url, b",
+			Usage: "`URL` of the TR064 provider, e.g. http://fritz.box:49000",
+		},
+		cli.StringFlag{
+			Name:  "user, u",
+			Usage: "`USERNAME`",
+		},
+		cli.StringFlag{
+			Name:  "password, p",
+			Usage: "`PASSWORD`",
+		},
+		cli.BoolFlag{
+			Name:  "https",
+			Usage: "use TR064 via HTTPS",
+		},
+		cli.StringFlag{
+			Name:  "fingerprint",
+			Usage: "SHA-256 `FINGERPRINT` of the trusted device certificate",
+		},
+		cli.StringFlag{
+			Name:  "trust_store",
+			Usage: "`FILE` storing the fingerprints of device certificates trusted on first use",
+		},
+		cli.DurationFlag{
+			Name:  "request_timeout",
+			Usage: "maximum `DURATION` of a single request (0 for no limit)",
+			Value: 30 * time.Second,
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "shell",
+			Usage: "explore the services of the device interactively",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "history",
+					Usage: "`FILE` storing the command history without action calls (default: ~/.tr064_history)",
+				},
+			},
+			Action: runShell,
+		},
+		{
+			Name:  "describe",
+			Usage: "document all services, actions, arguments and state variables of the device",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Usage: "output `FORMAT` (markdown or json)",
+					Value: "markdown",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "write the document to `FILE` instead of stdout",
+				},
+			},
+			Action: describe,
+		},
+		{
+			Name:      "watch",
+			Usage:     "print the events of services, e.g. “watch X_AVM-DE_OnTel:1”",
+			ArgsUsage: "SERVICE…",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen, l",
+					Usage: "`ADDRESS` to receive the events at; it has to be reachable by the device",
+					Value: ":0",
+				},
+				cli.DurationFlag{
+					Name:  "timeout, t",
+					Usage: "requested `DURATION` of the subscriptions, they are renewed automatically",
+					Value: tr064.DefaultSubscriptionTimeout,
+				},
+			},
+			Action: watch,
+		},
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// connect creates a TR064 client according to the global flags.
+func connect(ctx *cli.Context) (*tr064.Client, error) {
+	baseURL := ctx.GlobalString("base_url")
+	if baseURL == "" {
+		return nil, errors.New("you have to specify the base URL")
+	}
+	return tr064.NewClient(context.Background(), baseURL, ctx.GlobalString("user"), ctx.GlobalString("password"),
+		tr064.ClientOptions{
+			HTTPS: ctx.GlobalBool("https"),
+			TLS: tr064.TLSOptions{
+				Fingerprint: ctx.GlobalString("fingerprint"),
+				TrustStore:  ctx.GlobalString("trust_store"),
+			},
+			Timeout: ctx.GlobalDuration("request_timeout"),
+		})
+}
+
+func runShell(ctx *cli.Context) error {
+	client, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	historyFile := ctx.String("history")
+	if historyFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			historyFile = filepath.Join(home, ".tr064_history")
+		}
+	}
+	return newShell(client, historyFile).run()
+}
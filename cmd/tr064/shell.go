@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// shell is an interactive explorer for the services of a TR064 device.
+type shell struct {
+	adapter     *tr064.Adapter
+	client      *tr064.Client
+	commands    []shellCommand
+	editor      *lineEditor
+	historyFile string
+	out         io.Writer
+	scpd        *tr064.SCPD
+	service     *tr064.Service
+	trace       bool
+}
+
+type shellCommand struct {
+	name  string
+	args  string
+	usage string
+	run   func(args []string) error
+	// complete returns the candidates for the argument at index i.
+	complete func(i int, args []string) []string
+}
+
+// serviceTypePrefix is the common prefix of all TR064 service types.
+const serviceTypePrefix = "urn:dslforum-org:service:"
+
+// errExit terminates the shell.
+var errExit = errors.New("exit")
+
+func newShell(client *tr064.Client, historyFile string) *shell {
+	s := &shell{client: client, historyFile: historyFile, out: os.Stdout}
+	s.commands = []shellCommand{
+		{name: "devices", usage: "list the devices and their services", run: s.devices},
+		{name: "services", usage: "list all services", run: s.services},
+		{name: "use", args: "<service>", usage: "select a service by type, ID or short type (e.g. Hosts:1)",
+			run: s.use, complete: s.completeService},
+		{name: "actions", usage: "list the actions of the selected service", run: s.actions},
+		{name: "describe", args: "<action>", usage: "show the arguments of an action", run: s.describe,
+			complete: s.completeAction},
+		{name: "call", args: "<action> [<argument>=<value> …]",
+			usage: "perform an action, missing in arguments are prompted for, quote values containing spaces",
+			run:   s.call, complete: s.completeCall},
+		{name: "dump", args: "on|off", usage: "print the SOAP requests and responses", run: s.dump,
+			complete: func(i int, _ []string) []string {
+				if i == 0 {
+					return []string{"on", "off"}
+				}
+				return nil
+			}},
+		{name: "history", usage: "show the command history", run: s.history},
+		{name: "help", usage: "show this help", run: s.help},
+		{name: "exit", usage: "leave the shell", run: func([]string) error { return errExit }},
+	}
+	s.editor = newLineEditor(os.Stdin, s.out, s.complete)
+	return s
+}
+
+func (s *shell) run() error {
+	s.loadHistory()
+	desc := s.client.Description()
+	fmt.Fprintf(s.out, "Connected to %s (%s) via %s. Type “help” for a list of commands.\n",
+		desc.Device.FriendlyName, desc.SystemVersion.Display, s.client.BaseURL())
+	for {
+		line, err := s.editor.readLine(s.prompt(), true)
+		if err == errInterrupted {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintln(s.out, "error:", err)
+			continue
+		}
+		command := s.findCommand(fields[0])
+		s.editor.addHistory(line)
+		// the arguments of actions may contain passwords, therefore calls are not written to the history file
+		if command == nil || command.name != "call" {
+			s.saveHistory(line)
+		}
+		if command == nil {
+			fmt.Fprintf(s.out, "unknown command “%s”, type “help” for a list of commands\n", fields[0])
+			continue
+		}
+		if err := command.run(fields[1:]); err == errExit {
+			return nil
+		} else if err != nil {
+			fmt.Fprintln(s.out, "error:", err)
+		}
+	}
+}
+
+func (s *shell) actions([]string) error {
+	if err := s.requireService(); err != nil {
+		return err
+	}
+	for _, name := range s.scpd.ActionNames() {
+		fmt.Fprintln(s.out, name)
+	}
+	return nil
+}
+
+func (s *shell) call(args []string) error {
+	if err := s.requireService(); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("usage: call <action> [<argument>=<value> …]")
+	}
+	action := args[0]
+	specs, err := s.scpd.Arguments(action, "in")
+	if err != nil {
+		return err
+	}
+
+	values := map[string]string{}
+	for _, arg := range args[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid argument “%s”, expected <argument>=<value>", arg)
+		}
+		values[parts[0]] = parts[1]
+	}
+	for _, spec := range specs {
+		if _, ok := values[spec.Name]; ok {
+			continue
+		}
+		value, err := s.editor.readLine(spec.String()+": ", false)
+		if err != nil {
+			return err
+		}
+		values[spec.Name] = value
+	}
+	params, err := s.scpd.PrepareArguments(action, values)
+	if err != nil {
+		return err
+	}
+
+	var result tr064.ArgumentValues
+	if err := s.adapter.Perform(context.Background(), s.service.Type, action, params, &result); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(s.out, 0, 4, 2, ' ', 0)
+	for _, value := range result {
+		fmt.Fprintf(w, "%s\t%s\n", value.Name, value.Value)
+	}
+	return w.Flush()
+}
+
+func (s *shell) complete(line string) []string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields) == 1 && !strings.HasSuffix(line, " ") {
+		names := make([]string, 0, len(s.commands))
+		for _, command := range s.commands {
+			names = append(names, command.name)
+		}
+		return names
+	}
+	command := s.findCommand(fields[0])
+	if command == nil || command.complete == nil {
+		return nil
+	}
+	args := fields[1:]
+	i := len(args)
+	if !strings.HasSuffix(line, " ") {
+		i--
+	}
+	return command.complete(i, args)
+}
+
+func (s *shell) completeAction(i int, _ []string) []string {
+	if i != 0 || s.scpd == nil {
+		return nil
+	}
+	return s.scpd.ActionNames()
+}
+
+func (s *shell) completeCall(i int, args []string) []string {
+	if i == 0 {
+		return s.completeAction(i, args)
+	}
+	if s.scpd == nil {
+		return nil
+	}
+	specs, err := s.scpd.Arguments(args[0], "in")
+	if err != nil {
+		return nil
+	}
+	given := map[string]bool{}
+	for j, arg := range args[1:] {
+		if j+1 != i {
+			given[strings.SplitN(arg, "=", 2)[0]] = true
+		}
+	}
+	var candidates []string
+	for _, spec := range specs {
+		if i < len(args) && strings.HasPrefix(args[i], spec.Name+"=") {
+			// complete the allowed values of the argument
+			candidates = nil
+			for _, value := range spec.AllowedValues {
+				candidates = append(candidates, spec.Name+"="+value)
+			}
+			return candidates
+		}
+		if !given[spec.Name] {
+			candidates = append(candidates, spec.Name+"=")
+		}
+	}
+	return candidates
+}
+
+func (s *shell) completeService(i int, _ []string) []string {
+	if i != 0 {
+		return nil
+	}
+	var candidates []string
+	for _, service := range s.client.Services() {
+		candidates = append(candidates, shortServiceType(service.Type))
+	}
+	return candidates
+}
+
+func (s *shell) describe(args []string) error {
+	if err := s.requireService(); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("usage: describe <action>")
+	}
+	w := tabwriter.NewWriter(s.out, 0, 4, 2, ' ', 0)
+	for _, direction := range []string{"in", "out"} {
+		specs, err := s.scpd.Arguments(args[0], direction)
+		if err != nil {
+			return err
+		}
+		for _, spec := range specs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", direction, spec.Name, spec.DataType,
+				strings.Join(spec.AllowedValues, "|"))
+		}
+	}
+	return w.Flush()
+}
+
+func (s *shell) devices([]string) error {
+	s.printDevice(&s.client.Description().Device, "")
+	return nil
+}
+
+func (s *shell) dump(args []string) error {
+	if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+		return errors.New("usage: dump on|off")
+	}
+	s.trace = args[0] == "on"
+	if s.adapter != nil {
+		s.adapter.SetTrace(s.traceWriter())
+	}
+	return nil
+}
+
+func (s *shell) findCommand(name string) *shellCommand {
+	if name == "quit" {
+		name = "exit"
+	}
+	for i := range s.commands {
+		if s.commands[i].name == name {
+			return &s.commands[i]
+		}
+	}
+	return nil
+}
+
+func (s *shell) help([]string) error {
+	w := tabwriter.NewWriter(s.out, 0, 4, 2, ' ', 0)
+	for _, command := range s.commands {
+		fmt.Fprintf(w, "%s %s\t%s\n", command.name, command.args, command.usage)
+	}
+	return w.Flush()
+}
+
+func (s *shell) history([]string) error {
+	for i, line := range s.editor.history {
+		fmt.Fprintf(s.out, "%4d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+func (s *shell) loadHistory() {
+	if s.historyFile == "" {
+		return
+	}
+	file, err := os.Open(s.historyFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		s.editor.addHistory(scanner.Text())
+	}
+}
+
+func (s *shell) printDevice(device *tr064.Device, indent string) {
+	fmt.Fprintf(s.out, "%s%s (%s)\n", indent, device.FriendlyName, device.Type)
+	for _, service := range device.Services {
+		fmt.Fprintf(s.out, "%s  - %s\n", indent, shortServiceType(service.Type))
+	}
+	for i := range device.Devices {
+		s.printDevice(&device.Devices[i], indent+"  ")
+	}
+}
+
+func (s *shell) prompt() string {
+	if s.service == nil {
+		return "tr064> "
+	}
+	return "tr064 " + shortServiceType(s.service.Type) + "> "
+}
+
+func (s *shell) requireService() error {
+	if s.service == nil {
+		return errors.New("no service selected, select one with “use <service>”")
+	}
+	return nil
+}
+
+func (s *shell) saveHistory(line string) {
+	if s.historyFile == "" {
+		return
+	}
+	file, err := os.OpenFile(s.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	_, _ = fmt.Fprintln(file, line)
+}
+
+func (s *shell) services([]string) error {
+	w := tabwriter.NewWriter(s.out, 0, 4, 2, ' ', 0)
+	for _, service := range s.client.Services() {
+		fmt.Fprintf(w, "%s\t%s\n", shortServiceType(service.Type), service.ID)
+	}
+	return w.Flush()
+}
+
+func (s *shell) traceWriter() io.Writer {
+	if s.trace {
+		return s.out
+	}
+	return nil
+}
+
+func (s *shell) use(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: use <service>")
+	}
+	service := s.findService(args[0])
+	if service == nil {
+		return fmt.Errorf("unknown service “%s”", args[0])
+	}
+	// the ID is unique whereas several devices may provide services of the same type
+	scpd, err := s.client.SCPD(context.Background(), service.ID)
+	if err != nil {
+		return err
+	}
+	adapter, err := s.client.Service(service.ID)
+	if err != nil {
+		return err
+	}
+	adapter.SetTrace(s.traceWriter())
+	s.adapter = adapter
+	s.scpd = scpd
+	s.service = service
+	return nil
+}
+
+// findService looks up a service by its type, ID or short type (e.g. “Hosts:1”).
+func (s *shell) findService(name string) *tr064.Service {
+	if service := s.client.FindService(name); service != nil {
+		return service
+	}
+	return s.client.FindService(serviceTypePrefix + name)
+}
+
+// shortServiceType returns the service type without the common prefix, e.g. “Hosts:1”.
+// splitArgs splits a command line into arguments at unquoted whitespace.
+// Single quotes preserve everything up to the next single quote, double quotes preserve everything up to the next
+// unescaped double quote and a backslash outside of single quotes preserves the following character.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote %c", quote)
+	}
+	if escaped {
+		return nil, errors.New("unterminated escape sequence")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+func shortServiceType(serviceType string) string {
+	return strings.TrimPrefix(serviceType, serviceTypePrefix)
+}
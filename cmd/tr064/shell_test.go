@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := map[string]struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		"plain": {
+			line: "call  GetPhonebook\tNewPhonebookID=0",
+			want: []string{"call", "GetPhonebook", "NewPhonebookID=0"},
+		},
+		"double quoted value": {
+			line: `call SetPhonebookEntryUID NewPhonebookEntryData="<contact><person><realName>Jane Doe</realName></person></contact>"`,
+			want: []string{"call", "SetPhonebookEntryUID",
+				"NewPhonebookEntryData=<contact><person><realName>Jane Doe</realName></person></contact>"},
+		},
+		"single quoted value": {
+			line: `call SetPhonebookEntryUID 'NewPhonebookEntryData=<?xml version="1.0"?><contact/>'`,
+			want: []string{"call", "SetPhonebookEntryUID", `NewPhonebookEntryData=<?xml version="1.0"?><contact/>`},
+		},
+		"escaped quote": {
+			line: `call X NewValue="say \"hello\"" NewOther=a\ b`,
+			want: []string{"call", "X", `NewValue=say "hello"`, "NewOther=a b"},
+		},
+		"backslash in single quotes": {
+			line: `call X 'NewPath=C:\temp'`,
+			want: []string{"call", "X", `NewPath=C:\temp`},
+		},
+		"empty value": {
+			line: `call X NewName=""`,
+			want: []string{"call", "X", "NewName="},
+		},
+		"empty argument": {
+			line: `call X ''`,
+			want: []string{"call", "X", ""},
+		},
+		"unterminated quote": {
+			line:    `call X NewName="Jane`,
+			wantErr: true,
+		},
+		"unterminated escape": {
+			line:    `call X NewName=\`,
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := splitArgs(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "errors"
+
+// terminalState is a placeholder for the terminal state on platforms without raw mode support.
+type terminalState struct{}
+
+// makeRaw fails because raw mode is not supported on this platform; lines are read without editing support.
+func makeRaw(uintptr) (*terminalState, error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
+
+func restoreTerminal(uintptr, *terminalState) {}
@@ -0,0 +1,39 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// makeRaw switches the terminal fd into raw mode and returns its previous state.
+// It fails if fd is not a terminal.
+func makeRaw(fd uintptr) (*syscall.Termios, error) {
+	var state syscall.Termios
+	if err := ioctlTermios(fd, ioctlGetTermios, &state); err != nil {
+		return nil, err
+	}
+	raw := state
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctlTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// restoreTerminal restores the state of the terminal fd returned by makeRaw.
+func restoreTerminal(fd uintptr, state *syscall.Termios) {
+	_ = ioctlTermios(fd, ioctlSetTermios, state)
+}
+
+func ioctlTermios(fd, request uintptr, termios *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(termios))); errno != 0 {
+		return errno
+	}
+	return nil
+}
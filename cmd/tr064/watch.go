@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// watch subscribes to the events of the given services and prints them until it is interrupted.
+func watch(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return errors.New("you have to specify at least one service")
+	}
+	client, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	listener, err := tr064.NewEventListener(ctx.String("listen"))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	events := make(chan tr064.Event)
+	var subscriptions []*tr064.Subscription
+	defer func() {
+		for _, subscription := range subscriptions {
+			unsubscribeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_ = subscription.Unsubscribe(unsubscribeCtx)
+			cancel()
+		}
+	}()
+	failures := make(chan error, ctx.NArg())
+	for _, name := range ctx.Args() {
+		service := client.FindService(name)
+		if service == nil {
+			service = client.FindService(serviceTypePrefix + name)
+		}
+		if service == nil {
+			return fmt.Errorf("unknown service “%s”", name)
+		}
+		subscription, err := client.Subscribe(context.Background(), listener, service.ID, ctx.Duration("timeout"))
+		if err != nil {
+			return err
+		}
+		subscriptions = append(subscriptions, subscription)
+		go func() {
+			for event := range subscription.Events() {
+				events <- event
+			}
+			if err := subscription.Err(); err != nil {
+				failures <- err
+			}
+		}()
+		fmt.Printf("Subscribed to %s (%s)\n", shortServiceType(service.Type), subscription.SID())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case event := <-events:
+			printEvent(event)
+		case err := <-failures:
+			return err
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+func printEvent(event tr064.Event) {
+	names := make([]string, 0, len(event.Values))
+	for name := range event.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("%s %s #%d\n", time.Now().Format("15:04:05"), shortServiceType(event.Service.Type), event.Seq)
+	for _, name := range names {
+		value := event.Values[name]
+		fmt.Printf("  %s = %v (%s)\n", name, value, reflect.TypeOf(value))
+	}
+}
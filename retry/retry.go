@@ -0,0 +1,181 @@
+// Package retry repeats operations which failed because of transient errors.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy defines how failing operations are retried.
+type Policy struct {
+	// Attempts is the maximum amount of attempts including the first one (values < 2 disable retries).
+	Attempts int
+	// InitialDelay is the delay before the first retry. It doubles with every further retry.
+	InitialDelay time.Duration
+	// MaxDelay limits the delay between two attempts.
+	MaxDelay time.Duration
+	// Log receives a message for every retry (optional).
+	Log *log.Logger
+	// Stats counts the retries (optional).
+	Stats *Stats
+}
+
+// DefaultPolicy is a reasonable policy for requests to a Fritz!Box or a CardDAV server.
+var DefaultPolicy = Policy{Attempts: 4, InitialDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second}
+
+// Stats counts retries per operation kind. It is safe for concurrent use.
+type Stats struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+// retryableError marks an error as transient.
+type retryableError struct {
+	err error
+}
+
+// Retryable marks err as transient, i.e. the failed operation may succeed when it is repeated.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err}
+}
+
+// IsRetryable reports whether err is transient.
+// Errors marked with Retryable and network timeouts are transient, cancelled contexts are not.
+// A mark takes precedence because per-request timeouts (e.g. of http.Client) also match
+// context.DeadlineExceeded; Do never retries if its own context is done anyway.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var retryable *retryableError
+	if errors.As(err, &retryable) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Do calls f until it succeeds, fails with an error which is not retryable (see IsRetryable),
+// the attempts are exhausted or ctx is done.
+// The kind describes the operation in log messages and Stats, e.g. “TR-064 GetPhonebook”.
+// Errors marked with Retryable are returned unwrapped.
+func (p Policy) Do(ctx context.Context, kind string, f func() error) error {
+	delay := p.InitialDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if attempt >= p.Attempts || !IsRetryable(err) || ctx.Err() != nil {
+			return unwrap(err)
+		}
+
+		wait := jitter(delay)
+		if p.Log != nil {
+			p.Log.Printf("%s failed (attempt %d of %d), retrying in %v: %v", kind, attempt, p.Attempts,
+				wait.Round(time.Millisecond), unwrap(err))
+		}
+		p.Stats.add(kind)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return unwrap(err)
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if p.MaxDelay > 0 && delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+}
+
+// WithDefaults returns the policy with the attempts and delays of DefaultPolicy if Attempts is not set.
+func (p Policy) WithDefaults() Policy {
+	if p.Attempts == 0 {
+		p.Attempts = DefaultPolicy.Attempts
+		p.InitialDelay = DefaultPolicy.InitialDelay
+		p.MaxDelay = DefaultPolicy.MaxDelay
+	}
+	return p
+}
+
+// Total returns the amount of all retries.
+func (s *Stats) Total() int {
+	if s == nil {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	total := 0
+	for _, n := range s.counts {
+		total += n
+	}
+	return total
+}
+
+// String returns the amount of retries per operation kind, e.g. “FTP upload: 2, TR-064 GetPhonebook: 1”.
+func (s *Stats) String() string {
+	if s == nil {
+		return ""
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	parts := make([]string, 0, len(s.counts))
+	for kind, n := range s.counts {
+		parts = append(parts, fmt.Sprintf("%s: %d", kind, n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+func (s *Stats) add(kind string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.counts == nil {
+		s.counts = map[string]int{}
+	}
+	s.counts[kind]++
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// jitter varies delay by ±25% which avoids retrying in lockstep with parallel operations.
+func jitter(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		return delay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1)) - delay/4
+}
+
+func unwrap(err error) error {
+	if retryable, ok := err.(*retryableError); ok {
+		return retryable.err
+	}
+	return err
+}
@@ -0,0 +1,197 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	timeout := &net.DNSError{Err: "timeout", IsTimeout: true}
+	tests := map[string]struct {
+		err  error
+		want bool
+	}{
+		"nil":                      {err: nil, want: false},
+		"plain error":              {err: errors.New("failed"), want: false},
+		"marked":                   {err: Retryable(errors.New("busy")), want: true},
+		"marked and wrapped":       {err: fmt.Errorf("request: %w", Retryable(errors.New("busy"))), want: true},
+		"network timeout":          {err: timeout, want: true},
+		"other network error":      {err: &net.DNSError{Err: "no such host", IsNotFound: true}, want: false},
+		"cancelled":                {err: context.Canceled, want: false},
+		"deadline exceeded":        {err: context.DeadlineExceeded, want: false},
+		"marked deadline exceeded": {err: Retryable(fmt.Errorf("request: %w", context.DeadlineExceeded)), want: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+	if Retryable(nil) != nil {
+		t.Error("marking nil has to return nil")
+	}
+}
+
+func TestDo(t *testing.T) {
+	busy := errors.New("busy")
+	permanent := errors.New("permanent")
+	tests := map[string]struct {
+		attempts  int
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		"success":                {attempts: 3, wantCalls: 1},
+		"success after failures": {attempts: 3, errs: []error{Retryable(busy), Retryable(busy)}, wantCalls: 3},
+		"attempts exhausted": {
+			attempts:  3,
+			errs:      []error{Retryable(busy), Retryable(busy), Retryable(busy)},
+			wantCalls: 3,
+			wantErr:   busy,
+		},
+		"permanent error":  {attempts: 3, errs: []error{Retryable(busy), permanent}, wantCalls: 2, wantErr: permanent},
+		"retries disabled": {attempts: 1, errs: []error{Retryable(busy)}, wantCalls: 1, wantErr: busy},
+		"no attempts":      {attempts: 0, errs: []error{Retryable(busy)}, wantCalls: 1, wantErr: busy},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			err := Policy{Attempts: tt.attempts, InitialDelay: time.Millisecond}.Do(context.Background(), "test",
+				func() error {
+					calls++
+					if calls <= len(tt.errs) {
+						return tt.errs[calls-1]
+					}
+					return nil
+				})
+			if err != tt.wantErr {
+				t.Errorf("expected the unwrapped error %v, got %#v", tt.wantErr, err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestDoStopsWhenTheContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	err := Policy{Attempts: 5, InitialDelay: time.Hour}.Do(ctx, "test", func() error {
+		calls++
+		return Retryable(errors.New("busy"))
+	})
+	if err == nil || err.Error() != "busy" {
+		t.Errorf("expected the last error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the delay has to be interrupted, took %v", elapsed)
+	}
+
+	calls = 0
+	err = Policy{Attempts: 5}.Do(ctx, "test", func() error {
+		calls++
+		return Retryable(errors.New("busy"))
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("a done context must not be retried, got %d calls and %v", calls, err)
+	}
+}
+
+func TestDoBackoff(t *testing.T) {
+	var logged bytes.Buffer
+	policy := Policy{
+		Attempts:     5,
+		InitialDelay: 20 * time.Millisecond,
+		MaxDelay:     50 * time.Millisecond,
+		Log:          log.New(&logged, "", 0),
+	}
+	_ = policy.Do(context.Background(), "test", func() error { return Retryable(errors.New("busy")) })
+
+	matches := regexp.MustCompile(`retrying in (\S+):`).FindAllStringSubmatch(logged.String(), -1)
+	want := []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	if len(matches) != len(want) {
+		t.Fatalf("expected %d retries, got %q", len(want), logged.String())
+	}
+	for i, match := range matches {
+		wait, err := time.ParseDuration(match[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the logged delay is rounded to milliseconds
+		if min, max := want[i]*3/4-time.Millisecond, want[i]*5/4+time.Millisecond; wait < min || wait > max {
+			t.Errorf("expected retry %d after %v to %v, got %v", i+1, min, max, wait)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if jitter(0) != 0 {
+		t.Error("no delay must stay without delay")
+	}
+	delay := 100 * time.Millisecond
+	min, max := delay, delay
+	for i := 0; i < 1000; i++ {
+		wait := jitter(delay)
+		if wait < delay*3/4 || wait > delay*5/4 {
+			t.Fatalf("expected a delay between %v and %v, got %v", delay*3/4, delay*5/4, wait)
+		}
+		if wait < min {
+			min = wait
+		}
+		if wait > max {
+			max = wait
+		}
+	}
+	if min == delay && max == delay {
+		t.Error("expected the delay to vary")
+	}
+}
+
+func TestStats(t *testing.T) {
+	var nilStats *Stats
+	nilStats.add("test")
+	if nilStats.Total() != 0 || nilStats.String() != "" {
+		t.Error("nil stats have to be empty")
+	}
+
+	stats := &Stats{}
+	policy := Policy{Attempts: 3, Stats: stats}
+	for _, kind := range []string{"TR-064 GetPhonebook", "FTP upload"} {
+		_ = policy.Do(context.Background(), kind, func() error { return Retryable(errors.New("busy")) })
+	}
+	_ = policy.Do(context.Background(), "CardDAV read", func() error { return nil })
+	if stats.Total() != 4 {
+		t.Errorf("expected 4 retries, got %d", stats.Total())
+	}
+	if want := "FTP upload: 2, TR-064 GetPhonebook: 2"; stats.String() != want {
+		t.Errorf("expected %q, got %q", want, stats.String())
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	if got := (Policy{}).WithDefaults(); got.Attempts != DefaultPolicy.Attempts ||
+		got.InitialDelay != DefaultPolicy.InitialDelay || got.MaxDelay != DefaultPolicy.MaxDelay {
+		t.Errorf("expected the default policy, got %+v", got)
+	}
+	custom := Policy{Attempts: 1}
+	if got := custom.WithDefaults(); got.Attempts != 1 || got.InitialDelay != 0 {
+		t.Errorf("expected the policy to be kept, got %+v", got)
+	}
+}
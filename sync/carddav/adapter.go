@@ -1,36 +1,88 @@
 package carddav
 
 import (
+	"context"
+	"errors"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-vcard"
 	"github.com/studio-b12/gowebdav"
 
+	"github.com/toaster/fritz_sync/retry"
 	"github.com/toaster/fritz_sync/sync"
 )
 
 // Adapter implements the sync.Reader interface for accessing CardDAV contacts.
 type Adapter struct {
-	client *gowebdav.Client
+	client      *gowebdav.Client
+	retryPolicy retry.Policy
+	transport   http.RoundTripper
 }
 
 // NewAdapter creates a new Adapter for a given CardDAV URL and the corresponding credentials.
 func NewAdapter(contactsURL, user, pass string) *Adapter {
-	return &Adapter{gowebdav.NewClient(contactsURL, user, pass)}
+	return &Adapter{
+		client:      gowebdav.NewClient(contactsURL, user, pass),
+		retryPolicy: retry.DefaultPolicy,
+		transport:   http.DefaultTransport,
+	}
+}
+
+// contextTransport binds all requests to a context.
+// gowebdav creates its requests internally and its methods like ReadDir and Read take no context.
+// ReadAll therefore installs this transport on the client for its duration, so that cancelling the context
+// aborts the running PROPFIND or GET.
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+// SetRetryPolicy defines how requests which failed because of transient errors are retried
+// (default retry.DefaultPolicy).
+func (a *Adapter) SetRetryPolicy(policy retry.Policy) {
+	a.retryPolicy = policy
+}
+
+// SetTransport defines the transport of all requests to the CardDAV server (default http.DefaultTransport),
+// e.g. for recording them (see package cassette).
+func (a *Adapter) SetTransport(transport http.RoundTripper) {
+	a.transport = transport
+}
+
+// SetTimeout limits the duration of every request to the CardDAV server (0 means no limit).
+func (a *Adapter) SetTimeout(timeout time.Duration) {
+	a.client.SetTimeout(timeout)
 }
 
 // ReadAll reads all contacts (part of sync.Reader interface).
-func (a *Adapter) ReadAll(categories []string) (map[string]sync.Contact, error) {
-	files, err := a.client.ReadDir("/")
+func (a *Adapter) ReadAll(ctx context.Context, categories []string) (map[string]sync.Contact, error) {
+	a.client.SetTransport(&contextTransport{ctx, a.transport})
+	defer a.client.SetTransport(a.transport)
+
+	var files []os.FileInfo
+	err := a.retryPolicy.Do(ctx, "CardDAV list", func() (err error) {
+		files, err = a.client.ReadDir("/")
+		return classifyError(ctx, err)
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	contacts := map[string]sync.Contact{}
 	for _, file := range files {
-		if err := a.readFile(file, categories, contacts); err != nil {
+		if err := sync.Stopped(ctx); err != nil {
+			return nil, err
+		}
+		err := a.retryPolicy.Do(ctx, "CardDAV read", func() error {
+			return classifyError(ctx, a.readFile(file, categories, contacts))
+		})
+		if err != nil {
 			return nil, err
 		}
 	}
@@ -76,6 +128,33 @@ func (a *Adapter) readFile(file os.FileInfo, categories []string, contacts map[s
 	return nil
 }
 
+// classifyError marks transient errors as retryable: network errors and server errors (HTTP 5xx).
+func classifyError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		// gowebdav reports HTTP failures as “503” or, for PROPFIND, as “503 Service Unavailable - PROPFIND /”
+		if status, convErr := strconv.Atoi(strings.SplitN(pathErr.Err.Error(), " ", 2)[0]); convErr == nil {
+			if status >= http.StatusInternalServerError {
+				return retry.Retryable(err)
+			}
+			return err
+		}
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return retry.Retryable(err)
+	}
+	return err
+}
+
+// RoundTrip is part of the http.RoundTripper interface.
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(req.WithContext(t.ctx))
+}
+
 func contactFromCard(card vcard.Card) sync.Contact {
 	contact := sync.Contact{
 		FullName: strings.TrimSpace(card.PreferredValue(vcard.FieldFormattedName)),
@@ -0,0 +1,289 @@
+package carddav
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-vcard"
+
+	"github.com/toaster/fritz_sync/retry"
+	"github.com/toaster/fritz_sync/sync"
+	"github.com/toaster/fritz_sync/sync/carddav/carddavtest"
+	"github.com/toaster/fritz_sync/sync/synctest"
+)
+
+func TestReadAll(t *testing.T) {
+	server := carddavtest.NewServer(carddavtest.Options{})
+	defer server.Close()
+	putCard(t, server, "ada.vcf", newCard("ada", "Ada Lovelace", "Family", "Friends"))
+	putCard(t, server, "charles.vcf", newCard("charles", "Charles Babbage", "Work"))
+	putCard(t, server, "grace.vcf", newCard("grace", "Grace Hopper"))
+	server.PutFile("two.vcf", []byte("BEGIN:VCARD\r\nVERSION:3.0\r\nUID:alan\r\nFN:Alan Turing\r\nCATEGORIES:Work\r\nEND:VCARD\r\n"+
+		"BEGIN:VCARD\r\nVERSION:3.0\r\nUID:konrad\r\nFN:Konrad Zuse\r\nEND:VCARD\r\n"))
+
+	tests := map[string]struct {
+		categories []string
+		want       []string
+	}{
+		"all":                  {want: []string{"ada", "alan", "charles", "grace", "konrad"}},
+		"one category":         {categories: []string{"Work"}, want: []string{"alan", "charles"}},
+		"several categories":   {categories: []string{"Friends", "Work"}, want: []string{"ada", "alan", "charles"}},
+		"second category":      {categories: []string{"Friends"}, want: []string{"ada"}},
+		"unknown category":     {categories: []string{"Unknown"}, want: nil},
+		"categories are exact": {categories: []string{"work"}, want: nil},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			contacts, err := newTestAdapter(server.URL, carddavtest.DefaultUser, carddavtest.DefaultPassword).
+				ReadAll(context.Background(), tt.categories)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := contactIDs(contacts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReadAllAuthentication(t *testing.T) {
+	tests := map[string]struct {
+		digest   bool
+		password string
+		wantErr  bool
+	}{
+		"basic":                  {password: carddavtest.DefaultPassword},
+		"digest":                 {digest: true, password: carddavtest.DefaultPassword},
+		"basic, wrong password":  {password: "wrong", wantErr: true},
+		"digest, wrong password": {digest: true, password: "wrong", wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := carddavtest.NewServer(carddavtest.Options{Digest: tt.digest})
+			defer server.Close()
+			putCard(t, server, "ada.vcf", newCard("ada", "Ada Lovelace"))
+
+			contacts, err := newTestAdapter(server.URL, carddavtest.DefaultUser, tt.password).
+				ReadAll(context.Background(), nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(contacts) != 1 {
+				t.Errorf("expected 1 contact, got %d", len(contacts))
+			}
+		})
+	}
+}
+
+func TestReadAllFailures(t *testing.T) {
+	tests := map[string]struct {
+		method  string
+		fault   carddavtest.Fault
+		n       int
+		wantErr bool
+	}{
+		"list unavailable once":  {method: "PROPFIND", fault: carddavtest.Fault{HTTPStatus: http.StatusServiceUnavailable}, n: 1},
+		"list disconnected once": {method: "PROPFIND", fault: carddavtest.Fault{Disconnect: true}, n: 1},
+		"read unavailable once":  {method: "GET", fault: carddavtest.Fault{HTTPStatus: http.StatusServiceUnavailable}, n: 1},
+		"read timed out once":    {method: "GET", fault: carddavtest.Fault{Delay: 300 * time.Millisecond}, n: 1},
+		"read unavailable":       {method: "GET", fault: carddavtest.Fault{HTTPStatus: http.StatusServiceUnavailable}, n: 3, wantErr: true},
+		"read forbidden":         {method: "GET", fault: carddavtest.Fault{HTTPStatus: http.StatusForbidden}, n: 1, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := carddavtest.NewServer(carddavtest.Options{})
+			defer server.Close()
+			putCard(t, server, "ada.vcf", newCard("ada", "Ada Lovelace"))
+			a := newTestAdapter(server.URL, carddavtest.DefaultUser, carddavtest.DefaultPassword)
+			a.SetTimeout(100 * time.Millisecond)
+
+			server.FailRequests(tt.method, tt.n, tt.fault)
+			contacts, err := a.ReadAll(context.Background(), nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the failure to be retried: %v", err)
+			}
+			if len(contacts) != 1 {
+				t.Errorf("expected 1 contact, got %d", len(contacts))
+			}
+		})
+	}
+}
+
+func TestReadAllMalformedCard(t *testing.T) {
+	server := carddavtest.NewServer(carddavtest.Options{})
+	defer server.Close()
+	server.PutFile("broken.vcf", []byte("BEGIN:VCARD\r\nVERSION:3.0\r\nFN Ada\r\n"))
+
+	_, err := newTestAdapter(server.URL, carddavtest.DefaultUser, carddavtest.DefaultPassword).
+		ReadAll(context.Background(), nil)
+	if err == nil {
+		t.Error("expected an error for a malformed vCard")
+	}
+}
+
+func TestReadAllCancelled(t *testing.T) {
+	server := carddavtest.NewServer(carddavtest.Options{})
+	defer server.Close()
+	putCard(t, server, "ada.vcf", newCard("ada", "Ada Lovelace"))
+	server.FailRequests("PROPFIND", 1, carddavtest.Fault{Delay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := newTestAdapter(server.URL, carddavtest.DefaultUser, carddavtest.DefaultPassword).
+		ReadAll(ctx, nil); err == nil {
+		t.Error("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the context has to abort the request, it took %v", elapsed)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	synctest.TestReader(t, func(t *testing.T, contacts []sync.Contact) sync.Reader {
+		server := carddavtest.NewServer(carddavtest.Options{})
+		t.Cleanup(server.Close)
+		for _, contact := range contacts {
+			putCard(t, server, contact.ID+".vcf", cardFromContact(contact))
+		}
+		return newTestAdapter(server.URL, carddavtest.DefaultUser, carddavtest.DefaultPassword)
+	})
+}
+
+func TestContactFromCard(t *testing.T) {
+	tests := map[string]struct {
+		card string
+		want sync.Contact
+	}{
+		"minimal": {
+			card: "UID:1\r\nFN:Ada Lovelace\r\n",
+			want: sync.Contact{ID: "1", FullName: "Ada Lovelace", Numbers: []sync.PhoneNumber{}},
+		},
+		"trimmed values": {
+			card: "UID: 1 \r\nFN: Ada Lovelace \r\nEMAIL: ada@example.com \r\nTEL: +49301234567 \r\n",
+			want: sync.Contact{ID: "1", FullName: "Ada Lovelace", Email: "ada@example.com",
+				Numbers: []sync.PhoneNumber{{Number: "+49301234567", Priority: true}}},
+		},
+		"preferred email": {
+			card: "UID:1\r\nEMAIL:private@example.com\r\nEMAIL;PREF=1:work@example.com\r\n",
+			want: sync.Contact{ID: "1", Email: "work@example.com", Numbers: []sync.PhoneNumber{}},
+		},
+		"photo": {
+			card: "UID:1\r\nPHOTO:data:image/jpeg;base64,/9j/\r\n",
+			want: sync.Contact{ID: "1", Image: "data:image/jpeg;base64,/9j/", Numbers: []sync.PhoneNumber{}},
+		},
+		"number types": {
+			card: "UID:1\r\nTEL;TYPE=home:1\r\nTEL;TYPE=work:2\r\nTEL;TYPE=cell:3\r\nTEL;TYPE=fax,work:4\r\nTEL;TYPE=VOICE:5\r\n",
+			want: sync.Contact{ID: "1", Numbers: []sync.PhoneNumber{
+				{Number: "1", Purpose: sync.Home, Priority: true},
+				{Number: "2", Purpose: sync.Work},
+				{Number: "3", Type: sync.Cell},
+				{Number: "4", Purpose: sync.Work, Type: sync.Fax},
+				{Number: "5"},
+			}},
+		},
+		"preferred number via type (vCard 3)": {
+			card: "UID:1\r\nTEL;TYPE=home:1\r\nTEL;TYPE=cell,pref:2\r\n",
+			want: sync.Contact{ID: "1", Numbers: []sync.PhoneNumber{
+				{Number: "1", Purpose: sync.Home},
+				{Number: "2", Type: sync.Cell, Priority: true},
+			}},
+		},
+		"preferred number via parameter (vCard 4)": {
+			card: "UID:1\r\nTEL;TYPE=home:1\r\nTEL;TYPE=work;PREF=1:2\r\n",
+			want: sync.Contact{ID: "1", Numbers: []sync.PhoneNumber{
+				{Number: "1", Purpose: sync.Home},
+				{Number: "2", Purpose: sync.Work, Priority: true},
+			}},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			card, err := vcard.NewDecoder(strings.NewReader("BEGIN:VCARD\r\nVERSION:3.0\r\n" + tt.card + "END:VCARD\r\n")).Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := contactFromCard(card); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func newTestAdapter(url, user, pass string) *Adapter {
+	a := NewAdapter(url, user, pass)
+	a.SetRetryPolicy(retry.Policy{Attempts: 3, InitialDelay: time.Millisecond})
+	return a
+}
+
+// cardFromContact is the inverse of contactFromCard for the fields the sync uses.
+func cardFromContact(contact sync.Contact) vcard.Card {
+	card := newCard(contact.ID, contact.FullName)
+	if contact.Email != "" {
+		card.SetValue(vcard.FieldEmail, contact.Email)
+	}
+	if contact.Image != "" {
+		card.SetValue(vcard.FieldPhoto, contact.Image)
+	}
+	for _, number := range contact.Numbers {
+		var types []string
+		if number.Purpose == sync.Work {
+			types = append(types, vcard.TypeWork)
+		}
+		switch number.Type {
+		case sync.Cell:
+			types = append(types, vcard.TypeCell)
+		case sync.Fax:
+			types = append(types, vcard.TypeFax)
+		}
+		if number.Priority {
+			types = append(types, "pref")
+		}
+		card.Add(vcard.FieldTelephone, &vcard.Field{Value: number.Number, Params: vcard.Params{vcard.ParamType: types}})
+	}
+	return card
+}
+
+func newCard(uid, name string, categories ...string) vcard.Card {
+	card := vcard.Card{}
+	card.SetValue(vcard.FieldVersion, "3.0")
+	card.SetValue(vcard.FieldUID, uid)
+	card.SetValue(vcard.FieldFormattedName, name)
+	if len(categories) > 0 {
+		card.SetCategories(categories)
+	}
+	return card
+}
+
+func putCard(t *testing.T, server *carddavtest.Server, name string, card vcard.Card) {
+	t.Helper()
+	if _, err := server.PutCard(name, card); err != nil {
+		t.Fatalf("cannot store %s: %v", name, err)
+	}
+}
+
+func contactIDs(contacts map[string]sync.Contact) []string {
+	var ids []string
+	for id := range contacts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,376 @@
+// Package carddavtest provides an in-process fake CardDAV server for tests of the CardDAV adapter.
+//
+// The fake serves a single address book from in-memory vCards via WebDAV (OPTIONS, PROPFIND, GET, PUT, DELETE)
+// and CardDAV (REPORT with addressbook-query, addressbook-multiget and sync-collection). It authenticates all
+// requests via HTTP basic or digest authentication and provides ETags and sync tokens:
+//
+//	server := carddavtest.NewServer(carddavtest.Options{})
+//	defer server.Close()
+//	card := vcard.Card{}
+//	card.SetValue(vcard.FieldUID, "1")
+//	card.SetValue(vcard.FieldFormattedName, "Jane Doe")
+//	if _, err := server.PutCard("jane.vcf", card); err != nil {
+//		...
+//	}
+//	adapter := carddav.NewAdapter(server.URL, carddavtest.DefaultUser, carddavtest.DefaultPassword)
+//
+// Malformed vCards can be stored with PutFile. Faults can be injected per method with FailRequests or for
+// arbitrary requests with SetHook.
+package carddavtest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-vcard"
+)
+
+// The defaults of the fake.
+const (
+	// DefaultPassword is the password accepted if Options.Password is empty.
+	DefaultPassword = "secret"
+	// DefaultUser is the user accepted if Options.User is empty.
+	DefaultUser = "user"
+)
+
+// AddressBookPath is the path of the address book collection.
+const AddressBookPath = "/addressbooks/users/test/contacts/"
+
+// authRealm is the realm of the basic and digest authentication.
+const authRealm = "carddavtest"
+
+// Options configures a Server.
+type Options struct {
+	// Digest selects HTTP digest authentication instead of basic authentication.
+	Digest bool
+	// Password is the password of User (default DefaultPassword).
+	Password string
+	// User is the user accepted by the authentication (default DefaultUser).
+	User string
+}
+
+// Server is a fake CardDAV server. It is safe for concurrent use.
+type Server struct {
+	// URL is the URL of the address book, e.g. http://127.0.0.1:49152/addressbooks/users/test/contacts/.
+	URL string
+
+	httpServer *httptest.Server
+	nonce      string
+	opts       Options
+
+	mutex     sync.Mutex
+	faults    map[string][]Fault
+	files     map[string]*file
+	hook      Hook
+	modified  map[string]uint64
+	requests  []Request
+	syncToken uint64
+}
+
+// Request is a request received by the server.
+type Request struct {
+	// Depth is the value of the Depth header, e.g. “1”.
+	Depth string
+	// Method is the HTTP method, e.g. “PROPFIND”.
+	Method string
+	// Path is the path of the request URL, e.g. “/addressbooks/users/test/contacts/jane.vcf”.
+	Path string
+}
+
+// Fault replaces or delays the regular response to a request.
+type Fault struct {
+	// Delay delays the response, e.g. to provoke client timeouts.
+	// If no other field is set, the request is processed regularly after the delay.
+	Delay time.Duration
+	// Disconnect closes the connection without sending a response.
+	Disconnect bool
+	// HTTPStatus is the status of the response, e.g. 503.
+	HTTPStatus int
+}
+
+// Hook decides about a fault for an authenticated request. It returns nil for regular processing.
+type Hook func(req Request) *Fault
+
+type file struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+var digestParam = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// NewServer starts a fake CardDAV server with an empty address book.
+func NewServer(opts Options) *Server {
+	if opts.Password == "" {
+		opts.Password = DefaultPassword
+	}
+	if opts.User == "" {
+		opts.User = DefaultUser
+	}
+
+	s := &Server{
+		faults:    map[string][]Fault{},
+		files:     map[string]*file{},
+		modified:  map[string]uint64{},
+		nonce:     newToken(),
+		opts:      opts,
+		syncToken: 1,
+	}
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.httpServer.URL + AddressBookPath
+	return s
+}
+
+// Close shuts the fake down.
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// DeleteFile removes a file from the address book. It reports whether the file existed.
+func (s *Server) DeleteFile(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deleteFile(name)
+}
+
+// FailRequests makes the next n requests with the given method fail with fault.
+// Faults of FailRequests take precedence over the hook.
+func (s *Server) FailRequests(method string, n int, fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		s.faults[method] = append(s.faults[method], fault)
+	}
+}
+
+// File returns the content and the ETag of a file of the address book.
+func (s *Server) File(name string) ([]byte, string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, "", false
+	}
+	return append([]byte(nil), f.data...), f.etag, true
+}
+
+// Files returns the names of all files of the address book in alphabetical order.
+func (s *Server) Files() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fileNames()
+}
+
+// PutCard stores a vCard under the given name, e.g. “jane.vcf”, and returns its ETag.
+// The VERSION field is set to 3.0 if the card has none.
+func (s *Server) PutCard(name string, card vcard.Card) (string, error) {
+	if card.Get(vcard.FieldVersion) == nil {
+		versioned := vcard.Card{}
+		for k, fields := range card {
+			versioned[k] = fields
+		}
+		versioned.SetValue(vcard.FieldVersion, "3.0")
+		card = versioned
+	}
+	var data bytes.Buffer
+	if err := vcard.NewEncoder(&data).Encode(card); err != nil {
+		return "", fmt.Errorf("cannot encode vCard %s: %v", name, err)
+	}
+	return s.PutFile(name, data.Bytes()), nil
+}
+
+// PutFile stores arbitrary data under the given name and returns its ETag.
+// The data is not validated, i.e. it may be used for malformed vCards.
+func (s *Server) PutFile(name string, data []byte) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.putFile(name, data)
+}
+
+// Requests returns all authenticated requests received so far in their order.
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// SetHook installs a hook which is called for every authenticated request (nil removes it).
+// The hook must not block; it may call the methods of the server.
+func (s *Server) SetHook(hook Hook) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hook = hook
+}
+
+// SyncToken returns the current sync token of the address book.
+func (s *Server) SyncToken() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return formatSyncToken(s.syncToken)
+}
+
+// authenticate checks the authentication of a request and sends a challenge if it is missing or invalid.
+func (s *Server) authenticate(w http.ResponseWriter, req *http.Request) bool {
+	header := req.Header.Get("Authorization")
+	if s.opts.Digest {
+		if strings.HasPrefix(header, "Digest ") {
+			params := map[string]string{}
+			for _, match := range digestParam.FindAllStringSubmatch(header[len("Digest "):], -1) {
+				params[match[1]] = match[2] + match[3]
+			}
+			ha1 := md5Hex(s.opts.User + ":" + authRealm + ":" + s.opts.Password)
+			ha2 := md5Hex(req.Method + ":" + params["uri"])
+			expected := md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+			if params["qop"] != "" {
+				expected = md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"],
+					params["qop"], ha2}, ":"))
+			}
+			if params["username"] == s.opts.User && params["realm"] == authRealm &&
+				params["nonce"] == s.nonce && params["response"] == expected {
+				return true
+			}
+		}
+		w.Header().Set("WWW-Authenticate",
+			fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm=MD5, qop="auth"`, authRealm, s.nonce))
+	} else {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(s.opts.User+":"+s.opts.Password))
+		if header == expected {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, authRealm))
+	}
+	http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (s *Server) deleteFile(name string) bool {
+	if _, ok := s.files[name]; !ok {
+		return false
+	}
+	delete(s.files, name)
+	s.syncToken++
+	s.modified[name] = s.syncToken
+	return true
+}
+
+// fault records a request and returns the fault to inject, if any.
+func (s *Server) fault(req Request) *Fault {
+	s.mutex.Lock()
+	s.requests = append(s.requests, req)
+	hook := s.hook
+	if faults := s.faults[req.Method]; len(faults) > 0 {
+		s.faults[req.Method] = faults[1:]
+		s.mutex.Unlock()
+		return &faults[0]
+	}
+	s.mutex.Unlock()
+
+	if hook == nil {
+		return nil
+	}
+	return hook(req)
+}
+
+func (s *Server) fileNames() []string {
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) putFile(name string, data []byte) string {
+	sum := md5.Sum(data)
+	f := &file{
+		data:     append([]byte(nil), data...),
+		etag:     `"` + hex.EncodeToString(sum[:]) + `"`,
+		modified: time.Now().UTC().Truncate(time.Second),
+	}
+	s.files[name] = f
+	s.syncToken++
+	s.modified[name] = s.syncToken
+	return f.etag
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, strings.TrimSuffix(AddressBookPath, "/")) {
+		http.NotFound(w, req)
+		return
+	}
+	if !s.authenticate(w, req) {
+		return
+	}
+
+	if fault := s.fault(Request{Depth: req.Header.Get("Depth"), Method: req.Method, Path: req.URL.Path}); fault != nil {
+		time.Sleep(fault.Delay)
+		switch {
+		case fault.Disconnect:
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		case fault.HTTPStatus != 0:
+			http.Error(w, http.StatusText(fault.HTTPStatus), fault.HTTPStatus)
+			return
+		}
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(AddressBookPath, "/")), "/")
+	if strings.Contains(name, "/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch req.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+		w.Header().Set("DAV", "1, 3, addressbook")
+	case "PROPFIND":
+		s.propfind(w, req, name)
+	case "REPORT":
+		s.report(w, req, name)
+	case http.MethodGet, http.MethodHead:
+		s.get(w, req, name)
+	case http.MethodPut:
+		s.put(w, req, name)
+	case http.MethodDelete:
+		s.delete(w, req, name)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func formatSyncToken(token uint64) string {
+	return syncTokenPrefix + strconv.FormatUint(token, 10)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
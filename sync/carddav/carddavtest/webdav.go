@@ -0,0 +1,282 @@
+package carddavtest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+)
+
+const syncTokenPrefix = "http://carddavtest/sync/"
+
+type multistatus struct {
+	XMLName   xml.Name      `xml:"d:multistatus"`
+	NSCard    string        `xml:"xmlns:card,attr"`
+	NSDAV     string        `xml:"xmlns:d,attr"`
+	Responses []davResponse `xml:"d:response"`
+	SyncToken string        `xml:"d:sync-token,omitempty"`
+}
+
+type davResponse struct {
+	Href     string     `xml:"d:href"`
+	Propstat []propstat `xml:"d:propstat,omitempty"`
+	Status   string     `xml:"d:status,omitempty"`
+}
+
+type propstat struct {
+	Prop   prop   `xml:"d:prop"`
+	Status string `xml:"d:status"`
+}
+
+type prop struct {
+	AddressData   *string       `xml:"card:address-data,omitempty"`
+	ContentLength string        `xml:"d:getcontentlength,omitempty"`
+	ContentType   string        `xml:"d:getcontenttype,omitempty"`
+	DisplayName   string        `xml:"d:displayname,omitempty"`
+	ETag          string        `xml:"d:getetag,omitempty"`
+	LastModified  string        `xml:"d:getlastmodified,omitempty"`
+	ResourceType  *resourceType `xml:"d:resourcetype,omitempty"`
+	SyncToken     string        `xml:"d:sync-token,omitempty"`
+}
+
+type resourceType struct {
+	AddressBook *struct{} `xml:"card:addressbook,omitempty"`
+	Collection  *struct{} `xml:"d:collection,omitempty"`
+}
+
+// reportRequest is the body of a REPORT request: addressbook-query, addressbook-multiget or sync-collection.
+type reportRequest struct {
+	XMLName xml.Name
+	Hrefs   []string `xml:"DAV: href"`
+	Prop    struct {
+		AddressData *struct{} `xml:"urn:ietf:params:xml:ns:carddav address-data"`
+	} `xml:"DAV: prop"`
+	SyncToken string `xml:"DAV: sync-token"`
+}
+
+func (s *Server) delete(w http.ResponseWriter, req *http.Request, name string) {
+	f, ok := s.files[name]
+	if name == "" || !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if match := req.Header.Get("If-Match"); match != "" && match != "*" && match != f.etag {
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+	s.deleteFile(name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) get(w http.ResponseWriter, req *http.Request, name string) {
+	f, ok := s.files[name]
+	if name == "" || !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("ETag", f.etag)
+	w.Header().Set("Last-Modified", f.modified.Format(http.TimeFormat))
+	if req.Header.Get("If-None-Match") == f.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(f.data)))
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(f.data)
+	}
+}
+
+// propfind reports the properties of the address book (and its cards for depth 1) or of a single card.
+// The requested properties are ignored; all supported properties are reported.
+func (s *Server) propfind(w http.ResponseWriter, req *http.Request, name string) {
+	_, _ = io.Copy(ioutil.Discard, req.Body)
+	result := newMultistatus()
+	if name != "" {
+		f, ok := s.files[name]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		result.Responses = append(result.Responses, s.fileResponse(name, f, false))
+	} else {
+		result.Responses = append(result.Responses, davResponse{
+			Href: AddressBookPath,
+			Propstat: []propstat{{
+				Prop: prop{
+					DisplayName:  "Contacts",
+					ResourceType: &resourceType{AddressBook: &struct{}{}, Collection: &struct{}{}},
+					SyncToken:    formatSyncToken(s.syncToken),
+				},
+				Status: "HTTP/1.1 200 OK",
+			}},
+		})
+		if req.Header.Get("Depth") != "0" {
+			for _, fileName := range s.fileNames() {
+				result.Responses = append(result.Responses, s.fileResponse(fileName, s.files[fileName], false))
+			}
+		}
+	}
+	writeMultistatus(w, result)
+}
+
+func (s *Server) put(w http.ResponseWriter, req *http.Request, name string) {
+	if name == "" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	f, exists := s.files[name]
+	if match := req.Header.Get("If-Match"); match != "" && (!exists || match != "*" && match != f.etag) {
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+	if req.Header.Get("If-None-Match") == "*" && exists {
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := vcard.NewDecoder(bytes.NewReader(data)).Decode(); err != nil {
+		http.Error(w, "invalid vCard: "+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("ETag", s.putFile(name, data))
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// report implements the addressbook-query (without filters), addressbook-multiget and sync-collection reports.
+func (s *Server) report(w http.ResponseWriter, req *http.Request, name string) {
+	var body reportRequest
+	if err := xml.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if name != "" {
+		http.Error(w, "reports are only supported for the address book", http.StatusForbidden)
+		return
+	}
+
+	withData := body.Prop.AddressData != nil
+	result := newMultistatus()
+	switch body.XMLName.Local {
+	case "addressbook-query":
+		for _, fileName := range s.fileNames() {
+			result.Responses = append(result.Responses, s.fileResponse(fileName, s.files[fileName], withData))
+		}
+	case "addressbook-multiget":
+		for _, href := range body.Hrefs {
+			fileName := hrefName(href)
+			if f, ok := s.files[fileName]; ok {
+				result.Responses = append(result.Responses, s.fileResponse(fileName, f, withData))
+			} else {
+				result.Responses = append(result.Responses, davResponse{Href: href, Status: "HTTP/1.1 404 Not Found"})
+			}
+		}
+	case "sync-collection":
+		since := uint64(0)
+		if body.SyncToken != "" {
+			var err error
+			since, err = strconv.ParseUint(strings.TrimPrefix(body.SyncToken, syncTokenPrefix), 10, 64)
+			if err != nil || !strings.HasPrefix(body.SyncToken, syncTokenPrefix) || since > s.syncToken {
+				w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = io.WriteString(w, xml.Header+`<d:error xmlns:d="DAV:"><d:valid-sync-token/></d:error>`)
+				return
+			}
+		}
+		for _, fileName := range s.changedSince(since) {
+			if f, ok := s.files[fileName]; ok {
+				result.Responses = append(result.Responses, s.fileResponse(fileName, f, withData))
+			} else {
+				result.Responses = append(result.Responses,
+					davResponse{Href: AddressBookPath + url.PathEscape(fileName), Status: "HTTP/1.1 404 Not Found"})
+			}
+		}
+		result.SyncToken = formatSyncToken(s.syncToken)
+	default:
+		http.Error(w, "unsupported report "+body.XMLName.Local, http.StatusForbidden)
+		return
+	}
+	writeMultistatus(w, result)
+}
+
+// changedSince returns the names of the files which were stored or deleted after the given sync token.
+// An initial sync (token 0) only reports existing files.
+func (s *Server) changedSince(token uint64) []string {
+	if token == 0 {
+		return s.fileNames()
+	}
+	var names []string
+	for name, modified := range s.modified {
+		if modified > token {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) fileResponse(name string, f *file, withData bool) davResponse {
+	p := prop{
+		ContentLength: strconv.Itoa(len(f.data)),
+		ContentType:   "text/vcard; charset=utf-8",
+		DisplayName:   name,
+		ETag:          f.etag,
+		LastModified:  f.modified.Format(http.TimeFormat),
+		ResourceType:  &resourceType{},
+	}
+	if withData {
+		data := string(f.data)
+		p.AddressData = &data
+	}
+	return davResponse{
+		Href:     AddressBookPath + url.PathEscape(name),
+		Propstat: []propstat{{Prop: p, Status: "HTTP/1.1 200 OK"}},
+	}
+}
+
+func newMultistatus() *multistatus {
+	return &multistatus{NSCard: "urn:ietf:params:xml:ns:carddav", NSDAV: "DAV:"}
+}
+
+// hrefName returns the file name of an href of the address book, or an empty string for other hrefs.
+func hrefName(href string) string {
+	if u, err := url.Parse(href); err == nil {
+		href = u.Path
+	}
+	if !strings.HasPrefix(href, AddressBookPath) || href == AddressBookPath {
+		return ""
+	}
+	name, err := url.PathUnescape(path.Base(href))
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+func writeMultistatus(w http.ResponseWriter, result *multistatus) {
+	data, err := xml.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(data)
+}
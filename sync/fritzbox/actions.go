@@ -0,0 +1,90 @@
+package fritzbox
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// errActionUnavailable is returned when calling an optional action the Fritz!Box does not provide.
+var errActionUnavailable = errors.New("action is not available on this Fritz!Box")
+
+// actionSpec describes a TR-064 action used by the Adapter.
+type actionSpec struct {
+	name     string
+	in       []string
+	out      []string
+	optional bool
+}
+
+// onTelActions are all actions of the X_AVM-DE_OnTel service used by the Adapter.
+var onTelActions = []actionSpec{
+	{
+		name: "GetPhonebookList",
+		out:  []string{"NewPhonebookList"},
+	},
+	{
+		name: "GetPhonebook",
+		in:   []string{"NewPhonebookID"},
+		out:  []string{"NewPhonebookName", "NewPhonebookExtraID", "NewPhonebookURL"},
+	},
+	{
+		name: "GetPhonebookEntry",
+		in:   []string{"NewPhonebookID", "NewPhonebookEntryID"},
+		out:  []string{"NewPhonebookEntryData"},
+	},
+	{
+		name: "SetPhonebookEntryUID",
+		in:   []string{"NewPhonebookID", "NewPhonebookEntryData"},
+		out:  []string{"NewPhonebookEntryUniqueID"},
+	},
+	{
+		name: "DeletePhonebookEntryUID",
+		in:   []string{"NewPhonebookID", "NewPhonebookEntryUniqueID"},
+	},
+	// needed to remove the photos of deleted or updated entries
+	{
+		name:     "GetPhonebookEntryUID",
+		in:       []string{"NewPhonebookID", "NewPhonebookEntryUniqueID"},
+		out:      []string{"NewPhonebookEntryData"},
+		optional: true,
+	},
+	// handset assignment
+	{
+		name:     "GetDECTHandsetList",
+		out:      []string{"NewDectIDList"},
+		optional: true,
+	},
+	{
+		name:     "GetDECTHandsetInfo",
+		in:       []string{"NewDectID"},
+		out:      []string{"NewHandsetName", "NewPhonebookID"},
+		optional: true,
+	},
+	{
+		name:     "GetNumberOfEntries",
+		out:      []string{"NewOnTelNumberOfEntries"},
+		optional: true,
+	},
+}
+
+// checkActions verifies that scpd defines all required actions.
+// It returns the set of available actions and logs the unavailable optional ones.
+func checkActions(scpd *tr064.SCPD, service string, specs []actionSpec, logger *log.Logger) (map[string]bool, error) {
+	available := map[string]bool{}
+	for _, spec := range specs {
+		err := scpd.CheckAction(spec.name, spec.in, spec.out)
+		if err == nil {
+			available[spec.name] = true
+			continue
+		}
+		if !spec.optional {
+			return nil, fmt.Errorf("the Fritz!Box does not support the required TR-064 action %s#%s "+
+				"(does the user lack permissions or is the Fritz!OS too old?): %v", service, spec.name, err)
+		}
+		warn(logger, "optional TR-064 action %s#%s is not available: %v", service, spec.name, err)
+	}
+	return available, nil
+}
@@ -0,0 +1,148 @@
+package fritzbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/toaster/fritz_sync/sync"
+	"github.com/toaster/fritz_sync/tr064"
+	"github.com/toaster/fritz_sync/tr064/tr064test"
+)
+
+const testSCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:dslforum-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>GetPhonebook</name><argumentList>
+<argument><name>NewPhonebookID</name><direction>in</direction><relatedStateVariable>PhonebookID</relatedStateVariable></argument>
+<argument><name>NewPhonebookURL</name><direction>out</direction><relatedStateVariable>PhonebookURL</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetPhonebookList</name><argumentList>
+<argument><name>NewPhonebookList</name><direction>out</direction><relatedStateVariable>PhonebookList</relatedStateVariable></argument>
+</argumentList></action>
+</actionList>
+</scpd>`
+
+func TestCheckActions(t *testing.T) {
+	tests := map[string]struct {
+		specs         []actionSpec
+		wantActions   map[string]bool
+		wantErr       string
+		wantWarning   string
+		wantNoWarning bool
+	}{
+		"all available": {
+			specs: []actionSpec{
+				{name: "GetPhonebookList", out: []string{"NewPhonebookList"}},
+				{name: "GetPhonebook", in: []string{"NewPhonebookID"}, out: []string{"NewPhonebookURL"}},
+			},
+			wantActions:   map[string]bool{"GetPhonebookList": true, "GetPhonebook": true},
+			wantNoWarning: true,
+		},
+		"required action missing": {
+			specs: []actionSpec{
+				{name: "GetPhonebookList", out: []string{"NewPhonebookList"}},
+				{name: "SetPhonebookEntryUID", in: []string{"NewPhonebookID"}},
+			},
+			wantErr: "required TR-064 action urn:test#SetPhonebookEntryUID",
+		},
+		"required argument missing": {
+			specs: []actionSpec{
+				{name: "GetPhonebook", in: []string{"NewPhonebookID"}, out: []string{"NewPhonebookName"}},
+			},
+			wantErr: "action GetPhonebook has no out argument NewPhonebookName",
+		},
+		"argument with wrong direction": {
+			specs: []actionSpec{
+				{name: "GetPhonebook", in: []string{"NewPhonebookURL"}},
+			},
+			wantErr: "action GetPhonebook has no in argument NewPhonebookURL",
+		},
+		"optional action missing": {
+			specs: []actionSpec{
+				{name: "GetPhonebookList", out: []string{"NewPhonebookList"}},
+				{name: "GetDECTHandsetList", out: []string{"NewDectIDList"}, optional: true},
+			},
+			wantActions: map[string]bool{"GetPhonebookList": true},
+			wantWarning: "optional TR-064 action urn:test#GetDECTHandsetList is not available",
+		},
+	}
+	var scpd tr064.SCPD
+	if err := xml.Unmarshal([]byte(testSCPD), &scpd); err != nil {
+		t.Fatal(err)
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var logged bytes.Buffer
+			actions, err := checkActions(&scpd, "urn:test", tt.specs, log.New(&logged, "", 0))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(actions) != len(tt.wantActions) {
+				t.Errorf("expected actions %v, got %v", tt.wantActions, actions)
+			}
+			for action := range tt.wantActions {
+				if !actions[action] {
+					t.Errorf("expected action %s to be available", action)
+				}
+			}
+			if tt.wantNoWarning && logged.Len() > 0 {
+				t.Errorf("expected no warning, got %q", logged.String())
+			}
+			if !strings.Contains(logged.String(), tt.wantWarning) {
+				t.Errorf("expected a warning containing %q, got %q", tt.wantWarning, logged.String())
+			}
+		})
+	}
+}
+
+func TestMissingRequiredAction(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{UnavailableActions: []string{"SetPhonebookEntryUID"}})
+	defer box.Close()
+
+	_, err := NewAdapter(context.Background(), box.URL, tr064test.DefaultPhonebook, tr064test.DefaultUser,
+		tr064test.DefaultPassword, "", "syncid", Options{ImageTransport: HTTPTransport, WebURL: box.URL})
+	if err == nil || !strings.Contains(err.Error(), "SetPhonebookEntryUID") {
+		t.Errorf("expected an error naming the missing action, got %v", err)
+	}
+}
+
+func TestMissingOptionalAction(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{UnavailableActions: []string{"GetPhonebookEntryUID"}})
+	defer box.Close()
+	var logged bytes.Buffer
+	a := newTestAdapter(t, box, Options{Log: log.New(&logged, "", 0)})
+	if !strings.Contains(logged.String(), "GetPhonebookEntryUID is not available") {
+		t.Errorf("expected a warning about the missing action, got %q", logged.String())
+	}
+
+	if err := a.Add(ctx, []sync.Contact{{FullName: "Jane", SyncID: "jane"}}); err != nil {
+		t.Fatal(err)
+	}
+	// a new adapter has not read the entries and would need GetPhonebookEntryUID for their photos
+	a = newTestAdapter(t, box, Options{})
+	contacts := []sync.Contact{{FullName: "Jane", ID: "1", SyncID: "jane"}}
+	if err := a.Update(ctx, contacts); err != nil {
+		t.Errorf("update has to work without the optional action: %v", err)
+	}
+	if err := a.Delete(ctx, contacts); err != nil {
+		t.Errorf("delete has to work without the optional action: %v", err)
+	}
+	if entries := box.Entries(0); len(entries) != 0 {
+		t.Errorf("expected the entry to be deleted, got %v", entries)
+	}
+	if n := countCalls(box, "GetPhonebookEntryUID"); n != 0 {
+		t.Errorf("the unavailable action must not be called, got %d calls", n)
+	}
+}
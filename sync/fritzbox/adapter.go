@@ -1,32 +1,83 @@
 package fritzbox
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"io"
+	"log"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	gosync "sync"
+	"time"
 
-	"github.com/huin/goupnp/soap"
-	"github.com/jlaffaye/ftp"
-
+	"github.com/toaster/fritz_sync/retry"
 	"github.com/toaster/fritz_sync/sync"
 	"github.com/toaster/fritz_sync/tr064"
+	"github.com/toaster/fritz_sync/tr064/ontel"
 )
 
 // Adapter implements the sync.Reader interface for accessing Fritz!Box contacts.
 type Adapter struct {
-	ftpHost      string
-	ftpPass      string
-	ftpUser      string
-	ns           string
-	pbID         string
-	pixStorage   string
+	actions      map[string]bool
+	entryCount   int
+	firmware     Firmware
+	httpClient   *http.Client
+	images       imageTransport
+	imgOpts      ImageOptions
+	imgURLs      map[string]string // the image URLs of the entries read by ReadAll by unique ID
+	log          *log.Logger
+	onTel        *ontel.Client
+	pbID         uint16
+	pbURLs       []string
+	quirks       Quirks
+	storage      *storage // detected on first use, see photoStorage
+	storageMutex gosync.Mutex
+	storageName  string
 	syncIDKey    string
-	tr064Adapter *tr064.Adapter
+}
+
+// Options contains the optional settings of an Adapter.
+type Options struct {
+	// FTPCertFingerprint is the SHA-256 fingerprint of the Fritz!Box's certificate which is trusted for FTP via TLS.
+	// If it is empty, the certificate is verified according to TLS.
+	FTPCertFingerprint string
+	// FTPConnections is the maximum amount of parallel FTP connections used for photo transfers (default 1).
+	FTPConnections int
+	// FTPPort is the port of the FTP server of the Fritz!Box (default 21).
+	FTPPort int
+	// FTPSecurity defines whether the FTP connections for photo transfers are encrypted.
+	FTPSecurity FTPSecurity
+	// Image configures how contact photos are converted before they are uploaded.
+	Image ImageOptions
+	// ImageTransport selects how photos are transferred from and to the Fritz!Box.
+	ImageTransport ImageTransport
+	// HTTPS enables TR-064 via HTTPS even if the Fritz!Box URL is a plain HTTP URL.
+	// The HTTPS port is queried from the Fritz!Box.
+	HTTPS bool
+	// Log receives warnings, e.g. about skipped photos (optional).
+	Log *log.Logger
+	// Retry defines how requests which failed because of transient errors are retried.
+	// If Retry.Attempts is not set, the attempts and delays of retry.DefaultPolicy are used.
+	Retry retry.Policy
+	// TLS configures how the certificate of the Fritz!Box is verified for HTTPS and FTP via TLS.
+	TLS tr064.TLSOptions
+	// Timeout limits the duration of every single request to the Fritz!Box (0 means no limit).
+	Timeout time.Duration
+	// WebURL is the URL of the Fritz!Box web interface used by the HTTPTransport.
+	// It defaults to the host of the Fritz!Box URL on the default HTTP port.
+	WebURL string
+	// WrapTransport wraps the transports of all HTTP requests to the Fritz!Box (optional),
+	// e.g. for recording them (see package cassette). FTP connections are not affected.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+}
+
+// imageRefs holds the storage paths of the photos referenced by other phonebooks during a Delete or Update.
+type imageRefs struct {
+	paths map[string]bool
 }
 
 type fritzPbPerson struct {
@@ -70,74 +121,80 @@ type fritzPhonebookEntry struct {
 	Unknown   []tr064.UnknownXML `xml:",any"`
 }
 
-const (
-	errorInvalidArrayIndex = "713"
-	errorInternalError     = "820"
-)
-
-const imgURLPrefix = "file:///var/InternerSpeicher"
-
 // NewAdapter creates a new Adapter for a given Fritz!Box URL and the corresponding credentials.
-func NewAdapter(boxURL, phonebookName, user, pass, storageName, syncIDKey string) (*Adapter, error) {
+// If storageName is empty, the storage used for contact photos is detected automatically.
+// The storage is detected on the first photo transfer so that contacts without photos can be synced even if
+// the storage of the Fritz!Box is not accessible.
+// If phonebookName is empty, only operations which are not bound to a phonebook (e.g. DeleteOrphanedImages)
+// may be used.
+func NewAdapter(ctx context.Context, boxURL, phonebookName, user, pass, storageName, syncIDKey string, opts Options) (*Adapter, error) {
 	uri, err := url.Parse(boxURL)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse Fritz!Box URL: %v", err)
 	}
 
-	describeURL := boxURL + "/tr64desc.xml"
-	var desc tr064.Description
-	if err := tr064.FetchXML(describeURL, &desc); err != nil {
+	opts.Retry = opts.Retry.WithDefaults()
+	conn, err := connect(ctx, uri, user, pass, opts)
+	if err != nil {
 		return nil, err
 	}
 
-	var telService *tr064.Service
-	for _, service := range desc.Device.Services {
-		if service.Type == "urn:dslforum-org:service:X_AVM-DE_OnTel:1" {
-			telService = &service
-			break
-		}
+	onTel, err := ontel.Connect(conn.client)
+	if err != nil {
+		return nil, err
 	}
-	if telService == nil {
-		return nil, fmt.Errorf("%s does not provide a X_AVM-DE_OnTel:1 service", boxURL)
+	scpd, err := conn.client.SCPD(ctx, ontel.ServiceType)
+	if err != nil {
+		return nil, err
 	}
-
-	var scpd tr064.SCPD
-	if err := tr064.FetchXML(boxURL+telService.ScpdURL, &scpd); err != nil {
+	actions, err := checkActions(scpd, ontel.ServiceType, onTelActions, opts.Log)
+	if err != nil {
 		return nil, err
 	}
-	// TODO: check scpd for required Function definitions
 
-	tr064Adapter, err := tr064.NewAdapter(boxURL, telService.ControlURL, user, pass)
+	firmware := firmwareFromDescription(conn.client.Description())
+	quirks := quirksFor(firmware)
+	if opts.Log != nil {
+		opts.Log.Println("Connected to", firmware, "via", conn.client.BaseURL())
+	}
+
+	images, err := newImageTransport(ctx, uri, conn, opts, quirks)
 	if err != nil {
 		return nil, err
 	}
 
 	adapter := &Adapter{
-		ftpHost:      uri.Hostname(),
-		ftpPass:      pass,
-		ftpUser:      user,
-		ns:           telService.Type,
-		pixStorage:   storageName,
-		syncIDKey:    syncIDKey,
-		tr064Adapter: tr064Adapter,
-	}
-
-	pbIDs, err := adapter.getPhonebookList()
+		actions:     actions,
+		entryCount:  -1,
+		firmware:    firmware,
+		httpClient:  conn.client.HTTPClient(),
+		images:      images,
+		imgOpts:     opts.Image.withDefaults(),
+		log:         opts.Log,
+		onTel:       onTel,
+		quirks:      quirks,
+		storageName: storageName,
+		syncIDKey:   syncIDKey,
+	}
+
+	pbIDs, err := adapter.getPhonebookList(ctx)
 	if err != nil {
 		return nil, err
 	}
+	found := false
 	for _, pbID := range pbIDs {
-		name, err := adapter.getPhonebook(pbID)
+		name, pbURL, err := adapter.getPhonebook(ctx, pbID)
 		if err != nil {
 			return nil, err
 		}
 		if name == phonebookName {
 			adapter.pbID = pbID
-			break
+			found = true
 		}
+		adapter.pbURLs = append(adapter.pbURLs, pbURL)
 	}
 
-	if adapter.pbID == "" {
+	if phonebookName != "" && !found {
 		return nil, fmt.Errorf("could not find phonebook “%s” on %s", phonebookName, boxURL)
 	}
 
@@ -145,64 +202,187 @@ func NewAdapter(boxURL, phonebookName, user, pass, storageName, syncIDKey string
 }
 
 // ReadAll reads all contacts (part of sync.Reader interface).
-func (a *Adapter) ReadAll(_ []string) (map[string]sync.Contact, error) {
+func (a *Adapter) ReadAll(ctx context.Context, _ []string) (map[string]sync.Contact, error) {
+	var entries []*fritzPhonebookEntry
+	err := a.forEachPhonebookEntry(ctx, a.pbID, func(entry *fritzPhonebookEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.entryCount = len(entries)
+
+	imgURLs := make([]string, len(entries))
+	for i, entry := range entries {
+		imgURLs[i] = entry.Person.ImgURL
+	}
+	images, err := a.downloadImages(ctx, imgURLs)
+	if err != nil {
+		return nil, err
+	}
+
 	contacts := map[string]sync.Contact{}
-	for i := 0; ; i++ {
-		data, err := a.getPhonebookEntry(i)
-		if err != nil {
-			if serr, ok := err.(*soap.SOAPFaultError); ok {
-				if serr.FaultCode == "s:Client" && serr.FaultString == "UPnPError" {
-					var upnpError tr064.UPNPError
-					if err := xml.Unmarshal(serr.Detail.Raw, &upnpError); err != nil {
-						return nil, err
-					}
-					// Fritz!OS 7.20 on Fritz!Box 7590 returns 820 (internal) instead of 713 (invalid index)
-					if upnpError.Code == errorInvalidArrayIndex || upnpError.Code == errorInternalError {
-						break
-					}
-				}
-			}
-			return nil, err
-		}
-		contact, err := a.contactFromPhonebookEntry(data)
-		if err != nil {
-			return nil, err
-		}
+	a.imgURLs = map[string]string{}
+	for i, entry := range entries {
+		contact := a.contactFromPhonebookEntry(entry)
+		contact.Image = images[i]
 		contacts[contact.ID] = contact
+		a.imgURLs[contact.ID] = entry.Person.ImgURL
 	}
 	return contacts, nil
 }
 
 // Add writes all given contacts into the phonebook (part of sync.Writer interface).
-func (a *Adapter) Add(contacts []sync.Contact) error {
+func (a *Adapter) Add(ctx context.Context, contacts []sync.Contact) error {
+	if max := a.quirks.MaxEntries; max > 0 && a.entryCount >= 0 && a.entryCount+len(contacts) > max {
+		return fmt.Errorf("cannot add %d contacts: phonebooks of %s are limited to %d entries",
+			len(contacts), a.firmware, max)
+	}
 	for _, contact := range contacts {
-		entry, err := a.phonebookEntryFromContact(contact)
+		if err := sync.Stopped(ctx); err != nil {
+			return err
+		}
+		entry, err := a.phonebookEntryFromContact(ctx, contact)
 		if err != nil {
 			return err
 		}
-		if _, err := a.setPhonebookEntry(entry); err != nil {
+		id, err := a.setPhonebookEntry(ctx, entry)
+		if err != nil {
 			return err
 		}
+		if a.imgURLs != nil {
+			a.imgURLs[id] = entry.Person.ImgURL
+		}
+		if a.entryCount >= 0 {
+			a.entryCount++
+		}
 	}
 	return nil
 }
 
 // Delete removes all given contacts from the phonebook (part of sync.Writer interface).
-func (a *Adapter) Delete(contacts []sync.Contact) error {
+// Their photos are removed unless they are referenced by another phonebook.
+func (a *Adapter) Delete(ctx context.Context, contacts []sync.Contact) error {
+	var refs imageRefs
 	for _, contact := range contacts {
-		if err := a.deletePhonebookEntry(contact.ID); err != nil {
+		if err := sync.Stopped(ctx); err != nil {
+			return err
+		}
+		oldImgURL, err := a.imgURLOfEntry(ctx, contact.ID)
+		if err != nil {
 			return err
 		}
+		if err := a.deletePhonebookEntry(ctx, contact.ID); err != nil {
+			return err
+		}
+		delete(a.imgURLs, contact.ID)
+		if a.entryCount > 0 {
+			a.entryCount--
+		}
+		a.deleteImageIfUnused(ctx, &refs, oldImgURL, "")
 	}
 	return nil
 }
 
 // Update updates all given contacts in the phonebook (part of sync.Writer interface).
-func (a *Adapter) Update(contacts []sync.Contact) error {
-	return a.Add(contacts)
+// Photos which are no longer used by the updated entry are removed unless they are referenced by another phonebook.
+func (a *Adapter) Update(ctx context.Context, contacts []sync.Contact) error {
+	var refs imageRefs
+	for _, contact := range contacts {
+		if err := sync.Stopped(ctx); err != nil {
+			return err
+		}
+		oldImgURL, err := a.imgURLOfEntry(ctx, contact.ID)
+		if err != nil {
+			return err
+		}
+		entry, err := a.phonebookEntryFromContact(ctx, contact)
+		if err != nil {
+			return err
+		}
+		if _, err := a.setPhonebookEntry(ctx, entry); err != nil {
+			return err
+		}
+		if a.imgURLs != nil {
+			a.imgURLs[contact.ID] = entry.Person.ImgURL
+		}
+		a.deleteImageIfUnused(ctx, &refs, oldImgURL, entry.Person.ImgURL)
+	}
+	return nil
+}
+
+// DeleteOrphanedImages removes all photos from the Fritz!Box storage which are not referenced
+// by any entry of any phonebook.
+// It returns the paths of the orphaned photos. If dryRun is true, nothing is deleted.
+func (a *Adapter) DeleteOrphanedImages(ctx context.Context, dryRun bool) ([]string, error) {
+	s, err := a.photoStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	used, err := a.referencedImages(ctx, s, func(uint16) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	pixPath := s.dir()
+	files, err := a.images.List(ctx, pixPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %v", err)
+	}
+	var orphans []string
+	for _, file := range files {
+		if file.dir {
+			continue
+		}
+		imgPath := pixPath + "/" + file.name
+		if used[imgPath] {
+			continue
+		}
+		orphans = append(orphans, imgPath)
+		if dryRun {
+			continue
+		}
+		if err := sync.Stopped(ctx); err != nil {
+			return orphans, err
+		}
+		if err := a.images.Delete(ctx, imgPath); err != nil {
+			return orphans, fmt.Errorf("cannot delete image %s: %v", imgPath, err)
+		}
+	}
+	return orphans, nil
+}
+
+// Firmware returns the model and the Fritz!OS version of the Fritz!Box.
+func (a *Adapter) Firmware() Firmware {
+	return a.firmware
+}
+
+// Quirks returns the version specific behaviour of the Fritz!Box.
+func (a *Adapter) Quirks() Quirks {
+	return a.quirks
+}
+
+// Close terminates the connections used for photo transfers.
+func (a *Adapter) Close() error {
+	return a.images.Close()
+}
+
+// Normalize converts the contact's photo the same way it would be stored on the Fritz!Box
+// (part of sync.Normalizer interface).
+func (a *Adapter) Normalize(contact sync.Contact) sync.Contact {
+	if contact.Image != "" {
+		data := a.prepareImage(contact.ID, contact.Image)
+		if data == nil {
+			contact.Image = ""
+		} else {
+			contact.Image = base64.StdEncoding.EncodeToString(data)
+		}
+	}
+	return contact
 }
 
-func (a *Adapter) contactFromPhonebookEntry(entry *fritzPhonebookEntry) (sync.Contact, error) {
+func (a *Adapter) contactFromPhonebookEntry(entry *fritzPhonebookEntry) sync.Contact {
 	contact := sync.Contact{
 		FullName: strings.TrimSpace(entry.Person.RealName),
 		Email:    strings.TrimSpace(entry.Email.Address),
@@ -231,161 +411,238 @@ func (a *Adapter) contactFromPhonebookEntry(entry *fritzPhonebookEntry) (sync.Co
 			break
 		}
 	}
-	img, err := a.downloadImage(entry.Person.ImgURL)
+	return contact
+}
+
+func (a *Adapter) deletePhonebookEntry(ctx context.Context, uniqueID string) error {
+	id, err := strconv.ParseUint(uniqueID, 10, 32)
 	if err != nil {
-		return sync.Contact{}, err
+		return fmt.Errorf("invalid phonebook entry ID %s: %v", uniqueID, err)
+	}
+	if err := a.available("DeletePhonebookEntryUID"); err != nil {
+		return err
 	}
-	contact.Image = img
-	return contact, nil
+	return a.onTel.DeletePhonebookEntryUID(ctx, a.pbID, uint32(id))
 }
 
-func (a *Adapter) deletePhonebookEntry(uniqueID string) error {
-	params := struct {
-		NewPhonebookID            string
-		NewPhonebookEntryUniqueID string
-	}{
-		NewPhonebookID:            a.pbID,
-		NewPhonebookEntryUniqueID: uniqueID,
+// deleteImageIfUnused removes the image of oldURL from the Fritz!Box storage unless newURL refers to the same
+// file or it is referenced by an entry of another phonebook, e.g. one synced from the same source.
+// The URLs are compared by their storage paths because the same file may be referenced by different URLs,
+// e.g. by one written before the storage was detected.
+// The references of the other phonebooks are loaded into refs on first use.
+// Failures are only logged because the phonebook itself is already consistent at this point.
+func (a *Adapter) deleteImageIfUnused(ctx context.Context, refs *imageRefs, oldURL, newURL string) {
+	if oldURL == "" {
+		return
+	}
+	s, err := a.photoStorage(ctx)
+	if err != nil {
+		a.warn("keeping image %s: %v", oldURL, err)
+		return
 	}
-	if err := a.tr064Adapter.Perform(a.ns, "DeletePhonebookEntryUID", &params, nil); err != nil {
-		return err
+	imgPath := s.pathForURL(oldURL)
+	if newURL != "" && s.pathForURL(newURL) == imgPath {
+		return
+	}
+
+	if refs.paths == nil {
+		paths, err := a.referencedImages(ctx, s, func(pbID uint16) bool { return pbID != a.pbID })
+		if err != nil {
+			a.warn("keeping image %s: cannot check the other phonebooks: %v", oldURL, err)
+			return
+		}
+		refs.paths = paths
+	}
+	if refs.paths[imgPath] {
+		return
+	}
+	if err := a.images.Delete(ctx, imgPath); err != nil {
+		a.warn("cannot delete image %s: %v", oldURL, err)
 	}
-	return nil
 }
 
-func (a *Adapter) downloadImage(imgURL string) (string, error) {
+func (a *Adapter) downloadImage(ctx context.Context, imgURL string) (string, error) {
 	if imgURL == "" {
 		return "", nil
 	}
 
-	ftpConn, err := a.ftpConn()
+	s, err := a.photoStorage(ctx)
 	if err != nil {
 		return "", err
 	}
-	defer func() { _ = ftpConn.Quit() }()
-
-	imgPath := a.imgPathForImgURL(imgURL)
-	imgReader, err := ftpConn.Retr(imgPath)
+	data, err := a.images.Download(ctx, s.pathForURL(imgURL))
 	if err != nil {
 		return "", fmt.Errorf("cannot download image: %v", err)
 	}
-	buf := new(bytes.Buffer)
-	encoder := base64.NewEncoder(base64.StdEncoding, buf)
-	if _, err := io.Copy(encoder, imgReader); err != nil {
-		return "", fmt.Errorf("cannot download/encode image: %v", err)
-	}
-	if err := encoder.Close(); err != nil {
-		return "", fmt.Errorf("cannot encode image: %v", err)
-	}
 
-	return buf.String(), nil
+	return base64.StdEncoding.EncodeToString(data), nil
 }
 
-func (a *Adapter) ftpConn() (*ftp.ServerConn, error) {
-	ftpConn, err := ftp.Dial(
-		a.ftpHost + ":21",
-		// TLS deactivated because it is not stable on upload (Fritz!OS 7.20).
-		// ftp.DialWithExplicitTLS(&tls.Config{ServerName: a.ftpHost}),
-		// ftp.DialWithDebugOutput(os.Stdout),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("cannot connect to FTP server: %v", err)
+// downloadImages downloads the images of all given URLs using parallel connections.
+func (a *Adapter) downloadImages(ctx context.Context, imgURLs []string) ([]string, error) {
+	images := make([]string, len(imgURLs))
+	indices := make(chan int)
+	errs := make(chan error, len(imgURLs))
+	var wg gosync.WaitGroup
+	for w := 0; w < a.images.Parallelism(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				img, err := a.downloadImage(ctx, imgURLs[i])
+				if err != nil {
+					errs <- err
+					continue
+				}
+				images[i] = img
+			}
+		}()
+	}
+	for i := range imgURLs {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
 	}
+	return images, nil
+}
 
-	if err := ftpConn.Login(a.ftpUser, a.ftpPass); err != nil {
-		_ = ftpConn.Quit()
-		return nil, fmt.Errorf("cannot log into FTP server: %v", err)
+func (a *Adapter) forEachPhonebookEntry(ctx context.Context, pbID uint16, f func(*fritzPhonebookEntry) error) error {
+	for i := uint32(0); ; i++ {
+		entry, err := a.getPhonebookEntry(ctx, pbID, i)
+		if a.quirks.isEndOfList(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(entry); err != nil {
+			return err
+		}
 	}
-	return ftpConn, nil
 }
 
-func (a *Adapter) getDECTHandsetInfo(id string) (string, string, error) {
-	params := struct{ NewDectID string }{NewDectID: id}
-	result := struct {
-		NewHandsetName string
-		NewPhonebookID string
-	}{}
-	if err := a.tr064Adapter.Perform(a.ns, "GetDECTHandsetInfo", &params, &result); err != nil {
-		return "", "", err
+func (a *Adapter) getDECTHandsetInfo(ctx context.Context, id uint16) (string, uint16, error) {
+	if err := a.available("GetDECTHandsetInfo"); err != nil {
+		return "", 0, err
+	}
+	result, err := a.onTel.GetDECTHandsetInfo(ctx, id)
+	if err != nil {
+		return "", 0, err
 	}
-	return result.NewHandsetName, result.NewPhonebookID, nil
+	return result.HandsetName, result.PhonebookID, nil
 }
 
-func (a *Adapter) getDECTHandsetList() (string, error) {
-	result := struct{ NewDectIDList string }{}
-	if err := a.tr064Adapter.Perform(a.ns, "GetDECTHandsetList", nil, &result); err != nil {
+func (a *Adapter) getDECTHandsetList(ctx context.Context) (string, error) {
+	if err := a.available("GetDECTHandsetList"); err != nil {
 		return "", err
 	}
-	return result.NewDectIDList, nil
+	return a.onTel.GetDECTHandsetList(ctx)
 }
 
-func (a *Adapter) getNumberOfEntries() (string, error) {
-	result := struct{ NewOnTelNumberOfEntries string }{}
-	if err := a.tr064Adapter.Perform(a.ns, "GetNumberOfEntries", nil, &result); err != nil {
-		return "", err
+func (a *Adapter) getNumberOfEntries(ctx context.Context) (uint16, error) {
+	if err := a.available("GetNumberOfEntries"); err != nil {
+		return 0, err
 	}
-	return result.NewOnTelNumberOfEntries, nil
+	return a.onTel.GetNumberOfEntries(ctx)
 }
 
-func (a *Adapter) getPhonebook(id string) (string, error) {
-	params := struct{ NewPhonebookID string }{NewPhonebookID: id}
-	result := struct {
-		NewPhonebookName    string
-		NewPhonebookExtraID string
-		NewPhonebookURL     string
-	}{}
-	if err := a.tr064Adapter.Perform(a.ns, "GetPhonebook", &params, &result); err != nil {
-		return "", err
+func (a *Adapter) getPhonebook(ctx context.Context, id uint16) (string, string, error) {
+	if err := a.available("GetPhonebook"); err != nil {
+		return "", "", err
+	}
+	result, err := a.onTel.GetPhonebook(ctx, id)
+	if err != nil {
+		return "", "", err
 	}
-	return result.NewPhonebookName, nil
+	return result.PhonebookName, result.PhonebookURL, nil
 }
 
-func (a *Adapter) getPhonebookEntry(index int) (*fritzPhonebookEntry, error) {
-	params := struct {
-		NewPhonebookID      string
-		NewPhonebookEntryID string
-	}{
-		NewPhonebookID:      a.pbID,
-		NewPhonebookEntryID: strconv.Itoa(index),
+func (a *Adapter) getPhonebookEntry(ctx context.Context, pbID uint16, index uint32) (*fritzPhonebookEntry, error) {
+	if err := a.available("GetPhonebookEntry"); err != nil {
+		return nil, err
 	}
-	result := struct{ NewPhonebookEntryData string }{}
-	if err := a.tr064Adapter.Perform(a.ns, "GetPhonebookEntry", &params, &result); err != nil {
+	data, err := a.onTel.GetPhonebookEntry(ctx, pbID, index)
+	if err != nil {
 		return nil, err
 	}
 	var entry fritzPhonebookEntry
-	if err := xml.Unmarshal([]byte(result.NewPhonebookEntryData), &entry); err != nil {
+	if err := xml.Unmarshal([]byte(data), &entry); err != nil {
 		return nil, err
 	}
 
 	return &entry, nil
 }
 
-func (a *Adapter) getPhonebookList() ([]string, error) {
-	result := struct{ NewPhonebookList string }{}
-	if err := a.tr064Adapter.Perform(a.ns, "GetPhonebookList", nil, &result); err != nil {
+func (a *Adapter) getPhonebookEntryByUID(ctx context.Context, uniqueID string) (*fritzPhonebookEntry, error) {
+	id, err := strconv.ParseUint(uniqueID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid phonebook entry ID %s: %v", uniqueID, err)
+	}
+	if err := a.available("GetPhonebookEntryUID"); err != nil {
+		return nil, err
+	}
+	data, err := a.onTel.GetPhonebookEntryUID(ctx, a.pbID, uint32(id))
+	if err != nil {
+		return nil, err
+	}
+	var entry fritzPhonebookEntry
+	if err := xml.Unmarshal([]byte(data), &entry); err != nil {
 		return nil, err
 	}
-	return strings.Split(result.NewPhonebookList, ","), nil
+
+	return &entry, nil
 }
 
-func (a *Adapter) imgPathForID(id string) string {
-	pixPath := "/FRITZ/fonpix"
-	if a.pixStorage != "" {
-		pixPath = "/" + a.pixStorage + pixPath
+func (a *Adapter) getPhonebookList(ctx context.Context) ([]uint16, error) {
+	if err := a.available("GetPhonebookList"); err != nil {
+		return nil, err
 	}
-	imgPath := pixPath + "/" + id
-	return imgPath
+	list, err := a.onTel.GetPhonebookList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint16
+	for _, field := range strings.Split(list, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid phonebook list “%s”: %v", list, err)
+		}
+		ids = append(ids, uint16(id))
+	}
+	return ids, nil
 }
 
-func (a *Adapter) imgPathForImgURL(imgURL string) string {
-	return strings.TrimPrefix(imgURL, imgURLPrefix)
+// imgURLOfEntry returns the image URL of the phonebook entry with the given unique ID.
+// The URL is taken from the entries read by ReadAll if possible, otherwise the entry is requested.
+// It returns an empty URL if the Fritz!Box cannot provide single entries by their unique ID.
+func (a *Adapter) imgURLOfEntry(ctx context.Context, uniqueID string) (string, error) {
+	if imgURL, ok := a.imgURLs[uniqueID]; ok {
+		return imgURL, nil
+	}
+	entry, err := a.getPhonebookEntryByUID(ctx, uniqueID)
+	if errors.Is(err, errActionUnavailable) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return entry.Person.ImgURL, nil
 }
 
-func (a *Adapter) imgURLForImgPath(imgPath string) string {
-	return imgURLPrefix + imgPath
+// available returns errActionUnavailable if the Fritz!Box does not provide the action of the
+// X_AVM-DE_OnTel service.
+func (a *Adapter) available(action string) error {
+	if !a.actions[action] {
+		return fmt.Errorf("%s: %w", action, errActionUnavailable)
+	}
+	return nil
 }
 
-func (a *Adapter) phonebookEntryFromContact(contact sync.Contact) (*fritzPhonebookEntry, error) {
+func (a *Adapter) phonebookEntryFromContact(ctx context.Context, contact sync.Contact) (*fritzPhonebookEntry, error) {
 	entry := fritzPhonebookEntry{
 		Person: fritzPbPerson{RealName: contact.FullName},
 		Email:  fritzPbEmail{Address: contact.Email},
@@ -422,46 +679,113 @@ func (a *Adapter) phonebookEntryFromContact(contact sync.Contact) (*fritzPhonebo
 		}
 	}
 	if contact.Image != "" {
-		imgURL, err := a.uploadImage(contact.SyncID, contact.Image)
+		if data := a.prepareImage(contact.SyncID, contact.Image); data != nil {
+			imgURL, err := a.uploadImage(ctx, contact.SyncID, data)
+			if err != nil {
+				return nil, err
+			}
+			entry.Person.ImgURL = imgURL
+		}
+	}
+	return &entry, nil
+}
+
+// prepareImage converts a base64 encoded photo into the format used on the Fritz!Box.
+// It returns nil if the photo cannot be converted and has to be skipped.
+func (a *Adapter) prepareImage(id, image string) []byte {
+	if i := strings.Index(image, ";base64,"); strings.HasPrefix(image, "data:") && i >= 0 {
+		image = image[i+len(";base64,"):]
+	}
+	data, err := base64.StdEncoding.DecodeString(image)
+	if err != nil {
+		a.warn("skipping photo of contact %s: cannot decode base64 data: %v", id, err)
+		return nil
+	}
+	data, err = transcodeImage(data, a.imgOpts)
+	if err != nil {
+		a.warn("skipping photo of contact %s: %v", id, err)
+		return nil
+	}
+	return data
+}
+
+// photoStorage returns the storage used for contact photos. It is detected on first use.
+func (a *Adapter) photoStorage(ctx context.Context) (storage, error) {
+	a.storageMutex.Lock()
+	defer a.storageMutex.Unlock()
+
+	if a.storage == nil {
+		s, err := detectStorage(ctx, a.images, a.storageName, a.pbURLs, a.httpClient, a.log)
+		if err != nil {
+			return storage{}, err
+		}
+		if a.log != nil {
+			a.log.Println("Using Fritz!Box storage for photos:", s)
+		}
+		a.storage = &s
+	}
+	return *a.storage, nil
+}
+
+// referencedImages returns the paths within storage s of the photos referenced by the entries of all phonebooks
+// for which include returns true.
+func (a *Adapter) referencedImages(ctx context.Context, s storage, include func(pbID uint16) bool) (map[string]bool, error) {
+	pbIDs, err := a.getPhonebookList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, pbID := range pbIDs {
+		if !include(pbID) {
+			continue
+		}
+		err := a.forEachPhonebookEntry(ctx, pbID, func(entry *fritzPhonebookEntry) error {
+			if entry.Person.ImgURL != "" {
+				used[s.pathForURL(entry.Person.ImgURL)] = true
+			}
+			return nil
+		})
 		if err != nil {
 			return nil, err
 		}
-		entry.Person.ImgURL = imgURL
 	}
-	return &entry, nil
+	return used, nil
 }
 
-func (a *Adapter) setPhonebookEntry(entry *fritzPhonebookEntry) (string, error) {
+func (a *Adapter) setPhonebookEntry(ctx context.Context, entry *fritzPhonebookEntry) (string, error) {
 	data, err := xml.Marshal(entry)
 	if err != nil {
 		return "", err
 	}
-	params := struct {
-		NewPhonebookID        string
-		NewPhonebookEntryData string
-	}{
-		NewPhonebookID:        a.pbID,
-		NewPhonebookEntryData: xml.Header + string(data),
+	if err := a.available("SetPhonebookEntryUID"); err != nil {
+		return "", err
 	}
-	result := struct{ NewPhonebookEntryUniqueID string }{}
-	if err := a.tr064Adapter.Perform(a.ns, "SetPhonebookEntryUID", &params, &result); err != nil {
+	id, err := a.onTel.SetPhonebookEntryUID(ctx, a.pbID, xml.Header+string(data))
+	if err != nil {
 		return "", err
 	}
-	return result.NewPhonebookEntryUniqueID, nil
+	return strconv.FormatUint(uint64(id), 10), nil
 }
 
-func (a *Adapter) uploadImage(id, image string) (string, error) {
-	ftpConn, err := a.ftpConn()
+func (a *Adapter) uploadImage(ctx context.Context, id string, image []byte) (string, error) {
+	s, err := a.photoStorage(ctx)
 	if err != nil {
 		return "", err
 	}
-	defer func() { _ = ftpConn.Quit() }()
-
-	imgPath := a.imgPathForID(id)
-	imgReader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(image))
-	if err := ftpConn.Stor(imgPath, imgReader); err != nil {
+	imgPath := s.pathForID(id)
+	if err := a.images.Upload(ctx, imgPath, image); err != nil {
 		return "", fmt.Errorf("cannot upload image: %v", err)
 	}
 
-	return a.imgURLForImgPath(imgPath), nil
+	return s.urlForPath(imgPath), nil
+}
+
+func (a *Adapter) warn(format string, args ...interface{}) {
+	warn(a.log, format, args...)
+}
+
+func warn(logger *log.Logger, format string, args ...interface{}) {
+	if logger != nil {
+		logger.Printf("WARNING: "+format, args...)
+	}
 }
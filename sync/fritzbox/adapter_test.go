@@ -0,0 +1,384 @@
+package fritzbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/toaster/fritz_sync/retry"
+	"github.com/toaster/fritz_sync/sync"
+	"github.com/toaster/fritz_sync/sync/synctest"
+	"github.com/toaster/fritz_sync/tr064"
+	"github.com/toaster/fritz_sync/tr064/tr064test"
+)
+
+func TestAdapterConformance(t *testing.T) {
+	for name, opts := range map[string]tr064test.Options{
+		"713": {},
+		"820": {EndOfListCode: tr064.ErrInternalError.Code},
+	} {
+		t.Run(name, func(t *testing.T) {
+			synctest.TestReaderWriter(t, func(t *testing.T) sync.ReaderWriter {
+				box := tr064test.NewServer(opts)
+				t.Cleanup(box.Close)
+				return newTestAdapter(t, box, Options{})
+			})
+		})
+	}
+}
+
+func TestReadAllEndOfList(t *testing.T) {
+	tests := map[string]struct {
+		opts    tr064test.Options
+		wantErr bool
+	}{
+		"713":                     {opts: tr064test.Options{}},
+		"820 on 7590 with 7.29":   {opts: tr064test.Options{EndOfListCode: 820}},
+		"820 on 7590 with 7.20":   {opts: tr064test.Options{EndOfListCode: 820, Firmware: "154.07.20"}},
+		"820 on 7590 with 7.12":   {opts: tr064test.Options{EndOfListCode: 820, Firmware: "154.07.12"}, wantErr: true},
+		"820 on 7490 with 7.29":   {opts: tr064test.Options{EndOfListCode: 820, Model: "FRITZ!Box 7490", Firmware: "113.07.29"}, wantErr: true},
+		"820 on unknown firmware": {opts: tr064test.Options{EndOfListCode: 820, Firmware: "unknown"}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			box := tr064test.NewServer(tt.opts)
+			defer box.Close()
+			for i := 0; i < 3; i++ {
+				if _, err := box.AddEntry(0, fmt.Sprintf("<contact><person><realName>%d</realName></person></contact>", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a := newTestAdapter(t, box, Options{})
+
+			contacts, err := a.ReadAll(context.Background(), nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error for the unexpected end of list code")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(contacts) != 3 {
+				t.Errorf("expected 3 contacts, got %d", len(contacts))
+			}
+		})
+	}
+}
+
+func TestAddRespectsMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	if _, err := box.AddEntry(0, "<contact><person><realName>Jane</realName></person></contact>"); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAdapter(t, box, Options{})
+	a.quirks.MaxEntries = 3
+	if _, err := a.ReadAll(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tooMany := []sync.Contact{{FullName: "A", SyncID: "a"}, {FullName: "B", SyncID: "b"}, {FullName: "C", SyncID: "c"}}
+	if err := a.Add(ctx, tooMany); err == nil {
+		t.Error("expected an error for exceeding the maximum amount of entries")
+	}
+	if n := countCalls(box, "SetPhonebookEntryUID"); n != 0 {
+		t.Errorf("no entry may be added if the limit would be exceeded, got %d calls", n)
+	}
+	if err := a.Add(ctx, tooMany[:2]); err != nil {
+		t.Errorf("expected the entries to fit: %v", err)
+	}
+	if err := a.Add(ctx, tooMany[2:]); err == nil {
+		t.Error("expected an error for exceeding the maximum amount of entries")
+	}
+}
+
+func TestStaleNonce(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	a := newTestAdapter(t, box, Options{})
+	if err := a.Add(ctx, []sync.Contact{{FullName: "Jane", SyncID: "jane"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	box.ExpireNonce()
+	contacts, err := a.ReadAll(ctx, nil)
+	if err != nil {
+		t.Fatalf("a stale nonce has to be renewed: %v", err)
+	}
+	if len(contacts) != 1 {
+		t.Errorf("expected 1 contact, got %d", len(contacts))
+	}
+}
+
+func TestFailedActionsAreRetried(t *testing.T) {
+	busy := tr064test.Fault{Code: tr064.ErrActionFailed.Code}
+	tests := map[string]struct {
+		action  string
+		fault   tr064test.Fault
+		n       int
+		wantErr bool
+	}{
+		"busy once":            {action: "GetPhonebookEntry", fault: busy, n: 1},
+		"busy twice":           {action: "GetPhonebookEntry", fault: busy, n: 2},
+		"busy too often":       {action: "GetPhonebookEntry", fault: busy, n: 3, wantErr: true},
+		"server error":         {action: "GetPhonebookEntry", fault: tr064test.Fault{HTTPStatus: 503}, n: 1},
+		"broken connection":    {action: "GetPhonebookEntry", fault: tr064test.Fault{Disconnect: true}, n: 1},
+		"timeout":              {action: "GetPhonebookEntry", fault: tr064test.Fault{Delay: 300 * time.Millisecond}, n: 1},
+		"permanent UPnP error": {action: "GetPhonebookEntry", fault: tr064test.Fault{Code: tr064.ErrInvalidArgs.Code}, n: 1, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			box := tr064test.NewServer(tr064test.Options{})
+			defer box.Close()
+			if _, err := box.AddEntry(0, "<contact><person><realName>Jane</realName></person></contact>"); err != nil {
+				t.Fatal(err)
+			}
+			a := newTestAdapter(t, box, Options{Timeout: 100 * time.Millisecond})
+
+			box.FailAction(tt.action, tt.n, tt.fault)
+			contacts, err := a.ReadAll(context.Background(), nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the failure to be retried: %v", err)
+			}
+			if len(contacts) != 1 {
+				t.Errorf("expected 1 contact, got %d", len(contacts))
+			}
+		})
+	}
+}
+
+func TestStopFinishesCurrentContact(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	a := newTestAdapter(t, box, Options{})
+	stop := make(chan struct{})
+	box.SetHook(func(call tr064test.Call) *tr064test.Fault {
+		if call.Action == "SetPhonebookEntryUID" {
+			select {
+			case <-stop:
+			default:
+				close(stop)
+			}
+		}
+		return nil
+	})
+
+	err := a.Add(sync.WithStop(context.Background(), stop), synctest.SampleContacts)
+	if err != sync.ErrStopped {
+		t.Errorf("expected the adapter to stop, got %v", err)
+	}
+	if entries := box.Entries(0); len(entries) != 1 {
+		t.Errorf("expected the contact being added during the stop to be stored, got %d entries", len(entries))
+	}
+}
+
+func TestPhotoTransfer(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	a := newTestAdapter(t, box, Options{})
+
+	photo := base64.StdEncoding.EncodeToString(encodePNG(t, newTestImage(300, 200)))
+	if err := a.Add(ctx, []sync.Contact{{FullName: "Jane", SyncID: "jane", Image: photo}}); err != nil {
+		t.Fatal(err)
+	}
+	stored, ok := box.File(photoPath(t, a, "jane"))
+	if !ok {
+		t.Fatalf("photo was not uploaded, files: %v", box.Files())
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || cfg.Width != DefaultImageOptions.Width || cfg.Height != DefaultImageOptions.Height {
+		t.Errorf("expected the photo to be converted, got %dx%d %s", cfg.Width, cfg.Height, format)
+	}
+
+	box.ExpireSessions()
+	contacts, err := a.ReadAll(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, contact := range contacts {
+		if contact.Image != base64.StdEncoding.EncodeToString(stored) {
+			t.Error("expected the stored photo to be read")
+		}
+	}
+}
+
+func TestRemovedImagesOfOtherPhonebooksAreKept(t *testing.T) {
+	tests := map[string]func(a *Adapter, ctx context.Context, contacts []sync.Contact) error{
+		"Delete": func(a *Adapter, ctx context.Context, contacts []sync.Contact) error {
+			return a.Delete(ctx, contacts)
+		},
+		"Update": func(a *Adapter, ctx context.Context, contacts []sync.Contact) error {
+			for i := range contacts {
+				contacts[i].Image = ""
+			}
+			return a.Update(ctx, contacts)
+		},
+	}
+	for name, remove := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			box := tr064test.NewServer(tr064test.Options{})
+			defer box.Close()
+			a := newTestAdapter(t, box, Options{})
+
+			image := base64.StdEncoding.EncodeToString(encodeJPEG(t, newTestImage(240, 240)))
+			err := a.Add(ctx, []sync.Contact{
+				{FullName: "Jane", SyncID: "jane", Image: image},
+				{FullName: "John", SyncID: "john", Image: image},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := a.ReadAll(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var contacts []sync.Contact
+			for _, contact := range read {
+				contacts = append(contacts, contact)
+				if contact.SyncID == "jane" {
+					// another phonebook synced from the same source references the same photo
+					other := box.AddPhonebook("Copy")
+					data := fmt.Sprintf("<contact><person><realName>Jane</realName><imageURL>%s</imageURL></person></contact>",
+						a.imgURLs[contact.ID])
+					if _, err := box.AddEntry(other, data); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			for _, syncID := range []string{"jane", "john"} {
+				if _, ok := box.File(photoPath(t, a, syncID)); !ok {
+					t.Fatalf("photo of %s was not uploaded", syncID)
+				}
+			}
+
+			calls := len(box.Calls())
+			if err := remove(a, ctx, contacts); err != nil {
+				t.Fatal(err)
+			}
+			for _, call := range box.Calls()[calls:] {
+				if call.Action == "GetPhonebookEntryUID" {
+					t.Error("the image URLs read by ReadAll have to be used")
+				}
+			}
+			if _, ok := box.File(photoPath(t, a, "jane")); !ok {
+				t.Error("the photo referenced by another phonebook has to be kept")
+			}
+			if _, ok := box.File(photoPath(t, a, "john")); ok {
+				t.Error("the unreferenced photo has to be removed")
+			}
+		})
+	}
+}
+
+func TestUpdateKeepsPhotoWithLegacyURL(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	// written before the storage was detected: the USB storage addressed via the internal memory
+	photo := encodeJPEG(t, newTestImage(240, 240))
+	box.AddFile("/USB/FRITZ/fonpix/jane", photo)
+	_, err := box.AddEntry(0, "<contact><person><realName>Jane</realName>"+
+		"<imageURL>file:///var/InternerSpeicher/USB/FRITZ/fonpix/jane</imageURL></person>"+
+		"<syncid>jane</syncid></contact>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAdapterWithStorage(t, box, "USB", Options{})
+
+	contacts, err := a.ReadAll(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var updated []sync.Contact
+	for _, contact := range contacts {
+		contact.FullName = "Jane Doe"
+		updated = append(updated, contact)
+	}
+	if err := a.Update(ctx, updated); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := box.File("/USB/FRITZ/fonpix/jane"); !ok {
+		t.Fatal("the photo which has just been uploaded has to be kept")
+	}
+	if _, err := a.ReadAll(ctx, nil); err != nil {
+		t.Errorf("cannot read the updated entry: %v", err)
+	}
+}
+
+func TestInaccessibleStorage(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	// the user lacks the permission for the storage (NAS)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer web.Close()
+	a := newTestAdapter(t, box, Options{ImageTransport: HTTPTransport, WebURL: web.URL})
+
+	if err := a.Add(ctx, []sync.Contact{{FullName: "Jane", SyncID: "jane"}}); err != nil {
+		t.Fatalf("contacts without photos have to be synced: %v", err)
+	}
+	if _, err := a.ReadAll(ctx, nil); err != nil {
+		t.Fatalf("contacts without photos have to be read: %v", err)
+	}
+	photo := base64.StdEncoding.EncodeToString(encodeJPEG(t, newTestImage(240, 240)))
+	if err := a.Add(ctx, []sync.Contact{{FullName: "John", SyncID: "john", Image: photo}}); err == nil {
+		t.Error("expected an error for a photo")
+	}
+}
+
+// photoPath returns the storage path of the photo of the contact with the given sync ID.
+func photoPath(t *testing.T, a *Adapter, syncID string) string {
+	t.Helper()
+	s, err := a.photoStorage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.pathForID(syncID)
+}
+
+func newTestAdapter(t *testing.T, box *tr064test.Server, opts Options) *Adapter {
+	t.Helper()
+	return newTestAdapterWithStorage(t, box, "", opts)
+}
+
+func newTestAdapterWithStorage(t *testing.T, box *tr064test.Server, storageName string, opts Options) *Adapter {
+	t.Helper()
+	if opts.Retry.Attempts == 0 {
+		opts.Retry = retry.Policy{Attempts: 3, InitialDelay: time.Millisecond}
+	}
+	if opts.ImageTransport == AutoTransport {
+		opts.ImageTransport = HTTPTransport
+		opts.WebURL = box.URL
+	}
+	a, err := NewAdapter(context.Background(), box.URL, tr064test.DefaultPhonebook, tr064test.DefaultUser,
+		tr064test.DefaultPassword, storageName, "syncid", opts)
+	if err != nil {
+		t.Fatalf("cannot create adapter: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+	return a
+}
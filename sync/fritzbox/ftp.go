@@ -0,0 +1,404 @@
+package fritzbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	gosync "sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+
+	"github.com/toaster/fritz_sync/retry"
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// FTPSecurity defines whether the FTP connections to the Fritz!Box are encrypted.
+type FTPSecurity int
+
+// The supported FTP security modes.
+const (
+	// FTPPlain uses unencrypted FTP.
+	FTPPlain FTPSecurity = iota
+	// FTPExplicitTLS uses explicit TLS but falls back to unencrypted FTP for uploads which fail repeatedly.
+	FTPExplicitTLS
+	// FTPRequireTLS uses explicit TLS and never falls back to unencrypted FTP.
+	FTPRequireTLS
+)
+
+// errFTPAborted is returned if an FTP operation is cancelled or exceeds the timeout.
+var errFTPAborted = errors.New("FTP operation aborted")
+
+// tlsUploadAttempts is the amount of attempts for an upload via TLS before it fails or falls back to plain FTP.
+const tlsUploadAttempts = 3
+
+// ParseFTPSecurity parses an FTP security mode: “off”, “explicit” or “required”.
+func ParseFTPSecurity(mode string) (FTPSecurity, error) {
+	switch mode {
+	case "", "off":
+		return FTPPlain, nil
+	case "explicit":
+		return FTPExplicitTLS, nil
+	case "required":
+		return FTPRequireTLS, nil
+	}
+	return FTPPlain, fmt.Errorf("unknown FTP security mode “%s”", mode)
+}
+
+// ftpSessions implements the imageTransport via FTP.
+// It keeps authenticated FTP connections to the Fritz!Box open for reuse.
+// The amount of parallel connections is limited by Options.FTPConnections.
+type ftpSessions struct {
+	host        string
+	log         *log.Logger
+	pass        string
+	port        int
+	retry       retry.Policy
+	security    FTPSecurity
+	slots       chan struct{}
+	timeout     time.Duration
+	tlsConfig   *tls.Config
+	unstableTLS bool
+	user        string
+
+	mutex        gosync.Mutex
+	idle         []*ftp.ServerConn
+	unstableOnce gosync.Once
+}
+
+func newFTPSessions(host, user, pass string, opts Options, quirks Quirks) (*ftpSessions, error) {
+	max := opts.FTPConnections
+	if max < 1 {
+		max = 1
+	}
+	port := opts.FTPPort
+	if port == 0 {
+		port = 21
+	}
+	s := &ftpSessions{
+		host:        host,
+		log:         opts.Log,
+		pass:        pass,
+		port:        port,
+		retry:       opts.Retry,
+		security:    opts.FTPSecurity,
+		slots:       make(chan struct{}, max),
+		timeout:     opts.Timeout,
+		unstableTLS: quirks.UnstableTLSUpload,
+		user:        user,
+	}
+	if opts.FTPSecurity != FTPPlain {
+		tlsOpts := opts.TLS
+		if opts.FTPCertFingerprint != "" {
+			tlsOpts = tr064.TLSOptions{Fingerprint: opts.FTPCertFingerprint}
+		}
+		tlsConfig, err := tr064.NewTLSConfig(host, tlsOpts)
+		if err != nil {
+			return nil, err
+		}
+		s.tlsConfig = tlsConfig
+	}
+	return s, nil
+}
+
+// Close terminates all open connections (part of imageTransport interface).
+func (s *ftpSessions) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var firstErr error
+	for _, conn := range s.idle {
+		if err := conn.Quit(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.idle = nil
+	return firstErr
+}
+
+// Delete removes a file (part of imageTransport interface).
+func (s *ftpSessions) Delete(ctx context.Context, path string) error {
+	return s.retried(ctx, "FTP delete", func(conn *ftp.ServerConn) error { return conn.Delete(path) })
+}
+
+// Download reads a file (part of imageTransport interface).
+// Every attempt reads into its own buffer because an aborted attempt may still be running while it is retried.
+func (s *ftpSessions) Download(ctx context.Context, path string) ([]byte, error) {
+	var result attemptResult
+	err := s.retried(ctx, "FTP download", func(conn *ftp.ServerConn) error {
+		reader, err := conn.Retr(path)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		buf := new(bytes.Buffer)
+		if _, err := io.Copy(buf, reader); err != nil {
+			return err
+		}
+		result.publish(buf.Bytes())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, _ := result.get().([]byte)
+	return data, nil
+}
+
+// List returns all files and directories in a directory (part of imageTransport interface).
+func (s *ftpSessions) List(ctx context.Context, dir string) ([]fileInfo, error) {
+	var result attemptResult
+	err := s.retried(ctx, "FTP list", func(conn *ftp.ServerConn) error {
+		entries, err := conn.List(dir)
+		if err != nil {
+			return err
+		}
+		result.publish(entries)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := result.get().([]*ftp.Entry)
+	var files []fileInfo
+	for _, entry := range entries {
+		switch entry.Type {
+		case ftp.EntryTypeFile:
+			files = append(files, fileInfo{name: entry.Name})
+		case ftp.EntryTypeFolder:
+			if entry.Name != "." && entry.Name != ".." {
+				files = append(files, fileInfo{dir: true, name: entry.Name})
+			}
+		}
+	}
+	return files, nil
+}
+
+// Probe checks whether the FTP server is reachable and accepts the credentials.
+func (s *ftpSessions) Probe(ctx context.Context) error {
+	return s.Do(ctx, func(conn *ftp.ServerConn) error { return conn.NoOp() })
+}
+
+// Upload writes a file (part of imageTransport interface).
+// Failing uploads via TLS are retried and, if TLS is not required, finally performed via unencrypted FTP.
+func (s *ftpSessions) Upload(ctx context.Context, path string, data []byte) error {
+	return s.upload(ctx, func(conn *ftp.ServerConn) error { return conn.Stor(path, bytes.NewReader(data)) })
+}
+
+// Do calls f with an authenticated connection.
+// If f fails because the connection broke (e.g. the Fritz!Box closed an idle session), f is retried once
+// with a new connection. Therefore f has to be repeatable.
+// If ctx is done or f exceeds the timeout, the connection is closed and Do returns without waiting for f.
+func (s *ftpSessions) Do(ctx context.Context, f func(*ftp.ServerConn) error) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer func() { <-s.slots }()
+
+	conn, reused, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.run(ctx, conn, f)
+	if err != nil && reused && isFTPConnError(err) && !errors.Is(err, errFTPAborted) {
+		_ = conn.Quit()
+		if conn, err = s.dial(ctx, s.tlsConfig); err != nil {
+			return err
+		}
+		err = s.run(ctx, conn, f)
+	}
+	if errors.Is(err, errFTPAborted) {
+		return err
+	}
+	if err != nil && isFTPConnError(err) {
+		_ = conn.Quit()
+		return err
+	}
+	s.put(conn)
+	return err
+}
+
+// Parallelism returns the amount of connections which may be used in parallel (part of imageTransport interface).
+func (s *ftpSessions) Parallelism() int {
+	return cap(s.slots)
+}
+
+// retried calls f like Do and retries transient failures according to the retry policy.
+func (s *ftpSessions) retried(ctx context.Context, kind string, f func(*ftp.ServerConn) error) error {
+	return s.retry.Do(ctx, kind, func() error { return classifyFTPError(ctx, s.Do(ctx, f)) })
+}
+
+// upload calls f like Do but retries failing TLS uploads.
+// If the upload still fails and TLS is not required, it is performed via unencrypted FTP.
+func (s *ftpSessions) upload(ctx context.Context, f func(*ftp.ServerConn) error) error {
+	if s.tlsConfig == nil {
+		return s.retried(ctx, "FTP upload", f)
+	}
+
+	if s.unstableTLS && s.security == FTPExplicitTLS {
+		s.unstableOnce.Do(func() {
+			s.warn("FTP uploads via TLS are not stable on this Fritz!OS version, uploading unencrypted")
+		})
+	} else {
+		var err error
+		for attempt := 1; attempt <= tlsUploadAttempts; attempt++ {
+			if err = s.Do(ctx, f); err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return err
+			}
+			s.warn("FTP upload via TLS failed (attempt %d of %d): %v", attempt, tlsUploadAttempts, err)
+		}
+		if s.security == FTPRequireTLS {
+			return err
+		}
+		s.warn("FTP upload via TLS failed permanently, falling back to unencrypted FTP")
+	}
+
+	return s.retry.Do(ctx, "FTP upload", func() error { return classifyFTPError(ctx, s.doPlain(ctx, f)) })
+}
+
+// doPlain calls f with a new unencrypted connection.
+func (s *ftpSessions) doPlain(ctx context.Context, f func(*ftp.ServerConn) error) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer func() { <-s.slots }()
+	conn, err := s.dial(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = s.run(ctx, conn, f)
+	if !errors.Is(err, errFTPAborted) {
+		_ = conn.Quit()
+	}
+	return err
+}
+
+// acquire waits for a free connection slot.
+func (s *ftpSessions) acquire(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *ftpSessions) dial(ctx context.Context, tlsConfig *tls.Config) (*ftp.ServerConn, error) {
+	opts := []ftp.DialOption{ftp.DialWithContext(ctx)}
+	if s.timeout > 0 {
+		opts = append(opts, ftp.DialWithTimeout(s.timeout))
+	}
+	if tlsConfig != nil {
+		opts = append(opts, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+	conn, err := ftp.Dial(net.JoinHostPort(s.host, strconv.Itoa(s.port)), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to FTP server: %w", err)
+	}
+
+	err = s.run(ctx, conn, func(conn *ftp.ServerConn) error { return conn.Login(s.user, s.pass) })
+	if errors.Is(err, errFTPAborted) {
+		return nil, err
+	}
+	if err != nil {
+		_ = conn.Quit()
+		return nil, fmt.Errorf("cannot log into FTP server: %w", err)
+	}
+	return conn, nil
+}
+
+func (s *ftpSessions) get(ctx context.Context) (*ftp.ServerConn, bool, error) {
+	s.mutex.Lock()
+	if n := len(s.idle); n > 0 {
+		conn := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mutex.Unlock()
+		return conn, true, nil
+	}
+	s.mutex.Unlock()
+
+	conn, err := s.dial(ctx, s.tlsConfig)
+	return conn, false, err
+}
+
+// run calls f with conn.
+// If ctx is done or f exceeds the timeout, conn is closed and run returns errFTPAborted without waiting for f.
+// The connection must not be used anymore in that case.
+func (s *ftpSessions) run(ctx context.Context, conn *ftp.ServerConn, f func(*ftp.ServerConn) error) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %v", errFTPAborted, err)
+	}
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	result := make(chan error, 1)
+	go func() { result <- f(conn) }()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		go func() { _ = conn.Quit() }()
+		return fmt.Errorf("%w: %v", errFTPAborted, ctx.Err())
+	}
+}
+
+func (s *ftpSessions) put(conn *ftp.ServerConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.idle = append(s.idle, conn)
+}
+
+func (s *ftpSessions) warn(format string, args ...interface{}) {
+	warn(s.log, format, args...)
+}
+
+// attemptResult holds the result of the successful attempt of a retried FTP operation.
+// Aborted attempts are not waited for (see ftpSessions.Do) and may finish concurrently to their retries,
+// therefore attempts must not share state other than via publish.
+type attemptResult struct {
+	mutex gosync.Mutex
+	value interface{}
+}
+
+func (r *attemptResult) get() interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.value
+}
+
+func (r *attemptResult) publish(value interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.value = value
+}
+
+// classifyFTPError marks transient FTP errors as retryable: broken connections, timeouts and
+// transient negative replies (4xx).
+func classifyFTPError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	var reply *textproto.Error
+	if errors.As(err, &reply) && (reply.Code < 400 || reply.Code >= 500) {
+		return err
+	}
+	return retry.Retryable(err)
+}
+
+// isFTPConnError reports whether err is caused by a broken connection instead of an FTP error reply.
+func isFTPConnError(err error) bool {
+	var reply *textproto.Error
+	return !errors.As(err, &reply)
+}
@@ -0,0 +1,258 @@
+package fritzbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/toaster/fritz_sync/retry"
+	"github.com/toaster/fritz_sync/sync"
+	"github.com/toaster/fritz_sync/sync/fritzbox/ftptest"
+	"github.com/toaster/fritz_sync/tr064/tr064test"
+)
+
+func TestFTPRoundTrip(t *testing.T) {
+	tests := map[string]struct {
+		server   ftptest.Options
+		security FTPSecurity
+		wantTLS  bool
+	}{
+		"plain":              {security: FTPPlain},
+		"plain without EPSV": {server: ftptest.Options{DisableEPSV: true}, security: FTPPlain},
+		"explicit TLS":       {server: ftptest.Options{TLS: true}, security: FTPExplicitTLS, wantTLS: true},
+		"required TLS":       {server: ftptest.Options{RequireTLS: true}, security: FTPRequireTLS, wantTLS: true},
+		"required TLS without EPSV": {
+			server:   ftptest.Options{DisableEPSV: true, RequireTLS: true},
+			security: FTPRequireTLS,
+			wantTLS:  true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			server := ftptest.NewServer(tt.server)
+			defer server.Close()
+			sessions := newTestFTPSessions(t, server, Options{
+				FTPCertFingerprint: server.Fingerprint(),
+				FTPSecurity:        tt.security,
+			}, Quirks{})
+
+			data := encodeJPEG(t, newTestImage(16, 16))
+			if err := sessions.Upload(ctx, "/FRITZ/fonpix/jane", data); err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+			if stored, _ := server.File("/FRITZ/fonpix/jane"); !bytes.Equal(stored, data) {
+				t.Error("the uploaded file differs")
+			}
+			got, err := sessions.Download(ctx, "/FRITZ/fonpix/jane")
+			if err != nil {
+				t.Fatalf("download failed: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("the downloaded file differs")
+			}
+			files, err := sessions.List(ctx, "/FRITZ/fonpix")
+			if err != nil {
+				t.Fatalf("list failed: %v", err)
+			}
+			if want := []fileInfo{{name: "jane"}}; !reflect.DeepEqual(files, want) {
+				t.Errorf("expected %v, got %v", want, files)
+			}
+			if err := sessions.Delete(ctx, "/FRITZ/fonpix/jane"); err != nil {
+				t.Fatalf("delete failed: %v", err)
+			}
+			if files := server.Files(); len(files) != 0 {
+				t.Errorf("expected no files, got %v", files)
+			}
+
+			for _, cmd := range server.Commands() {
+				if cmd.Name == "STOR" || cmd.Name == "RETR" || cmd.Name == "PASS" {
+					if cmd.TLS != tt.wantTLS {
+						t.Errorf("%s: expected TLS %v, got %v", cmd.Name, tt.wantTLS, cmd.TLS)
+					}
+				}
+			}
+			if server.Logins() != 1 {
+				t.Errorf("expected the connection to be reused, got %d logins", server.Logins())
+			}
+		})
+	}
+}
+
+func TestFTPMissingFile(t *testing.T) {
+	ctx := context.Background()
+	server := ftptest.NewServer(ftptest.Options{})
+	defer server.Close()
+	sessions := newTestFTPSessions(t, server, Options{}, Quirks{})
+
+	if _, err := sessions.Download(ctx, "/FRITZ/fonpix/missing"); err == nil {
+		t.Error("expected an error for downloading a missing file")
+	}
+	if err := sessions.Delete(ctx, "/FRITZ/fonpix/missing"); err == nil {
+		t.Error("expected an error for deleting a missing file")
+	}
+	if _, err := sessions.List(ctx, "/FRITZ/missing"); err == nil {
+		t.Error("expected an error for listing a missing directory")
+	}
+	if n := countCommands(server, "RETR"); n != 1 {
+		t.Errorf("permanent errors must not be retried, got %d RETR commands", n)
+	}
+}
+
+func TestFTPAuthFailure(t *testing.T) {
+	tests := map[string]struct {
+		server   ftptest.Options
+		security FTPSecurity
+	}{
+		"wrong password":          {server: ftptest.Options{Password: "other"}},
+		"wrong password with TLS": {server: ftptest.Options{Password: "other", TLS: true}, security: FTPRequireTLS},
+		"TLS required by server":  {server: ftptest.Options{RequireTLS: true}},
+		"TLS required by client":  {security: FTPRequireTLS},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := ftptest.NewServer(tt.server)
+			defer server.Close()
+			sessions := newTestFTPSessions(t, server, Options{
+				FTPCertFingerprint: server.Fingerprint(),
+				FTPSecurity:        tt.security,
+			}, Quirks{})
+
+			if err := sessions.Probe(context.Background()); err == nil {
+				t.Error("expected the login to fail")
+			}
+			if server.Logins() != 0 {
+				t.Errorf("expected no login, got %d", server.Logins())
+			}
+		})
+	}
+}
+
+func TestFTPTLSUploadFallback(t *testing.T) {
+	refused := ftptest.Fault{Code: 421, Message: "Data connection failed"}
+	tests := map[string]struct {
+		security      FTPSecurity
+		quirks        Quirks
+		failures      int
+		wantErr       bool
+		wantTLSStor   int
+		wantPlainStor int
+	}{
+		"stable TLS":                   {security: FTPExplicitTLS, wantTLSStor: 1},
+		"TLS recovers":                 {security: FTPExplicitTLS, failures: 2, wantTLSStor: 3},
+		"TLS fails, plain fallback":    {security: FTPExplicitTLS, failures: 3, wantTLSStor: 3, wantPlainStor: 1},
+		"TLS fails, fallback disabled": {security: FTPRequireTLS, failures: 3, wantErr: true, wantTLSStor: 3},
+		"unstable TLS quirk": {
+			security:      FTPExplicitTLS,
+			quirks:        Quirks{UnstableTLSUpload: true},
+			wantPlainStor: 1,
+		},
+		"unstable TLS quirk, TLS required": {
+			security:    FTPRequireTLS,
+			quirks:      Quirks{UnstableTLSUpload: true},
+			wantTLSStor: 1,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			server := ftptest.NewServer(ftptest.Options{TLS: true})
+			defer server.Close()
+			server.FailCommands("STOR", tt.failures, refused)
+			sessions := newTestFTPSessions(t, server, Options{
+				FTPCertFingerprint: server.Fingerprint(),
+				FTPSecurity:        tt.security,
+			}, tt.quirks)
+
+			err := sessions.Upload(ctx, "/FRITZ/fonpix/jane", []byte("photo"))
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("unexpected result: %v", err)
+			}
+			var tlsStor, plainStor int
+			for _, cmd := range server.Commands() {
+				if cmd.Name == "STOR" && cmd.TLS {
+					tlsStor++
+				} else if cmd.Name == "STOR" {
+					plainStor++
+				}
+			}
+			if tlsStor != tt.wantTLSStor || plainStor != tt.wantPlainStor {
+				t.Errorf("expected %d uploads via TLS and %d unencrypted, got %d and %d",
+					tt.wantTLSStor, tt.wantPlainStor, tlsStor, plainStor)
+			}
+
+			if _, err := sessions.Download(ctx, "/FRITZ/fonpix/missing"); err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, cmd := range server.Commands() {
+				if cmd.Name == "RETR" && !cmd.TLS {
+					t.Error("only uploads may fall back to unencrypted FTP")
+				}
+			}
+		})
+	}
+}
+
+func TestFTPPort(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	server := ftptest.NewServer(ftptest.Options{Password: tr064test.DefaultPassword, User: tr064test.DefaultUser})
+	defer server.Close()
+	a := newTestAdapter(t, box, Options{FTPPort: server.Port, ImageTransport: FTPTransport})
+
+	photo := base64.StdEncoding.EncodeToString(encodeJPEG(t, newTestImage(240, 240)))
+	if err := a.Add(ctx, []sync.Contact{{FullName: "Jane", SyncID: "jane", Image: photo}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.File(photoPath(t, a, "jane")); !ok {
+		t.Fatalf("expected the photo to be uploaded via FTP, files: %v", server.Files())
+	}
+	if _, ok := box.File(photoPath(t, a, "jane")); ok {
+		t.Error("expected the photo not to be uploaded via HTTP")
+	}
+}
+
+func TestFTPDownloadRetriesAbortedAttempts(t *testing.T) {
+	server := ftptest.NewServer(ftptest.Options{})
+	defer server.Close()
+	data := []byte("photo")
+	server.AddFile("/FRITZ/fonpix/jane", data)
+	server.FailCommands("RETR", 1, ftptest.Fault{Delay: 500 * time.Millisecond})
+
+	sessions := newTestFTPSessions(t, server, Options{Timeout: 100 * time.Millisecond}, Quirks{})
+	got, err := sessions.Download(context.Background(), "/FRITZ/fonpix/jane")
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected %q, got %q", data, got)
+	}
+}
+
+func countCommands(server *ftptest.Server, name string) int {
+	n := 0
+	for _, cmd := range server.Commands() {
+		if cmd.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestFTPSessions(t *testing.T, server *ftptest.Server, opts Options, quirks Quirks) *ftpSessions {
+	t.Helper()
+	opts.FTPPort = server.Port
+	if opts.Retry.Attempts == 0 {
+		opts.Retry = retry.Policy{Attempts: 3, InitialDelay: time.Millisecond}
+	}
+	sessions, err := newFTPSessions("127.0.0.1", ftptest.DefaultUser, ftptest.DefaultPassword, opts, quirks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sessions.Close() })
+	return sessions
+}
@@ -0,0 +1,320 @@
+// Package ftptest provides an in-process fake of the FTP server of a Fritz!Box for tests of the photo transfers.
+//
+// The fake keeps its files in memory and supports the commands used by the Fritz!Box adapter: USER/PASS,
+// PASV/EPSV, LIST, RETR, STOR, DELE and SIZE as well as explicit TLS (AUTH TLS, PBSZ, PROT) if enabled:
+//
+//	server := ftptest.NewServer(ftptest.Options{TLS: true})
+//	defer server.Close()
+//	adapter, err := fritzbox.NewAdapter(ctx, box.URL, …, fritzbox.Options{
+//		FTPCertFingerprint: server.Fingerprint(),
+//		FTPPort:            server.Port,
+//		FTPSecurity:        fritzbox.FTPRequireTLS,
+//		ImageTransport:     fritzbox.FTPTransport,
+//	})
+//
+// Faults can be injected per command with FailCommands or for arbitrary commands with SetHook.
+package ftptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The defaults of the fake.
+const (
+	// DefaultPassword is the password accepted if Options.Password is empty.
+	DefaultPassword = "secret"
+	// DefaultUser is the user accepted if Options.User is empty.
+	DefaultUser = "admin"
+)
+
+// Options configures a Server.
+type Options struct {
+	// DisableEPSV makes the server reject EPSV so that clients have to fall back to PASV.
+	DisableEPSV bool
+	// Password is the password of User (default DefaultPassword).
+	Password string
+	// RequireTLS rejects logins via unencrypted connections. It implies TLS.
+	RequireTLS bool
+	// TLS enables explicit TLS (AUTH TLS) with a self-signed certificate (see Server.Fingerprint).
+	TLS bool
+	// User is the user accepted by the server (default DefaultUser).
+	User string
+}
+
+// Server is a fake FTP server. It is safe for concurrent use.
+type Server struct {
+	// Addr is the address of the server, e.g. 127.0.0.1:40021.
+	Addr string
+	// Port is the port of the server.
+	Port int
+
+	fingerprint string
+	listener    net.Listener
+	opts        Options
+	tlsConfig   *tls.Config
+	wg          sync.WaitGroup
+
+	mutex       sync.Mutex
+	closed      bool
+	commands    []Command
+	connections map[net.Conn]bool
+	dirs        map[string]bool
+	faults      map[string][]Fault
+	files       map[string][]byte
+	hook        Hook
+	logins      int
+}
+
+// Command is a command received by the server.
+type Command struct {
+	// Args contains the arguments of the command, e.g. “/FRITZ/fonpix/1234”.
+	Args string
+	// Name is the name of the command in upper case, e.g. “RETR”.
+	Name string
+	// TLS reports whether the control connection was encrypted.
+	TLS bool
+}
+
+// Fault replaces or delays the regular reply to a command.
+type Fault struct {
+	// Code is the code of the reply, e.g. 421 or 550.
+	Code int
+	// Delay delays the reply, e.g. to provoke client timeouts.
+	// If no other field is set, the command is processed regularly after the delay.
+	Delay time.Duration
+	// Disconnect closes the control connection without a reply.
+	Disconnect bool
+	// Message is the text of the reply (default “Injected fault”).
+	Message string
+}
+
+// Hook decides about a fault for a command. It returns nil for regular processing.
+type Hook func(cmd Command) *Fault
+
+// NewServer starts a fake FTP server on a local port with an empty internal storage.
+// It panics if it cannot listen or create its certificate, like httptest.NewServer.
+func NewServer(opts Options) *Server {
+	if opts.Password == "" {
+		opts.Password = DefaultPassword
+	}
+	if opts.User == "" {
+		opts.User = DefaultUser
+	}
+	if opts.RequireTLS {
+		opts.TLS = true
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("ftptest: failed to listen on a port: %v", err))
+	}
+	s := &Server{
+		Addr:        listener.Addr().String(),
+		Port:        listener.Addr().(*net.TCPAddr).Port,
+		connections: map[net.Conn]bool{},
+		dirs:        map[string]bool{"/": true, "/FRITZ": true, "/FRITZ/fonpix": true},
+		faults:      map[string][]Fault{},
+		files:       map[string][]byte{},
+		listener:    listener,
+		opts:        opts,
+	}
+	if opts.TLS {
+		cert, err := newCertificate()
+		if err != nil {
+			panic(fmt.Sprintf("ftptest: failed to create a certificate: %v", err))
+		}
+		sum := sha256.Sum256(cert.Certificate[0])
+		s.fingerprint = hex.EncodeToString(sum[:])
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// AddDir creates a directory of the storage, e.g. “/USB-Stick/FRITZ/fonpix” for a USB storage.
+// Missing parent directories are created, too.
+func (s *Server) AddDir(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.addDir(path)
+}
+
+// AddFile stores a file in the storage, e.g. “/FRITZ/fonpix/1234”.
+func (s *Server) AddFile(path string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.addDir(parentDir(path))
+	s.files[path] = append([]byte(nil), data...)
+}
+
+// Close shuts the server down and closes all connections.
+func (s *Server) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	_ = s.listener.Close()
+	for conn := range s.connections {
+		_ = conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+// Commands returns all commands received so far in their order.
+func (s *Server) Commands() []Command {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Command(nil), s.commands...)
+}
+
+// FailCommands makes the next n commands with the given name (e.g. “STOR”) fail with fault.
+// Faults of FailCommands take precedence over the hook.
+func (s *Server) FailCommands(name string, n int, fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name = strings.ToUpper(name)
+	for i := 0; i < n; i++ {
+		s.faults[name] = append(s.faults[name], fault)
+	}
+}
+
+// File returns the content of a file of the storage.
+func (s *Server) File(path string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ok := s.files[path]
+	return append([]byte(nil), data...), ok
+}
+
+// Files returns the paths of all files of the storage in alphabetical order.
+func (s *Server) Files() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Fingerprint returns the hex encoded SHA-256 fingerprint of the certificate of the server
+// or an empty string if TLS is not enabled.
+func (s *Server) Fingerprint() string {
+	return s.fingerprint
+}
+
+// Logins returns the amount of successful logins, i.e. of authenticated connections.
+func (s *Server) Logins() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.logins
+}
+
+// SetHook installs a hook which is called for every command (nil removes it).
+// The hook must not block; it may call the methods of the server.
+func (s *Server) SetHook(hook Hook) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hook = hook
+}
+
+func (s *Server) addDir(path string) {
+	for path != "/" && path != "" {
+		s.dirs[path] = true
+		path = parentDir(path)
+	}
+}
+
+// fault records a command and returns the fault to inject, if any.
+func (s *Server) fault(cmd Command) *Fault {
+	s.mutex.Lock()
+	s.commands = append(s.commands, cmd)
+	hook := s.hook
+	if faults := s.faults[cmd.Name]; len(faults) > 0 {
+		s.faults[cmd.Name] = faults[1:]
+		s.mutex.Unlock()
+		return &faults[0]
+	}
+	s.mutex.Unlock()
+
+	if hook == nil {
+		return nil
+	}
+	return hook(cmd)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.connections[conn] = true
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c := &session{conn: conn, cwd: "/", reader: bufio.NewReader(conn), server: s}
+			c.serve()
+			s.mutex.Lock()
+			delete(s.connections, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// newCertificate creates a self-signed certificate for 127.0.0.1.
+func newCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		DNSNames:     []string{"localhost", "fritz.box"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fritz.box"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func parentDir(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
@@ -0,0 +1,375 @@
+package ftptest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dataTimeout limits how long the server waits for the client to open a data connection.
+const dataTimeout = 10 * time.Second
+
+// features is the reply to FEAT without the features which depend on the options.
+var features = []string{"EPSV", "PASV", "SIZE", "UTF8"}
+
+// session is a control connection of a client.
+type session struct {
+	conn     net.Conn
+	cwd      string
+	loggedIn bool
+	passive  net.Listener
+	protect  bool
+	reader   *bufio.Reader
+	server   *Server
+	tls      bool
+	user     string
+}
+
+func (c *session) serve() {
+	defer func() {
+		c.closePassive()
+		_ = c.conn.Close()
+	}()
+
+	c.reply(220, "FRITZ!Box FTP server ready.")
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+		cmd := Command{Name: strings.ToUpper(fields[0]), TLS: c.tls}
+		if len(fields) > 1 {
+			cmd.Args = fields[1]
+		}
+
+		if fault := c.server.fault(cmd); fault != nil {
+			time.Sleep(fault.Delay)
+			if fault.Disconnect {
+				return
+			}
+			if fault.Code != 0 {
+				message := fault.Message
+				if message == "" {
+					message = "Injected fault"
+				}
+				c.closePassive()
+				c.reply(fault.Code, message)
+				continue
+			}
+		}
+		if quit := c.handle(cmd); quit {
+			return
+		}
+	}
+}
+
+// handle performs a command and reports whether the connection has to be closed.
+func (c *session) handle(cmd Command) bool {
+	opts := c.server.opts
+	switch cmd.Name {
+	case "AUTH":
+		if c.server.tlsConfig == nil || strings.ToUpper(cmd.Args) != "TLS" || c.tls {
+			c.reply(504, "AUTH not supported for this parameter")
+			return false
+		}
+		c.reply(234, "Using authentication type TLS")
+		conn := tls.Server(c.conn, c.server.tlsConfig)
+		if err := conn.Handshake(); err != nil {
+			return true
+		}
+		c.conn = conn
+		c.reader = bufio.NewReader(conn)
+		c.tls = true
+	case "FEAT":
+		lines := append([]string(nil), features...)
+		if c.server.tlsConfig != nil {
+			lines = append(lines, "AUTH TLS", "PBSZ", "PROT")
+		}
+		sort.Strings(lines)
+		c.write("211-Features:\r\n " + strings.Join(lines, "\r\n ") + "\r\n211 End\r\n")
+	case "NOOP":
+		c.reply(200, "NOOP command successful")
+	case "PASS":
+		if c.user == "" {
+			c.reply(503, "Login with USER first")
+			return false
+		}
+		if c.user != opts.User || cmd.Args != opts.Password || opts.RequireTLS && !c.tls {
+			c.user = ""
+			c.reply(530, "Login incorrect")
+			return false
+		}
+		c.loggedIn = true
+		c.server.mutex.Lock()
+		c.server.logins++
+		c.server.mutex.Unlock()
+		c.reply(230, "User logged in")
+	case "PBSZ":
+		if !c.tls {
+			c.reply(503, "PBSZ requires AUTH TLS")
+			return false
+		}
+		c.reply(200, "PBSZ=0")
+	case "PROT":
+		switch strings.ToUpper(cmd.Args) {
+		case "C":
+			c.protect = false
+			c.reply(200, "Protection level set to C")
+		case "P":
+			if !c.tls {
+				c.reply(503, "PROT requires AUTH TLS")
+				return false
+			}
+			c.protect = true
+			c.reply(200, "Protection level set to P")
+		default:
+			c.reply(504, "Protection level not supported")
+		}
+	case "QUIT":
+		c.reply(221, "Goodbye")
+		return true
+	case "USER":
+		c.loggedIn = false
+		if opts.RequireTLS && !c.tls {
+			c.reply(530, "TLS required")
+			return false
+		}
+		c.user = cmd.Args
+		c.reply(331, "Password required")
+	default:
+		if !c.loggedIn {
+			c.reply(530, "Not logged in")
+			return false
+		}
+		c.handleFile(cmd)
+	}
+	return false
+}
+
+// handleFile performs the commands which require a login.
+func (c *session) handleFile(cmd Command) {
+	s := c.server
+	p := c.resolve(cmd.Args)
+	switch cmd.Name {
+	case "CWD":
+		if !c.isDir(p) {
+			c.reply(550, "No such directory")
+			return
+		}
+		c.cwd = p
+		c.reply(250, "CWD command successful")
+	case "DELE":
+		s.mutex.Lock()
+		_, ok := s.files[p]
+		delete(s.files, p)
+		s.mutex.Unlock()
+		if !ok {
+			c.reply(550, "No such file")
+			return
+		}
+		c.reply(250, "DELE command successful")
+	case "EPSV":
+		if s.opts.DisableEPSV {
+			c.reply(502, "EPSV not implemented")
+			return
+		}
+		port, err := c.listenPassive()
+		if err != nil {
+			c.reply(425, "Cannot open data connection")
+			return
+		}
+		c.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	case "LIST", "NLST":
+		listing, ok := c.list(strings.TrimSpace(strings.TrimPrefix(cmd.Args, "-a")), cmd.Name == "NLST")
+		if !ok {
+			c.closePassive()
+			c.reply(550, "No such file or directory")
+			return
+		}
+		c.transfer(func(conn net.Conn) error {
+			_, err := conn.Write(listing)
+			return err
+		})
+	case "MKD":
+		if !c.isDir(parentDir(p)) {
+			c.reply(550, "No such directory")
+			return
+		}
+		s.AddDir(p)
+		c.reply(257, fmt.Sprintf("%q created", p))
+	case "OPTS", "TYPE":
+		c.reply(200, cmd.Name+" command successful")
+	case "PASV":
+		port, err := c.listenPassive()
+		if err != nil {
+			c.reply(425, "Cannot open data connection")
+			return
+		}
+		c.reply(227, fmt.Sprintf("Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256))
+	case "PWD":
+		c.reply(257, fmt.Sprintf("%q is the current directory", c.cwd))
+	case "RETR":
+		data, ok := s.File(p)
+		if !ok {
+			c.closePassive()
+			c.reply(550, "No such file")
+			return
+		}
+		c.transfer(func(conn net.Conn) error {
+			_, err := io.Copy(conn, bytes.NewReader(data))
+			return err
+		})
+	case "SIZE":
+		data, ok := s.File(p)
+		if !ok {
+			c.reply(550, "No such file")
+			return
+		}
+		c.reply(213, fmt.Sprint(len(data)))
+	case "STOR":
+		if !c.isDir(parentDir(p)) {
+			c.closePassive()
+			c.reply(553, "Could not create file")
+			return
+		}
+		c.transfer(func(conn net.Conn) error {
+			data, err := ioutil.ReadAll(conn)
+			if err != nil {
+				return err
+			}
+			s.AddFile(p, data)
+			return nil
+		})
+	default:
+		c.reply(502, "Command not implemented")
+	}
+}
+
+func (c *session) closePassive() {
+	if c.passive != nil {
+		_ = c.passive.Close()
+		c.passive = nil
+	}
+}
+
+func (c *session) isDir(p string) bool {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	return c.server.dirs[p]
+}
+
+// list returns the listing of a directory (or of a single file) in the format of “ls -l” or, for NLST,
+// the names only.
+func (c *session) list(arg string, namesOnly bool) ([]byte, bool) {
+	s := c.server
+	p := c.resolve(arg)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	type entry struct {
+		dir  bool
+		name string
+		size int
+	}
+	var entries []entry
+	if data, ok := s.files[p]; ok {
+		entries = append(entries, entry{name: path.Base(p), size: len(data)})
+	} else if s.dirs[p] {
+		for d := range s.dirs {
+			if d != "/" && parentDir(d) == p {
+				entries = append(entries, entry{dir: true, name: path.Base(d)})
+			}
+		}
+		for f, data := range s.files {
+			if parentDir(f) == p {
+				entries = append(entries, entry{name: path.Base(f), size: len(data)})
+			}
+		}
+	} else {
+		return nil, false
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	var listing bytes.Buffer
+	modified := time.Now().Format("Jan _2 15:04")
+	for _, e := range entries {
+		switch {
+		case namesOnly:
+			fmt.Fprintf(&listing, "%s\r\n", e.name)
+		case e.dir:
+			fmt.Fprintf(&listing, "drwxr-x--- 1 ftpuser ftpuser %d %s %s\r\n", 0, modified, e.name)
+		default:
+			fmt.Fprintf(&listing, "-rw-r----- 1 ftpuser ftpuser %d %s %s\r\n", e.size, modified, e.name)
+		}
+	}
+	return listing.Bytes(), true
+}
+
+// listenPassive opens the listener for the next data connection and returns its port.
+func (c *session) listenPassive() (int, error) {
+	c.closePassive()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	c.passive = listener
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (c *session) reply(code int, message string) {
+	c.write(fmt.Sprintf("%d %s\r\n", code, message))
+}
+
+func (c *session) resolve(p string) string {
+	if p == "" {
+		return c.cwd
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(c.cwd, p)
+	}
+	return path.Clean(p)
+}
+
+// transfer accepts the data connection opened via PASV or EPSV and calls f with it.
+func (c *session) transfer(f func(net.Conn) error) {
+	if c.passive == nil {
+		c.reply(425, "Use PASV or EPSV first")
+		return
+	}
+	listener := c.passive
+	c.passive = nil
+	defer listener.Close()
+
+	c.reply(150, "Opening data connection")
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		_ = tcpListener.SetDeadline(time.Now().Add(dataTimeout))
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		c.reply(425, "Cannot open data connection")
+		return
+	}
+	if c.protect {
+		conn = tls.Server(conn, c.server.tlsConfig)
+	}
+	err = f(conn)
+	_ = conn.Close()
+	if err != nil {
+		c.reply(426, "Transfer aborted")
+		return
+	}
+	c.reply(226, "Transfer complete")
+}
+
+func (c *session) write(s string) {
+	_, _ = io.WriteString(c.conn, s)
+}
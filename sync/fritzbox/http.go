@@ -0,0 +1,240 @@
+package fritzbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	gosync "sync"
+
+	"github.com/toaster/fritz_sync/retry"
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+const deviceConfigService = "urn:dslforum-org:service:DeviceConfig:1"
+
+// errSessionExpired is returned by the web interface requests if the session ID is not (or no longer) valid.
+var errSessionExpired = errors.New("session expired")
+
+// httpTransport implements the imageTransport via the storage (NAS) functions of the Fritz!Box web interface.
+// The session ID needed for the web interface is obtained via TR-064.
+type httpTransport struct {
+	client       *http.Client
+	deviceConfig *tr064.Adapter
+	retry        retry.Policy
+	webURL       string
+
+	mutex gosync.Mutex
+	sid   string
+}
+
+type nasBrowseResult struct {
+	Directories []struct {
+		Filename string `json:"filename"`
+	} `json:"directories"`
+	Files []struct {
+		Filename string `json:"filename"`
+	} `json:"files"`
+}
+
+func newHTTPTransport(boxURL *url.URL, conn *boxConnection, opts Options) (*httpTransport, error) {
+	deviceConfig, err := conn.client.Service(deviceConfigService)
+	if err != nil {
+		return nil, err
+	}
+
+	webURL := opts.WebURL
+	if webURL == "" {
+		webURL = boxURL.Scheme + "://" + boxURL.Hostname()
+	}
+	return &httpTransport{
+		client:       conn.webClient(),
+		deviceConfig: deviceConfig,
+		retry:        opts.Retry,
+		webURL:       strings.TrimSuffix(webURL, "/"),
+	}, nil
+}
+
+// Close is part of imageTransport interface.
+func (t *httpTransport) Close() error {
+	return nil
+}
+
+// Delete removes a file (part of imageTransport interface).
+func (t *httpTransport) Delete(ctx context.Context, filePath string) error {
+	paths, err := json.Marshal([]string{filePath})
+	if err != nil {
+		return err
+	}
+	return t.withSession(ctx, func(sid string) error {
+		form := url.Values{"sid": {sid}, "c": {"files"}, "a": {"delete"}, "paths": {string(paths)}}
+		_, err := t.post(ctx, "/nas/api/data.lua", "application/x-www-form-urlencoded",
+			strings.NewReader(form.Encode()), false)
+		return err
+	})
+}
+
+// Download reads a file (part of imageTransport interface).
+func (t *httpTransport) Download(ctx context.Context, filePath string) ([]byte, error) {
+	var data []byte
+	err := t.withSession(ctx, func(sid string) error {
+		query := url.Values{
+			"sid":       {sid},
+			"script":    {"/http_file_download.lua"},
+			"cmd":       {"httpdownload"},
+			"cmd_files": {filePath},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			t.webURL+"/nas/cgi-bin/luacgi_notimeout?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		data, err = t.do(req, false)
+		return err
+	})
+	return data, err
+}
+
+// List returns all files and directories in a directory (part of imageTransport interface).
+func (t *httpTransport) List(ctx context.Context, dir string) ([]fileInfo, error) {
+	var result nasBrowseResult
+	err := t.withSession(ctx, func(sid string) error {
+		form := url.Values{"sid": {sid}, "c": {"files"}, "a": {"browse"}, "path": {dir}}
+		body, err := t.post(ctx, "/nas/api/data.lua", "application/x-www-form-urlencoded",
+			strings.NewReader(form.Encode()), false)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(body, &result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	files := make([]fileInfo, 0, len(result.Directories)+len(result.Files))
+	for _, dir := range result.Directories {
+		files = append(files, fileInfo{dir: true, name: dir.Filename})
+	}
+	for _, file := range result.Files {
+		files = append(files, fileInfo{name: file.Filename})
+	}
+	return files, nil
+}
+
+// Parallelism is part of imageTransport interface.
+func (t *httpTransport) Parallelism() int {
+	return 1
+}
+
+// Upload writes a file (part of imageTransport interface).
+func (t *httpTransport) Upload(ctx context.Context, filePath string, data []byte) error {
+	return t.withSession(ctx, func(sid string) error {
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		fields := [][2]string{{"sid", sid}, {"dir", path.Dir(filePath)}, {"ResultScript", "upload.lua"}}
+		for _, field := range fields {
+			if err := w.WriteField(field[0], field[1]); err != nil {
+				return err
+			}
+		}
+		file, err := w.CreateFormFile("UploadFile", path.Base(filePath))
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		_, err = t.post(ctx, "/nas/cgi-bin/nasupload_notimeout", w.FormDataContentType(), body, true)
+		return err
+	})
+}
+
+func (t *httpTransport) post(ctx context.Context, endpoint, contentType string, body io.Reader,
+	htmlResult bool) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.webURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return t.do(req, htmlResult)
+}
+
+// do sends a request and reads the response (see readResponse).
+// Network errors are marked as retryable unless the request was cancelled.
+func (t *httpTransport) do(req *http.Request, htmlResult bool) ([]byte, error) {
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if req.Context().Err() == nil {
+			err = retry.Retryable(err)
+		}
+		return nil, err
+	}
+	return t.readResponse(resp, htmlResult)
+}
+
+// readResponse reads the body of a successful response.
+// Unless htmlResult is true, an HTML response is considered to be the login page of the web interface.
+// Server errors (HTTP 5xx) are marked as retryable.
+func (t *httpTransport) readResponse(resp *http.Response, htmlResult bool) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, retry.Retryable(err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, errSessionExpired
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, retry.Retryable(fmt.Errorf("%s: %s", resp.Request.URL.Path, resp.Status))
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s: %s", resp.Request.URL.Path, resp.Status)
+	case !htmlResult && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"):
+		return nil, errSessionExpired
+	}
+	return body, nil
+}
+
+// sessionID returns the current session ID of the web interface, requesting a new one if necessary.
+func (t *httpTransport) sessionID(ctx context.Context, renew bool) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.sid != "" && !renew {
+		return t.sid, nil
+	}
+	result := struct {
+		SID string `xml:"NewX_AVM-DE_UrlSID"`
+	}{}
+	if err := t.deviceConfig.Perform(ctx, deviceConfigService, "X_AVM-DE_CreateUrlSID", nil, &result); err != nil {
+		return "", fmt.Errorf("cannot create session for the web interface: %v", err)
+	}
+	t.sid = strings.TrimPrefix(result.SID, "sid=")
+	return t.sid, nil
+}
+
+// withSession calls f with a valid session ID. If the session expired, f is called again with a new one.
+// Transient failures of f are retried according to the retry policy. The session is requested via TR-064
+// which retries on its own.
+func (t *httpTransport) withSession(ctx context.Context, f func(sid string) error) error {
+	sid, err := t.sessionID(ctx, false)
+	if err != nil {
+		return err
+	}
+	if err := t.retry.Do(ctx, "HTTP photo transfer", func() error { return f(sid) }); err != errSessionExpired {
+		return err
+	}
+	if sid, err = t.sessionID(ctx, true); err != nil {
+		return err
+	}
+	return t.retry.Do(ctx, "HTTP photo transfer", func() error { return f(sid) })
+}
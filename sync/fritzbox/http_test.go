@@ -0,0 +1,243 @@
+package fritzbox
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/toaster/fritz_sync/retry"
+	"github.com/toaster/fritz_sync/tr064"
+	"github.com/toaster/fritz_sync/tr064/tr064test"
+)
+
+func TestHTTPRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	transport := newTestHTTPTransport(t, box, Options{WebURL: box.URL})
+
+	data := encodeJPEG(t, newTestImage(16, 16))
+	if err := transport.Upload(ctx, "/FRITZ/fonpix/jane", data); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if stored, _ := box.File("/FRITZ/fonpix/jane"); !bytes.Equal(stored, data) {
+		t.Error("the uploaded file differs")
+	}
+	got, err := transport.Download(ctx, "/FRITZ/fonpix/jane")
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("the downloaded file differs")
+	}
+	files, err := transport.List(ctx, "/FRITZ")
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if want := []fileInfo{{dir: true, name: "fonpix"}}; !reflect.DeepEqual(files, want) {
+		t.Errorf("expected %v, got %v", want, files)
+	}
+	files, err = transport.List(ctx, "/FRITZ/fonpix")
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if want := []fileInfo{{name: "jane"}}; !reflect.DeepEqual(files, want) {
+		t.Errorf("expected %v, got %v", want, files)
+	}
+	if err := transport.Delete(ctx, "/FRITZ/fonpix/jane"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if files := box.Files(); len(files) != 0 {
+		t.Errorf("expected no files, got %v", files)
+	}
+
+	if n := countCalls(box, "X_AVM-DE_CreateUrlSID"); n != 1 {
+		t.Errorf("expected the session to be reused, got %d sessions", n)
+	}
+}
+
+func TestHTTPExpiredSession(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	box.AddFile("/FRITZ/fonpix/jane", []byte("photo"))
+	transport := newTestHTTPTransport(t, box, Options{WebURL: box.URL})
+
+	if _, err := transport.Download(ctx, "/FRITZ/fonpix/jane"); err != nil {
+		t.Fatal(err)
+	}
+	box.ExpireSessions()
+	got, err := transport.Download(ctx, "/FRITZ/fonpix/jane")
+	if err != nil {
+		t.Fatalf("an expired session has to be renewed: %v", err)
+	}
+	if string(got) != "photo" {
+		t.Errorf("expected %q, got %q", "photo", got)
+	}
+	if n := countCalls(box, "X_AVM-DE_CreateUrlSID"); n != 2 {
+		t.Errorf("expected 2 sessions, got %d", n)
+	}
+}
+
+func TestHTTPLoginPage(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	box.AddFile("/FRITZ/fonpix/jane", []byte("photo"))
+	// the web interface rejects every session, e.g. because the user lacks the permission for the NAS
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<!DOCTYPE html><html><body>Login</body></html>"))
+	}))
+	defer web.Close()
+	transport := newTestHTTPTransport(t, box, Options{WebURL: web.URL})
+
+	if _, err := transport.Download(context.Background(), "/FRITZ/fonpix/jane"); err != errSessionExpired {
+		t.Errorf("expected the login page to be detected, got %v", err)
+	}
+	if _, err := transport.List(context.Background(), "/FRITZ/fonpix"); err != errSessionExpired {
+		t.Errorf("expected the login page to be detected, got %v", err)
+	}
+	if n := countCalls(box, "X_AVM-DE_CreateUrlSID"); n != 3 {
+		t.Errorf("expected the session to be renewed once per transfer, got %d sessions", n)
+	}
+}
+
+func TestHTTPMissingFile(t *testing.T) {
+	ctx := context.Background()
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	web := newFaultyWebInterface(t, box.URL, 0)
+	transport := newTestHTTPTransport(t, box, Options{WebURL: web.url})
+
+	if _, err := transport.Download(ctx, "/FRITZ/fonpix/missing"); err == nil {
+		t.Error("expected an error for downloading a missing file")
+	}
+	if _, err := transport.List(ctx, "/FRITZ/missing"); err == nil {
+		t.Error("expected an error for listing a missing directory")
+	}
+	if n := web.requests(); n != 2 {
+		t.Errorf("permanent errors must not be retried, got %d requests", n)
+	}
+}
+
+func TestHTTPFailuresAreRetried(t *testing.T) {
+	tests := map[string]struct {
+		failures     int
+		wantErr      bool
+		wantRequests int
+	}{
+		"unavailable once":     {failures: 1, wantRequests: 2},
+		"unavailable twice":    {failures: 2, wantRequests: 3},
+		"unavailable too long": {failures: 3, wantErr: true, wantRequests: 3},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			box := tr064test.NewServer(tr064test.Options{})
+			defer box.Close()
+			box.AddFile("/FRITZ/fonpix/jane", []byte("photo"))
+			web := newFaultyWebInterface(t, box.URL, tt.failures)
+			transport := newTestHTTPTransport(t, box, Options{WebURL: web.url})
+
+			_, err := transport.Download(context.Background(), "/FRITZ/fonpix/jane")
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("unexpected result: %v", err)
+			}
+			if n := web.requests(); n != tt.wantRequests {
+				t.Errorf("expected %d requests, got %d", tt.wantRequests, n)
+			}
+		})
+	}
+}
+
+func TestHTTPSessionFailuresAreRetriedOnce(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	box.AddFile("/FRITZ/fonpix/jane", []byte("photo"))
+	transport := newTestHTTPTransport(t, box, Options{WebURL: box.URL})
+
+	box.FailAction("X_AVM-DE_CreateUrlSID", 3, tr064test.Fault{Code: tr064.ErrActionFailed.Code})
+	if _, err := transport.Download(context.Background(), "/FRITZ/fonpix/jane"); err == nil {
+		t.Fatal("expected an error")
+	}
+	// the TR-064 client retries, the HTTP transport must not repeat the whole sequence
+	if n := countCalls(box, "X_AVM-DE_CreateUrlSID"); n != 3 {
+		t.Errorf("expected 3 attempts to create a session, got %d", n)
+	}
+}
+
+// faultyWebInterface forwards requests to the web interface of a fake Fritz!Box after answering the first
+// requests with 503 Service Unavailable.
+type faultyWebInterface struct {
+	url string
+
+	mutex    gosync.Mutex
+	failures int
+	count    int
+}
+
+func newFaultyWebInterface(t *testing.T, boxURL string, failures int) *faultyWebInterface {
+	t.Helper()
+	target, err := url.Parse(boxURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	web := &faultyWebInterface{failures: failures}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		web.mutex.Lock()
+		web.count++
+		fail := web.count <= web.failures
+		web.mutex.Unlock()
+		if fail {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, req)
+	}))
+	t.Cleanup(server.Close)
+	web.url = server.URL
+	return web
+}
+
+func (w *faultyWebInterface) requests() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.count
+}
+
+func countCalls(box *tr064test.Server, action string) int {
+	n := 0
+	for _, call := range box.Calls() {
+		if call.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestHTTPTransport(t *testing.T, box *tr064test.Server, opts Options) *httpTransport {
+	t.Helper()
+	if opts.Retry.Attempts == 0 {
+		opts.Retry = retry.Policy{Attempts: 3, InitialDelay: time.Millisecond}
+	}
+	boxURL, err := url.Parse(box.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := connect(context.Background(), boxURL, tr064test.DefaultUser, tr064test.DefaultPassword, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := newHTTPTransport(boxURL, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
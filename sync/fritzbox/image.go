@@ -0,0 +1,162 @@
+package fritzbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+
+	// register the decoders for the supported source formats
+	_ "image/gif"
+	_ "image/png"
+)
+
+// ImageOptions configures how contact photos are prepared for the Fritz!Box handsets.
+type ImageOptions struct {
+	// Width is the target width in pixels.
+	Width int
+	// Height is the target height in pixels.
+	Height int
+	// MaxBytes is the maximum size of the encoded JPEG.
+	MaxBytes int
+}
+
+// DefaultImageOptions are used for every zero value field of the ImageOptions passed to NewAdapter.
+var DefaultImageOptions = ImageOptions{
+	Width:    240,
+	Height:   240,
+	MaxBytes: 64 * 1024,
+}
+
+// errUnsupportedImage is returned by transcodeImage if the image format cannot be decoded.
+var errUnsupportedImage = errors.New("unsupported image format")
+
+var jpegQualities = []int{90, 80, 70, 60, 50, 40, 30}
+
+func (o ImageOptions) withDefaults() ImageOptions {
+	if o.Width <= 0 {
+		o.Width = DefaultImageOptions.Width
+	}
+	if o.Height <= 0 {
+		o.Height = DefaultImageOptions.Height
+	}
+	if o.MaxBytes <= 0 {
+		o.MaxBytes = DefaultImageOptions.MaxBytes
+	}
+	return o
+}
+
+// transcodeImage converts a JPEG, PNG or GIF image into a baseline JPEG of the configured size.
+// The image is center-cropped to the target aspect ratio before it is scaled.
+// Images which already match the options are returned unchanged.
+func transcodeImage(data []byte, opts ImageOptions) ([]byte, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	if format == "jpeg" && cfg.Width == opts.Width && cfg.Height == opts.Height &&
+		len(data) <= opts.MaxBytes && isBaselineJPEG(data) {
+		return data, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s image: %v", format, err)
+	}
+	dst := scaleImage(cropImage(src, opts.Width, opts.Height), opts.Width, opts.Height)
+
+	buf := new(bytes.Buffer)
+	for _, quality := range jpegQualities {
+		buf.Reset()
+		if err := jpeg.Encode(buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, fmt.Errorf("cannot encode image: %v", err)
+		}
+		if buf.Len() <= opts.MaxBytes {
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot encode image within %d bytes", opts.MaxBytes)
+}
+
+// cropImage returns the centered part of src which has the aspect ratio width:height.
+func cropImage(src image.Image, width, height int) *image.RGBA {
+	b := src.Bounds()
+	cw, ch := b.Dx(), b.Dy()
+	if cw*height > ch*width {
+		cw = ch * width / height
+	} else {
+		ch = cw * height / width
+	}
+	if cw < 1 {
+		cw = 1
+	}
+	if ch < 1 {
+		ch = 1
+	}
+	x := b.Min.X + (b.Dx()-cw)/2
+	y := b.Min.Y + (b.Dy()-ch)/2
+	cropped := image.NewRGBA(image.Rect(0, 0, cw, ch))
+	// JPEG has no alpha channel, therefore transparent areas become white
+	draw.Draw(cropped, cropped.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(cropped, cropped.Bounds(), src, image.Pt(x, y), draw.Over)
+	return cropped
+}
+
+// scaleImage scales src to width×height by averaging all source pixels covered by a target pixel.
+func scaleImage(src *image.RGBA, width, height int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := (y + 1) * sh / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := (x + 1) * sw / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					i := src.PixOffset(sx, sy)
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					a += int(src.Pix[i+3])
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// isBaselineJPEG reports whether the JPEG data uses a baseline DCT frame.
+func isBaselineJPEG(data []byte) bool {
+	for i := 2; i+3 < len(data); {
+		if data[i] != 0xff {
+			return false
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xc0:
+			return true
+		case marker >= 0xc1 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			return false
+		case marker == 0xda:
+			return false
+		}
+		i += 2 + int(data[i+2])<<8 + int(data[i+3])
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package fritzbox
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestTranscodeImage(t *testing.T) {
+	baseline := encodeJPEG(t, newTestImage(240, 240))
+	progressive, err := ioutil.ReadFile("testdata/progressive.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	progressiveCfg, err := jpeg.DecodeConfig(bytes.NewReader(progressive))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		input      []byte
+		opts       ImageOptions
+		wantWidth  int
+		wantHeight int
+		unchanged  bool
+	}{
+		"matching baseline JPEG is kept": {
+			input:      baseline,
+			opts:       DefaultImageOptions,
+			wantWidth:  240,
+			wantHeight: 240,
+			unchanged:  true,
+		},
+		"baseline JPEG is scaled": {
+			input:      baseline,
+			opts:       ImageOptions{Width: 120, Height: 120, MaxBytes: 64 * 1024},
+			wantWidth:  120,
+			wantHeight: 120,
+		},
+		"progressive JPEG of matching size is re-encoded": {
+			input:      progressive,
+			opts:       ImageOptions{Width: progressiveCfg.Width, Height: progressiveCfg.Height, MaxBytes: 64 * 1024},
+			wantWidth:  progressiveCfg.Width,
+			wantHeight: progressiveCfg.Height,
+		},
+		"PNG is converted": {
+			input:      encodePNG(t, newTestImage(300, 200)),
+			opts:       DefaultImageOptions,
+			wantWidth:  240,
+			wantHeight: 240,
+		},
+		"non-square target": {
+			input:      encodePNG(t, newTestImage(300, 300)),
+			opts:       ImageOptions{Width: 200, Height: 100, MaxBytes: 64 * 1024},
+			wantWidth:  200,
+			wantHeight: 100,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			output, err := transcodeImage(tt.input, tt.opts)
+			if err != nil {
+				t.Fatalf("transcodeImage failed: %v", err)
+			}
+			if tt.unchanged && !bytes.Equal(output, tt.input) {
+				t.Error("expected the image to be returned unchanged")
+			}
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(output))
+			if err != nil {
+				t.Fatalf("cannot decode result: %v", err)
+			}
+			if format != "jpeg" || cfg.Width != tt.wantWidth || cfg.Height != tt.wantHeight {
+				t.Errorf("expected %dx%d jpeg, got %dx%d %s", tt.wantWidth, tt.wantHeight, cfg.Width, cfg.Height, format)
+			}
+			if !isBaselineJPEG(output) {
+				t.Error("expected a baseline JPEG")
+			}
+			if len(output) > tt.opts.MaxBytes {
+				t.Errorf("result has %d bytes, limit is %d", len(output), tt.opts.MaxBytes)
+			}
+		})
+	}
+}
+
+func TestTranscodeImageSizeLimit(t *testing.T) {
+	noise := image.NewRGBA(image.Rect(0, 0, 240, 240))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+	input := encodePNG(t, noise)
+
+	unlimited, err := transcodeImage(input, ImageOptions{Width: 240, Height: 240, MaxBytes: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := len(unlimited) * 2 / 3
+	limited, err := transcodeImage(input, ImageOptions{Width: 240, Height: 240, MaxBytes: limit})
+	if err != nil {
+		t.Fatalf("lower quality should fit into %d bytes: %v", limit, err)
+	}
+	if len(limited) > limit {
+		t.Errorf("result has %d bytes, limit is %d", len(limited), limit)
+	}
+
+	if _, err := transcodeImage(input, ImageOptions{Width: 240, Height: 240, MaxBytes: 100}); err == nil {
+		t.Error("expected an error if the image cannot be encoded within the limit")
+	}
+}
+
+func TestTranscodeImageUnsupported(t *testing.T) {
+	for name, input := range map[string][]byte{
+		"empty":     nil,
+		"text":      []byte("this is not an image"),
+		"truncated": encodePNG(t, newTestImage(10, 10))[:20],
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := transcodeImage(input, DefaultImageOptions); err != errUnsupportedImage {
+				t.Errorf("expected errUnsupportedImage, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCropImage(t *testing.T) {
+	tests := map[string]struct {
+		src           image.Rectangle
+		width, height int
+		want          image.Rectangle // the cropped part of src
+	}{
+		"landscape to square": {image.Rect(0, 0, 300, 100), 240, 240, image.Rect(100, 0, 200, 100)},
+		"portrait to square":  {image.Rect(0, 0, 100, 300), 240, 240, image.Rect(0, 100, 100, 200)},
+		"square to landscape": {image.Rect(0, 0, 200, 200), 200, 100, image.Rect(0, 50, 200, 150)},
+		"matching ratio":      {image.Rect(0, 0, 120, 60), 240, 120, image.Rect(0, 0, 120, 60)},
+		"offset bounds":       {image.Rect(10, 20, 310, 120), 1, 1, image.Rect(110, 20, 210, 120)},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := newTestImage(tt.src.Dx(), tt.src.Dy())
+			src.Rect = tt.src
+			cropped := cropImage(src, tt.width, tt.height)
+			if cropped.Bounds().Dx() != tt.want.Dx() || cropped.Bounds().Dy() != tt.want.Dy() {
+				t.Fatalf("expected %dx%d, got %v", tt.want.Dx(), tt.want.Dy(), cropped.Bounds())
+			}
+			for _, p := range []image.Point{{0, 0}, {tt.want.Dx() - 1, tt.want.Dy() - 1}} {
+				if got, want := cropped.At(p.X, p.Y), src.At(tt.want.Min.X+p.X, tt.want.Min.Y+p.Y); got != want {
+					t.Errorf("pixel %v: expected %v, got %v", p, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCropImageTransparency(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	cropped := cropImage(src, 1, 1)
+	if got := cropped.RGBAAt(0, 0); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("transparent pixels have to become white, got %v", got)
+	}
+}
+
+func TestScaleImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			src.Set(x, y, color.RGBA{uint8(x * 60), uint8(y * 100), 0, 255})
+		}
+	}
+
+	down := scaleImage(src, 2, 1)
+	if got, want := down.RGBAAt(0, 0), (color.RGBA{30, 50, 0, 255}); got != want {
+		t.Errorf("downscaling has to average the source pixels: expected %v, got %v", want, got)
+	}
+	if got, want := down.RGBAAt(1, 0), (color.RGBA{150, 50, 0, 255}); got != want {
+		t.Errorf("downscaling has to average the source pixels: expected %v, got %v", want, got)
+	}
+
+	up := scaleImage(src, 8, 4)
+	if got, want := up.RGBAAt(7, 3), src.RGBAAt(3, 1); got != want {
+		t.Errorf("upscaling has to repeat the source pixels: expected %v, got %v", want, got)
+	}
+}
+
+func TestIsBaselineJPEG(t *testing.T) {
+	progressive, err := ioutil.ReadFile("testdata/progressive.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline := encodeJPEG(t, newTestImage(16, 16))
+	tests := map[string]struct {
+		data []byte
+		want bool
+	}{
+		"baseline":    {baseline, true},
+		"progressive": {progressive, false},
+		"PNG":         {encodePNG(t, newTestImage(16, 16)), false},
+		"truncated":   {baseline[:4], false},
+		"empty":       {nil, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := isBaselineJPEG(tt.data); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// newTestImage returns an image with a horizontal and a vertical gradient, i.e. with distinct pixels.
+func newTestImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
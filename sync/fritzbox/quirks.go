@@ -0,0 +1,176 @@
+package fritzbox
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// Firmware identifies the model and the Fritz!OS version of a Fritz!Box.
+// Major and Minor are 0 if the Fritz!Box does not report its version.
+type Firmware struct {
+	// Model is the model name, e.g. “FRITZ!Box 7590”.
+	Model string
+	// Major is the major Fritz!OS version, e.g. 7 for Fritz!OS 7.20.
+	Major int
+	// Minor is the minor Fritz!OS version, e.g. 20 for Fritz!OS 7.20.
+	Minor int
+	// Display is the full version string reported by the Fritz!Box, e.g. “154.07.20” (hardware, major, minor).
+	Display string
+}
+
+// Quirks describes the version specific behaviour of a Fritz!Box.
+type Quirks struct {
+	// BulkImport is true if the Fritz!Box can import a whole phonebook at once.
+	BulkImport bool
+	// EndOfListCodes are the UPnP error codes GetPhonebookEntry returns after the last entry.
+	EndOfListCodes []int
+	// MaxEntries is the maximum amount of entries of a phonebook (0 if unknown).
+	// Add refuses to exceed it, so the quirkTable must only set documented limits.
+	MaxEntries int
+	// UnstableTLSUpload is true if FTP uploads via TLS fail regularly.
+	UnstableTLSUpload bool
+}
+
+// quirk modifies the default Quirks for all Fritz!Boxes matching model and version range.
+// Quirks with a version range never apply to Fritz!Boxes which do not report their version.
+type quirk struct {
+	// model is the model the quirk applies to ("" for all models).
+	model string
+	// from is the first Fritz!OS version the quirk applies to (major, minor).
+	from [2]int
+	// to is the last Fritz!OS version the quirk applies to (major, minor; 0, 0 for no limit).
+	to [2]int
+	// apply modifies the quirks.
+	apply func(*Quirks)
+}
+
+// defaultQuirks are the quirks of a Fritz!Box no entry of the quirkTable applies to.
+var defaultQuirks = Quirks{
+	EndOfListCodes: []int{tr064.ErrSpecifiedArrayIndexInvalid.Code},
+}
+
+// quirkTable contains all known version specific behaviour.
+// Every entry which matches a Fritz!Box is applied in order.
+var quirkTable = []quirk{
+	{
+		// the phonebook import of the web interface (PhonebookImportFile) replaces a phonebook by an XML export
+		from:  [2]int{7, 0},
+		apply: func(q *Quirks) { q.BulkImport = true },
+	},
+	{
+		model: "FRITZ!Box 7590",
+		from:  [2]int{7, 20},
+		apply: func(q *Quirks) {
+			// returns 820 (internal) instead of 713 (invalid index)
+			q.EndOfListCodes = append(q.EndOfListCodes, tr064.ErrInternalError.Code)
+		},
+	},
+	{
+		from:  [2]int{7, 20},
+		to:    [2]int{7, 20},
+		apply: func(q *Quirks) { q.UnstableTLSUpload = true },
+	},
+}
+
+// firmwareFromDescription extracts the firmware information from a TR-064 description.
+// A Fritz!Box reports e.g. Fritz!OS 7.29 as Major 154 (the hardware), Minor 7 and Patch 29
+// and as Display “154.07.29”. Labor versions append the build to Display, e.g. “154.07.39-101390”.
+func firmwareFromDescription(desc *tr064.Description) Firmware {
+	firmware := Firmware{Model: desc.Device.Name, Display: desc.SystemVersion.Display}
+	if major, minor, ok := parseDisplayVersion(desc.SystemVersion.Display); ok {
+		firmware.Major, firmware.Minor = major, minor
+	} else if desc.SystemVersion.Minor > 0 {
+		firmware.Major, firmware.Minor = desc.SystemVersion.Minor, desc.SystemVersion.Patch
+	}
+	return firmware
+}
+
+// String returns the model and the Fritz!OS version.
+func (f Firmware) String() string {
+	if !f.known() {
+		return fmt.Sprintf("%s (unknown Fritz!OS version)", f.Model)
+	}
+	return fmt.Sprintf("%s (Fritz!OS %d.%02d)", f.Model, f.Major, f.Minor)
+}
+
+func (f Firmware) known() bool {
+	return f.Major > 0
+}
+
+// quirksFor returns the quirks of a Fritz!Box according to the quirkTable.
+func quirksFor(firmware Firmware) Quirks {
+	q := defaultQuirks
+	q.EndOfListCodes = append([]int(nil), defaultQuirks.EndOfListCodes...)
+	for _, entry := range quirkTable {
+		if entry.matches(firmware) {
+			entry.apply(&q)
+		}
+	}
+	return q
+}
+
+func (q quirk) matches(firmware Firmware) bool {
+	if q.model != "" && q.model != firmware.Model {
+		return false
+	}
+	if q.from == [2]int{0, 0} && q.to == [2]int{0, 0} {
+		return true
+	}
+	if !firmware.known() {
+		return false
+	}
+	version := [2]int{firmware.Major, firmware.Minor}
+	if compareVersions(version, q.from) < 0 {
+		return false
+	}
+	return q.to == [2]int{0, 0} || compareVersions(version, q.to) <= 0
+}
+
+// isEndOfList reports whether err is the UPnP error signalling the end of a phonebook.
+func (q Quirks) isEndOfList(err error) bool {
+	var terr *tr064.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	for _, code := range q.EndOfListCodes {
+		if terr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func compareVersions(a, b [2]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] - b[i]
+		}
+	}
+	return 0
+}
+
+// parseDisplayVersion extracts the Fritz!OS version from a display version like “154.07.29”.
+func parseDisplayVersion(display string) (int, int, bool) {
+	parts := strings.SplitN(display, ".", 3)
+	if len(parts) != 3 {
+		return 0, 0, false
+	}
+	minorPart := parts[2]
+	if end := strings.IndexFunc(minorPart, func(r rune) bool { return !unicode.IsDigit(r) }); end >= 0 {
+		minorPart = minorPart[:end]
+	}
+	major, err := strconv.Atoi(parts[1])
+	if err != nil || major <= 0 {
+		return 0, 0, false
+	}
+	minor, err := strconv.Atoi(minorPart)
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
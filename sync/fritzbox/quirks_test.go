@@ -0,0 +1,94 @@
+package fritzbox
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+func TestQuirksFromDescription(t *testing.T) {
+	tests := []struct {
+		description string
+		firmware    Firmware
+		quirks      Quirks
+	}{
+		{
+			description: "tr64desc-7590-07.29.xml",
+			firmware:    Firmware{Model: "FRITZ!Box 7590", Major: 7, Minor: 29, Display: "154.07.29"},
+			quirks:      Quirks{BulkImport: true, EndOfListCodes: []int{713, 820}},
+		},
+		{
+			description: "tr64desc-7590-07.20.xml",
+			firmware:    Firmware{Model: "FRITZ!Box 7590", Major: 7, Minor: 20, Display: "154.07.20"},
+			quirks:      Quirks{BulkImport: true, EndOfListCodes: []int{713, 820}, UnstableTLSUpload: true},
+		},
+		{
+			description: "tr64desc-7590-labor.xml",
+			firmware:    Firmware{Model: "FRITZ!Box 7590", Major: 7, Minor: 39, Display: "154.07.39-101390"},
+			quirks:      Quirks{BulkImport: true, EndOfListCodes: []int{713, 820}},
+		},
+		{
+			description: "tr64desc-7490-07.20.xml",
+			firmware:    Firmware{Model: "FRITZ!Box 7490", Major: 7, Minor: 20, Display: "113.07.20"},
+			quirks:      Quirks{BulkImport: true, EndOfListCodes: []int{713}, UnstableTLSUpload: true},
+		},
+		{
+			description: "tr64desc-7490-06.83.xml",
+			firmware:    Firmware{Model: "FRITZ!Box 7490", Major: 6, Minor: 83, Display: "113.06.83"},
+			quirks:      Quirks{EndOfListCodes: []int{713}},
+		},
+		{
+			description: "tr64desc-no-systemversion.xml",
+			firmware:    Firmware{Model: "FRITZ!Box 7590"},
+			quirks:      Quirks{EndOfListCodes: []int{713}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			data, err := ioutil.ReadFile("testdata/" + tt.description)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var desc tr064.Description
+			if err := xml.Unmarshal(data, &desc); err != nil {
+				t.Fatal(err)
+			}
+
+			firmware := firmwareFromDescription(&desc)
+			if firmware != tt.firmware {
+				t.Errorf("expected firmware %#v, got %#v", tt.firmware, firmware)
+			}
+			if quirks := quirksFor(firmware); !reflect.DeepEqual(quirks, tt.quirks) {
+				t.Errorf("expected quirks %+v, got %+v", tt.quirks, quirks)
+			}
+		})
+	}
+}
+
+func TestFirmwareFromDescriptionWithoutDisplay(t *testing.T) {
+	var desc tr064.Description
+	desc.Device.Name = "FRITZ!Box 7590"
+	desc.SystemVersion.Major = 154
+	desc.SystemVersion.Minor = 7
+	desc.SystemVersion.Patch = 29
+
+	want := Firmware{Model: "FRITZ!Box 7590", Major: 7, Minor: 29}
+	if firmware := firmwareFromDescription(&desc); firmware != want {
+		t.Errorf("expected %#v, got %#v", want, firmware)
+	}
+}
+
+func TestFirmwareString(t *testing.T) {
+	for firmware, want := range map[Firmware]string{
+		{Model: "FRITZ!Box 7590", Major: 7, Minor: 5}: "FRITZ!Box 7590 (Fritz!OS 7.05)",
+		{Model: "FRITZ!Box 7590"}:                     "FRITZ!Box 7590 (unknown Fritz!OS version)",
+	} {
+		if got := fmt.Sprint(firmware); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
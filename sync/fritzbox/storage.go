@@ -0,0 +1,191 @@
+package fritzbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+const (
+	// fonpixDir is the directory for contact photos relative to the root of a storage.
+	fonpixDir = "/FRITZ/fonpix"
+	// internalStorageName is the name of the internal memory if it is listed as a storage in the NAS root.
+	internalStorageName = "InternerSpeicher"
+	// internalURLPrefix is the image URL prefix for files on the internal memory.
+	internalURLPrefix = "file:///var/InternerSpeicher"
+	// mediaURLPrefix is the image URL prefix for files on USB media (followed by the storage name).
+	mediaURLPrefix = "file:///var/media/ftp"
+)
+
+// storage describes the Fritz!Box storage used for contact photos.
+type storage struct {
+	// internal is true if the storage is the internal memory of the Fritz!Box.
+	internal bool
+	// internalDir is the directory of the internal memory within the NAS root ("" if it is the NAS root itself).
+	internalDir string
+	// name is the name of the storage within the NAS root (e.g. the name of the USB stick).
+	name string
+}
+
+type fritzPhonebooks struct {
+	Contacts []fritzPhonebookEntry `xml:"phonebook>contact"`
+}
+
+// detectStorage determines the storage for contact photos.
+// If name is empty, the storage which is already used by the photos in the given phonebooks is chosen.
+// The phonebooks are fetched with client. Phonebooks which cannot be fetched are skipped with a warning.
+func detectStorage(ctx context.Context, images imageTransport, name string, phonebookURLs []string, client *http.Client,
+	logger *log.Logger) (storage, error) {
+	root, err := images.List(ctx, "/")
+	if err != nil {
+		return storage{}, fmt.Errorf("cannot list Fritz!Box storages: %v", err)
+	}
+	var dirs []string
+	rootIsInternal := false
+	for _, f := range root {
+		if !f.dir {
+			continue
+		}
+		if f.name == "FRITZ" {
+			rootIsInternal = true
+		} else {
+			dirs = append(dirs, f.name)
+		}
+	}
+	s := storage{}
+	if !rootIsInternal {
+		s.internalDir = "/" + internalStorageName
+	}
+
+	if name != "" {
+		if !contains(dirs, name) {
+			return storage{}, fmt.Errorf("Fritz!Box storage “%s” does not exist, available storages: %s",
+				name, strings.Join(dirs, ", "))
+		}
+		s.name = name
+		s.internal = name == internalStorageName
+		return s, nil
+	}
+
+	if used := s.mostUsedStorage(ctx, phonebookURLs, client, logger); used != nil {
+		return *used, nil
+	}
+	if rootIsInternal || contains(dirs, internalStorageName) {
+		s.internal = true
+		if !rootIsInternal {
+			s.name = internalStorageName
+		}
+		return s, nil
+	}
+	if len(dirs) == 0 {
+		return storage{}, fmt.Errorf("the Fritz!Box has no storage for photos")
+	}
+	s.name = dirs[0]
+	return s, nil
+}
+
+// pathForID returns the path of the photo of the contact with the given sync ID within the NAS root.
+func (s storage) pathForID(id string) string {
+	return s.dir() + "/" + id
+}
+
+// dir returns the photo directory within the NAS root.
+func (s storage) dir() string {
+	if s.internal {
+		return s.internalDir + fonpixDir
+	}
+	return "/" + s.name + fonpixDir
+}
+
+// pathForURL returns the path within the NAS root for an image URL.
+func (s storage) pathForURL(imgURL string) string {
+	if strings.Contains(imgURL, "download.lua?") {
+		// the phonebook export uses links to the download script of the web interface
+		if u, err := url.Parse(imgURL); err == nil && u.Query().Get("path") != "" {
+			imgURL = "file://" + u.Query().Get("path")
+		}
+	}
+	if strings.HasPrefix(imgURL, internalURLPrefix) {
+		return s.internalDir + strings.TrimPrefix(imgURL, internalURLPrefix)
+	}
+	return strings.TrimPrefix(imgURL, mediaURLPrefix)
+}
+
+// urlForPath returns the image URL for a path within the NAS root.
+func (s storage) urlForPath(imgPath string) string {
+	if s.internal {
+		return internalURLPrefix + strings.TrimPrefix(imgPath, s.internalDir)
+	}
+	return mediaURLPrefix + imgPath
+}
+
+// String returns a human readable description of the storage.
+func (s storage) String() string {
+	if s.internal {
+		return "internal memory"
+	}
+	return s.name
+}
+
+// mostUsedStorage returns the storage most of the photos of the given phonebooks are stored on.
+func (s storage) mostUsedStorage(ctx context.Context, phonebookURLs []string, client *http.Client,
+	logger *log.Logger) *storage {
+	counts := map[storage]int{}
+	for _, pbURL := range phonebookURLs {
+		var pbs fritzPhonebooks
+		if err := tr064.FetchXMLWith(ctx, client, pbURL, &pbs); err != nil {
+			// the URL contains the session ID
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			warn(logger, "ignoring a phonebook for the storage detection: %v", err)
+			continue
+		}
+		for _, entry := range pbs.Contacts {
+			imgPath := s.pathForURL(entry.Person.ImgURL)
+			i := strings.Index(imgPath, fonpixDir+"/")
+			if i < 0 {
+				continue
+			}
+			used := storage{internalDir: s.internalDir}
+			if strings.HasPrefix(entry.Person.ImgURL, internalURLPrefix) || imgPath[:i] == s.internalDir {
+				used.internal = true
+				used.name = strings.TrimPrefix(s.internalDir, "/")
+			} else {
+				used.name = strings.TrimPrefix(imgPath[:i], "/")
+			}
+			counts[used]++
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	var candidates []storage
+	for candidate := range counts {
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if counts[candidates[i]] != counts[candidates[j]] {
+			return counts[candidates[i]] > counts[candidates[j]]
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	return &candidates[0]
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package fritzbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDetectStorage(t *testing.T) {
+	internalRoot := []fileInfo{{dir: true, name: "FRITZ"}, {dir: true, name: "USB"}}
+	storagesRoot := []fileInfo{{dir: true, name: "InternerSpeicher"}, {dir: true, name: "USB"}}
+	tests := map[string]struct {
+		name      string
+		photos    []string
+		root      []fileInfo
+		want      storage
+		wantDir   string
+		wantError bool
+	}{
+		"internal memory as NAS root": {
+			root:    []fileInfo{{dir: true, name: "FRITZ"}, {name: "readme.txt"}},
+			want:    storage{internal: true},
+			wantDir: "/FRITZ/fonpix",
+		},
+		"internal memory as storage": {
+			root:    storagesRoot,
+			want:    storage{internal: true, internalDir: "/InternerSpeicher", name: "InternerSpeicher"},
+			wantDir: "/InternerSpeicher/FRITZ/fonpix",
+		},
+		"USB only": {
+			root:    []fileInfo{{dir: true, name: "USB"}},
+			want:    storage{internalDir: "/InternerSpeicher", name: "USB"},
+			wantDir: "/USB/FRITZ/fonpix",
+		},
+		"photos on USB": {
+			root: internalRoot,
+			photos: []string{
+				"file:///var/media/ftp/USB/FRITZ/fonpix/1",
+				"file:///var/media/ftp/USB/FRITZ/fonpix/2",
+				"file:///var/InternerSpeicher/FRITZ/fonpix/3",
+			},
+			want:    storage{name: "USB"},
+			wantDir: "/USB/FRITZ/fonpix",
+		},
+		"photos on internal memory": {
+			root:    storagesRoot,
+			photos:  []string{"file:///var/InternerSpeicher/FRITZ/fonpix/1"},
+			want:    storage{internal: true, internalDir: "/InternerSpeicher", name: "InternerSpeicher"},
+			wantDir: "/InternerSpeicher/FRITZ/fonpix",
+		},
+		"photos referenced via download.lua": {
+			root: internalRoot,
+			photos: []string{
+				"https://fritz.box/download.lua?path=/var/media/ftp/USB/FRITZ/fonpix/1",
+				"https://fritz.box/download.lua?path=/var/media/ftp/USB/FRITZ/fonpix/2",
+			},
+			want:    storage{name: "USB"},
+			wantDir: "/USB/FRITZ/fonpix",
+		},
+		"other images are ignored": {
+			root:    internalRoot,
+			photos:  []string{"file:///var/media/ftp/USB/pictures/1"},
+			want:    storage{internal: true},
+			wantDir: "/FRITZ/fonpix",
+		},
+		"configured storage": {
+			name:    "USB",
+			photos:  []string{"file:///var/InternerSpeicher/FRITZ/fonpix/1"},
+			root:    internalRoot,
+			want:    storage{name: "USB"},
+			wantDir: "/USB/FRITZ/fonpix",
+		},
+		"configured internal memory": {
+			name:    "InternerSpeicher",
+			root:    storagesRoot,
+			want:    storage{internal: true, internalDir: "/InternerSpeicher", name: "InternerSpeicher"},
+			wantDir: "/InternerSpeicher/FRITZ/fonpix",
+		},
+		"configured storage does not exist": {
+			name:      "Stick",
+			root:      internalRoot,
+			wantError: true,
+		},
+		"no storage": {
+			root:      []fileInfo{{name: "readme.txt"}},
+			wantError: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			pbURL := servePhonebook(t, tt.photos)
+			s, err := detectStorage(context.Background(), &listingTransport{root: tt.root}, tt.name,
+				[]string{pbURL}, http.DefaultClient, nil)
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, s)
+			}
+			if s.dir() != tt.wantDir {
+				t.Errorf("expected photo directory %s, got %s", tt.wantDir, s.dir())
+			}
+		})
+	}
+}
+
+func TestDetectStorageFailures(t *testing.T) {
+	root := []fileInfo{{dir: true, name: "FRITZ"}, {dir: true, name: "USB"}}
+
+	if _, err := detectStorage(context.Background(), &listingTransport{err: errors.New("530 Login incorrect")}, "",
+		nil, http.DefaultClient, nil); err == nil {
+		t.Error("expected an error if the storages cannot be listed")
+	}
+
+	var logged bytes.Buffer
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	s, err := detectStorage(context.Background(), &listingTransport{root: root}, "",
+		[]string{
+			unreachable.URL + "/phonebook.lua?sid=0123456789abcdef&pbid=1",
+			servePhonebook(t, []string{"file:///var/media/ftp/USB/FRITZ/fonpix/1"}),
+		},
+		http.DefaultClient, log.New(&logged, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (storage{name: "USB"}); s != want {
+		t.Errorf("expected %+v, got %+v", want, s)
+	}
+	if !strings.Contains(logged.String(), "WARNING: ignoring a phonebook") {
+		t.Errorf("expected a warning about the unreachable phonebook, got %q", logged.String())
+	}
+	if strings.Contains(logged.String(), "0123456789abcdef") {
+		t.Errorf("the session ID must not be logged: %q", logged.String())
+	}
+}
+
+func TestStorageURLs(t *testing.T) {
+	internal := storage{internal: true}
+	internalStorage := storage{internal: true, internalDir: "/InternerSpeicher", name: "InternerSpeicher"}
+	usb := storage{name: "USB"}
+	usbWithStorages := storage{internalDir: "/InternerSpeicher", name: "USB"}
+	tests := []struct {
+		storage storage
+		path    string
+		url     string
+	}{
+		{storage: internal, path: "/FRITZ/fonpix/1", url: "file:///var/InternerSpeicher/FRITZ/fonpix/1"},
+		{storage: internalStorage, path: "/InternerSpeicher/FRITZ/fonpix/1", url: "file:///var/InternerSpeicher/FRITZ/fonpix/1"},
+		{storage: usb, path: "/USB/FRITZ/fonpix/1", url: "file:///var/media/ftp/USB/FRITZ/fonpix/1"},
+		{storage: usbWithStorages, path: "/USB/FRITZ/fonpix/1", url: "file:///var/media/ftp/USB/FRITZ/fonpix/1"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%+v", tt.storage), func(t *testing.T) {
+			if got := tt.storage.pathForID("1"); got != tt.path {
+				t.Errorf("expected path %s, got %s", tt.path, got)
+			}
+			if got := tt.storage.urlForPath(tt.path); got != tt.url {
+				t.Errorf("expected URL %s for %s, got %s", tt.url, tt.path, got)
+			}
+			if got := tt.storage.pathForURL(tt.url); got != tt.path {
+				t.Errorf("expected path %s for %s, got %s", tt.path, tt.url, got)
+			}
+		})
+	}
+}
+
+func TestStoragePathForURL(t *testing.T) {
+	tests := map[string]struct {
+		storage storage
+		url     string
+		want    string
+	}{
+		"USB via internal memory": {
+			storage: storage{name: "USB"},
+			url:     "file:///var/InternerSpeicher/USB/FRITZ/fonpix/1",
+			want:    "/USB/FRITZ/fonpix/1",
+		},
+		"download.lua on internal memory": {
+			storage: storage{internal: true},
+			url:     "https://fritz.box/download.lua?path=/var/InternerSpeicher/FRITZ/fonpix/1",
+			want:    "/FRITZ/fonpix/1",
+		},
+		"download.lua on internal memory as storage": {
+			storage: storage{internal: true, internalDir: "/InternerSpeicher", name: "InternerSpeicher"},
+			url:     "http://192.168.178.1/download.lua?path=%2Fvar%2FInternerSpeicher%2FFRITZ%2Ffonpix%2F1",
+			want:    "/InternerSpeicher/FRITZ/fonpix/1",
+		},
+		"download.lua on USB": {
+			storage: storage{name: "USB"},
+			url:     "https://fritz.box/download.lua?path=/var/media/ftp/USB/FRITZ/fonpix/1&sid=0123456789abcdef",
+			want:    "/USB/FRITZ/fonpix/1",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tt.storage.pathForURL(tt.url); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// listingTransport is an imageTransport which only lists the NAS root.
+type listingTransport struct {
+	imageTransport
+	err  error
+	root []fileInfo
+}
+
+func (t *listingTransport) List(_ context.Context, dir string) ([]fileInfo, error) {
+	if dir != "/" {
+		return nil, fmt.Errorf("unexpected directory %s", dir)
+	}
+	return t.root, t.err
+}
+
+// servePhonebook serves a phonebook export with an entry per image URL and returns its URL.
+func servePhonebook(t *testing.T, imgURLs []string) string {
+	t.Helper()
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><phonebooks><phonebook name="Telefonbuch">`)
+	for i, imgURL := range imgURLs {
+		fmt.Fprintf(&body, "<contact><person><realName>%d</realName><imageURL>%s</imageURL></person></contact>",
+			i, strings.ReplaceAll(imgURL, "&", "&amp;"))
+	}
+	body.WriteString("</phonebook></phonebooks>")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write([]byte(body.String()))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/phonebook.lua?sid=0123456789abcdef&pbid=0"
+}
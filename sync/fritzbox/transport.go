@@ -0,0 +1,131 @@
+package fritzbox
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// ImageTransport selects how photos are transferred from and to the Fritz!Box storage.
+type ImageTransport int
+
+// The supported image transports.
+const (
+	// AutoTransport uses FTP if the Fritz!Box accepts FTP logins and HTTP otherwise.
+	AutoTransport ImageTransport = iota
+	// FTPTransport uses FTP (see Options.FTPSecurity).
+	FTPTransport
+	// HTTPTransport uses the storage (NAS) functions of the Fritz!Box web interface.
+	HTTPTransport
+)
+
+// ParseImageTransport parses an image transport: “auto”, “ftp” or “http”.
+func ParseImageTransport(transport string) (ImageTransport, error) {
+	switch transport {
+	case "", "auto":
+		return AutoTransport, nil
+	case "ftp":
+		return FTPTransport, nil
+	case "http":
+		return HTTPTransport, nil
+	}
+	return AutoTransport, fmt.Errorf("unknown image transport “%s”", transport)
+}
+
+// fileInfo describes an entry of a directory listing.
+type fileInfo struct {
+	dir  bool
+	name string
+}
+
+// imageTransport transfers photos from and to the Fritz!Box storage.
+// All paths are absolute paths within the NAS root, e.g. /FRITZ/fonpix/1234.
+type imageTransport interface {
+	// Close releases all resources (e.g. connections) of the transport.
+	Close() error
+	// Delete removes a file.
+	Delete(ctx context.Context, path string) error
+	// Download reads a file.
+	Download(ctx context.Context, path string) ([]byte, error)
+	// List returns all files and directories in a directory.
+	List(ctx context.Context, dir string) ([]fileInfo, error)
+	// Parallelism returns the amount of transfers which may be performed in parallel.
+	Parallelism() int
+	// Upload writes a file.
+	Upload(ctx context.Context, path string, data []byte) error
+}
+
+// boxConnection contains everything needed to access the services of a Fritz!Box.
+type boxConnection struct {
+	client        *tr064.Client
+	pass          string
+	timeout       time.Duration
+	user          string
+	wrapTransport func(http.RoundTripper) http.RoundTripper
+}
+
+// connect loads the TR-064 description of the Fritz!Box at boxURL.
+// If boxURL is an HTTPS URL or opts.HTTPS is set, the connection is encrypted and the certificate is verified
+// according to opts.TLS.
+func connect(ctx context.Context, boxURL *url.URL, user, pass string, opts Options) (*boxConnection, error) {
+	client, err := tr064.NewClient(ctx, boxURL.String(), user, pass, tr064.ClientOptions{
+		HTTPS:         opts.HTTPS,
+		Retry:         opts.Retry,
+		TLS:           opts.TLS,
+		Timeout:       opts.Timeout,
+		WrapTransport: opts.WrapTransport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boxConnection{
+		client:        client,
+		pass:          pass,
+		timeout:       opts.Timeout,
+		user:          user,
+		wrapTransport: opts.WrapTransport,
+	}, nil
+}
+
+// webClient returns an HTTP client for the web interface which trusts the same certificates as the
+// TR-064 connection.
+func (c *boxConnection) webClient() *http.Client {
+	transport := http.DefaultTransport
+	if c.client.TLSConfig() != nil {
+		tlsConfig := c.client.TLSConfig().Clone()
+		// the web interface may be reached via another host name
+		tlsConfig.ServerName = ""
+		transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	}
+	if c.wrapTransport != nil {
+		transport = c.wrapTransport(transport)
+	}
+	return &http.Client{Timeout: c.timeout, Transport: transport}
+}
+
+func newImageTransport(ctx context.Context, boxURL *url.URL, conn *boxConnection, opts Options, quirks Quirks) (imageTransport, error) {
+	if opts.ImageTransport == HTTPTransport {
+		return newHTTPTransport(boxURL, conn, opts)
+	}
+
+	ftpSessions, err := newFTPSessions(boxURL.Hostname(), conn.user, conn.pass, opts, quirks)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ImageTransport == FTPTransport {
+		return ftpSessions, nil
+	}
+
+	if err := ftpSessions.Probe(ctx); err != nil {
+		if opts.Log != nil {
+			opts.Log.Println("FTP is not available, using HTTP for photo transfers:", err)
+		}
+		_ = ftpSessions.Close()
+		return newHTTPTransport(boxURL, conn, opts)
+	}
+	return ftpSessions, nil
+}
@@ -1,10 +1,41 @@
 package sync
 
 import (
+	"context"
+	"errors"
 	"log"
 	"reflect"
 )
 
+// ErrStopped is returned by Sync, Readers and Writers which have been stopped via the stop channel of WithStop.
+var ErrStopped = errors.New("stopped")
+
+type stopKey struct{}
+
+// WithStop returns a copy of ctx which carries the stop channel.
+// Closing the channel makes Sync, Readers and Writers stop before the next contact.
+// Unlike cancelling the context it does not abort the requests which are in progress.
+func WithStop(ctx context.Context, stop <-chan struct{}) context.Context {
+	return context.WithValue(ctx, stopKey{}, stop)
+}
+
+// Stopped returns the context's error if ctx is done, ErrStopped if the stop channel of ctx is closed and nil
+// otherwise.
+// Readers and Writers check it between contacts.
+func Stopped(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if stop, ok := ctx.Value(stopKey{}).(<-chan struct{}); ok {
+		select {
+		case <-stop:
+			return ErrStopped
+		default:
+		}
+	}
+	return nil
+}
+
 // Contact represents a synchronisable contact record.
 type Contact struct {
 	Email    string
@@ -50,17 +81,19 @@ const (
 // Reader provides read access to contacts stored on a backend (e.g. CardDAV or Fritz!Box).
 type Reader interface {
 	// ReadAll reads all contacts, optionally restricted to a list of categories.
-	ReadAll([]string) (map[string]Contact, error)
+	ReadAll(context.Context, []string) (map[string]Contact, error)
 }
 
 // Writer provides write access to contacts stored on a backend (e.g. CardDAV or Fritz!Box).
+// If the context is cancelled or stopped (see WithStop), the methods stop before the next contact and return the
+// error of Stopped.
 type Writer interface {
 	// Add adds all given contacts.
-	Add([]Contact) error
+	Add(context.Context, []Contact) error
 	// Delete removes all given contacts.
-	Delete([]Contact) error
+	Delete(context.Context, []Contact) error
 	// Update updates all given contacts.
-	Update([]Contact) error
+	Update(context.Context, []Contact) error
 }
 
 // ReaderWriter combines read and write access to a contact storage.
@@ -69,12 +102,19 @@ type ReaderWriter interface {
 	Writer
 }
 
+// Normalizer can be implemented by a Writer which stores contacts in a converted form (e.g. with scaled photos).
+type Normalizer interface {
+	// Normalize returns the contact as it would be read back after being written.
+	Normalize(Contact) Contact
+}
+
 // Sync reads all contacts from “from” and adds or updates the appropriate contacts in “to” if necessary.
-func Sync(from []Reader, to ReaderWriter, categories []string, log *log.Logger) error {
+// If ctx is cancelled or stopped (see WithStop), Sync stops before the next operation and returns the error of Stopped.
+func Sync(ctx context.Context, from []Reader, to ReaderWriter, categories []string, log *log.Logger) error {
 	if log != nil {
 		log.Println("Read target records…")
 	}
-	old, err := to.ReadAll([]string{})
+	old, err := to.ReadAll(ctx, []string{})
 	if err != nil {
 		return err
 	}
@@ -87,7 +127,7 @@ func Sync(from []Reader, to ReaderWriter, categories []string, log *log.Logger)
 	}
 	newContacts := map[string]Contact{}
 	for _, r := range from {
-		n, err := r.ReadAll(categories)
+		n, err := r.ReadAll(ctx, categories)
 		if err != nil {
 			return err
 		}
@@ -98,6 +138,15 @@ func Sync(from []Reader, to ReaderWriter, categories []string, log *log.Logger)
 	if log != nil {
 		log.Println("Amount of source records:", len(newContacts))
 	}
+	if normalizer, ok := to.(Normalizer); ok {
+		for k, c := range newContacts {
+			newContacts[k] = normalizer.Normalize(c)
+		}
+	}
+
+	if err := Stopped(ctx); err != nil {
+		return err
+	}
 
 	var toBeDeleted []Contact
 	var toBeAdded []Contact
@@ -125,19 +174,19 @@ func Sync(from []Reader, to ReaderWriter, categories []string, log *log.Logger)
 	if log != nil {
 		log.Println("Delete", len(toBeDeleted), "records…")
 	}
-	if err := to.Delete(toBeDeleted); err != nil {
+	if err := to.Delete(ctx, toBeDeleted); err != nil {
 		return err
 	}
 	if log != nil {
 		log.Println("Update", len(toBeUpdated), "records…")
 	}
-	if err := to.Update(toBeUpdated); err != nil {
+	if err := to.Update(ctx, toBeUpdated); err != nil {
 		return err
 	}
 	if log != nil {
 		log.Println("Add", len(toBeAdded), "records…")
 	}
-	if err := to.Add(toBeAdded); err != nil {
+	if err := to.Add(ctx, toBeAdded); err != nil {
 		return err
 	}
 
@@ -0,0 +1,432 @@
+package synctest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/toaster/fritz_sync/sync"
+)
+
+// SampleContacts are the contacts used by TestReaderWriter. They only use features which all adapters support.
+// The SyncIDs are the IDs of the contacts in the (imaginary) source.
+var SampleContacts = []sync.Contact{
+	{
+		Email:    "ada@example.com",
+		FullName: "Ada Lovelace",
+		Numbers: []sync.PhoneNumber{
+			{Number: "+49301234567", Priority: true, Purpose: sync.Home},
+			{Number: "+491701234567", Type: sync.Cell},
+		},
+		SyncID: "src-1",
+	},
+	{
+		FullName: "Charles Babbage",
+		Numbers:  []sync.PhoneNumber{{Number: "+49307654321", Priority: true, Purpose: sync.Work}},
+		SyncID:   "src-2",
+	},
+	{
+		Email:    "grace@example.com",
+		FullName: "Grace Hopper",
+		Numbers:  []sync.PhoneNumber{{Number: "+494011122233", Priority: true}},
+		SyncID:   "src-3",
+	},
+}
+
+// TestReaderWriter checks whether an adapter behaves as sync.Sync expects:
+//
+//   - contacts are read back with the content and the SyncID they were added with
+//   - every contact gets a non-empty, unique ID which is also its key in the result of ReadAll and which
+//     does not change between reads or by an update
+//   - Delete removes exactly the given contacts; deleting a contact which is already gone does not affect
+//     the others (an error is allowed)
+//   - the Writer methods return the context's error if the context is cancelled
+//   - repeated syncs from a source converge and a sync without changes does not write anything
+//
+// newRW is called for every check and has to return an adapter with an empty storage.
+// If the adapter implements sync.Normalizer, contents are compared after normalization.
+func TestReaderWriter(t *testing.T, newRW func(t *testing.T) sync.ReaderWriter) {
+	t.Run("ReadEmpty", func(t *testing.T) {
+		if contacts := readAll(t, newRW(t)); len(contacts) != 0 {
+			t.Fatalf("a new adapter has to be empty, got %d contacts", len(contacts))
+		}
+	})
+
+	t.Run("AddAndRead", func(t *testing.T) {
+		rw := newRW(t)
+		add(t, rw, SampleContacts...)
+		contacts := readAll(t, rw)
+		if len(contacts) != len(SampleContacts) {
+			t.Fatalf("expected %d contacts after adding, got %d", len(SampleContacts), len(contacts))
+		}
+		expectContents(t, rw, contacts, SampleContacts)
+	})
+
+	t.Run("StableIDs", func(t *testing.T) {
+		rw := newRW(t)
+		add(t, rw, SampleContacts...)
+		first := idsBySyncID(t, readAll(t, rw))
+		second := idsBySyncID(t, readAll(t, rw))
+		if !reflect.DeepEqual(first, second) {
+			t.Fatalf("IDs changed between two reads: %v != %v", first, second)
+		}
+	})
+
+	t.Run("UpdatePreservesIdentity", func(t *testing.T) {
+		rw := newRW(t)
+		add(t, rw, SampleContacts...)
+		before := readAll(t, rw)
+		idsBefore := idsBySyncID(t, before)
+
+		updated := bySyncID(t, before)["src-1"]
+		updated.Email = "ada@example.org"
+		updated.FullName = "Augusta Ada King"
+		updated.Numbers = []sync.PhoneNumber{{Number: "+49309999999", Priority: true, Purpose: sync.Work}}
+		if err := rw.Update(context.Background(), []sync.Contact{updated}); err != nil {
+			t.Fatalf("cannot update contact: %v", err)
+		}
+
+		after := readAll(t, rw)
+		if ids := idsBySyncID(t, after); !reflect.DeepEqual(ids, idsBefore) {
+			t.Fatalf("update changed IDs: %v != %v", ids, idsBefore)
+		}
+		expected := []sync.Contact{updated, SampleContacts[1], SampleContacts[2]}
+		expectContents(t, rw, after, expected)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		rw := newRW(t)
+		add(t, rw, SampleContacts...)
+		before := readAll(t, rw)
+		idsBefore := idsBySyncID(t, before)
+
+		if err := rw.Delete(context.Background(), []sync.Contact{bySyncID(t, before)["src-2"]}); err != nil {
+			t.Fatalf("cannot delete contact: %v", err)
+		}
+
+		after := readAll(t, rw)
+		expectContents(t, rw, after, []sync.Contact{SampleContacts[0], SampleContacts[2]})
+		for syncID, id := range idsBySyncID(t, after) {
+			if id != idsBefore[syncID] {
+				t.Errorf("delete changed the ID of %s: %s != %s", syncID, id, idsBefore[syncID])
+			}
+		}
+	})
+
+	t.Run("DeleteMissing", func(t *testing.T) {
+		rw := newRW(t)
+		add(t, rw, SampleContacts...)
+		deleted := bySyncID(t, readAll(t, rw))["src-2"]
+		if err := rw.Delete(context.Background(), []sync.Contact{deleted}); err != nil {
+			t.Fatalf("cannot delete contact: %v", err)
+		}
+		before := readAll(t, rw)
+
+		if err := rw.Delete(context.Background(), []sync.Contact{deleted}); err != nil {
+			t.Logf("deleting a missing contact failed (allowed): %v", err)
+		}
+
+		after := readAll(t, rw)
+		if !reflect.DeepEqual(idsBySyncID(t, after), idsBySyncID(t, before)) {
+			t.Fatalf("deleting a missing contact changed the other contacts: %v != %v", after, before)
+		}
+		expectContents(t, rw, after, []sync.Contact{SampleContacts[0], SampleContacts[2]})
+	})
+
+	t.Run("CancelledContext", func(t *testing.T) {
+		rw := newRW(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := rw.Add(ctx, SampleContacts); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Add with a cancelled context has to return the context's error, got %v", err)
+		}
+		if contacts := readAll(t, rw); len(contacts) != 0 {
+			t.Fatalf("Add with a cancelled context must not add contacts, got %d", len(contacts))
+		}
+	})
+
+	t.Run("Stopped", func(t *testing.T) {
+		rw := newRW(t)
+		stop := make(chan struct{})
+		close(stop)
+		if err := rw.Add(sync.WithStop(context.Background(), stop), SampleContacts); err != sync.ErrStopped {
+			t.Fatalf("Add after a stop has to return ErrStopped, got %v", err)
+		}
+		if contacts := readAll(t, rw); len(contacts) != 0 {
+			t.Fatalf("Add after a stop must not add contacts, got %d", len(contacts))
+		}
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		ctx := context.Background()
+		target := &countingWriter{ReaderWriter: newRW(t)}
+		source := NewMemory()
+		for _, contact := range sourceContacts() {
+			source.Put(contact)
+		}
+
+		if err := sync.Sync(ctx, []sync.Reader{source}, target, nil, nil); err != nil {
+			t.Fatalf("initial sync failed: %v", err)
+		}
+		contacts := readAll(t, target)
+		expectContents(t, target, contacts, SampleContacts)
+		ids := idsBySyncID(t, contacts)
+
+		target.reset()
+		if err := sync.Sync(ctx, []sync.Reader{source}, target, nil, nil); err != nil {
+			t.Fatalf("repeated sync failed: %v", err)
+		}
+		if target.added+target.deleted+target.updated > 0 {
+			t.Fatalf("a sync without changes must not write anything, got %d added, %d updated, %d deleted",
+				target.added, target.updated, target.deleted)
+		}
+
+		changed := SampleContacts[0]
+		changed.FullName = "Augusta Ada King"
+		changed.ID = changed.SyncID
+		changed.SyncID = ""
+		source.Put(changed)
+		if err := source.Delete(ctx, []sync.Contact{{ID: "src-2"}}); err != nil {
+			t.Fatalf("cannot delete source contact: %v", err)
+		}
+		source.Put(sync.Contact{FullName: "Alan Turing", ID: "src-4",
+			Numbers: []sync.PhoneNumber{{Number: "+441234567890", Priority: true}}})
+		if err := sync.Sync(ctx, []sync.Reader{source}, target, nil, nil); err != nil {
+			t.Fatalf("sync of changes failed: %v", err)
+		}
+
+		contacts = readAll(t, target)
+		changed.SyncID = "src-1"
+		expectContents(t, target, contacts, []sync.Contact{
+			changed,
+			SampleContacts[2],
+			{FullName: "Alan Turing", Numbers: []sync.PhoneNumber{{Number: "+441234567890", Priority: true}},
+				SyncID: "src-4"},
+		})
+		if id := idsBySyncID(t, contacts)["src-1"]; id != ids["src-1"] {
+			t.Errorf("sync changed the ID of an updated contact: %s != %s", id, ids["src-1"])
+		}
+	})
+}
+
+// TestReader checks whether a read-only adapter (e.g. a sync source) behaves as sync.Sync expects:
+//
+//   - contacts are read with their IDs and contents; the IDs are also their keys in the result of ReadAll
+//   - the IDs do not change between reads
+//   - ReadAll returns the context's error if the context is cancelled
+//   - a sync from the adapter into a Memory transfers all contacts with their IDs as SyncIDs
+//
+// newReader is called for every check and has to return an adapter providing exactly the given contacts
+// under their IDs (e.g. as vCard UIDs).
+func TestReader(t *testing.T, newReader func(t *testing.T, contacts []sync.Contact) sync.Reader) {
+	t.Run("ReadAll", func(t *testing.T) {
+		contacts := readAll(t, newReader(t, sourceContacts()))
+		expectSourceContents(t, contacts, sourceContacts())
+	})
+
+	t.Run("StableIDs", func(t *testing.T) {
+		r := newReader(t, sourceContacts())
+		first := readAll(t, r)
+		second := readAll(t, r)
+		if !reflect.DeepEqual(contactIDs(first), contactIDs(second)) {
+			t.Fatalf("IDs changed between two reads: %v != %v", contactIDs(first), contactIDs(second))
+		}
+	})
+
+	t.Run("CancelledContext", func(t *testing.T) {
+		r := newReader(t, sourceContacts())
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := r.ReadAll(ctx, nil); !errors.Is(err, context.Canceled) {
+			t.Fatalf("ReadAll with a cancelled context has to return the context's error, got %v", err)
+		}
+	})
+
+	t.Run("Stopped", func(t *testing.T) {
+		r := newReader(t, sourceContacts())
+		stop := make(chan struct{})
+		close(stop)
+		if _, err := r.ReadAll(sync.WithStop(context.Background(), stop), nil); err != sync.ErrStopped {
+			t.Fatalf("ReadAll after a stop has to return ErrStopped, got %v", err)
+		}
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		target := NewMemory()
+		err := sync.Sync(context.Background(), []sync.Reader{newReader(t, sourceContacts())}, target, nil, nil)
+		if err != nil {
+			t.Fatalf("sync failed: %v", err)
+		}
+		expectContents(t, target, readAll(t, target), SampleContacts)
+	})
+}
+
+// countingWriter counts the contacts written to a sync.ReaderWriter.
+type countingWriter struct {
+	sync.ReaderWriter
+	added   int
+	deleted int
+	updated int
+}
+
+// Add is part of the sync.Writer interface.
+func (w *countingWriter) Add(ctx context.Context, contacts []sync.Contact) error {
+	w.added += len(contacts)
+	return w.ReaderWriter.Add(ctx, contacts)
+}
+
+// Delete is part of the sync.Writer interface.
+func (w *countingWriter) Delete(ctx context.Context, contacts []sync.Contact) error {
+	w.deleted += len(contacts)
+	return w.ReaderWriter.Delete(ctx, contacts)
+}
+
+// Normalize is part of the sync.Normalizer interface. It delegates to the wrapped adapter if it is a normalizer.
+func (w *countingWriter) Normalize(contact sync.Contact) sync.Contact {
+	return normalize(w.ReaderWriter, contact)
+}
+
+// Update is part of the sync.Writer interface.
+func (w *countingWriter) Update(ctx context.Context, contacts []sync.Contact) error {
+	w.updated += len(contacts)
+	return w.ReaderWriter.Update(ctx, contacts)
+}
+
+func (w *countingWriter) reset() {
+	w.added, w.deleted, w.updated = 0, 0, 0
+}
+
+// add adds contacts without IDs like sync.Sync does.
+func add(t *testing.T, rw sync.ReaderWriter, contacts ...sync.Contact) {
+	t.Helper()
+	var toBeAdded []sync.Contact
+	for _, contact := range contacts {
+		contact.ID = ""
+		toBeAdded = append(toBeAdded, contact)
+	}
+	if err := rw.Add(context.Background(), toBeAdded); err != nil {
+		t.Fatalf("cannot add contacts: %v", err)
+	}
+}
+
+// bySyncID indexes contacts by their SyncID. Contacts without SyncID or with duplicate ones are errors.
+func bySyncID(t *testing.T, contacts map[string]sync.Contact) map[string]sync.Contact {
+	t.Helper()
+	result := map[string]sync.Contact{}
+	for _, contact := range contacts {
+		if contact.SyncID == "" {
+			t.Fatalf("contact %s was read without SyncID", contact.ID)
+		}
+		if other, exists := result[contact.SyncID]; exists {
+			t.Fatalf("contacts %s and %s have the same SyncID %s", other.ID, contact.ID, contact.SyncID)
+		}
+		result[contact.SyncID] = contact
+	}
+	return result
+}
+
+// contactIDs returns the sorted IDs of contacts.
+func contactIDs(contacts map[string]sync.Contact) []string {
+	ids := make([]string, 0, len(contacts))
+	for id := range contacts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// expectContents checks that contacts contain exactly the expected contacts (identified by their SyncIDs)
+// with the expected contents.
+func expectContents(t *testing.T, rw sync.ReaderWriter, contacts map[string]sync.Contact, expected []sync.Contact) {
+	t.Helper()
+	actual := bySyncID(t, contacts)
+	if len(actual) != len(expected) {
+		t.Errorf("expected %d contacts, got %d: %v", len(expected), len(actual), contacts)
+	}
+	for _, want := range expected {
+		got, ok := actual[want.SyncID]
+		if !ok {
+			t.Errorf("contact with SyncID %s is missing", want.SyncID)
+			continue
+		}
+		want = normalize(rw, want)
+		if !sameContent(got, want) {
+			t.Errorf("contact with SyncID %s differs:\n got: %+v\nwant: %+v", want.SyncID, got, want)
+		}
+	}
+}
+
+// expectSourceContents checks that contacts contain exactly the expected contacts (identified by their IDs)
+// with the expected contents.
+func expectSourceContents(t *testing.T, contacts map[string]sync.Contact, expected []sync.Contact) {
+	t.Helper()
+	if len(contacts) != len(expected) {
+		t.Errorf("expected %d contacts, got %d: %v", len(expected), len(contacts), contacts)
+	}
+	for _, want := range expected {
+		got, ok := contacts[want.ID]
+		if !ok {
+			t.Errorf("contact with ID %s is missing", want.ID)
+			continue
+		}
+		if !sameContent(got, want) {
+			t.Errorf("contact with ID %s differs:\n got: %+v\nwant: %+v", want.ID, got, want)
+		}
+	}
+}
+
+// idsBySyncID returns the IDs of the contacts indexed by their SyncIDs.
+func idsBySyncID(t *testing.T, contacts map[string]sync.Contact) map[string]string {
+	t.Helper()
+	ids := map[string]string{}
+	for syncID, contact := range bySyncID(t, contacts) {
+		ids[syncID] = contact.ID
+	}
+	return ids
+}
+
+func normalize(rw sync.ReaderWriter, contact sync.Contact) sync.Contact {
+	if normalizer, ok := rw.(sync.Normalizer); ok {
+		return normalizer.Normalize(contact)
+	}
+	return contact
+}
+
+// readAll reads all contacts and checks that they are keyed by unique, non-empty IDs.
+func readAll(t *testing.T, r sync.Reader) map[string]sync.Contact {
+	t.Helper()
+	contacts, err := r.ReadAll(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("cannot read contacts: %v", err)
+	}
+	for key, contact := range contacts {
+		if contact.ID == "" {
+			t.Fatalf("contact %+v was read without ID", contact)
+		}
+		if key != contact.ID {
+			t.Fatalf("contact %s is keyed by %s instead of its ID", contact.ID, key)
+		}
+	}
+	return contacts
+}
+
+// sourceContacts returns the SampleContacts as a source provides them: with their SyncIDs as IDs.
+func sourceContacts() []sync.Contact {
+	contacts := make([]sync.Contact, 0, len(SampleContacts))
+	for _, contact := range SampleContacts {
+		contact.ID = contact.SyncID
+		contact.SyncID = ""
+		contacts = append(contacts, contact)
+	}
+	return contacts
+}
+
+// sameContent compares contacts like sync.Sync does to decide whether a contact has to be updated.
+func sameContent(a, b sync.Contact) bool {
+	return a.Email == b.Email &&
+		a.FullName == b.FullName &&
+		a.Image == b.Image &&
+		((len(a.Numbers) == 0 && len(b.Numbers) == 0) || reflect.DeepEqual(a.Numbers, b.Numbers))
+}
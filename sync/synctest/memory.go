@@ -0,0 +1,169 @@
+// Package synctest provides helpers for testing sync adapters and the sync engine: an in-memory reference
+// adapter and a conformance test suite for implementations of sync.ReaderWriter.
+package synctest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	gosync "sync"
+
+	"github.com/toaster/fritz_sync/sync"
+)
+
+// ErrNotFound is returned by Memory if a contact to update or delete does not exist.
+var ErrNotFound = errors.New("contact not found")
+
+// Memory is an in-memory contact storage implementing sync.ReaderWriter.
+// It can be used as source and as target in tests of the sync engine. It is safe for concurrent use.
+type Memory struct {
+	mutex    gosync.Mutex
+	contacts map[string]memoryEntry
+	nextID   int
+}
+
+type memoryEntry struct {
+	categories []string
+	contact    sync.Contact
+}
+
+// NewMemory creates an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{contacts: map[string]memoryEntry{}, nextID: 1}
+}
+
+// Add adds all given contacts with new IDs (part of sync.Writer interface).
+func (m *Memory) Add(ctx context.Context, contacts []sync.Contact) error {
+	for _, contact := range contacts {
+		if err := sync.Stopped(ctx); err != nil {
+			return err
+		}
+		m.mutex.Lock()
+		contact.ID = m.newID()
+		m.contacts[contact.ID] = memoryEntry{contact: copyContact(contact)}
+		m.mutex.Unlock()
+	}
+	return nil
+}
+
+// Contacts returns all contacts ordered by ID.
+func (m *Memory) Contacts() []sync.Contact {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	contacts := make([]sync.Contact, 0, len(m.contacts))
+	for _, entry := range m.contacts {
+		contacts = append(contacts, copyContact(entry.contact))
+	}
+	sort.Slice(contacts, func(i, j int) bool { return lessID(contacts[i].ID, contacts[j].ID) })
+	return contacts
+}
+
+// Delete removes all given contacts (part of sync.Writer interface).
+// It fails with ErrNotFound for a contact which does not exist; the contacts before it are removed anyway.
+func (m *Memory) Delete(ctx context.Context, contacts []sync.Contact) error {
+	for _, contact := range contacts {
+		if err := sync.Stopped(ctx); err != nil {
+			return err
+		}
+		m.mutex.Lock()
+		_, ok := m.contacts[contact.ID]
+		delete(m.contacts, contact.ID)
+		m.mutex.Unlock()
+		if !ok {
+			return fmt.Errorf("cannot delete contact %s: %w", contact.ID, ErrNotFound)
+		}
+	}
+	return nil
+}
+
+// Put stores a contact with the given categories as it is, i.e. without assigning a new ID.
+// If the contact has no ID, a new one is assigned. Put returns the ID of the contact.
+func (m *Memory) Put(contact sync.Contact, categories ...string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if contact.ID == "" {
+		contact.ID = m.newID()
+	}
+	m.contacts[contact.ID] = memoryEntry{
+		categories: append([]string(nil), categories...),
+		contact:    copyContact(contact),
+	}
+	return contact.ID
+}
+
+// ReadAll reads all contacts, optionally restricted to a list of categories (part of sync.Reader interface).
+func (m *Memory) ReadAll(ctx context.Context, categories []string) (map[string]sync.Contact, error) {
+	if err := sync.Stopped(ctx); err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	contacts := map[string]sync.Contact{}
+	for id, entry := range m.contacts {
+		if len(categories) == 0 || intersect(entry.categories, categories) {
+			contacts[id] = copyContact(entry.contact)
+		}
+	}
+	return contacts, nil
+}
+
+// Update updates all given contacts (part of sync.Writer interface).
+// It fails with ErrNotFound for a contact which does not exist; the contacts before it are updated anyway.
+func (m *Memory) Update(ctx context.Context, contacts []sync.Contact) error {
+	for _, contact := range contacts {
+		if err := sync.Stopped(ctx); err != nil {
+			return err
+		}
+		m.mutex.Lock()
+		entry, ok := m.contacts[contact.ID]
+		if ok {
+			entry.contact = copyContact(contact)
+			m.contacts[contact.ID] = entry
+		}
+		m.mutex.Unlock()
+		if !ok {
+			return fmt.Errorf("cannot update contact %s: %w", contact.ID, ErrNotFound)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) newID() string {
+	for {
+		id := strconv.Itoa(m.nextID)
+		m.nextID++
+		if _, exists := m.contacts[id]; !exists {
+			return id
+		}
+	}
+}
+
+func copyContact(contact sync.Contact) sync.Contact {
+	if contact.Numbers != nil {
+		contact.Numbers = append([]sync.PhoneNumber{}, contact.Numbers...)
+	}
+	return contact
+}
+
+func intersect(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lessID orders numeric IDs numerically and all other IDs alphabetically.
+func lessID(a, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	return a < b
+}
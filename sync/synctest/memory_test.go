@@ -0,0 +1,22 @@
+package synctest_test
+
+import (
+	"testing"
+
+	"github.com/toaster/fritz_sync/sync"
+	"github.com/toaster/fritz_sync/sync/synctest"
+)
+
+func TestMemory(t *testing.T) {
+	synctest.TestReaderWriter(t, func(*testing.T) sync.ReaderWriter { return synctest.NewMemory() })
+}
+
+func TestMemoryAsSource(t *testing.T) {
+	synctest.TestReader(t, func(_ *testing.T, contacts []sync.Contact) sync.Reader {
+		m := synctest.NewMemory()
+		for _, contact := range contacts {
+			m.Put(contact)
+		}
+		return m
+	})
+}
@@ -1,19 +1,45 @@
 package tr064
 
 import (
+	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/huin/goupnp/soap"
-	"github.com/toaster/digest"
+
+	"github.com/toaster/fritz_sync/retry"
 )
 
 // Adapter is a generic TR064 adapter.
 type Adapter struct {
-	httpClient *http.Client
-	soapClient *soap.SOAPClient
+	httpClient  *http.Client
+	retryPolicy retry.Policy
+	soapClient  *soap.SOAPClient
+	timeout     time.Duration
+	trace       io.Writer
+}
+
+// contextTransport binds all requests to a context.
+// It is needed because the SOAP client does not support contexts.
+// It also records the outcome of the last request for classifying errors.
+type contextTransport struct {
+	ctx       context.Context
+	trace     io.Writer
+	transport http.RoundTripper
+
+	err    error
+	status int
 }
 
 // UnknownXML collects unexpected XML into a string.
@@ -57,7 +83,8 @@ type Service struct {
 	Unknown     []UnknownXML `xml:",any"`
 }
 
-type device struct {
+// Device describes a TR064 device, its services and its sub devices.
+type Device struct {
 	Type            string       `xml:"deviceType"`
 	FriendlyName    string       `xml:"friendlyName"`
 	Manufacturer    string       `xml:"manufacturer"`
@@ -70,7 +97,7 @@ type device struct {
 	UPC             string       `xml:"UPC"`
 	Icons           []icon       `xml:"iconList>icon"`
 	Services        []Service    `xml:"serviceList>service"`
-	Devices         []device     `xml:"deviceList>device"`
+	Devices         []Device     `xml:"deviceList>device"`
 	PresentationURL string       `xml:"presentationURL"`
 	Unknown         []UnknownXML `xml:",any"`
 }
@@ -80,7 +107,7 @@ type Description struct {
 	XMLName       xml.Name      `xml:"urn:dslforum-org:device-1-0 root"`
 	SpecVersion   specVersion   `xml:"specVersion"`
 	SystemVersion systemVersion `xml:"systemVersion"`
-	Device        device        `xml:"device"`
+	Device        Device        `xml:"device"`
 	Unknown       []UnknownXML  `xml:",any"`
 }
 
@@ -121,9 +148,67 @@ type UPNPError struct {
 	Description string   `xml:"errorDescription"`
 }
 
+// CheckAction returns an error if the SCPD does not define the action with the given in and out arguments.
+func (s *SCPD) CheckAction(name string, in, out []string) error {
+	for _, a := range s.Actions {
+		if a.Name != name {
+			continue
+		}
+		for _, check := range []struct {
+			direction string
+			names     []string
+		}{{"in", in}, {"out", out}} {
+			for _, argName := range check.names {
+				if !a.hasArgument(argName, check.direction) {
+					return fmt.Errorf("action %s has no %s argument %s", name, check.direction, argName)
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("action %s is not defined", name)
+}
+
+func (a *action) hasArgument(name, direction string) bool {
+	for _, arg := range a.Arguments {
+		if arg.Name == name && arg.Direction == direction {
+			return true
+		}
+	}
+	return false
+}
+
+// FindService returns the service of the given type provided by the root device or one of its sub devices.
+func (d *Description) FindService(serviceType string) *Service {
+	return d.Device.findService(serviceType)
+}
+
+func (d *Device) findService(serviceType string) *Service {
+	for i, service := range d.Services {
+		if service.Type == serviceType {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if service := d.Devices[i].findService(serviceType); service != nil {
+			return service
+		}
+	}
+	return nil
+}
+
 // FetchXML fetches an XML document via an HTTP request and parses the response.
-func FetchXML(url string, result interface{}) error {
-	resp, err := http.Get(url)
+func FetchXML(ctx context.Context, url string, result interface{}) error {
+	return FetchXMLWith(ctx, http.DefaultClient, url, result)
+}
+
+// FetchXMLWith works like FetchXML but uses the given HTTP client.
+func FetchXMLWith(ctx context.Context, client *http.Client, url string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -139,22 +224,173 @@ func FetchXML(url string, result interface{}) error {
 }
 
 // NewAdapter creates a new Adapter for a given base URL, Service control URL and the corresponding credentials.
+// Use a Client for HTTPS connections.
 func NewAdapter(baseURL, svcCtrlURL, user, pass string) (*Adapter, error) {
 	controlURL, err := url.Parse(baseURL + svcCtrlURL)
 	if err != nil {
 		return nil, err
 	}
+	return newAdapter(controlURL, newDigestTransport(user, pass, http.DefaultTransport)), nil
+}
 
-	httpClient := http.Client{Transport: digest.NewTransport(user, pass)}
-	adapter := &Adapter{
-		httpClient: &httpClient,
-		soapClient: &soap.SOAPClient{EndpointURL: *controlURL, HTTPClient: httpClient},
+// newAdapter creates an Adapter for the given control URL which sends all requests via transport.
+func newAdapter(controlURL *url.URL, transport http.RoundTripper) *Adapter {
+	httpClient := http.Client{Transport: transport}
+	return &Adapter{
+		httpClient:  &httpClient,
+		retryPolicy: retry.DefaultPolicy,
+		soapClient:  &soap.SOAPClient{EndpointURL: *controlURL, HTTPClient: httpClient},
 	}
+}
+
+// SetRetryPolicy defines how actions which failed because of transient errors are retried
+// (default retry.DefaultPolicy).
+func (a *Adapter) SetRetryPolicy(policy retry.Policy) {
+	a.retryPolicy = policy
+}
 
-	return adapter, nil
+// SetTimeout limits the duration of every action performed by the adapter (0 means no limit).
+func (a *Adapter) SetTimeout(timeout time.Duration) {
+	a.timeout = timeout
+}
+
+// SetTrace enables writing the SOAP request and response of every action to w (nil disables tracing).
+func (a *Adapter) SetTrace(w io.Writer) {
+	a.trace = w
 }
 
 // Perform performs a TR064 action.
-func (a *Adapter) Perform(ns, action string, params, result interface{}) error {
-	return a.soapClient.PerformAction(ns, action, params, result)
+// The action is aborted if ctx is done or the timeout (see SetTimeout) is exceeded.
+// UPnP errors and HTTP-level failures are returned as *Error.
+// Failures caused by network problems, server errors (HTTP 5xx) or a busy device are retried according to
+// the retry policy (see SetRetryPolicy). If the device may have performed the action despite the failure
+// (e.g. the connection broke while waiting for the response), only idempotent actions are retried:
+// Get*, Delete* and phonebook entries carrying a unique ID. Other actions are only retried if the request
+// never reached the device. A retried Delete* action which fails because there is no such entry succeeds.
+func (a *Adapter) Perform(ctx context.Context, ns, action string, params, result interface{}) error {
+	attempt := 0
+	return a.retryPolicy.Do(ctx, "TR-064 "+action, func() error {
+		attempt++
+		err := a.perform(ctx, ns, action, params, result)
+		if attempt > 1 && isDelete(action) && errors.Is(err, ErrNoSuchArrayEntry) {
+			// a previous attempt deleted the entry but its response got lost
+			return nil
+		}
+		return err
+	})
+}
+
+// perform performs a TR064 action once and marks transient errors as retryable.
+func (a *Adapter) perform(ctx context.Context, ns, action string, params, result interface{}) error {
+	requestCtx := ctx
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		requestCtx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	transport := &contextTransport{ctx: requestCtx, trace: a.trace, transport: a.httpClient.Transport}
+	soapClient := *a.soapClient
+	soapClient.HTTPClient.Transport = transport
+	err := soapClient.PerformAction(ns, action, params, result)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	if terr := newError(action, err, transport.status); terr != nil {
+		// a UPnP error guarantees that the action was not performed
+		if terr.retryable() && (terr.Code != 0 || isIdempotent(action, params)) {
+			return retry.Retryable(terr)
+		}
+		return terr
+	}
+	if transport.err != nil && (isIdempotent(action, params) || isDialError(transport.err)) {
+		return retry.Retryable(err)
+	}
+	return err
+}
+
+// uniqueIDPattern matches the unique ID of an existing phonebook entry in the XML of the entry.
+var uniqueIDPattern = regexp.MustCompile(`<uniqueid>\s*0*[1-9][0-9]*\s*</uniqueid>`)
+
+// isIdempotent reports whether performing the action several times has the same effect as performing it once.
+// Setting a phonebook entry without unique ID creates a new entry every time.
+func isIdempotent(action string, params interface{}) bool {
+	name := strings.TrimPrefix(action, "X_AVM-DE_")
+	if strings.HasPrefix(name, "Get") || isDelete(action) {
+		return true
+	}
+	if !strings.HasPrefix(name, "Set") {
+		return false
+	}
+	for _, value := range argumentStrings(params) {
+		if uniqueIDPattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDelete reports whether the action deletes something.
+func isDelete(action string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(action, "X_AVM-DE_"), "Delete")
+}
+
+// argumentStrings returns the values of the in arguments of an action as passed to Perform:
+// a map[string]string or a (pointer to a) struct with string fields.
+func argumentStrings(params interface{}) []string {
+	if m, ok := params.(map[string]string); ok {
+		values := make([]string, 0, len(m))
+		for _, value := range m {
+			values = append(values, value)
+		}
+		return values
+	}
+	v := reflect.ValueOf(params)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	var values []string
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.String {
+			values = append(values, v.Field(i).String())
+		}
+	}
+	return values
+}
+
+// isDialError reports whether err occurred while connecting, i.e. before the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// RoundTrip is part of the http.RoundTripper interface.
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.trace != nil && req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fmt.Fprintf(t.trace, "> %s %s\n%s\n", req.Method, req.URL, body)
+	}
+	resp, err := t.transport.RoundTrip(req.WithContext(t.ctx))
+	t.err = err
+	if resp != nil {
+		t.status = resp.StatusCode
+	}
+	if t.trace != nil && err == nil {
+		body, readErr := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fmt.Fprintf(t.trace, "< %s\n%s\n", resp.Status, body)
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+	return resp, err
 }
@@ -0,0 +1,165 @@
+package tr064_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/toaster/fritz_sync/retry"
+	"github.com/toaster/fritz_sync/tr064"
+	"github.com/toaster/fritz_sync/tr064/ontel"
+	"github.com/toaster/fritz_sync/tr064/tr064test"
+)
+
+const (
+	newEntry      = "<contact><person><realName>Jane</realName></person></contact>"
+	existingEntry = "<contact><person><realName>Jane</realName></person><uniqueid>1</uniqueid></contact>"
+)
+
+func TestPerformRetriesOnlyIdempotentActions(t *testing.T) {
+	tests := map[string]struct {
+		action    string
+		fault     tr064test.Fault
+		perform   func(ctx context.Context, c *ontel.Client) error
+		wantCalls int
+	}{
+		"broken connection, get": {
+			action:    "GetPhonebookList",
+			fault:     tr064test.Fault{Disconnect: true},
+			perform:   getPhonebookList,
+			wantCalls: 2,
+		},
+		"broken connection, delete": {
+			action:    "DeletePhonebookEntryUID",
+			fault:     tr064test.Fault{Disconnect: true},
+			perform:   deleteEntry,
+			wantCalls: 2,
+		},
+		"lost response, delete": {
+			action:    "DeletePhonebookEntryUID",
+			fault:     tr064test.Fault{AfterAction: true, Disconnect: true},
+			perform:   deleteEntry,
+			wantCalls: 2,
+		},
+		"no such entry, delete": {
+			action:    "DeletePhonebookEntryUID",
+			fault:     tr064test.Fault{Code: tr064.ErrNoSuchArrayEntry.Code},
+			perform:   deleteEntry,
+			wantCalls: 1,
+		},
+		"broken connection, existing entry": {
+			action:    "SetPhonebookEntryUID",
+			fault:     tr064test.Fault{Disconnect: true},
+			perform:   setEntry(existingEntry),
+			wantCalls: 2,
+		},
+		"broken connection, new entry": {
+			action:    "SetPhonebookEntryUID",
+			fault:     tr064test.Fault{Disconnect: true},
+			perform:   setEntry(newEntry),
+			wantCalls: 1,
+		},
+		"timeout, new entry": {
+			action:    "SetPhonebookEntryUID",
+			fault:     tr064test.Fault{Delay: 300 * time.Millisecond},
+			perform:   setEntry(newEntry),
+			wantCalls: 1,
+		},
+		"server error, new entry": {
+			action:    "SetPhonebookEntryUID",
+			fault:     tr064test.Fault{HTTPStatus: http.StatusInternalServerError},
+			perform:   setEntry(newEntry),
+			wantCalls: 1,
+		},
+		"server error, existing entry": {
+			action:    "SetPhonebookEntryUID",
+			fault:     tr064test.Fault{HTTPStatus: http.StatusInternalServerError},
+			perform:   setEntry(existingEntry),
+			wantCalls: 2,
+		},
+		"action failed, new entry": {
+			action:    "SetPhonebookEntryUID",
+			fault:     tr064test.Fault{Code: tr064.ErrActionFailed.Code},
+			perform:   setEntry(newEntry),
+			wantCalls: 2,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			box := tr064test.NewServer(tr064test.Options{})
+			defer box.Close()
+			if _, err := box.AddEntry(0, newEntry); err != nil {
+				t.Fatal(err)
+			}
+			onTel := connectOnTel(t, box.URL, tr064.ClientOptions{Timeout: 100 * time.Millisecond})
+
+			box.FailAction(tt.action, 1, tt.fault)
+			err := tt.perform(ctx, onTel)
+			if tt.wantCalls > 1 && err != nil {
+				t.Errorf("expected the action to be retried, got %v", err)
+			}
+			if tt.wantCalls == 1 && err == nil {
+				t.Error("expected the action to fail without retry")
+			}
+			calls := 0
+			for _, call := range box.Calls() {
+				if call.Action == tt.action {
+					calls++
+				}
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d calls of %s, got %d", tt.wantCalls, tt.action, calls)
+			}
+		})
+	}
+}
+
+func TestPerformRetriesNewEntriesIfTheDeviceIsUnreachable(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{})
+	var stats retry.Stats
+	onTel := connectOnTel(t, box.URL, tr064.ClientOptions{
+		Retry: retry.Policy{Attempts: 3, InitialDelay: time.Millisecond, Stats: &stats},
+	})
+	box.Close()
+
+	if err := setEntry(newEntry)(context.Background(), onTel); err == nil {
+		t.Fatal("expected an error")
+	}
+	if stats.Total() != 2 {
+		t.Errorf("expected 2 retries of the refused request, got %d", stats.Total())
+	}
+}
+
+func connectOnTel(t *testing.T, url string, opts tr064.ClientOptions) *ontel.Client {
+	t.Helper()
+	if opts.Retry.Attempts == 0 {
+		opts.Retry = retry.Policy{Attempts: 3, InitialDelay: time.Millisecond}
+	}
+	client, err := tr064.NewClient(context.Background(), url, tr064test.DefaultUser, tr064test.DefaultPassword, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onTel, err := ontel.Connect(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return onTel
+}
+
+func deleteEntry(ctx context.Context, c *ontel.Client) error {
+	return c.DeletePhonebookEntryUID(ctx, 0, 1)
+}
+
+func getPhonebookList(ctx context.Context, c *ontel.Client) error {
+	_, err := c.GetPhonebookList(ctx)
+	return err
+}
+
+func setEntry(data string) func(ctx context.Context, c *ontel.Client) error {
+	return func(ctx context.Context, c *ontel.Client) error {
+		_, err := c.SetPhonebookEntryUID(ctx, 0, data)
+		return err
+	}
+}
@@ -0,0 +1,260 @@
+package tr064
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// ArgumentSpec describes an argument of a TR-064 action.
+type ArgumentSpec struct {
+	// AllowedValues lists the valid values of the argument (empty if there is no restriction).
+	AllowedValues []string
+	// DataType is the UPnP data type of the argument, e.g. “ui2”, “boolean” or “string”.
+	DataType string
+	// Direction is “in” or “out”.
+	Direction string
+	// Name is the name of the argument, e.g. “NewPhonebookID”.
+	Name string
+}
+
+// ArgumentValue is a named argument value of an action response.
+type ArgumentValue struct {
+	Name  string
+	Value string
+}
+
+// ArgumentValues collects the out arguments of an action response in their order.
+// It can be used as result of Adapter.Perform if the arguments are not known in advance.
+type ArgumentValues []ArgumentValue
+
+// ActionNames returns the names of all actions defined by the SCPD in alphabetical order.
+func (s *SCPD) ActionNames() []string {
+	names := make([]string, 0, len(s.Actions))
+	for _, a := range s.Actions {
+		names = append(names, a.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Arguments returns the arguments of the action with the given direction (“in” or “out”) in the order of the SCPD.
+func (s *SCPD) Arguments(action, direction string) ([]ArgumentSpec, error) {
+	a := s.findAction(action)
+	if a == nil {
+		return nil, fmt.Errorf("action %s is not defined", action)
+	}
+	var specs []ArgumentSpec
+	for _, arg := range a.Arguments {
+		if arg.Direction != direction {
+			continue
+		}
+		spec := s.stateVariable(arg.StateVariable)
+		spec.Direction = arg.Direction
+		spec.Name = arg.Name
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// PrepareArguments validates the in arguments of an action and converts their values into the canonical
+// representation of their data types (e.g. “true” into “1” for booleans).
+// All in arguments of the action have to be given.
+// The error message lists the expected arguments if names are unknown, missing or belong to out arguments.
+func (s *SCPD) PrepareArguments(action string, values map[string]string) (map[string]string, error) {
+	specs, err := s.Arguments(action, "in")
+	if err != nil {
+		return nil, err
+	}
+
+	outSpecs, _ := s.Arguments(action, "out")
+	var unknown, out []string
+	for name := range values {
+		switch {
+		case hasArgumentSpec(outSpecs, name):
+			out = append(out, name)
+		case !hasArgumentSpec(specs, name):
+			unknown = append(unknown, name)
+		}
+	}
+	var missing []string
+	for _, spec := range specs {
+		if _, ok := values[spec.Name]; !ok {
+			missing = append(missing, spec.Name)
+		}
+	}
+	if len(unknown) > 0 || len(out) > 0 || len(missing) > 0 {
+		sort.Strings(unknown)
+		sort.Strings(out)
+		var problems []string
+		if len(out) > 0 {
+			problems = append(problems, "out arguments cannot be passed: "+strings.Join(out, ", "))
+		}
+		if len(unknown) > 0 {
+			problems = append(problems, "unknown arguments "+strings.Join(unknown, ", "))
+		}
+		if len(missing) > 0 {
+			problems = append(problems, "missing arguments "+strings.Join(missing, ", "))
+		}
+		return nil, fmt.Errorf("%s: %s (expected: %s)", action, strings.Join(problems, ", "),
+			describeArguments(specs))
+	}
+
+	prepared := map[string]string{}
+	for _, spec := range specs {
+		value, err := spec.Normalize(values[spec.Name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", action, err)
+		}
+		prepared[spec.Name] = value
+	}
+	return prepared, nil
+}
+
+// Decode converts a value of the argument into a Go value:
+// uint64 for unsigned, int64 for signed integers, float64 for floating point numbers, bool for booleans and
+// string for all other types.
+func (a ArgumentSpec) Decode(value string) (interface{}, error) {
+	switch a.DataType {
+	case "ui1", "ui2", "ui4", "ui8":
+		return strconv.ParseUint(value, 10, 64)
+	case "i1", "i2", "i4", "int":
+		return strconv.ParseInt(value, 10, 64)
+	case "r4", "r8", "number", "float", "fixed.14.4":
+		return strconv.ParseFloat(value, 64)
+	case "boolean":
+		return soap.UnmarshalBoolean(value)
+	}
+	return value, nil
+}
+
+// Normalize checks that value is valid for the argument and returns its canonical representation.
+func (a ArgumentSpec) Normalize(value string) (string, error) {
+	var err error
+	switch a.DataType {
+	case "ui1", "ui2", "ui4", "ui8":
+		var n uint64
+		if n, err = strconv.ParseUint(strings.TrimSpace(value), 10, bitSize(a.DataType)); err == nil {
+			value = strconv.FormatUint(n, 10)
+		}
+	case "i1", "i2", "i4", "int":
+		var n int64
+		if n, err = strconv.ParseInt(strings.TrimSpace(value), 10, bitSize(a.DataType)); err == nil {
+			value = strconv.FormatInt(n, 10)
+		}
+	case "r4", "r8", "number", "float", "fixed.14.4":
+		_, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+	case "boolean":
+		var b bool
+		if b, err = soap.UnmarshalBoolean(strings.ToLower(strings.TrimSpace(value))); err == nil {
+			value, _ = soap.MarshalBoolean(b)
+		}
+	case "dateTime":
+		_, err = soap.UnmarshalDateTime(value)
+	case "dateTime.tz":
+		_, err = soap.UnmarshalDateTimeTz(value)
+	case "date":
+		_, err = soap.UnmarshalDate(value)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid value “%s” for argument %s of type %s", value, a.Name, a.DataType)
+	}
+	if len(a.AllowedValues) > 0 && !contains(a.AllowedValues, value) {
+		return "", fmt.Errorf("invalid value “%s” for argument %s (allowed: %s)", value, a.Name,
+			strings.Join(a.AllowedValues, ", "))
+	}
+	return value, nil
+}
+
+// String returns the argument in the form “NewPhonebookID (ui2)”.
+func (a ArgumentSpec) String() string {
+	if len(a.AllowedValues) > 0 {
+		return fmt.Sprintf("%s (%s: %s)", a.Name, a.DataType, strings.Join(a.AllowedValues, "|"))
+	}
+	return fmt.Sprintf("%s (%s)", a.Name, a.DataType)
+}
+
+// UnmarshalXML is part of the xml.Unmarshaler interface.
+func (v *ArgumentValues) UnmarshalXML(d *xml.Decoder, _ xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			var value string
+			if err := d.DecodeElement(&value, &t); err != nil {
+				return err
+			}
+			*v = append(*v, ArgumentValue{Name: t.Name.Local, Value: value})
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+func (s *SCPD) findAction(name string) *action {
+	for i := range s.Actions {
+		if s.Actions[i].Name == name {
+			return &s.Actions[i]
+		}
+	}
+	return nil
+}
+
+// stateVariable returns the specification of the state variable with the given name.
+// Unknown variables are treated as strings.
+func (s *SCPD) stateVariable(name string) ArgumentSpec {
+	for _, variable := range s.ServiceStateSpecs {
+		if variable.Name == name {
+			return ArgumentSpec{AllowedValues: variable.AllowedValues, DataType: variable.DataType, Name: name}
+		}
+	}
+	return ArgumentSpec{DataType: "string", Name: name}
+}
+
+func bitSize(dataType string) int {
+	switch dataType {
+	case "ui1", "i1":
+		return 8
+	case "ui2", "i2":
+		return 16
+	case "ui4", "i4":
+		return 32
+	}
+	return 64
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func describeArguments(specs []ArgumentSpec) string {
+	if len(specs) == 0 {
+		return "no arguments"
+	}
+	descriptions := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		descriptions = append(descriptions, spec.String())
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+func hasArgumentSpec(specs []ArgumentSpec, name string) bool {
+	for _, spec := range specs {
+		if spec.Name == name {
+			return true
+		}
+	}
+	return false
+}
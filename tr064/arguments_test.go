@@ -0,0 +1,256 @@
+package tr064_test
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+const argumentsSCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:dslforum-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>GetPhonebookEntry</name><argumentList>
+<argument><name>NewPhonebookID</name><direction>in</direction><relatedStateVariable>PhonebookID</relatedStateVariable></argument>
+<argument><name>NewPhonebookEntryID</name><direction>in</direction><relatedStateVariable>PhonebookEntryID</relatedStateVariable></argument>
+<argument><name>NewPhonebookEntryData</name><direction>out</direction><relatedStateVariable>PhonebookEntryData</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>SetEnable</name><argumentList>
+<argument><name>NewEnable</name><direction>in</direction><relatedStateVariable>Enable</relatedStateVariable></argument>
+<argument><name>NewMode</name><direction>in</direction><relatedStateVariable>Mode</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetInfo</name></action>
+</actionList>
+<serviceStateTable>
+<stateVariable><name>PhonebookID</name><dataType>ui2</dataType></stateVariable>
+<stateVariable><name>PhonebookEntryID</name><dataType>ui4</dataType></stateVariable>
+<stateVariable><name>PhonebookEntryData</name><dataType>string</dataType></stateVariable>
+<stateVariable><name>Enable</name><dataType>boolean</dataType></stateVariable>
+<stateVariable><name>Mode</name><dataType>string</dataType>
+<allowedValueList><allowedValue>Auto</allowedValue><allowedValue>Manual</allowedValue></allowedValueList>
+</stateVariable>
+</serviceStateTable>
+</scpd>`
+
+func TestPrepareArguments(t *testing.T) {
+	tests := map[string]struct {
+		action  string
+		values  map[string]string
+		want    map[string]string
+		wantErr string
+	}{
+		"unsigned integers": {
+			action: "GetPhonebookEntry",
+			values: map[string]string{"NewPhonebookID": " 007", "NewPhonebookEntryID": "4294967295"},
+			want:   map[string]string{"NewPhonebookID": "7", "NewPhonebookEntryID": "4294967295"},
+		},
+		"ui2 out of range": {
+			action:  "GetPhonebookEntry",
+			values:  map[string]string{"NewPhonebookID": "65536", "NewPhonebookEntryID": "1"},
+			wantErr: "invalid value “65536” for argument NewPhonebookID of type ui2",
+		},
+		"ui4 out of range": {
+			action:  "GetPhonebookEntry",
+			values:  map[string]string{"NewPhonebookID": "1", "NewPhonebookEntryID": "4294967296"},
+			wantErr: "invalid value “4294967296” for argument NewPhonebookEntryID of type ui4",
+		},
+		"negative unsigned integer": {
+			action:  "GetPhonebookEntry",
+			values:  map[string]string{"NewPhonebookID": "-1", "NewPhonebookEntryID": "1"},
+			wantErr: "argument NewPhonebookID of type ui2",
+		},
+		"boolean true": {
+			action: "SetEnable",
+			values: map[string]string{"NewEnable": "True", "NewMode": "Auto"},
+			want:   map[string]string{"NewEnable": "1", "NewMode": "Auto"},
+		},
+		"boolean no": {
+			action: "SetEnable",
+			values: map[string]string{"NewEnable": " no ", "NewMode": "Manual"},
+			want:   map[string]string{"NewEnable": "0", "NewMode": "Manual"},
+		},
+		"invalid boolean": {
+			action:  "SetEnable",
+			values:  map[string]string{"NewEnable": "maybe", "NewMode": "Auto"},
+			wantErr: "invalid value “maybe” for argument NewEnable of type boolean",
+		},
+		"value not allowed": {
+			action:  "SetEnable",
+			values:  map[string]string{"NewEnable": "1", "NewMode": "auto"},
+			wantErr: "invalid value “auto” for argument NewMode (allowed: Auto, Manual)",
+		},
+		"unknown argument": {
+			action:  "GetPhonebookEntry",
+			values:  map[string]string{"NewPhonebookID": "1", "NewPhonebookEntryID": "1", "NewID": "1"},
+			wantErr: "GetPhonebookEntry: unknown arguments NewID (expected: NewPhonebookID (ui2), NewPhonebookEntryID (ui4))",
+		},
+		"missing argument": {
+			action:  "GetPhonebookEntry",
+			values:  map[string]string{"NewPhonebookID": "1"},
+			wantErr: "GetPhonebookEntry: missing arguments NewPhonebookEntryID",
+		},
+		"out argument": {
+			action: "GetPhonebookEntry",
+			values: map[string]string{
+				"NewPhonebookID":        "1",
+				"NewPhonebookEntryID":   "1",
+				"NewPhonebookEntryData": "<contact/>",
+			},
+			wantErr: "GetPhonebookEntry: out arguments cannot be passed: NewPhonebookEntryData",
+		},
+		"all problems": {
+			action: "SetEnable",
+			values: map[string]string{"NewEnabled": "1"},
+			wantErr: "SetEnable: unknown arguments NewEnabled, missing arguments NewEnable, NewMode " +
+				"(expected: NewEnable (boolean), NewMode (string: Auto|Manual))",
+		},
+		"no arguments": {
+			action: "GetInfo",
+			values: map[string]string{},
+			want:   map[string]string{},
+		},
+		"arguments for action without arguments": {
+			action:  "GetInfo",
+			values:  map[string]string{"NewEnable": "1"},
+			wantErr: "(expected: no arguments)",
+		},
+		"unknown action": {
+			action:  "GetPhonebook",
+			wantErr: "action GetPhonebook is not defined",
+		},
+	}
+	scpd := parseSCPD(t, argumentsSCPD)
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := scpd.PrepareArguments(tt.action, tt.values)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestArgumentSpecNormalize(t *testing.T) {
+	tests := map[string]struct {
+		dataType string
+		value    string
+		want     string
+		wantErr  bool
+	}{
+		"ui1":              {dataType: "ui1", value: "255", want: "255"},
+		"ui1 out of range": {dataType: "ui1", value: "256", wantErr: true},
+		"i2":               {dataType: "i2", value: "-32768", want: "-32768"},
+		"i2 out of range":  {dataType: "i2", value: "32768", wantErr: true},
+		"i4 with spaces":   {dataType: "i4", value: " -007 ", want: "-7"},
+		"ui8":              {dataType: "ui8", value: "18446744073709551615", want: "18446744073709551615"},
+		"float":            {dataType: "r8", value: "1.5", want: "1.5"},
+		"invalid float":    {dataType: "r8", value: "one", wantErr: true},
+		"boolean 1":        {dataType: "boolean", value: "1", want: "1"},
+		"boolean false":    {dataType: "boolean", value: "FALSE", want: "0"},
+		"boolean yes":      {dataType: "boolean", value: "yes", want: "1"},
+		"dateTime":         {dataType: "dateTime", value: "2020-01-02T03:04:05", want: "2020-01-02T03:04:05"},
+		"invalid dateTime": {dataType: "dateTime", value: "yesterday", wantErr: true},
+		"string":           {dataType: "string", value: " as is ", want: " as is "},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tr064.ArgumentSpec{DataType: tt.dataType, Name: "NewValue"}.Normalize(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestArgumentSpecDecode(t *testing.T) {
+	tests := map[string]struct {
+		dataType string
+		value    string
+		want     interface{}
+		wantErr  bool
+	}{
+		"ui2":             {dataType: "ui2", value: "7", want: uint64(7)},
+		"ui4":             {dataType: "ui4", value: "4294967295", want: uint64(4294967295)},
+		"invalid ui4":     {dataType: "ui4", value: "-1", wantErr: true},
+		"i4":              {dataType: "i4", value: "-7", want: int64(-7)},
+		"float":           {dataType: "float", value: "0.25", want: 0.25},
+		"boolean":         {dataType: "boolean", value: "1", want: true},
+		"boolean false":   {dataType: "boolean", value: "0", want: false},
+		"invalid boolean": {dataType: "boolean", value: "2", wantErr: true},
+		"string":          {dataType: "string", value: "Telefonbuch", want: "Telefonbuch"},
+		"unknown type":    {dataType: "uri", value: "http://fritz.box", want: "http://fritz.box"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tr064.ArgumentSpec{DataType: tt.dataType}.Decode(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestArguments(t *testing.T) {
+	scpd := parseSCPD(t, argumentsSCPD)
+
+	in, err := scpd.Arguments("SetEnable", "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tr064.ArgumentSpec{
+		{DataType: "boolean", Direction: "in", Name: "NewEnable"},
+		{AllowedValues: []string{"Auto", "Manual"}, DataType: "string", Direction: "in", Name: "NewMode"},
+	}
+	if !reflect.DeepEqual(in, want) {
+		t.Errorf("expected %v, got %v", want, in)
+	}
+	out, err := scpd.Arguments("SetEnable", "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Errorf("expected no out arguments, got %v", out)
+	}
+	if names := scpd.ActionNames(); !reflect.DeepEqual(names, []string{"GetInfo", "GetPhonebookEntry", "SetEnable"}) {
+		t.Errorf("expected the actions in alphabetical order, got %v", names)
+	}
+}
+
+func parseSCPD(t *testing.T, data string) *tr064.SCPD {
+	t.Helper()
+	var scpd tr064.SCPD
+	if err := xml.Unmarshal([]byte(data), &scpd); err != nil {
+		t.Fatal(err)
+	}
+	return &scpd
+}
@@ -0,0 +1,204 @@
+package tr064
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toaster/fritz_sync/retry"
+)
+
+// Client provides access to all TR-064 services of a device.
+// It loads the device description once, indexes the services of the root device and all nested devices
+// and hands out adapters for them. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	desc    *Description
+	// httpClient is used for unauthenticated requests like fetching descriptions.
+	httpClient     *http.Client
+	retryPolicy    retry.Policy
+	services       []*Service
+	servicesByID   map[string]*Service
+	servicesByType map[string]*Service
+	timeout        time.Duration
+	tlsConfig      *tls.Config
+	// transport performs the authenticated requests of all adapters.
+	transport http.RoundTripper
+
+	mutex sync.Mutex
+	scpds map[string]*SCPD
+}
+
+// ClientOptions configures a Client.
+type ClientOptions struct {
+	// HTTPS enables encrypted connections even if the base URL is an HTTP URL.
+	// The HTTPS port is queried from the device via the DeviceInfo service.
+	HTTPS bool
+	// Retry defines how actions which failed because of transient errors are retried
+	// (default retry.DefaultPolicy).
+	Retry retry.Policy
+	// TLS configures how the certificate of the device is verified.
+	TLS TLSOptions
+	// Timeout limits the duration of every request (0 means no limit).
+	Timeout time.Duration
+	// WrapTransport wraps the transports used for all requests to the device (optional),
+	// e.g. for recording them (see package cassette).
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+}
+
+// NewClient fetches the description of the device at baseURL (e.g. http://fritz.box:49000) and creates a Client
+// for it.
+// If baseURL is an HTTPS URL or opts.HTTPS is set, the connection is encrypted and the certificate is verified
+// according to opts.TLS.
+func NewClient(ctx context.Context, baseURL, user, pass string, opts ClientOptions) (*Client, error) {
+	uri, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse base URL: %v", err)
+	}
+
+	c := &Client{
+		baseURL:        strings.TrimSuffix(uri.String(), "/"),
+		desc:           &Description{},
+		httpClient:     &http.Client{Timeout: opts.Timeout},
+		retryPolicy:    opts.Retry.WithDefaults(),
+		servicesByID:   map[string]*Service{},
+		servicesByType: map[string]*Service{},
+		scpds:          map[string]*SCPD{},
+		timeout:        opts.Timeout,
+	}
+	wrap := opts.WrapTransport
+	if wrap == nil {
+		wrap = func(transport http.RoundTripper) http.RoundTripper { return transport }
+	}
+	plainTransport := wrap(http.DefaultTransport)
+	baseTransport := plainTransport
+	secure := opts.HTTPS || uri.Scheme == "https"
+	if secure {
+		if c.tlsConfig, err = NewTLSConfig(uri.Hostname(), opts.TLS); err != nil {
+			return nil, err
+		}
+		baseTransport = wrap(&http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c.tlsConfig,
+			IdleConnTimeout: 90 * time.Second,
+		})
+	}
+	c.httpClient.Transport = baseTransport
+	c.transport = newDigestTransport(user, pass, baseTransport)
+
+	if err := FetchXMLWith(ctx, c.httpClient, c.baseURL+"/tr64desc.xml", c.desc); err != nil {
+		return nil, err
+	}
+	if secure && uri.Scheme != "https" {
+		if c.baseURL, err = secureBaseURL(ctx, c.baseURL, c.desc, plainTransport); err != nil {
+			return nil, err
+		}
+	}
+	c.index(&c.desc.Device)
+	return c, nil
+}
+
+// BaseURL returns the base URL of the device, i.e. the HTTPS URL if the connection is encrypted.
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// Description returns the description of the device.
+func (c *Client) Description() *Description {
+	return c.desc
+}
+
+// FindService returns the service with the given type or ID or nil if the device does not provide it.
+// If several devices provide a service of the same type, the first one is returned.
+func (c *Client) FindService(typeOrID string) *Service {
+	if service, ok := c.servicesByType[typeOrID]; ok {
+		return service
+	}
+	return c.servicesByID[typeOrID]
+}
+
+// HTTPClient returns the HTTP client for unauthenticated requests to the device (e.g. for fetching phonebooks).
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// SCPD returns the control protocol description of the service with the given type or ID.
+// It is fetched on first use and cached afterwards.
+func (c *Client) SCPD(ctx context.Context, typeOrID string) (*SCPD, error) {
+	service, err := c.service(typeOrID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	scpd, ok := c.scpds[service.ScpdURL]
+	c.mutex.Unlock()
+	if ok {
+		return scpd, nil
+	}
+
+	scpd = &SCPD{}
+	if err := FetchXMLWith(ctx, c.httpClient, c.baseURL+service.ScpdURL, scpd); err != nil {
+		return nil, fmt.Errorf("cannot fetch description of %s: %v", service.Type, err)
+	}
+	c.mutex.Lock()
+	c.scpds[service.ScpdURL] = scpd
+	c.mutex.Unlock()
+	return scpd, nil
+}
+
+// Service returns an adapter for the service with the given type or ID,
+// e.g. “urn:dslforum-org:service:X_AVM-DE_OnTel:1”.
+// All adapters of a client share their connections and authentication state.
+func (c *Client) Service(typeOrID string) (*Adapter, error) {
+	service, err := c.service(typeOrID)
+	if err != nil {
+		return nil, err
+	}
+	controlURL, err := url.Parse(c.baseURL + service.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	adapter := newAdapter(controlURL, c.transport)
+	adapter.SetRetryPolicy(c.retryPolicy)
+	adapter.SetTimeout(c.timeout)
+	return adapter, nil
+}
+
+// Services returns all services of the root device and its nested devices in the order of the description.
+func (c *Client) Services() []*Service {
+	return append([]*Service(nil), c.services...)
+}
+
+// TLSConfig returns the TLS configuration used for the device or nil if the connection is not encrypted.
+func (c *Client) TLSConfig() *tls.Config {
+	return c.tlsConfig
+}
+
+func (c *Client) index(d *Device) {
+	for i := range d.Services {
+		service := &d.Services[i]
+		c.services = append(c.services, service)
+		if _, ok := c.servicesByType[service.Type]; !ok {
+			c.servicesByType[service.Type] = service
+		}
+		c.servicesByID[service.ID] = service
+	}
+	for i := range d.Devices {
+		c.index(&d.Devices[i])
+	}
+}
+
+func (c *Client) service(typeOrID string) (*Service, error) {
+	service := c.FindService(typeOrID)
+	if service == nil {
+		return nil, fmt.Errorf("%s does not provide a %s service", c.baseURL,
+			strings.TrimPrefix(typeOrID, "urn:dslforum-org:service:"))
+	}
+	return service, nil
+}
@@ -0,0 +1,6 @@
+// Package deviceinfo provides a typed client for the DeviceInfo:1 service.
+//
+// The client is generated from deviceinfoSCPD.xml, a copy of the service description of a Fritz!Box.
+package deviceinfo
+
+//go:generate go run ../../cmd/generate_tr064_client -s urn:dslforum-org:service:DeviceInfo:1 -f deviceinfoSCPD.xml -o client.go
@@ -0,0 +1,235 @@
+package tr064
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxDrainBytes is the maximum amount of unread response data which is discarded to keep a connection alive.
+const maxDrainBytes = 64 << 10
+
+// digestTransport authenticates requests via HTTP digest authentication.
+// The challenge of the server is cached and used for all subsequent requests with an increasing nonce count,
+// so that only the first request and requests after the nonce became stale need an additional round trip.
+// Parallel requests may reach the server in another order than their nonce counts were assigned.
+// If the server rejects one of them as a replay, it is repeated once with a new nonce count.
+type digestTransport struct {
+	pass      string
+	transport http.RoundTripper
+	user      string
+
+	mutex     sync.Mutex
+	challenge *digestChallenge
+	nc        int
+}
+
+type digestChallenge struct {
+	algorithm string
+	nonce     string
+	opaque    string
+	qop       string
+	realm     string
+	stale     bool
+}
+
+func newDigestTransport(user, pass string, transport http.RoundTripper) *digestTransport {
+	return &digestTransport{pass: pass, transport: transport, user: user}
+}
+
+// RoundTrip is part of the http.RoundTripper interface.
+func (t *digestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+	}
+
+	authorization, err := t.authorization(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.send(req, body, authorization)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// there was no cached nonce yet, it is stale or the nonce count was rejected
+	challenge, err := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return resp, nil
+	}
+	drain(resp.Body)
+	t.updateChallenge(challenge)
+
+	if authorization, err = t.authorization(req); err != nil {
+		return nil, err
+	}
+	return t.send(req, body, authorization)
+}
+
+// updateChallenge caches the challenge of the server.
+// The nonce count is only reset for a new nonce: the counts already used for the current nonce must not be
+// reused even if the server repeats the nonce after rejecting a request.
+func (t *digestTransport) updateChallenge(challenge *digestChallenge) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.challenge == nil || challenge.stale || challenge.nonce != t.challenge.nonce {
+		t.nc = 0
+	}
+	t.challenge = challenge
+}
+
+// authorization returns the Authorization header for req based on the cached challenge
+// or an empty string if there is none yet.
+func (t *digestTransport) authorization(req *http.Request) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	c := t.challenge
+	if c == nil {
+		return "", nil
+	}
+	if c.algorithm != "" && !strings.EqualFold(c.algorithm, "MD5") {
+		return "", fmt.Errorf("unsupported digest algorithm %s", c.algorithm)
+	}
+
+	uri := req.URL.RequestURI()
+	ha1 := md5Hex(t.user + ":" + c.realm + ":" + t.pass)
+	ha2 := md5Hex(req.Method + ":" + uri)
+	fields := []string{
+		fmt.Sprintf(`username="%s"`, t.user),
+		fmt.Sprintf(`realm="%s"`, c.realm),
+		fmt.Sprintf(`nonce="%s"`, c.nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+	}
+	if c.qop == "" {
+		fields = append(fields, fmt.Sprintf(`response="%s"`, md5Hex(ha1+":"+c.nonce+":"+ha2)))
+	} else {
+		t.nc++
+		cnonce, err := newCnonce()
+		if err != nil {
+			return "", err
+		}
+		nc := fmt.Sprintf("%08x", t.nc)
+		response := md5Hex(strings.Join([]string{ha1, c.nonce, nc, cnonce, "auth", ha2}, ":"))
+		fields = append(fields, fmt.Sprintf(`response="%s"`, response), "qop=auth", "nc="+nc,
+			fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	if c.algorithm != "" {
+		fields = append(fields, "algorithm="+c.algorithm)
+	}
+	if c.opaque != "" {
+		fields = append(fields, fmt.Sprintf(`opaque="%s"`, c.opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+func (t *digestTransport) send(req *http.Request, body []byte, authorization string) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	resp, err := t.transport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &drainingBody{resp.Body}
+	return resp, nil
+}
+
+// drainingBody discards unread data when it is closed, so that the connection can be reused.
+type drainingBody struct {
+	io.ReadCloser
+}
+
+func (b *drainingBody) Close() error {
+	drain(b.ReadCloser)
+	return nil
+}
+
+func drain(body io.ReadCloser) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainBytes))
+	_ = body.Close()
+}
+
+func parseDigestChallenge(header string) (*digestChallenge, error) {
+	if !strings.HasPrefix(header, "Digest ") {
+		return nil, errors.New("no digest challenge")
+	}
+	c := &digestChallenge{}
+	for _, param := range splitChallengeParams(strings.TrimPrefix(header, "Digest ")) {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(parts[1]), `"`)
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "algorithm":
+			c.algorithm = value
+		case "nonce":
+			c.nonce = value
+		case "opaque":
+			c.opaque = value
+		case "qop":
+			for _, qop := range strings.Split(value, ",") {
+				if strings.TrimSpace(qop) == "auth" {
+					c.qop = "auth"
+				}
+			}
+		case "realm":
+			c.realm = value
+		case "stale":
+			c.stale = strings.EqualFold(value, "true")
+		}
+	}
+	if c.nonce == "" {
+		return nil, errors.New("digest challenge without nonce")
+	}
+	return c, nil
+}
+
+// splitChallengeParams splits the parameters of a challenge at commas outside of quoted strings.
+func splitChallengeParams(s string) []string {
+	var params []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			params = append(params, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(params, s[start:])
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func newCnonce() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
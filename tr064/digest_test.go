@@ -0,0 +1,222 @@
+package tr064
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+)
+
+func TestDigestNonceReuse(t *testing.T) {
+	server := newDigestServer(t)
+	transport := newDigestTransport("user", "secret", http.DefaultTransport)
+
+	for i := 0; i < 3; i++ {
+		expectStatus(t, transport, server.url, http.StatusOK)
+	}
+	if server.requests != 4 {
+		t.Errorf("expected the challenge to be reused, got %d requests", server.requests)
+	}
+	if want := []int{1, 2, 3}; fmt.Sprint(server.counts[server.nonce]) != fmt.Sprint(want) {
+		t.Errorf("expected the nonce counts %v, got %v", want, server.counts[server.nonce])
+	}
+}
+
+func TestDigestStaleNonce(t *testing.T) {
+	server := newDigestServer(t)
+	transport := newDigestTransport("user", "secret", http.DefaultTransport)
+	expectStatus(t, transport, server.url, http.StatusOK)
+	expectStatus(t, transport, server.url, http.StatusOK)
+
+	oldNonce := server.expireNonce()
+	expectStatus(t, transport, server.url, http.StatusOK)
+	if server.staleChallenges != 1 {
+		t.Errorf("expected a stale re-challenge, got %d", server.staleChallenges)
+	}
+	if len(server.counts[oldNonce]) != 3 {
+		t.Errorf("expected the old nonce to be used 3 times, got %v", server.counts[oldNonce])
+	}
+	if want := []int{1}; fmt.Sprint(server.counts[server.nonce]) != fmt.Sprint(want) {
+		t.Errorf("expected the nonce count to restart for the new nonce, got %v", server.counts[server.nonce])
+	}
+}
+
+func TestDigestRejectedNonceCount(t *testing.T) {
+	server := newDigestServer(t)
+	transport := newDigestTransport("user", "secret", http.DefaultTransport)
+	expectStatus(t, transport, server.url, http.StatusOK)
+
+	// another request used nc 2 meanwhile, e.g. because it overtook this one
+	server.counts[server.nonce] = append(server.counts[server.nonce], 2)
+	expectStatus(t, transport, server.url, http.StatusOK)
+	expectStatus(t, transport, server.url, http.StatusOK)
+	if want := []int{1, 2, 3, 4}; fmt.Sprint(server.counts[server.nonce]) != fmt.Sprint(want) {
+		t.Errorf("expected the nonce counts %v, got %v", want, server.counts[server.nonce])
+	}
+}
+
+func TestDigestWrongPassword(t *testing.T) {
+	server := newDigestServer(t)
+	transport := newDigestTransport("user", "wrong", http.DefaultTransport)
+
+	expectStatus(t, transport, server.url, http.StatusUnauthorized)
+	if server.requests != 2 {
+		t.Errorf("expected a single re-challenge, got %d requests", server.requests)
+	}
+}
+
+func TestDigestParallelRequests(t *testing.T) {
+	server := newDigestServer(t)
+	transport := newDigestTransport("user", "secret", http.DefaultTransport)
+	expectStatus(t, transport, server.url, http.StatusOK)
+
+	var wg gosync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			expectStatus(t, transport, server.url, http.StatusOK)
+		}()
+	}
+	wg.Wait()
+	if len(server.counts[server.nonce]) != 21 {
+		t.Errorf("expected every request to use its own nonce count, got %v", server.counts[server.nonce])
+	}
+}
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := map[string]struct {
+		header  string
+		want    digestChallenge
+		wantErr bool
+	}{
+		"Fritz!Box": {
+			header: `Digest realm="F!Box SOAP-Auth", nonce="0123456789ABCDEF", algorithm=MD5, qop="auth"`,
+			want:   digestChallenge{algorithm: "MD5", nonce: "0123456789ABCDEF", qop: "auth", realm: "F!Box SOAP-Auth"},
+		},
+		"stale": {
+			header: `Digest realm="box", nonce="abc", qop="auth", stale=TRUE`,
+			want:   digestChallenge{nonce: "abc", qop: "auth", realm: "box", stale: true},
+		},
+		"quoted comma": {
+			header: `Digest realm="a, b", nonce="abc", opaque="xyz", qop="auth-int,auth"`,
+			want:   digestChallenge{nonce: "abc", opaque: "xyz", qop: "auth", realm: "a, b"},
+		},
+		"without nonce": {header: `Digest realm="box"`, wantErr: true},
+		"basic":         {header: `Basic realm="box"`, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, err := parseDigestChallenge(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *c != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, *c)
+			}
+		})
+	}
+}
+
+// digestServer requires digest authentication with qop=auth and rejects reused nonce counts as replays.
+type digestServer struct {
+	url string
+
+	mutex           gosync.Mutex
+	counts          map[string][]int
+	nonce           string
+	requests        int
+	staleChallenges int
+}
+
+var testDigestParam = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+func newDigestServer(t *testing.T) *digestServer {
+	s := &digestServer{counts: map[string][]int{}, nonce: "nonce1"}
+	server := httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(server.Close)
+	s.url = server.URL + "/upnp/control/x_contact"
+	return s
+}
+
+// expireNonce replaces the nonce and returns the old one.
+func (s *digestServer) expireNonce() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old := s.nonce
+	s.nonce = old + "'"
+	return old
+}
+
+func (s *digestServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+
+	stale := false
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Digest ") {
+		params := map[string]string{}
+		for _, match := range testDigestParam.FindAllStringSubmatch(header, -1) {
+			params[match[1]] = match[2] + match[3]
+		}
+		ha1 := md5Hex("user:box:secret")
+		ha2 := md5Hex(req.Method + ":" + params["uri"])
+		expected := md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+		nc, _ := strconv.ParseInt(params["nc"], 16, 0)
+		switch {
+		case params["response"] != expected || params["realm"] != "box" || params["qop"] != "auth":
+		case params["nonce"] != s.nonce:
+			stale = true
+			s.staleChallenges++
+			s.counts[params["nonce"]] = append(s.counts[params["nonce"]], int(nc))
+		case s.used(int(nc)):
+		default:
+			s.counts[s.nonce] = append(s.counts[s.nonce], int(nc))
+			return
+		}
+	}
+
+	challenge := fmt.Sprintf(`Digest realm="box", nonce="%s", algorithm=MD5, qop="auth"`, s.nonce)
+	if stale {
+		challenge += ", stale=true"
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (s *digestServer) used(nc int) bool {
+	for _, used := range s.counts[s.nonce] {
+		if used == nc {
+			return true
+		}
+	}
+	return false
+}
+
+func expectStatus(t *testing.T, transport http.RoundTripper, url string, status int) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader("<body/>"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Errorf("expected HTTP %d, got %d", status, resp.StatusCode)
+	}
+}
@@ -0,0 +1,126 @@
+package tr064
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// SSDPAddress is the multicast address of SSDP (Simple Service Discovery Protocol).
+const SSDPAddress = "239.255.255.250:1900"
+
+// InternetGatewayDeviceType is the device type TR-064 devices (e.g. Fritz!Boxes) announce via SSDP.
+const InternetGatewayDeviceType = "urn:dslforum-org:device:InternetGatewayDevice:1"
+
+// DiscoveredDevice is a TR-064 device found via SSDP.
+type DiscoveredDevice struct {
+	// BaseURL is the base URL of the device which has to be used for NewAdapter.
+	BaseURL string
+	// Description is the TR-064 description of the device.
+	Description Description
+	// Location is the URL of the description.
+	Location string
+}
+
+// Discover searches for TR-064 devices in the local network and waits timeout for their answers.
+func Discover(ctx context.Context, timeout time.Duration) ([]DiscoveredDevice, error) {
+	return DiscoverAt(ctx, SSDPAddress, timeout)
+}
+
+// DiscoverAt works like Discover but sends the search request to the given UDP address instead of the SSDP
+// multicast address.
+func DiscoverAt(ctx context.Context, addr string, timeout time.Duration) ([]DiscoveredDevice, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	mx := int(timeout / time.Second)
+	if mx < 1 {
+		mx = 1
+	}
+	request := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: %d\r\nST: %s\r\n\r\n",
+		SSDPAddress, mx, InternetGatewayDeviceType)
+	if _, err := conn.WriteToUDP([]byte(request), udpAddr); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// ReadFromUDP does not support contexts: interrupt it via the deadline when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var locations []string
+	seen := map[string]bool{}
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		location := parseSearchResponse(buf[:n])
+		if location != "" && !seen[location] {
+			seen[location] = true
+			locations = append(locations, location)
+		}
+	}
+
+	var devices []DiscoveredDevice
+	for _, location := range locations {
+		u, err := url.Parse(location)
+		if err != nil {
+			continue
+		}
+		device := DiscoveredDevice{BaseURL: u.Scheme + "://" + u.Host, Location: location}
+		if err := FetchXML(ctx, location, &device.Description); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// parseSearchResponse returns the description location of an SSDP search response
+// or an empty string if the response does not belong to a TR-064 device.
+func parseSearchResponse(data []byte) string {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ST") != InternetGatewayDeviceType {
+		return ""
+	}
+	return resp.Header.Get("Location")
+}
@@ -0,0 +1,103 @@
+package tr064_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toaster/fritz_sync/tr064"
+	"github.com/toaster/fritz_sync/tr064/tr064test"
+)
+
+func TestDiscoverAt(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+	location := box.URL + "/tr64desc.xml"
+	responder := newSSDPResponder(t,
+		searchResponse("upnp:rootdevice", "http://127.0.0.1:1/rootDesc.xml"),
+		searchResponse(tr064.InternetGatewayDeviceType, location),
+		searchResponse(tr064.InternetGatewayDeviceType, location),
+		"garbage",
+	)
+
+	devices, err := tr064.DiscoverAt(context.Background(), responder.addr, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("expected one device, got %d", len(devices))
+	}
+	device := devices[0]
+	if device.BaseURL != box.URL || device.Location != location {
+		t.Errorf("unexpected device URLs: base %s, location %s", device.BaseURL, device.Location)
+	}
+	if device.Description.Device.Name != tr064test.DefaultModel {
+		t.Errorf("expected model %s, got %s", tr064test.DefaultModel, device.Description.Device.Name)
+	}
+
+	request := <-responder.requests
+	for _, header := range []string{"M-SEARCH * HTTP/1.1\r\n", "MAN: \"ssdp:discover\"\r\n",
+		"ST: " + tr064.InternetGatewayDeviceType + "\r\n"} {
+		if !strings.Contains(request, header) {
+			t.Errorf("search request lacks %q: %q", header, request)
+		}
+	}
+}
+
+func TestDiscoverAtCancel(t *testing.T) {
+	responder := newSSDPResponder(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := tr064.DiscoverAt(ctx, responder.addr, 10*time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelling has to interrupt the discovery, it took %v", elapsed)
+	}
+}
+
+type ssdpResponder struct {
+	addr     string
+	requests chan string
+}
+
+// newSSDPResponder starts a local UDP server which answers every search request with the given responses.
+func newSSDPResponder(t *testing.T, responses ...string) *ssdpResponder {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	r := &ssdpResponder{addr: conn.LocalAddr().String(), requests: make(chan string, 10)}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, sender, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case r.requests <- string(buf[:n]):
+			default:
+			}
+			for _, response := range responses {
+				_, _ = conn.WriteToUDP([]byte(response), sender)
+			}
+		}
+	}()
+	return r
+}
+
+func searchResponse(st, location string) string {
+	return fmt.Sprintf("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=1800\r\nEXT:\r\nLOCATION: %s\r\n"+
+		"SERVER: FRITZ!Box 7590 UPnP/1.0 AVM FRITZ!Box 7590 154.07.29\r\nST: %s\r\n"+
+		"USN: uuid:739f2409-bccb-40e7-8e6c-3431C4A1B2C3::%s\r\n\r\n", location, st, st)
+}
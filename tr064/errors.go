@@ -0,0 +1,181 @@
+package tr064
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// Error is a failed TR-064 action.
+// It is either a UPnP error reported by the device (Code is set) or an HTTP-level failure (only HTTPStatus is set).
+//
+// Errors can be compared to the catalogue errors with errors.Is:
+//
+//	if errors.Is(err, tr064.ErrActionNotAuthorized) { … }
+type Error struct {
+	// Action is the name of the failed action.
+	Action string
+	// Code is the UPnP error code (0 for HTTP-level failures).
+	Code int
+	// Description is the error description reported by the device or the one from the catalogue.
+	Description string
+	// HTTPStatus is the HTTP status code of the response.
+	HTTPStatus int
+
+	err error
+}
+
+// The catalogue of known TR-064 and AVM errors.
+var (
+	// ErrInvalidAction means the service does not provide the action.
+	ErrInvalidAction = &Error{Code: 401, Description: "Invalid Action"}
+	// ErrInvalidArgs means arguments are missing, unknown or have an invalid type.
+	ErrInvalidArgs = &Error{Code: 402, Description: "Invalid Args"}
+	// ErrActionFailed means the device could not perform the action, e.g. because it is busy.
+	ErrActionFailed = &Error{Code: 501, Description: "Action Failed"}
+	// ErrArgumentValueInvalid means an argument value is invalid.
+	ErrArgumentValueInvalid = &Error{Code: 600, Description: "Argument Value Invalid"}
+	// ErrArgumentValueOutOfRange means an argument value is out of the allowed range.
+	ErrArgumentValueOutOfRange = &Error{Code: 601, Description: "Argument Value Out of Range"}
+	// ErrOptionalActionNotImplemented means the device does not implement the optional action.
+	ErrOptionalActionNotImplemented = &Error{Code: 602, Description: "Optional Action Not Implemented"}
+	// ErrOutOfMemory means the device does not have enough memory to perform the action.
+	ErrOutOfMemory = &Error{Code: 603, Description: "Out of Memory"}
+	// ErrHumanInterventionRequired means the action requires an interaction with the device.
+	ErrHumanInterventionRequired = &Error{Code: 604, Description: "Human Intervention Required"}
+	// ErrStringArgumentTooLong means a string argument is too long.
+	ErrStringArgumentTooLong = &Error{Code: 605, Description: "String Argument Too Long"}
+	// ErrActionNotAuthorized means the user lacks the permission for the action.
+	ErrActionNotAuthorized = &Error{Code: 606, Description: "Action Not Authorized"}
+	// ErrValueAlreadySpecified means the value is already set.
+	ErrValueAlreadySpecified = &Error{Code: 701, Description: "Value Already Specified"}
+	// ErrValueSpecifiedIsInvalid means a value is invalid in the current state of the device.
+	ErrValueSpecifiedIsInvalid = &Error{Code: 702, Description: "Value Specified Is Invalid"}
+	// ErrInactiveConnectionStateRequired means the action requires an inactive connection.
+	ErrInactiveConnectionStateRequired = &Error{Code: 703, Description: "Inactive Connection State Required"}
+	// ErrConnectionSetupFailed means a connection could not be established.
+	ErrConnectionSetupFailed = &Error{Code: 704, Description: "Connection Setup Failed"}
+	// ErrConnectionSetupInProgress means a connection is currently being established.
+	ErrConnectionSetupInProgress = &Error{Code: 705, Description: "Connection Setup in Progress"}
+	// ErrConnectionNotConfigured means the connection is not configured.
+	ErrConnectionNotConfigured = &Error{Code: 706, Description: "Connection Not Configured"}
+	// ErrDisconnectInProgress means the connection is currently being terminated.
+	ErrDisconnectInProgress = &Error{Code: 707, Description: "Disconnect in Progress"}
+	// ErrInvalidLayer2Address means a layer 2 (MAC) address is invalid.
+	ErrInvalidLayer2Address = &Error{Code: 708, Description: "Invalid Layer2 Address"}
+	// ErrInternetAccessDisabled means the internet access is disabled.
+	ErrInternetAccessDisabled = &Error{Code: 709, Description: "Internet Access Disabled"}
+	// ErrInvalidConnectionType means the connection type is invalid.
+	ErrInvalidConnectionType = &Error{Code: 710, Description: "Invalid Connection Type"}
+	// ErrConnectionAlreadyTerminated means the connection is already terminated.
+	ErrConnectionAlreadyTerminated = &Error{Code: 711, Description: "Connection Already Terminated"}
+	// ErrSpecifiedArrayIndexInvalid means there is no entry at the given index, e.g. after the last one.
+	ErrSpecifiedArrayIndexInvalid = &Error{Code: 713, Description: "Specified Array Index Invalid"}
+	// ErrNoSuchArrayEntry means there is no entry with the given key.
+	ErrNoSuchArrayEntry = &Error{Code: 714, Description: "No Such Array Entry"}
+	// ErrInternalError is an unspecified error of an AVM action.
+	ErrInternalError = &Error{Code: 820, Description: "Internal Error"}
+	// ErrSecondFactorAuthRequired means the action has to be confirmed at the device (AVM).
+	ErrSecondFactorAuthRequired = &Error{Code: 866, Description: "Second Factor Authentication Required"}
+	// ErrSecondFactorAuthBlocked means the second factor authentication is blocked (AVM).
+	ErrSecondFactorAuthBlocked = &Error{Code: 867, Description: "Second Factor Authentication Blocked"}
+	// ErrSecondFactorAuthBusy means another second factor authentication is in progress (AVM).
+	ErrSecondFactorAuthBusy = &Error{Code: 868, Description: "Second Factor Authentication Busy"}
+
+	// ErrAuthFailed means the device rejected the credentials (HTTP 401).
+	ErrAuthFailed = &Error{HTTPStatus: http.StatusUnauthorized, Description: "Authentication Failed"}
+	// ErrServiceUnavailable means the device is temporarily unable to handle requests (HTTP 503).
+	ErrServiceUnavailable = &Error{HTTPStatus: http.StatusServiceUnavailable, Description: "Service Unavailable"}
+)
+
+var knownErrors = []*Error{
+	ErrInvalidAction, ErrInvalidArgs, ErrActionFailed, ErrArgumentValueInvalid, ErrArgumentValueOutOfRange,
+	ErrOptionalActionNotImplemented, ErrOutOfMemory, ErrHumanInterventionRequired, ErrStringArgumentTooLong,
+	ErrActionNotAuthorized, ErrValueAlreadySpecified, ErrValueSpecifiedIsInvalid,
+	ErrInactiveConnectionStateRequired, ErrConnectionSetupFailed, ErrConnectionSetupInProgress,
+	ErrConnectionNotConfigured, ErrDisconnectInProgress, ErrInvalidLayer2Address, ErrInternetAccessDisabled,
+	ErrInvalidConnectionType, ErrConnectionAlreadyTerminated, ErrSpecifiedArrayIndexInvalid, ErrNoSuchArrayEntry,
+	ErrInternalError, ErrSecondFactorAuthRequired, ErrSecondFactorAuthBlocked, ErrSecondFactorAuthBusy,
+}
+
+// Error is part of the error interface.
+func (e *Error) Error() string {
+	prefix := ""
+	if e.Action != "" {
+		prefix = e.Action + ": "
+	}
+	if e.Code != 0 {
+		return fmt.Sprintf("%sUPnP error %d (%s)", prefix, e.Code, e.Description)
+	}
+	if e.err != nil {
+		return fmt.Sprintf("%sHTTP %d %s: %v", prefix, e.HTTPStatus, http.StatusText(e.HTTPStatus), e.err)
+	}
+	return fmt.Sprintf("%sHTTP %d %s", prefix, e.HTTPStatus, http.StatusText(e.HTTPStatus))
+}
+
+// Is reports whether e matches target (used by errors.Is).
+// An Error matches another one if it has the same UPnP code or, for HTTP-level failures, the same HTTP status.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	if t.Code != 0 {
+		return t.Code == e.Code
+	}
+	return e.Code == 0 && t.HTTPStatus != 0 && t.HTTPStatus == e.HTTPStatus
+}
+
+// Unwrap returns the underlying SOAP or HTTP error.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// retryable reports whether the failure may vanish when the action is repeated:
+// the device was busy or responded with a server error without reporting a UPnP error.
+func (e *Error) retryable() bool {
+	if e.Code != 0 {
+		return e.Is(ErrActionFailed)
+	}
+	return e.HTTPStatus >= http.StatusInternalServerError
+}
+
+// newError converts the result of a failed SOAP request into an Error.
+// It returns nil if err is neither a UPnP error nor an HTTP-level failure (e.g. a network error).
+func newError(action string, err error, httpStatus int) *Error {
+	if serr, ok := err.(*soap.SOAPFaultError); ok {
+		var upnpError UPNPError
+		if xml.Unmarshal(serr.Detail.Raw, &upnpError) == nil && upnpError.Code != "" {
+			code, convErr := strconv.Atoi(upnpError.Code)
+			if convErr == nil {
+				e := &Error{
+					Action:      action,
+					Code:        code,
+					Description: upnpError.Description,
+					HTTPStatus:  httpStatus,
+					err:         err,
+				}
+				if e.Description == "" {
+					e.Description = describeCode(code)
+				}
+				return e
+			}
+		}
+	}
+	if httpStatus >= http.StatusBadRequest {
+		return &Error{Action: action, HTTPStatus: httpStatus, Description: http.StatusText(httpStatus), err: err}
+	}
+	return nil
+}
+
+func describeCode(code int) string {
+	for _, known := range knownErrors {
+		if known.Code == code {
+			return known.Description
+		}
+	}
+	return "Unknown Error"
+}
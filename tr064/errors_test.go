@@ -0,0 +1,176 @@
+package tr064
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/huin/goupnp/soap"
+)
+
+func TestNewError(t *testing.T) {
+	tests := map[string]struct {
+		err             error
+		httpStatus      int
+		wantCode        int
+		wantDescription string
+		wantHTTPStatus  int
+		wantNil         bool
+	}{
+		"catalogue code": {
+			err:             upnpFault("714", ""),
+			httpStatus:      http.StatusInternalServerError,
+			wantCode:        714,
+			wantDescription: ErrNoSuchArrayEntry.Description,
+			wantHTTPStatus:  http.StatusInternalServerError,
+		},
+		"description of the device": {
+			err:             upnpFault("820", "Internal Error: phonebook locked"),
+			httpStatus:      http.StatusInternalServerError,
+			wantCode:        820,
+			wantDescription: "Internal Error: phonebook locked",
+			wantHTTPStatus:  http.StatusInternalServerError,
+		},
+		"unknown code": {
+			err:             upnpFault("999", ""),
+			httpStatus:      http.StatusInternalServerError,
+			wantCode:        999,
+			wantDescription: "Unknown Error",
+			wantHTTPStatus:  http.StatusInternalServerError,
+		},
+		"fault without UPnP error": {
+			err:             &soap.SOAPFaultError{FaultString: "Client"},
+			httpStatus:      http.StatusInternalServerError,
+			wantDescription: http.StatusText(http.StatusInternalServerError),
+			wantHTTPStatus:  http.StatusInternalServerError,
+		},
+		"invalid code": {
+			err:             upnpFault("abc", "Invalid"),
+			httpStatus:      http.StatusInternalServerError,
+			wantDescription: http.StatusText(http.StatusInternalServerError),
+			wantHTTPStatus:  http.StatusInternalServerError,
+		},
+		"HTTP failure": {
+			err:             errors.New("unexpected response"),
+			httpStatus:      http.StatusUnauthorized,
+			wantDescription: http.StatusText(http.StatusUnauthorized),
+			wantHTTPStatus:  http.StatusUnauthorized,
+		},
+		"network error": {
+			err:     errors.New("connection refused"),
+			wantNil: true,
+		},
+		"successful response with other error": {
+			err:        errors.New("invalid XML"),
+			httpStatus: http.StatusOK,
+			wantNil:    true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			e := newError("GetPhonebook", tt.err, tt.httpStatus)
+			if tt.wantNil {
+				if e != nil {
+					t.Errorf("expected no Error, got %v", e)
+				}
+				return
+			}
+			if e == nil {
+				t.Fatal("expected an Error")
+			}
+			if e.Action != "GetPhonebook" || e.Code != tt.wantCode || e.Description != tt.wantDescription ||
+				e.HTTPStatus != tt.wantHTTPStatus {
+				t.Errorf("expected code %d, description %q and HTTP status %d, got %+v", tt.wantCode,
+					tt.wantDescription, tt.wantHTTPStatus, e)
+			}
+			if !errors.Is(e, tt.err) {
+				t.Error("the Error has to wrap the original error")
+			}
+		})
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	noSuchEntry := newError("DeletePhonebookEntryUID", upnpFault("714", "no entry 42"), http.StatusInternalServerError)
+	unauthorized := newError("GetPhonebook", errors.New("unauthorized"), http.StatusUnauthorized)
+	unavailable := newError("GetPhonebook", errors.New("unavailable"), http.StatusServiceUnavailable)
+	tests := map[string]struct {
+		err    error
+		target error
+		want   bool
+	}{
+		"same code":                 {err: noSuchEntry, target: ErrNoSuchArrayEntry, want: true},
+		"wrapped":                   {err: fmt.Errorf("delete: %w", noSuchEntry), target: ErrNoSuchArrayEntry, want: true},
+		"other code":                {err: noSuchEntry, target: ErrSpecifiedArrayIndexInvalid},
+		"UPnP error and HTTP error": {err: noSuchEntry, target: &Error{HTTPStatus: http.StatusInternalServerError}},
+		"authentication failed":     {err: unauthorized, target: ErrAuthFailed, want: true},
+		"401 is not 503":            {err: unauthorized, target: ErrServiceUnavailable},
+		"service unavailable":       {err: unavailable, target: ErrServiceUnavailable, want: true},
+		"503 is not 401":            {err: unavailable, target: ErrAuthFailed},
+		"HTTP error and UPnP error": {err: unauthorized, target: ErrInvalidAction},
+		"other error type":          {err: noSuchEntry, target: errors.New("No Such Array Entry")},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := errors.Is(tt.err, tt.target); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestErrorRetryable(t *testing.T) {
+	tests := map[string]struct {
+		err  *Error
+		want bool
+	}{
+		"action failed":       {err: &Error{Code: 501, HTTPStatus: http.StatusInternalServerError}, want: true},
+		"other UPnP error":    {err: &Error{Code: 820, HTTPStatus: http.StatusInternalServerError}},
+		"invalid args":        {err: &Error{Code: 402, HTTPStatus: http.StatusInternalServerError}},
+		"server error":        {err: &Error{HTTPStatus: http.StatusInternalServerError}, want: true},
+		"service unavailable": {err: &Error{HTTPStatus: http.StatusServiceUnavailable}, want: true},
+		"unauthorized":        {err: &Error{HTTPStatus: http.StatusUnauthorized}},
+		"not found":           {err: &Error{HTTPStatus: http.StatusNotFound}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tt.err.retryable(); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	tests := map[string]struct {
+		err  *Error
+		want string
+	}{
+		"UPnP error": {
+			err:  &Error{Action: "GetPhonebook", Code: 714, Description: "No Such Array Entry"},
+			want: "GetPhonebook: UPnP error 714 (No Such Array Entry)",
+		},
+		"HTTP error": {
+			err:  newError("GetPhonebook", errors.New("denied"), http.StatusUnauthorized),
+			want: "GetPhonebook: HTTP 401 Unauthorized: denied",
+		},
+		"catalogue":      {err: ErrServiceUnavailable, want: "HTTP 503 Service Unavailable"},
+		"catalogue UPnP": {err: ErrActionFailed, want: "UPnP error 501 (Action Failed)"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// upnpFault returns a SOAP fault as reported by the device for a UPnP error.
+func upnpFault(code, description string) *soap.SOAPFaultError {
+	fault := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	fault.Detail.Raw = []byte(`<UPnPError xmlns="urn:dslforum-org:control-1-0"><errorCode>` + code +
+		`</errorCode><errorDescription>` + description + `</errorDescription></UPnPError>`)
+	return fault
+}
@@ -0,0 +1,438 @@
+package tr064
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toaster/fritz_sync/retry"
+)
+
+// DefaultSubscriptionTimeout is the subscription duration requested if Subscribe is called without a timeout.
+const DefaultSubscriptionTimeout = 30 * time.Minute
+
+// minRenewDelay limits how often a subscription is renewed if the device grants very short durations.
+// It must not exceed half of the shortest possible duration (one second) to renew such subscriptions in time.
+const minRenewDelay = 500 * time.Millisecond
+
+// Event is a change of evented state variables of a service, e.g. of PhonebookUpdateID.
+type Event struct {
+	// Seq is the sequence number of the notification, 0 for the initial one containing all evented variables.
+	// A gap in the sequence numbers indicates lost notifications.
+	Seq uint32
+	// Service is the service whose state variables changed.
+	Service *Service
+	// Values contains the changed variables converted according to their data types (see ArgumentSpec.Decode).
+	// Values which cannot be converted are kept as strings.
+	Values map[string]interface{}
+	// Variables contains the changed variables as sent by the device in their order.
+	Variables ArgumentValues
+}
+
+// EventListener is a local HTTP server receiving the event notifications (GENA NOTIFY requests) of
+// subscriptions. It must be reachable by the device. One listener can serve any amount of subscriptions.
+type EventListener struct {
+	listener net.Listener
+	server   *http.Server
+
+	mutex         sync.Mutex
+	nextID        int
+	subscriptions map[string]*Subscription
+}
+
+// Subscription is a subscription to the events of a service (see Client.Subscribe).
+// It is renewed automatically until it is cancelled with Unsubscribe or cannot be renewed anymore.
+type Subscription struct {
+	callbackURL string
+	client      *Client
+	done        chan struct{}
+	events      chan Event
+	listener    *EventListener
+	path        string
+	scpd        *SCPD
+	service     *Service
+	timeout     time.Duration
+
+	mutex   sync.Mutex
+	err     error
+	granted time.Duration
+	sid     string
+
+	// sendMutex guards closing the events channel.
+	sendMutex sync.Mutex
+	closed    bool
+	once      sync.Once
+}
+
+type propertySet struct {
+	Properties []ArgumentValues `xml:"property"`
+}
+
+// NewEventListener starts an event listener on the given TCP address, e.g. “:0” for an arbitrary port on all
+// interfaces.
+func NewEventListener(addr string) (*EventListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for events: %v", err)
+	}
+	l := &EventListener{listener: listener, subscriptions: map[string]*Subscription{}}
+	l.server = &http.Server{Handler: l, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		_ = l.server.Serve(listener)
+	}()
+	return l, nil
+}
+
+// Addr returns the address the listener accepts connections on.
+func (l *EventListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Close stops the listener. It does not cancel the subscriptions at the devices.
+func (l *EventListener) Close() error {
+	return l.server.Close()
+}
+
+// ServeHTTP handles the notifications of the devices (part of the http.Handler interface).
+func (l *EventListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "NOTIFY" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	l.mutex.Lock()
+	subscription := l.subscriptions[req.URL.Path]
+	l.mutex.Unlock()
+	if subscription == nil || req.Header.Get("NT") != "upnp:event" || req.Header.Get("NTS") != "upnp:propchange" ||
+		!subscription.accepts(req.Header.Get("SID")) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	seq, err := strconv.ParseUint(req.Header.Get("SEQ"), 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var set propertySet
+	if err := xml.Unmarshal(body, &set); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	subscription.deliver(subscription.newEvent(uint32(seq), &set))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (l *EventListener) add(s *Subscription) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.nextID++
+	path := "/events/" + strconv.Itoa(l.nextID)
+	l.subscriptions[path] = s
+	return path
+}
+
+func (l *EventListener) remove(path string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.subscriptions, path)
+}
+
+// Subscribe subscribes to the events of the service with the given type or ID.
+// The notifications are received by listener and delivered via the Events channel of the subscription.
+// timeout is the requested duration of the subscription (0 means DefaultSubscriptionTimeout);
+// the subscription is renewed automatically before the duration granted by the device expires.
+func (c *Client) Subscribe(ctx context.Context, listener *EventListener, typeOrID string,
+	timeout time.Duration) (*Subscription, error) {
+	service, err := c.service(typeOrID)
+	if err != nil {
+		return nil, err
+	}
+	if service.EventSubURL == "" {
+		return nil, fmt.Errorf("%s does not send events", service.Type)
+	}
+	scpd, err := c.SCPD(ctx, service.ID)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = DefaultSubscriptionTimeout
+	}
+
+	s := &Subscription{
+		client:   c,
+		done:     make(chan struct{}),
+		events:   make(chan Event, 16),
+		listener: listener,
+		scpd:     scpd,
+		service:  service,
+		timeout:  timeout,
+	}
+	host, err := c.callbackHost(listener)
+	if err != nil {
+		return nil, err
+	}
+	s.path = listener.add(s)
+	s.callbackURL = "http://" + net.JoinHostPort(host, strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)) + s.path
+	if err := s.subscribe(ctx); err != nil {
+		listener.remove(s.path)
+		return nil, err
+	}
+	go s.keepAlive()
+	return s, nil
+}
+
+// callbackHost returns the IP address of the listener which is reachable by the device.
+// If the listener accepts connections on all interfaces, the address of the interface routing to the device is
+// used.
+func (c *Client) callbackHost(listener *EventListener) (string, error) {
+	addr := listener.Addr().(*net.TCPAddr)
+	if !addr.IP.IsUnspecified() {
+		return addr.IP.String(), nil
+	}
+	uri, err := url.Parse(c.baseURL)
+	if err != nil {
+		return "", err
+	}
+	// no packets are sent when “connecting” via UDP
+	conn, err := net.Dial("udp", net.JoinHostPort(uri.Hostname(), "1900"))
+	if err != nil {
+		return "", fmt.Errorf("cannot determine the local address for event notifications: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// Done returns a channel which is closed when the subscription ended.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason why the subscription ended or nil if it is active or was cancelled with Unsubscribe.
+func (s *Subscription) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// Events returns the channel delivering the events. It is closed when the subscription ends.
+// A notification is acknowledged to the device when its event has been delivered.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Renew extends the subscription by the requested duration.
+// If the device does not know the subscription anymore (e.g. after a reboot), it subscribes anew.
+func (s *Subscription) Renew(ctx context.Context) error {
+	s.mutex.Lock()
+	sid := s.sid
+	s.mutex.Unlock()
+
+	resp, err := s.request(ctx, "SUBSCRIBE", http.Header{"SID": {sid}, "TIMEOUT": {formatTimeout(s.timeout)}})
+	var e *Error
+	if errors.As(err, &e) && e.HTTPStatus == http.StatusPreconditionFailed {
+		return s.subscribe(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return s.update(resp)
+}
+
+// SID returns the subscription identifier assigned by the device.
+func (s *Subscription) SID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sid
+}
+
+// Unsubscribe cancels the subscription at the device and closes the Events channel.
+func (s *Subscription) Unsubscribe(ctx context.Context) error {
+	s.end(nil)
+	_, err := s.request(ctx, "UNSUBSCRIBE", http.Header{"SID": {s.SID()}})
+	return err
+}
+
+// accepts reports whether a notification with the given SID belongs to the subscription.
+// The initial notification may arrive before the response to the SUBSCRIBE request, i.e. before the SID is known.
+func (s *Subscription) accepts(sid string) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sid == "" || s.sid == sid
+}
+
+func (s *Subscription) deliver(event Event) {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- event:
+	case <-s.done:
+	}
+}
+
+// end stops the renewal of the subscription and closes the Events channel.
+func (s *Subscription) end(err error) {
+	s.once.Do(func() {
+		s.listener.remove(s.path)
+		s.mutex.Lock()
+		s.err = err
+		s.mutex.Unlock()
+		close(s.done)
+		// deliver stops waiting when done is closed, so the lock becomes available
+		s.sendMutex.Lock()
+		s.closed = true
+		close(s.events)
+		s.sendMutex.Unlock()
+	})
+}
+
+// keepAlive renews the subscription when half of the granted duration has passed.
+func (s *Subscription) keepAlive() {
+	for {
+		s.mutex.Lock()
+		delay := s.granted / 2
+		s.mutex.Unlock()
+		if delay < minRenewDelay {
+			delay = minRenewDelay
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-s.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := s.client.retryPolicy.Do(ctx, "GENA renew", func() error {
+			err := s.Renew(ctx)
+			var e *Error
+			var urlErr *url.Error
+			if errors.As(err, &e) && e.HTTPStatus >= http.StatusInternalServerError || errors.As(err, &urlErr) {
+				return retry.Retryable(err)
+			}
+			return err
+		})
+		cancel()
+		if err != nil {
+			s.end(fmt.Errorf("cannot renew subscription to %s: %v", s.service.Type, err))
+			return
+		}
+	}
+}
+
+func (s *Subscription) newEvent(seq uint32, set *propertySet) Event {
+	event := Event{Seq: seq, Service: s.service, Values: map[string]interface{}{}}
+	for _, property := range set.Properties {
+		for _, variable := range property {
+			event.Variables = append(event.Variables, variable)
+			value, err := s.scpd.stateVariable(variable.Name).Decode(variable.Value)
+			if err != nil {
+				value = variable.Value
+			}
+			event.Values[variable.Name] = value
+		}
+	}
+	return event
+}
+
+// request sends a GENA request to the event URL of the service.
+func (s *Subscription) request(ctx context.Context, method string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.client.baseURL+s.service.EventSubURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		// GENA headers are upper case, some devices do not accept canonicalized names
+		req.Header[name] = values
+	}
+	httpClient := http.Client{Transport: s.client.transport, Timeout: s.client.timeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	drain(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &Error{Action: method, Description: http.StatusText(resp.StatusCode), HTTPStatus: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+func (s *Subscription) subscribe(ctx context.Context) error {
+	// accept the initial notification of the new subscription which may arrive before its SID is known
+	s.mutex.Lock()
+	s.sid = ""
+	s.mutex.Unlock()
+	resp, err := s.request(ctx, "SUBSCRIBE", http.Header{
+		"CALLBACK": {"<" + s.callbackURL + ">"},
+		"NT":       {"upnp:event"},
+		"TIMEOUT":  {formatTimeout(s.timeout)},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot subscribe to %s: %v", s.service.Type, err)
+	}
+	return s.update(resp)
+}
+
+// update takes over the SID and the granted duration from the response to a SUBSCRIBE request.
+func (s *Subscription) update(resp *http.Response) error {
+	sid := resp.Header.Get("SID")
+	if sid == "" {
+		return fmt.Errorf("subscription to %s: device did not return a SID", s.service.Type)
+	}
+	granted, err := parseTimeout(resp.Header.Get("TIMEOUT"))
+	if err != nil {
+		return fmt.Errorf("subscription to %s: %v", s.service.Type, err)
+	}
+	s.mutex.Lock()
+	s.granted = granted
+	s.sid = sid
+	s.mutex.Unlock()
+	return nil
+}
+
+func formatTimeout(timeout time.Duration) string {
+	return "Second-" + strconv.Itoa(int(timeout/time.Second))
+}
+
+// parseTimeout parses a TIMEOUT header like “Second-1800”. “Second-infinite” is treated as one day.
+func parseTimeout(header string) (time.Duration, error) {
+	value := strings.TrimPrefix(strings.TrimSpace(header), "Second-")
+	if strings.EqualFold(value, "infinite") {
+		return 24 * time.Hour, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid subscription timeout “%s”", header)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,319 @@
+package tr064_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toaster/fritz_sync/tr064"
+	"github.com/toaster/fritz_sync/tr064/tr064test"
+)
+
+func TestSubscribe(t *testing.T) {
+	box, client, listener := newEventTest(t, tr064test.Options{})
+	if err := box.Notify(tr064test.OnTelService, tr064.ArgumentValue{Name: "X_AVM-DE_PhonebookList", Value: "0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscription, err := client.Subscribe(context.Background(), listener, tr064test.OnTelService, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Unsubscribe(context.Background())
+	if !strings.HasPrefix(subscription.SID(), "uuid:") {
+		t.Errorf("expected the SID of the device, got %q", subscription.SID())
+	}
+	calls := genaCalls(box)
+	if len(calls) != 1 || calls[0].Action != "SUBSCRIBE" || calls[0].Arguments["NT"] != "upnp:event" ||
+		calls[0].Arguments["TIMEOUT"] != "Second-60" || calls[0].Arguments["SID"] != "" {
+		t.Fatalf("expected a new subscription, got %v", calls)
+	}
+	callback := calls[0].Arguments["CALLBACK"]
+	if want := "<http://" + listener.Addr().String() + "/"; !strings.HasPrefix(callback, want) {
+		t.Errorf("expected a callback URL of the listener (%s…), got %s", want, callback)
+	}
+
+	initial := nextEvent(t, subscription)
+	if initial.Seq != 0 || initial.Service.Type != tr064test.OnTelService {
+		t.Errorf("expected the initial event of the service, got %+v", initial)
+	}
+	if want := map[string]interface{}{"X_AVM-DE_PhonebookList": "0"}; !reflect.DeepEqual(initial.Values, want) {
+		t.Errorf("expected the initial event to contain %v, got %v", want, initial.Values)
+	}
+
+	err = box.Notify(tr064test.OnTelService,
+		tr064.ArgumentValue{Name: "X_AVM-DE_PhonebookID", Value: "3"},
+		tr064.ArgumentValue{Name: "X_AVM-DE_PhonebookList", Value: "0,3"},
+		tr064.ArgumentValue{Name: "X_AVM-DE_PhonebookEntryID", Value: "not a number"},
+		tr064.ArgumentValue{Name: "X_AVM-DE_Unknown", Value: "<&>"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := nextEvent(t, subscription)
+	if event.Seq != 1 {
+		t.Errorf("expected the sequence number 1, got %d", event.Seq)
+	}
+	wantValues := map[string]interface{}{
+		"X_AVM-DE_PhonebookID":      uint64(3),
+		"X_AVM-DE_PhonebookList":    "0,3",
+		"X_AVM-DE_PhonebookEntryID": "not a number",
+		"X_AVM-DE_Unknown":          "<&>",
+	}
+	if !reflect.DeepEqual(event.Values, wantValues) {
+		t.Errorf("expected the values %v, got %v", wantValues, event.Values)
+	}
+	wantVariables := tr064.ArgumentValues{
+		{Name: "X_AVM-DE_PhonebookID", Value: "3"},
+		{Name: "X_AVM-DE_PhonebookList", Value: "0,3"},
+		{Name: "X_AVM-DE_PhonebookEntryID", Value: "not a number"},
+		{Name: "X_AVM-DE_Unknown", Value: "<&>"},
+	}
+	if !reflect.DeepEqual(event.Variables, wantVariables) {
+		t.Errorf("expected the variables %v, got %v", wantVariables, event.Variables)
+	}
+}
+
+func TestSubscribeWithoutEvents(t *testing.T) {
+	_, client, listener := newEventTest(t, tr064test.Options{})
+
+	_, err := client.Subscribe(context.Background(), listener, tr064test.DeviceConfigService, 0)
+	if err == nil || !strings.Contains(err.Error(), "does not send events") {
+		t.Errorf("expected an error for a service without events, got %v", err)
+	}
+}
+
+func TestNotificationValidation(t *testing.T) {
+	box, client, listener := newEventTest(t, tr064test.Options{})
+	subscription, err := client.Subscribe(context.Background(), listener, tr064test.OnTelService, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Unsubscribe(context.Background())
+	nextEvent(t, subscription)
+	callback := strings.Trim(genaCalls(box)[0].Arguments["CALLBACK"], "<>")
+	const body = `<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">` +
+		`<e:property><X_AVM-DE_PhonebookID>1</X_AVM-DE_PhonebookID></e:property></e:propertyset>`
+
+	tests := map[string]struct {
+		method     string
+		url        string
+		header     map[string]string
+		body       string
+		wantStatus int
+	}{
+		"wrong method": {method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+		"unknown subscription": {
+			url:        "http://" + listener.Addr().String() + "/events/unknown",
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		"wrong SID":       {header: map[string]string{"SID": "uuid:other"}, wantStatus: http.StatusPreconditionFailed},
+		"missing NT":      {header: map[string]string{"NT": ""}, wantStatus: http.StatusPreconditionFailed},
+		"wrong NTS":       {header: map[string]string{"NTS": "upnp:other"}, wantStatus: http.StatusPreconditionFailed},
+		"missing SEQ":     {header: map[string]string{"SEQ": ""}, wantStatus: http.StatusBadRequest},
+		"invalid SEQ":     {header: map[string]string{"SEQ": "-1"}, wantStatus: http.StatusBadRequest},
+		"SEQ overflow":    {header: map[string]string{"SEQ": "4294967296"}, wantStatus: http.StatusBadRequest},
+		"invalid XML":     {body: "<e:propertyset>", wantStatus: http.StatusBadRequest},
+		"valid":           {wantStatus: http.StatusOK},
+		"valid, last SEQ": {header: map[string]string{"SEQ": "4294967295"}, wantStatus: http.StatusOK},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			method, url, reqBody := "NOTIFY", callback, body
+			if tt.method != "" {
+				method = tt.method
+			}
+			if tt.url != "" {
+				url = tt.url
+			}
+			if tt.body != "" {
+				reqBody = tt.body
+			}
+			req, err := http.NewRequest(method, url, strings.NewReader(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := map[string]string{"NT": "upnp:event", "NTS": "upnp:propchange", "SID": subscription.SID(),
+				"SEQ": "7"}
+			for name, value := range tt.header {
+				header[name] = value
+			}
+			for name, value := range header {
+				if value != "" {
+					req.Header[name] = []string{value}
+				}
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected HTTP %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if event := nextEvent(t, subscription); event.Values["X_AVM-DE_PhonebookID"] != uint64(1) {
+					t.Errorf("expected the notified event, got %+v", event)
+				}
+			}
+		})
+	}
+	select {
+	case event := <-subscription.Events():
+		t.Errorf("rejected notifications must not be delivered, got %+v", event)
+	default:
+	}
+}
+
+func TestSubscriptionIsRenewedBeforeTheTimeout(t *testing.T) {
+	box, client, listener := newEventTest(t, tr064test.Options{SubscriptionTimeout: 2 * time.Second})
+	start := time.Now()
+	subscription, err := client.Subscribe(context.Background(), listener, tr064test.OnTelService, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Unsubscribe(context.Background())
+	nextEvent(t, subscription)
+	sid := subscription.SID()
+
+	// the fake forgets subscriptions which are not renewed within the granted 2 seconds
+	time.Sleep(time.Until(start.Add(2500 * time.Millisecond)))
+	if err := box.Notify(tr064test.OnTelService, tr064.ArgumentValue{Name: "X_AVM-DE_PhonebookID", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, subscription); event.Seq != 1 {
+		t.Errorf("expected the subscription to be alive, got %+v", event)
+	}
+
+	var renewals int
+	for _, call := range genaCalls(box) {
+		if call.Action == "SUBSCRIBE" && call.Arguments["SID"] == sid {
+			renewals++
+			if call.Arguments["TIMEOUT"] != "Second-3600" || call.Arguments["CALLBACK"] != "" {
+				t.Errorf("expected a renewal requesting the original duration, got %v", call.Arguments)
+			}
+		}
+	}
+	if renewals < 2 {
+		t.Errorf("expected the subscription to be renewed after half of the granted duration, got %d renewals",
+			renewals)
+	}
+	if subscription.SID() != sid || subscription.Err() != nil {
+		t.Errorf("expected the subscription to be kept, got SID %s and error %v", subscription.SID(),
+			subscription.Err())
+	}
+}
+
+func TestRenewResubscribesUnknownSubscriptions(t *testing.T) {
+	box, client, listener := newEventTest(t, tr064test.Options{})
+	subscription, err := client.Subscribe(context.Background(), listener, tr064test.OnTelService, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Unsubscribe(context.Background())
+	nextEvent(t, subscription)
+	oldSID := subscription.SID()
+
+	box.ExpireSubscriptions()
+	if err := subscription.Renew(context.Background()); err != nil {
+		t.Fatalf("expected a new subscription after 412 Precondition Failed: %v", err)
+	}
+	if subscription.SID() == oldSID || subscription.SID() == "" {
+		t.Errorf("expected a new SID, got %s", subscription.SID())
+	}
+	calls := genaCalls(box)
+	if len(calls) != 3 || calls[1].Arguments["SID"] != oldSID || calls[2].Arguments["CALLBACK"] == "" {
+		t.Errorf("expected a renewal and a new subscription, got %v", calls)
+	}
+	if event := nextEvent(t, subscription); event.Seq != 0 {
+		t.Errorf("expected the initial event of the new subscription, got %+v", event)
+	}
+	if err := box.Notify(tr064test.OnTelService, tr064.ArgumentValue{Name: "X_AVM-DE_PhonebookID", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, subscription); event.Seq != 1 {
+		t.Errorf("expected the events of the new subscription, got %+v", event)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	box, client, listener := newEventTest(t, tr064test.Options{})
+	subscription, err := client.Subscribe(context.Background(), listener, tr064test.OnTelService, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, subscription)
+	sid := subscription.SID()
+
+	if err := subscription.Unsubscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-subscription.Events():
+		if ok {
+			t.Error("expected no further events")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the events channel to be closed")
+	}
+	select {
+	case <-subscription.Done():
+	default:
+		t.Error("expected the subscription to be done")
+	}
+	if subscription.Err() != nil {
+		t.Errorf("an unsubscribed subscription has no error, got %v", subscription.Err())
+	}
+	calls := genaCalls(box)
+	if last := calls[len(calls)-1]; last.Action != "UNSUBSCRIBE" || last.Arguments["SID"] != sid {
+		t.Errorf("expected the subscription to be cancelled at the device, got %v", last)
+	}
+	if err := box.Notify(tr064test.OnTelService, tr064.ArgumentValue{Name: "X_AVM-DE_PhonebookID", Value: "1"}); err != nil {
+		t.Errorf("the device must not notify a cancelled subscription: %v", err)
+	}
+}
+
+func newEventTest(t *testing.T, opts tr064test.Options) (*tr064test.Server, *tr064.Client, *tr064.EventListener) {
+	t.Helper()
+	box := tr064test.NewServer(opts)
+	t.Cleanup(box.Close)
+	client, err := tr064.NewClient(context.Background(), box.URL, tr064test.DefaultUser, tr064test.DefaultPassword,
+		tr064.ClientOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tr064.NewEventListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	return box, client, listener
+}
+
+// genaCalls returns the SUBSCRIBE and UNSUBSCRIBE requests received by the box.
+func genaCalls(box *tr064test.Server) []tr064test.Call {
+	var calls []tr064test.Call
+	for _, call := range box.Calls() {
+		if call.Action == "SUBSCRIBE" || call.Action == "UNSUBSCRIBE" {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func nextEvent(t *testing.T, subscription *tr064.Subscription) tr064.Event {
+	t.Helper()
+	select {
+	case event, ok := <-subscription.Events():
+		if !ok {
+			t.Fatalf("the subscription ended: %v", subscription.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	return tr064.Event{}
+}
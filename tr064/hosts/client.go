@@ -0,0 +1,290 @@
+// Code generated by generate_tr064_client from hostsSCPD.xml; DO NOT EDIT.
+
+package hosts
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/huin/goupnp/soap"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// ServiceType is the type of the Hosts:1 service.
+const ServiceType = "urn:dslforum-org:service:Hosts:1"
+
+// Client performs the actions of the Hosts:1 service.
+type Client struct {
+	adapter *tr064.Adapter
+}
+
+// AddressSource is a value of the AddressSource state variable.
+type AddressSource string
+
+// The allowed values of AddressSource.
+const (
+	AddressSourceDHCP   AddressSource = "DHCP"
+	AddressSourceStatic AddressSource = "Static"
+	AddressSourceAutoIP AddressSource = "AutoIP"
+)
+
+// InterfaceType is a value of the InterfaceType state variable.
+type InterfaceType string
+
+// The allowed values of InterfaceType.
+const (
+	InterfaceTypeEthernet InterfaceType = "Ethernet"
+	InterfaceTypeV80211   InterfaceType = "802.11"
+	InterfaceTypeHomePNA  InterfaceType = "HomePNA"
+	InterfaceTypeHomePlug InterfaceType = "HomePlug"
+	InterfaceTypeOther    InterfaceType = "Other"
+)
+
+// New creates a Client which performs the actions via adapter.
+func New(adapter *tr064.Adapter) *Client {
+	return &Client{adapter: adapter}
+}
+
+// Connect creates a Client for the Hosts:1 service of the device accessed by client.
+func Connect(client *tr064.Client) (*Client, error) {
+	adapter, err := client.Service(ServiceType)
+	if err != nil {
+		return nil, err
+	}
+	return New(adapter), nil
+}
+
+// GetHostNumberOfEntries performs the GetHostNumberOfEntries action.
+func (c *Client) GetHostNumberOfEntries(ctx context.Context) (uint16, error) {
+	response := struct {
+		HostNumberOfEntries string `xml:"NewHostNumberOfEntries"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetHostNumberOfEntries", nil, &response); err != nil {
+		return 0, err
+	}
+	result, err := soap.UnmarshalUi2(response.HostNumberOfEntries)
+	if err != nil {
+		return 0, fmt.Errorf("GetHostNumberOfEntries: invalid NewHostNumberOfEntries: %v", err)
+	}
+	return result, nil
+}
+
+// GetSpecificHostEntryResult contains the out arguments of the GetSpecificHostEntry action.
+type GetSpecificHostEntryResult struct {
+	IPAddress          string
+	AddressSource      AddressSource
+	LeaseTimeRemaining int32
+	InterfaceType      InterfaceType
+	Active             bool
+	HostName           string
+}
+
+// GetSpecificHostEntry performs the GetSpecificHostEntry action.
+func (c *Client) GetSpecificHostEntry(ctx context.Context, macAddress string) (*GetSpecificHostEntryResult, error) {
+	request := struct {
+		MACAddress string `soap:"NewMACAddress"`
+	}{}
+	request.MACAddress = macAddress
+	response := struct {
+		IPAddress          string `xml:"NewIPAddress"`
+		AddressSource      string `xml:"NewAddressSource"`
+		LeaseTimeRemaining string `xml:"NewLeaseTimeRemaining"`
+		InterfaceType      string `xml:"NewInterfaceType"`
+		Active             string `xml:"NewActive"`
+		HostName           string `xml:"NewHostName"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetSpecificHostEntry", &request, &response); err != nil {
+		return nil, err
+	}
+	result := &GetSpecificHostEntryResult{}
+	result.IPAddress = response.IPAddress
+	result.AddressSource = AddressSource(response.AddressSource)
+	{
+		value, err := soap.UnmarshalI4(response.LeaseTimeRemaining)
+		if err != nil {
+			return nil, fmt.Errorf("GetSpecificHostEntry: invalid NewLeaseTimeRemaining: %v", err)
+		}
+		result.LeaseTimeRemaining = value
+	}
+	result.InterfaceType = InterfaceType(response.InterfaceType)
+	{
+		value, err := soap.UnmarshalBoolean(response.Active)
+		if err != nil {
+			return nil, fmt.Errorf("GetSpecificHostEntry: invalid NewActive: %v", err)
+		}
+		result.Active = value
+	}
+	result.HostName = response.HostName
+	return result, nil
+}
+
+// GetGenericHostEntryResult contains the out arguments of the GetGenericHostEntry action.
+type GetGenericHostEntryResult struct {
+	IPAddress          string
+	AddressSource      AddressSource
+	LeaseTimeRemaining int32
+	MACAddress         string
+	InterfaceType      InterfaceType
+	Active             bool
+	HostName           string
+}
+
+// GetGenericHostEntry performs the GetGenericHostEntry action.
+func (c *Client) GetGenericHostEntry(ctx context.Context, index uint16) (*GetGenericHostEntryResult, error) {
+	request := struct {
+		Index string `soap:"NewIndex"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(index)
+		if err != nil {
+			return nil, fmt.Errorf("GetGenericHostEntry: invalid NewIndex: %v", err)
+		}
+		request.Index = value
+	}
+	response := struct {
+		IPAddress          string `xml:"NewIPAddress"`
+		AddressSource      string `xml:"NewAddressSource"`
+		LeaseTimeRemaining string `xml:"NewLeaseTimeRemaining"`
+		MACAddress         string `xml:"NewMACAddress"`
+		InterfaceType      string `xml:"NewInterfaceType"`
+		Active             string `xml:"NewActive"`
+		HostName           string `xml:"NewHostName"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetGenericHostEntry", &request, &response); err != nil {
+		return nil, err
+	}
+	result := &GetGenericHostEntryResult{}
+	result.IPAddress = response.IPAddress
+	result.AddressSource = AddressSource(response.AddressSource)
+	{
+		value, err := soap.UnmarshalI4(response.LeaseTimeRemaining)
+		if err != nil {
+			return nil, fmt.Errorf("GetGenericHostEntry: invalid NewLeaseTimeRemaining: %v", err)
+		}
+		result.LeaseTimeRemaining = value
+	}
+	result.MACAddress = response.MACAddress
+	result.InterfaceType = InterfaceType(response.InterfaceType)
+	{
+		value, err := soap.UnmarshalBoolean(response.Active)
+		if err != nil {
+			return nil, fmt.Errorf("GetGenericHostEntry: invalid NewActive: %v", err)
+		}
+		result.Active = value
+	}
+	result.HostName = response.HostName
+	return result, nil
+}
+
+// GetChangeCounter performs the X_AVM-DE_GetChangeCounter action.
+func (c *Client) GetChangeCounter(ctx context.Context) (uint32, error) {
+	response := struct {
+		ChangeCounter string `xml:"NewX_AVM-DE_ChangeCounter"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "X_AVM-DE_GetChangeCounter", nil, &response); err != nil {
+		return 0, err
+	}
+	result, err := soap.UnmarshalUi4(response.ChangeCounter)
+	if err != nil {
+		return 0, fmt.Errorf("X_AVM-DE_GetChangeCounter: invalid NewX_AVM-DE_ChangeCounter: %v", err)
+	}
+	return result, nil
+}
+
+// SetHostNameByMACAddress performs the X_AVM-DE_SetHostNameByMACAddress action.
+func (c *Client) SetHostNameByMACAddress(ctx context.Context, macAddress string, hostName string) error {
+	request := struct {
+		MACAddress string `soap:"NewMACAddress"`
+		HostName   string `soap:"NewHostName"`
+	}{}
+	request.MACAddress = macAddress
+	request.HostName = hostName
+	return c.adapter.Perform(ctx, ServiceType, "X_AVM-DE_SetHostNameByMACAddress", &request, nil)
+}
+
+// GetSpecificHostEntryByIPResult contains the out arguments of the X_AVM-DE_GetSpecificHostEntryByIP action.
+type GetSpecificHostEntryByIPResult struct {
+	MACAddress    string
+	Active        bool
+	HostName      string
+	InterfaceType InterfaceType
+	Port          uint32
+	Speed         uint32
+}
+
+// GetSpecificHostEntryByIP performs the X_AVM-DE_GetSpecificHostEntryByIP action.
+func (c *Client) GetSpecificHostEntryByIP(ctx context.Context, ipAddress string) (*GetSpecificHostEntryByIPResult, error) {
+	request := struct {
+		IPAddress string `soap:"NewIPAddress"`
+	}{}
+	request.IPAddress = ipAddress
+	response := struct {
+		MACAddress    string `xml:"NewMACAddress"`
+		Active        string `xml:"NewActive"`
+		HostName      string `xml:"NewHostName"`
+		InterfaceType string `xml:"NewInterfaceType"`
+		Port          string `xml:"NewX_AVM-DE_Port"`
+		Speed         string `xml:"NewX_AVM-DE_Speed"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "X_AVM-DE_GetSpecificHostEntryByIP", &request, &response); err != nil {
+		return nil, err
+	}
+	result := &GetSpecificHostEntryByIPResult{}
+	result.MACAddress = response.MACAddress
+	{
+		value, err := soap.UnmarshalBoolean(response.Active)
+		if err != nil {
+			return nil, fmt.Errorf("X_AVM-DE_GetSpecificHostEntryByIP: invalid NewActive: %v", err)
+		}
+		result.Active = value
+	}
+	result.HostName = response.HostName
+	result.InterfaceType = InterfaceType(response.InterfaceType)
+	{
+		value, err := soap.UnmarshalUi4(response.Port)
+		if err != nil {
+			return nil, fmt.Errorf("X_AVM-DE_GetSpecificHostEntryByIP: invalid NewX_AVM-DE_Port: %v", err)
+		}
+		result.Port = value
+	}
+	{
+		value, err := soap.UnmarshalUi4(response.Speed)
+		if err != nil {
+			return nil, fmt.Errorf("X_AVM-DE_GetSpecificHostEntryByIP: invalid NewX_AVM-DE_Speed: %v", err)
+		}
+		result.Speed = value
+	}
+	return result, nil
+}
+
+// GetHostListPath performs the X_AVM-DE_GetHostListPath action.
+func (c *Client) GetHostListPath(ctx context.Context) (string, error) {
+	response := struct {
+		HostListPath string `xml:"NewX_AVM-DE_HostListPath"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "X_AVM-DE_GetHostListPath", nil, &response); err != nil {
+		return "", err
+	}
+	return response.HostListPath, nil
+}
+
+// GetMeshListPath performs the X_AVM-DE_GetMeshListPath action.
+func (c *Client) GetMeshListPath(ctx context.Context) (string, error) {
+	response := struct {
+		MeshListPath string `xml:"NewX_AVM-DE_MeshListPath"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "X_AVM-DE_GetMeshListPath", nil, &response); err != nil {
+		return "", err
+	}
+	return response.MeshListPath, nil
+}
+
+// WakeOnLANByMACAddress performs the X_AVM-DE_WakeOnLANByMACAddress action.
+func (c *Client) WakeOnLANByMACAddress(ctx context.Context, macAddress string) error {
+	request := struct {
+		MACAddress string `soap:"NewMACAddress"`
+	}{}
+	request.MACAddress = macAddress
+	return c.adapter.Perform(ctx, ServiceType, "X_AVM-DE_WakeOnLANByMACAddress", &request, nil)
+}
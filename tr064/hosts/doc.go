@@ -0,0 +1,6 @@
+// Package hosts provides a typed client for the Hosts:1 service.
+//
+// The client is generated from hostsSCPD.xml, a copy of the service description of a Fritz!Box.
+package hosts
+
+//go:generate go run ../../cmd/generate_tr064_client -s urn:dslforum-org:service:Hosts:1 -f hostsSCPD.xml -o client.go
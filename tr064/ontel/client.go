@@ -0,0 +1,371 @@
+// Code generated by generate_tr064_client from x_contactSCPD.xml; DO NOT EDIT.
+
+package ontel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/huin/goupnp/soap"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// ServiceType is the type of the X_AVM-DE_OnTel:1 service.
+const ServiceType = "urn:dslforum-org:service:X_AVM-DE_OnTel:1"
+
+// Client performs the actions of the X_AVM-DE_OnTel:1 service.
+type Client struct {
+	adapter *tr064.Adapter
+}
+
+// New creates a Client which performs the actions via adapter.
+func New(adapter *tr064.Adapter) *Client {
+	return &Client{adapter: adapter}
+}
+
+// Connect creates a Client for the X_AVM-DE_OnTel:1 service of the device accessed by client.
+func Connect(client *tr064.Client) (*Client, error) {
+	adapter, err := client.Service(ServiceType)
+	if err != nil {
+		return nil, err
+	}
+	return New(adapter), nil
+}
+
+// GetNumberOfEntries performs the GetNumberOfEntries action.
+func (c *Client) GetNumberOfEntries(ctx context.Context) (uint16, error) {
+	response := struct {
+		OnTelNumberOfEntries string `xml:"NewOnTelNumberOfEntries"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetNumberOfEntries", nil, &response); err != nil {
+		return 0, err
+	}
+	result, err := soap.UnmarshalUi2(response.OnTelNumberOfEntries)
+	if err != nil {
+		return 0, fmt.Errorf("GetNumberOfEntries: invalid NewOnTelNumberOfEntries: %v", err)
+	}
+	return result, nil
+}
+
+// GetCallList performs the GetCallList action.
+func (c *Client) GetCallList(ctx context.Context) (string, error) {
+	response := struct {
+		CallListURL string `xml:"NewCallListURL"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetCallList", nil, &response); err != nil {
+		return "", err
+	}
+	return response.CallListURL, nil
+}
+
+// GetPhonebookList performs the GetPhonebookList action.
+func (c *Client) GetPhonebookList(ctx context.Context) (string, error) {
+	response := struct {
+		PhonebookList string `xml:"NewPhonebookList"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetPhonebookList", nil, &response); err != nil {
+		return "", err
+	}
+	return response.PhonebookList, nil
+}
+
+// GetPhonebookResult contains the out arguments of the GetPhonebook action.
+type GetPhonebookResult struct {
+	PhonebookName    string
+	PhonebookExtraID string
+	PhonebookURL     string
+}
+
+// GetPhonebook performs the GetPhonebook action.
+func (c *Client) GetPhonebook(ctx context.Context, phonebookID uint16) (*GetPhonebookResult, error) {
+	request := struct {
+		PhonebookID string `soap:"NewPhonebookID"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(phonebookID)
+		if err != nil {
+			return nil, fmt.Errorf("GetPhonebook: invalid NewPhonebookID: %v", err)
+		}
+		request.PhonebookID = value
+	}
+	response := struct {
+		PhonebookName    string `xml:"NewPhonebookName"`
+		PhonebookExtraID string `xml:"NewPhonebookExtraID"`
+		PhonebookURL     string `xml:"NewPhonebookURL"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetPhonebook", &request, &response); err != nil {
+		return nil, err
+	}
+	result := &GetPhonebookResult{}
+	result.PhonebookName = response.PhonebookName
+	result.PhonebookExtraID = response.PhonebookExtraID
+	result.PhonebookURL = response.PhonebookURL
+	return result, nil
+}
+
+// AddPhonebook performs the AddPhonebook action.
+func (c *Client) AddPhonebook(ctx context.Context, phonebookExtraID string, phonebookName string) error {
+	request := struct {
+		PhonebookExtraID string `soap:"NewPhonebookExtraID"`
+		PhonebookName    string `soap:"NewPhonebookName"`
+	}{}
+	request.PhonebookExtraID = phonebookExtraID
+	request.PhonebookName = phonebookName
+	return c.adapter.Perform(ctx, ServiceType, "AddPhonebook", &request, nil)
+}
+
+// DeletePhonebook performs the DeletePhonebook action.
+func (c *Client) DeletePhonebook(ctx context.Context, phonebookID uint16, phonebookExtraID string) error {
+	request := struct {
+		PhonebookID      string `soap:"NewPhonebookID"`
+		PhonebookExtraID string `soap:"NewPhonebookExtraID"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(phonebookID)
+		if err != nil {
+			return fmt.Errorf("DeletePhonebook: invalid NewPhonebookID: %v", err)
+		}
+		request.PhonebookID = value
+	}
+	request.PhonebookExtraID = phonebookExtraID
+	return c.adapter.Perform(ctx, ServiceType, "DeletePhonebook", &request, nil)
+}
+
+// GetPhonebookEntry performs the GetPhonebookEntry action.
+func (c *Client) GetPhonebookEntry(ctx context.Context, phonebookID uint16, phonebookEntryID uint32) (string, error) {
+	request := struct {
+		PhonebookID      string `soap:"NewPhonebookID"`
+		PhonebookEntryID string `soap:"NewPhonebookEntryID"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(phonebookID)
+		if err != nil {
+			return "", fmt.Errorf("GetPhonebookEntry: invalid NewPhonebookID: %v", err)
+		}
+		request.PhonebookID = value
+	}
+	{
+		value, err := soap.MarshalUi4(phonebookEntryID)
+		if err != nil {
+			return "", fmt.Errorf("GetPhonebookEntry: invalid NewPhonebookEntryID: %v", err)
+		}
+		request.PhonebookEntryID = value
+	}
+	response := struct {
+		PhonebookEntryData string `xml:"NewPhonebookEntryData"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetPhonebookEntry", &request, &response); err != nil {
+		return "", err
+	}
+	return response.PhonebookEntryData, nil
+}
+
+// GetPhonebookEntryUID performs the GetPhonebookEntryUID action.
+func (c *Client) GetPhonebookEntryUID(ctx context.Context, phonebookID uint16, phonebookEntryUniqueID uint32) (string, error) {
+	request := struct {
+		PhonebookID            string `soap:"NewPhonebookID"`
+		PhonebookEntryUniqueID string `soap:"NewPhonebookEntryUniqueID"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(phonebookID)
+		if err != nil {
+			return "", fmt.Errorf("GetPhonebookEntryUID: invalid NewPhonebookID: %v", err)
+		}
+		request.PhonebookID = value
+	}
+	{
+		value, err := soap.MarshalUi4(phonebookEntryUniqueID)
+		if err != nil {
+			return "", fmt.Errorf("GetPhonebookEntryUID: invalid NewPhonebookEntryUniqueID: %v", err)
+		}
+		request.PhonebookEntryUniqueID = value
+	}
+	response := struct {
+		PhonebookEntryData string `xml:"NewPhonebookEntryData"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetPhonebookEntryUID", &request, &response); err != nil {
+		return "", err
+	}
+	return response.PhonebookEntryData, nil
+}
+
+// SetPhonebookEntry performs the SetPhonebookEntry action.
+func (c *Client) SetPhonebookEntry(ctx context.Context, phonebookID uint16, phonebookEntryID uint32, phonebookEntryData string) error {
+	request := struct {
+		PhonebookID        string `soap:"NewPhonebookID"`
+		PhonebookEntryID   string `soap:"NewPhonebookEntryID"`
+		PhonebookEntryData string `soap:"NewPhonebookEntryData"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(phonebookID)
+		if err != nil {
+			return fmt.Errorf("SetPhonebookEntry: invalid NewPhonebookID: %v", err)
+		}
+		request.PhonebookID = value
+	}
+	{
+		value, err := soap.MarshalUi4(phonebookEntryID)
+		if err != nil {
+			return fmt.Errorf("SetPhonebookEntry: invalid NewPhonebookEntryID: %v", err)
+		}
+		request.PhonebookEntryID = value
+	}
+	request.PhonebookEntryData = phonebookEntryData
+	return c.adapter.Perform(ctx, ServiceType, "SetPhonebookEntry", &request, nil)
+}
+
+// SetPhonebookEntryUID performs the SetPhonebookEntryUID action.
+func (c *Client) SetPhonebookEntryUID(ctx context.Context, phonebookID uint16, phonebookEntryData string) (uint32, error) {
+	request := struct {
+		PhonebookID        string `soap:"NewPhonebookID"`
+		PhonebookEntryData string `soap:"NewPhonebookEntryData"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(phonebookID)
+		if err != nil {
+			return 0, fmt.Errorf("SetPhonebookEntryUID: invalid NewPhonebookID: %v", err)
+		}
+		request.PhonebookID = value
+	}
+	request.PhonebookEntryData = phonebookEntryData
+	response := struct {
+		PhonebookEntryUniqueID string `xml:"NewPhonebookEntryUniqueID"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "SetPhonebookEntryUID", &request, &response); err != nil {
+		return 0, err
+	}
+	result, err := soap.UnmarshalUi4(response.PhonebookEntryUniqueID)
+	if err != nil {
+		return 0, fmt.Errorf("SetPhonebookEntryUID: invalid NewPhonebookEntryUniqueID: %v", err)
+	}
+	return result, nil
+}
+
+// DeletePhonebookEntry performs the DeletePhonebookEntry action.
+func (c *Client) DeletePhonebookEntry(ctx context.Context, phonebookID uint16, phonebookEntryID uint32) error {
+	request := struct {
+		PhonebookID      string `soap:"NewPhonebookID"`
+		PhonebookEntryID string `soap:"NewPhonebookEntryID"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(phonebookID)
+		if err != nil {
+			return fmt.Errorf("DeletePhonebookEntry: invalid NewPhonebookID: %v", err)
+		}
+		request.PhonebookID = value
+	}
+	{
+		value, err := soap.MarshalUi4(phonebookEntryID)
+		if err != nil {
+			return fmt.Errorf("DeletePhonebookEntry: invalid NewPhonebookEntryID: %v", err)
+		}
+		request.PhonebookEntryID = value
+	}
+	return c.adapter.Perform(ctx, ServiceType, "DeletePhonebookEntry", &request, nil)
+}
+
+// DeletePhonebookEntryUID performs the DeletePhonebookEntryUID action.
+func (c *Client) DeletePhonebookEntryUID(ctx context.Context, phonebookID uint16, phonebookEntryUniqueID uint32) error {
+	request := struct {
+		PhonebookID            string `soap:"NewPhonebookID"`
+		PhonebookEntryUniqueID string `soap:"NewPhonebookEntryUniqueID"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(phonebookID)
+		if err != nil {
+			return fmt.Errorf("DeletePhonebookEntryUID: invalid NewPhonebookID: %v", err)
+		}
+		request.PhonebookID = value
+	}
+	{
+		value, err := soap.MarshalUi4(phonebookEntryUniqueID)
+		if err != nil {
+			return fmt.Errorf("DeletePhonebookEntryUID: invalid NewPhonebookEntryUniqueID: %v", err)
+		}
+		request.PhonebookEntryUniqueID = value
+	}
+	return c.adapter.Perform(ctx, ServiceType, "DeletePhonebookEntryUID", &request, nil)
+}
+
+// GetCallBarringList performs the GetCallBarringList action.
+func (c *Client) GetCallBarringList(ctx context.Context) (string, error) {
+	response := struct {
+		PhonebookURL string `xml:"NewPhonebookURL"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetCallBarringList", nil, &response); err != nil {
+		return "", err
+	}
+	return response.PhonebookURL, nil
+}
+
+// GetDECTHandsetList performs the GetDECTHandsetList action.
+func (c *Client) GetDECTHandsetList(ctx context.Context) (string, error) {
+	response := struct {
+		DectIDList string `xml:"NewDectIDList"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetDECTHandsetList", nil, &response); err != nil {
+		return "", err
+	}
+	return response.DectIDList, nil
+}
+
+// GetDECTHandsetInfoResult contains the out arguments of the GetDECTHandsetInfo action.
+type GetDECTHandsetInfoResult struct {
+	HandsetName string
+	PhonebookID uint16
+}
+
+// GetDECTHandsetInfo performs the GetDECTHandsetInfo action.
+func (c *Client) GetDECTHandsetInfo(ctx context.Context, dectID uint16) (*GetDECTHandsetInfoResult, error) {
+	request := struct {
+		DectID string `soap:"NewDectID"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(dectID)
+		if err != nil {
+			return nil, fmt.Errorf("GetDECTHandsetInfo: invalid NewDectID: %v", err)
+		}
+		request.DectID = value
+	}
+	response := struct {
+		HandsetName string `xml:"NewHandsetName"`
+		PhonebookID string `xml:"NewPhonebookID"`
+	}{}
+	if err := c.adapter.Perform(ctx, ServiceType, "GetDECTHandsetInfo", &request, &response); err != nil {
+		return nil, err
+	}
+	result := &GetDECTHandsetInfoResult{}
+	result.HandsetName = response.HandsetName
+	{
+		value, err := soap.UnmarshalUi2(response.PhonebookID)
+		if err != nil {
+			return nil, fmt.Errorf("GetDECTHandsetInfo: invalid NewPhonebookID: %v", err)
+		}
+		result.PhonebookID = value
+	}
+	return result, nil
+}
+
+// SetDECTHandsetPhonebook performs the SetDECTHandsetPhonebook action.
+func (c *Client) SetDECTHandsetPhonebook(ctx context.Context, dectID uint16, phonebookID uint16) error {
+	request := struct {
+		DectID      string `soap:"NewDectID"`
+		PhonebookID string `soap:"NewPhonebookID"`
+	}{}
+	{
+		value, err := soap.MarshalUi2(dectID)
+		if err != nil {
+			return fmt.Errorf("SetDECTHandsetPhonebook: invalid NewDectID: %v", err)
+		}
+		request.DectID = value
+	}
+	{
+		value, err := soap.MarshalUi2(phonebookID)
+		if err != nil {
+			return fmt.Errorf("SetDECTHandsetPhonebook: invalid NewPhonebookID: %v", err)
+		}
+		request.PhonebookID = value
+	}
+	return c.adapter.Perform(ctx, ServiceType, "SetDECTHandsetPhonebook", &request, nil)
+}
@@ -0,0 +1,6 @@
+// Package ontel provides a typed client for the X_AVM-DE_OnTel:1 service.
+//
+// The client is generated from x_contactSCPD.xml, a copy of the service description of a Fritz!Box.
+package ontel
+
+//go:generate go run ../../cmd/generate_tr064_client -s urn:dslforum-org:service:X_AVM-DE_OnTel:1 -f x_contactSCPD.xml -o client.go
@@ -0,0 +1,157 @@
+package tr064
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// DeviceInfoService is the type of the TR-064 service providing general device information.
+const DeviceInfoService = "urn:dslforum-org:service:DeviceInfo:1"
+
+// TLSOptions configures how the certificate of a TR-064 device is verified.
+// Without Fingerprint and TrustStore, the certificate has to be signed by a trusted authority.
+type TLSOptions struct {
+	// Fingerprint is the hex encoded SHA-256 fingerprint of the trusted device certificate
+	// (optionally separated by colons).
+	Fingerprint string
+	// TrustStore is the path of a file which stores the fingerprints of device certificates.
+	// The certificate of an unknown device is trusted on first use and its fingerprint is added to the file.
+	TrustStore string
+}
+
+// trustStoreMutex serializes the access to trust store files.
+var trustStoreMutex sync.Mutex
+
+// NewTLSConfig returns a TLS configuration for connections to host which verifies the device certificate
+// according to opts.
+func NewTLSConfig(host string, opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	switch {
+	case opts.Fingerprint != "":
+		pin, err := hex.DecodeString(strings.ReplaceAll(opts.Fingerprint, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint “%s”", opts.Fingerprint)
+		}
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyFingerprint(rawCerts, pin)
+		}
+	case opts.TrustStore != "":
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyTrustOnFirstUse(rawCerts, host, opts.TrustStore)
+		}
+	}
+	return config, nil
+}
+
+// secureBaseURL returns the HTTPS base URL of the device reachable at baseURL.
+// The HTTPS port is queried via the DeviceInfo service, which does not require authentication.
+func secureBaseURL(ctx context.Context, baseURL string, desc *Description, transport http.RoundTripper) (string, error) {
+	service := desc.FindService(DeviceInfoService)
+	if service == nil {
+		return "", fmt.Errorf("%s does not provide a DeviceInfo:1 service", baseURL)
+	}
+	controlURL, err := url.Parse(baseURL + service.ControlURL)
+	if err != nil {
+		return "", err
+	}
+	soapClient := soap.SOAPClient{
+		EndpointURL: *controlURL,
+		HTTPClient:  http.Client{Transport: &contextTransport{ctx: ctx, transport: transport}},
+	}
+	result := struct{ NewSecurityPort string }{}
+	if err := soapClient.PerformAction(service.Type, "GetSecurityPort", nil, &result); err != nil {
+		return "", fmt.Errorf("cannot determine HTTPS port: %v", err)
+	}
+	return "https://" + net.JoinHostPort(controlURL.Hostname(), result.NewSecurityPort), nil
+}
+
+func fingerprint(rawCerts [][]byte) ([]byte, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("server did not present a certificate")
+	}
+	sum := sha256.Sum256(rawCerts[0])
+	return sum[:], nil
+}
+
+func verifyFingerprint(rawCerts [][]byte, pin []byte) error {
+	sum, err := fingerprint(rawCerts)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, pin) {
+		return fmt.Errorf("server certificate fingerprint %x does not match the pinned one", sum)
+	}
+	return nil
+}
+
+func verifyTrustOnFirstUse(rawCerts [][]byte, host, trustStore string) error {
+	sum, err := fingerprint(rawCerts)
+	if err != nil {
+		return err
+	}
+
+	trustStoreMutex.Lock()
+	defer trustStoreMutex.Unlock()
+
+	known, err := readTrustStore(trustStore)
+	if err != nil {
+		return err
+	}
+	if pin, ok := known[host]; ok {
+		return verifyFingerprint(rawCerts, pin)
+	}
+
+	file, err := os.OpenFile(trustStore, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot store certificate fingerprint: %v", err)
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s %x\n", host, sum); err != nil {
+		return fmt.Errorf("cannot store certificate fingerprint: %v", err)
+	}
+	return nil
+}
+
+// readTrustStore reads a trust store file consisting of lines “<host> <hex encoded SHA-256 fingerprint>”.
+func readTrustStore(path string) (map[string][]byte, error) {
+	known := map[string][]byte{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read trust store: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		pin, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid fingerprint for %s in trust store: %v", fields[0], err)
+		}
+		known[fields[0]] = pin
+	}
+	return known, scanner.Err()
+}
@@ -0,0 +1,152 @@
+package tr064_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/toaster/fritz_sync/retry"
+	"github.com/toaster/fritz_sync/tr064"
+	"github.com/toaster/fritz_sync/tr064/ontel"
+	"github.com/toaster/fritz_sync/tr064/tr064test"
+)
+
+func TestHTTPSViaSecurityPort(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{TLS: true})
+	defer box.Close()
+
+	client, err := tr064.NewClient(context.Background(), box.URL, tr064test.DefaultUser, tr064test.DefaultPassword,
+		tr064.ClientOptions{HTTPS: true, TLS: tr064.TLSOptions{Fingerprint: certFingerprint(box)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.BaseURL() != box.SecureURL {
+		t.Errorf("expected base URL %s, got %s", box.SecureURL, client.BaseURL())
+	}
+	onTel := connectOnTel(t, box.URL, tr064.ClientOptions{
+		HTTPS: true,
+		TLS:   tr064.TLSOptions{Fingerprint: certFingerprint(box)},
+	})
+	if err := getPhonebookList(context.Background(), onTel); err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range box.Calls() {
+		if call.Action == "GetPhonebookList" && !call.TLS {
+			t.Error("authenticated actions have to be performed via HTTPS")
+		}
+	}
+}
+
+func TestHTTPSWithoutSecurityPort(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{})
+	defer box.Close()
+
+	_, err := tr064.NewClient(context.Background(), box.URL, tr064test.DefaultUser, tr064test.DefaultPassword,
+		tr064.ClientOptions{HTTPS: true})
+	if err == nil || !strings.Contains(err.Error(), "cannot determine HTTPS port") {
+		t.Errorf("expected an error about the HTTPS port, got %v", err)
+	}
+}
+
+func TestFingerprintPinning(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{TLS: true})
+	defer box.Close()
+	pin := certFingerprint(box)
+	var colonSeparated []string
+	for i := 0; i < len(pin); i += 2 {
+		colonSeparated = append(colonSeparated, strings.ToUpper(pin[i:i+2]))
+	}
+
+	tests := map[string]struct {
+		fingerprint string
+		wantErr     string
+	}{
+		"matching fingerprint":  {fingerprint: pin},
+		"colon separated":       {fingerprint: strings.Join(colonSeparated, ":")},
+		"other fingerprint":     {fingerprint: strings.Repeat("00", sha256.Size), wantErr: "does not match the pinned one"},
+		"invalid fingerprint":   {fingerprint: "not a fingerprint", wantErr: "invalid SHA-256 certificate fingerprint"},
+		"truncated fingerprint": {fingerprint: pin[:32], wantErr: "invalid SHA-256 certificate fingerprint"},
+		"no fingerprint (CA)":   {wantErr: "certificate"},
+	}
+	for name, tt := range tests {
+		for urlName, baseURL := range map[string]string{"HTTPS URL": box.SecureURL, "security port": box.URL} {
+			t.Run(name+", "+urlName, func(t *testing.T) {
+				err := performViaHTTPS(baseURL, tr064.TLSOptions{Fingerprint: tt.fingerprint})
+				if tt.wantErr == "" {
+					if err != nil {
+						t.Errorf("expected the certificate to be trusted: %v", err)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+			})
+		}
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	box := tr064test.NewServer(tr064test.Options{TLS: true})
+	defer box.Close()
+	dir, err := ioutil.TempDir("", "tr064")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trustStore := filepath.Join(dir, "known_boxes")
+	connect := func() error {
+		return performViaHTTPS(box.URL, tr064.TLSOptions{TrustStore: trustStore})
+	}
+
+	if err := connect(); err != nil {
+		t.Fatalf("an unknown certificate has to be trusted on first use: %v", err)
+	}
+	want := "127.0.0.1 " + certFingerprint(box) + "\n"
+	if data, _ := ioutil.ReadFile(trustStore); string(data) != want {
+		t.Fatalf("expected the trust store to contain %q, got %q", want, data)
+	}
+	if err := connect(); err != nil {
+		t.Fatalf("the stored certificate has to be trusted: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(trustStore); string(data) != want {
+		t.Errorf("a known certificate must not be stored again, got %q", data)
+	}
+
+	// the certificate changed
+	changed := "fritz.box " + certFingerprint(box) + "\n127.0.0.1 " + strings.Repeat("00", sha256.Size) + "\n"
+	if err := ioutil.WriteFile(trustStore, []byte(changed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a changed certificate to be rejected, got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(trustStore); string(data) != changed {
+		t.Errorf("a rejected certificate must not be stored, got %q", data)
+	}
+}
+
+// performViaHTTPS connects to the device at baseURL via HTTPS and performs an authenticated action.
+func performViaHTTPS(baseURL string, opts tr064.TLSOptions) error {
+	ctx := context.Background()
+	client, err := tr064.NewClient(ctx, baseURL, tr064test.DefaultUser, tr064test.DefaultPassword,
+		tr064.ClientOptions{HTTPS: true, Retry: retry.Policy{Attempts: 1}, TLS: opts})
+	if err != nil {
+		return err
+	}
+	onTel, err := ontel.Connect(client)
+	if err != nil {
+		return err
+	}
+	return getPhonebookList(ctx, onTel)
+}
+
+func certFingerprint(box *tr064test.Server) string {
+	sum := sha256.Sum256(box.Certificate().Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,210 @@
+package tr064test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// subscription is a GENA event subscription of a client.
+type subscription struct {
+	callback string
+	expires  time.Time
+	service  string
+	sid      string
+
+	// sendMutex keeps the notifications of the subscription in the order of their sequence numbers.
+	sendMutex sync.Mutex
+	seq       uint32
+}
+
+// ExpireSubscriptions forgets all event subscriptions, e.g. like a Fritz!Box after a reboot.
+// Renewing them fails with 412 Precondition Failed.
+func (s *Server) ExpireSubscriptions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscriptions = map[string]*subscription{}
+}
+
+// Notify sends the changed state variables of the service with the given type to all of its subscribers
+// and returns the first failure of a delivery. The variables are part of the initial event of later subscriptions.
+func (s *Server) Notify(serviceType string, variables ...tr064.ArgumentValue) error {
+	s.mutex.Lock()
+	state := s.eventState[serviceType]
+	for _, variable := range variables {
+		state = setVariable(state, variable)
+	}
+	s.eventState[serviceType] = state
+	var subscribers []*subscription
+	for _, sub := range s.subscriptions {
+		if sub.service == serviceType && time.Now().Before(sub.expires) {
+			subscribers = append(subscribers, sub)
+		}
+	}
+	s.mutex.Unlock()
+
+	var firstErr error
+	for _, sub := range subscribers {
+		if err := sub.notify(variables); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// serveEvents handles the SUBSCRIBE and UNSUBSCRIBE requests of GENA.
+func (s *Server) serveEvents(w http.ResponseWriter, req *http.Request) {
+	svc := s.findService(func(svc *service) bool { return svc.eventSubURL != "" && svc.eventSubURL == req.URL.Path })
+	if svc == nil {
+		http.NotFound(w, req)
+		return
+	}
+	call := Call{Action: req.Method, Arguments: map[string]string{}, Service: svc.serviceType, TLS: req.TLS != nil}
+	for _, name := range []string{"CALLBACK", "NT", "SID", "TIMEOUT"} {
+		if value := req.Header.Get(name); value != "" {
+			call.Arguments[name] = value
+		}
+	}
+	s.mutex.Lock()
+	s.calls = append(s.calls, call)
+	s.mutex.Unlock()
+
+	sid := call.Arguments["SID"]
+	switch {
+	case sid != "" && (call.Arguments["CALLBACK"] != "" || call.Arguments["NT"] != ""):
+		w.WriteHeader(http.StatusBadRequest)
+	case req.Method == "UNSUBSCRIBE":
+		if s.removeSubscription(sid) == nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}
+	case sid != "":
+		s.renewSubscription(w, sid, call.Arguments["TIMEOUT"])
+	default:
+		s.addSubscription(w, svc, call.Arguments)
+	}
+}
+
+func (s *Server) addSubscription(w http.ResponseWriter, svc *service, headers map[string]string) {
+	callback := headers["CALLBACK"]
+	if headers["NT"] != "upnp:event" || !strings.HasPrefix(callback, "<") || !strings.HasSuffix(callback, ">") {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	timeout := s.grantedTimeout(headers["TIMEOUT"])
+	sub := &subscription{
+		callback: strings.Trim(callback, "<>"),
+		expires:  time.Now().Add(timeout),
+		service:  svc.serviceType,
+		sid:      "uuid:" + newToken(),
+	}
+	s.mutex.Lock()
+	s.subscriptions[sub.sid] = sub
+	initial := append(tr064.ArgumentValues(nil), s.eventState[svc.serviceType]...)
+	s.mutex.Unlock()
+
+	writeSubscription(w, sub.sid, timeout)
+	// the initial event may arrive before the response, like with a real device
+	go func() {
+		_ = sub.notify(initial)
+	}()
+}
+
+// grantedTimeout returns the subscription duration for the TIMEOUT header of a request (default 30 minutes).
+func (s *Server) grantedTimeout(header string) time.Duration {
+	timeout := 30 * time.Minute
+	if seconds, err := strconv.Atoi(strings.TrimPrefix(header, "Second-")); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if s.opts.SubscriptionTimeout > 0 && timeout > s.opts.SubscriptionTimeout {
+		timeout = s.opts.SubscriptionTimeout
+	}
+	return timeout
+}
+
+func (s *Server) removeSubscription(sid string) *subscription {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sub := s.subscriptions[sid]
+	delete(s.subscriptions, sid)
+	if sub == nil || time.Now().After(sub.expires) {
+		return nil
+	}
+	return sub
+}
+
+func (s *Server) renewSubscription(w http.ResponseWriter, sid, timeoutHeader string) {
+	timeout := s.grantedTimeout(timeoutHeader)
+	s.mutex.Lock()
+	sub := s.subscriptions[sid]
+	valid := sub != nil && time.Now().Before(sub.expires)
+	if valid {
+		sub.expires = time.Now().Add(timeout)
+	} else {
+		delete(s.subscriptions, sid)
+	}
+	s.mutex.Unlock()
+	if !valid {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	writeSubscription(w, sid, timeout)
+}
+
+// notify sends a NOTIFY request with the variables to the subscriber.
+func (sub *subscription) notify(variables tr064.ArgumentValues) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` + "\n" + `<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">`)
+	for _, variable := range variables {
+		fmt.Fprintf(&body, "<e:property><%s>", variable.Name)
+		_ = xml.EscapeText(&body, []byte(variable.Value))
+		fmt.Fprintf(&body, "</%s></e:property>", variable.Name)
+	}
+	body.WriteString("</e:propertyset>")
+
+	sub.sendMutex.Lock()
+	defer sub.sendMutex.Unlock()
+	req, err := http.NewRequest("NOTIFY", sub.callback, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header["NT"] = []string{"upnp:event"}
+	req.Header["NTS"] = []string{"upnp:propchange"}
+	req.Header["SID"] = []string{sub.sid}
+	req.Header["SEQ"] = []string{strconv.FormatUint(uint64(sub.seq), 10)}
+	sub.seq++
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("notification of %s failed: %s", sub.sid, resp.Status)
+	}
+	return nil
+}
+
+// setVariable replaces the value of the variable in values or appends it.
+func setVariable(values tr064.ArgumentValues, variable tr064.ArgumentValue) tr064.ArgumentValues {
+	for i := range values {
+		if values[i].Name == variable.Name {
+			values[i].Value = variable.Value
+			return values
+		}
+	}
+	return append(values, variable)
+}
+
+func writeSubscription(w http.ResponseWriter, sid string, timeout time.Duration) {
+	w.Header()["SID"] = []string{sid}
+	w.Header()["TIMEOUT"] = []string{"Second-" + strconv.Itoa(int(timeout/time.Second))}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,125 @@
+package tr064test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// loginPage is sent by the web interface instead of the requested data if the session ID is invalid.
+const loginPage = "<!DOCTYPE html><html><head><title>FRITZ!Box</title></head><body>Login</body></html>"
+
+type nasEntry struct {
+	Filename string `json:"filename"`
+	Path     string `json:"path"`
+}
+
+type nasBrowseResult struct {
+	Directories []nasEntry `json:"directories"`
+	Files       []nasEntry `json:"files"`
+}
+
+func (s *Server) createURLSID(map[string]string) (map[string]string, error) {
+	return map[string]string{"NewX_AVM-DE_UrlSID": "sid=" + s.newSession()}, nil
+}
+
+// newSession creates a session ID for the web interface.
+func (s *Server) newSession() string {
+	sid := newToken()
+	s.sessions[sid] = true
+	return sid
+}
+
+// serveNAS implements the storage functions of the web interface: browsing and deleting files, downloads and
+// uploads.
+func (s *Server) serveNAS(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := req.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.sessions[req.FormValue("sid")] {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(loginPage))
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/nas/api/data.lua" && req.FormValue("a") == "browse":
+		s.browse(w, req.FormValue("path"))
+	case req.URL.Path == "/nas/api/data.lua" && req.FormValue("a") == "delete":
+		var paths []string
+		if err := json.Unmarshal([]byte(req.FormValue("paths")), &paths); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, p := range paths {
+			delete(s.files, p)
+		}
+		writeJSON(w, map[string]interface{}{"delete_status": "ok"})
+	case req.URL.Path == "/nas/cgi-bin/luacgi_notimeout" && req.FormValue("cmd") == "httpdownload":
+		data, ok := s.files[req.FormValue("cmd_files")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+	case req.URL.Path == "/nas/cgi-bin/nasupload_notimeout" && req.Method == http.MethodPost:
+		file, header, err := req.FormFile("UploadFile")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dir := req.FormValue("dir")
+		s.addDir(dir)
+		s.files[path.Join(dir, header.Filename)] = data
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>Upload successful</body></html>"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// browse lists the files and directories within dir.
+func (s *Server) browse(w http.ResponseWriter, dir string) {
+	if !s.dirs[dir] {
+		http.Error(w, "no such directory", http.StatusNotFound)
+		return
+	}
+	result := nasBrowseResult{Directories: []nasEntry{}, Files: []nasEntry{}}
+	for d := range s.dirs {
+		if d != "/" && parentDir(d) == dir {
+			result.Directories = append(result.Directories, nasEntry{Filename: path.Base(d), Path: d})
+		}
+	}
+	for f := range s.files {
+		if parentDir(f) == dir {
+			result.Files = append(result.Files, nasEntry{Filename: path.Base(f), Path: f})
+		}
+	}
+	sort.Slice(result.Directories, func(i, j int) bool { return result.Directories[i].Path < result.Directories[j].Path })
+	sort.Slice(result.Files, func(i, j int) bool { return result.Files[i].Path < result.Files[j].Path })
+	writeJSON(w, result)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,247 @@
+package tr064test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+type phonebook struct {
+	entries []*entry
+	extraID string
+	name    string
+}
+
+// entry is a phonebook entry. Its elements are kept as they were set by the client.
+type entry struct {
+	XMLName  xml.Name  `xml:"contact"`
+	Elements []element `xml:",any"`
+}
+
+type element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// AddPhonebook creates a phonebook and returns its ID.
+func (s *Server) AddPhonebook(name string) uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.phonebooks = append(s.phonebooks, &phonebook{name: name})
+	return uint16(len(s.phonebooks) - 1)
+}
+
+// AddEntry adds an entry to a phonebook and returns its unique ID.
+// data is the XML of the entry as used by SetPhonebookEntryUID, e.g.
+// “<contact><person><realName>Jane</realName></person></contact>”.
+func (s *Server) AddEntry(pbID uint16, data string) (uint32, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.setEntry(pbID, data)
+}
+
+// Entries returns the XML of the entries of a phonebook in their order.
+func (s *Server) Entries(pbID uint16) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if int(pbID) >= len(s.phonebooks) {
+		return nil
+	}
+	var entries []string
+	for _, e := range s.phonebooks[pbID].entries {
+		entries = append(entries, e.String())
+	}
+	return entries
+}
+
+func (s *Server) deletePhonebookEntryUID(args map[string]string) (map[string]string, error) {
+	pb, err := s.phonebook(args["NewPhonebookID"])
+	if err != nil {
+		return nil, err
+	}
+	i, err := pb.find(args["NewPhonebookEntryUniqueID"])
+	if err != nil {
+		return nil, err
+	}
+	pb.entries = append(pb.entries[:i], pb.entries[i+1:]...)
+	return nil, nil
+}
+
+func (s *Server) getPhonebook(args map[string]string) (map[string]string, error) {
+	pb, err := s.phonebook(args["NewPhonebookID"])
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"NewPhonebookName":    pb.name,
+		"NewPhonebookExtraID": pb.extraID,
+		"NewPhonebookURL":     s.URL + "/phonebook.lua?sid=" + s.newSession() + "&pbid=" + args["NewPhonebookID"],
+	}, nil
+}
+
+// getPhonebookEntry returns the entry at the given index. The end of the list is reported with the error code
+// configured by Options.EndOfListCode.
+func (s *Server) getPhonebookEntry(args map[string]string) (map[string]string, error) {
+	pb, err := s.phonebook(args["NewPhonebookID"])
+	if err != nil {
+		return nil, err
+	}
+	index, err := strconv.ParseUint(args["NewPhonebookEntryID"], 10, 32)
+	if err != nil {
+		return nil, tr064.ErrInvalidArgs
+	}
+	if index >= uint64(len(pb.entries)) {
+		return nil, &tr064.Error{Code: s.opts.EndOfListCode, Description: "Specified Array Index Invalid"}
+	}
+	return map[string]string{"NewPhonebookEntryData": xml.Header + pb.entries[index].String()}, nil
+}
+
+func (s *Server) getPhonebookEntryUID(args map[string]string) (map[string]string, error) {
+	pb, err := s.phonebook(args["NewPhonebookID"])
+	if err != nil {
+		return nil, err
+	}
+	i, err := pb.find(args["NewPhonebookEntryUniqueID"])
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"NewPhonebookEntryData": xml.Header + pb.entries[i].String()}, nil
+}
+
+func (s *Server) getPhonebookList(map[string]string) (map[string]string, error) {
+	ids := make([]string, len(s.phonebooks))
+	for i := range s.phonebooks {
+		ids[i] = strconv.Itoa(i)
+	}
+	return map[string]string{"NewPhonebookList": strings.Join(ids, ",")}, nil
+}
+
+func (s *Server) setPhonebookEntryUID(args map[string]string) (map[string]string, error) {
+	id, err := strconv.ParseUint(args["NewPhonebookID"], 10, 16)
+	if err != nil {
+		return nil, tr064.ErrInvalidArgs
+	}
+	uniqueID, err := s.setEntry(uint16(id), args["NewPhonebookEntryData"])
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"NewPhonebookEntryUniqueID": strconv.FormatUint(uint64(uniqueID), 10)}, nil
+}
+
+func (s *Server) phonebook(id string) (*phonebook, error) {
+	i, err := strconv.ParseUint(id, 10, 16)
+	if err != nil {
+		return nil, tr064.ErrInvalidArgs
+	}
+	if i >= uint64(len(s.phonebooks)) {
+		return nil, tr064.ErrNoSuchArrayEntry
+	}
+	return s.phonebooks[i], nil
+}
+
+// servePhonebookExport serves the XML export of a phonebook (the URL returned by GetPhonebook).
+func (s *Server) servePhonebookExport(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.sessions[req.URL.Query().Get("sid")] {
+		http.Error(w, "invalid session", http.StatusForbidden)
+		return
+	}
+	pb, err := s.phonebook(req.URL.Query().Get("pbid"))
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	var body bytes.Buffer
+	body.WriteString(xml.Header + `<phonebooks><phonebook name="`)
+	_ = xml.EscapeText(&body, []byte(pb.name))
+	body.WriteString(`">`)
+	for _, e := range pb.entries {
+		body.WriteString(e.String())
+	}
+	body.WriteString("</phonebook></phonebooks>")
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write(body.Bytes())
+}
+
+// setEntry adds an entry or replaces the one with the same unique ID.
+// Entries without a unique ID or with the unique ID 0 are new.
+func (s *Server) setEntry(pbID uint16, data string) (uint32, error) {
+	if int(pbID) >= len(s.phonebooks) {
+		return 0, tr064.ErrNoSuchArrayEntry
+	}
+	pb := s.phonebooks[pbID]
+	var e entry
+	if err := xml.Unmarshal([]byte(data), &e); err != nil {
+		return 0, tr064.ErrArgumentValueInvalid
+	}
+
+	uniqueID := e.value("uniqueid")
+	index := -1
+	if uniqueID != "" && uniqueID != "0" {
+		i, err := pb.find(uniqueID)
+		if err != nil {
+			return 0, err
+		}
+		index = i
+	} else {
+		uniqueID = strconv.FormatUint(uint64(s.nextUniqueID), 10)
+		s.nextUniqueID++
+	}
+	e.set("uniqueid", uniqueID)
+	e.set("mod_time", strconv.FormatInt(time.Now().Unix(), 10))
+	if index < 0 {
+		pb.entries = append(pb.entries, &e)
+	} else {
+		pb.entries[index] = &e
+	}
+	id, _ := strconv.ParseUint(uniqueID, 10, 32)
+	return uint32(id), nil
+}
+
+// find returns the index of the entry with the given unique ID.
+func (pb *phonebook) find(uniqueID string) (int, error) {
+	for i, e := range pb.entries {
+		if e.value("uniqueid") == uniqueID {
+			return i, nil
+		}
+	}
+	return 0, tr064.ErrNoSuchArrayEntry
+}
+
+// String returns the XML of the entry.
+func (e *entry) String() string {
+	data, err := xml.Marshal(e)
+	if err != nil {
+		return fmt.Sprintf("<!-- %v -->", err)
+	}
+	return string(data)
+}
+
+func (e *entry) set(name, value string) {
+	var escaped bytes.Buffer
+	_ = xml.EscapeText(&escaped, []byte(value))
+	for i := range e.Elements {
+		if e.Elements[i].XMLName.Local == name {
+			e.Elements[i].Inner = escaped.String()
+			return
+		}
+	}
+	e.Elements = append(e.Elements, element{XMLName: xml.Name{Local: name}, Inner: escaped.String()})
+}
+
+func (e *entry) value(name string) string {
+	for _, el := range e.Elements {
+		if el.XMLName.Local == name {
+			return strings.TrimSpace(el.Inner)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,347 @@
+// Package tr064test provides an in-process fake Fritz!Box for tests of TR-064 clients and the Fritz!Box adapter.
+//
+// The fake serves the device description and the SCPDs of the X_AVM-DE_OnTel, DeviceConfig and DeviceInfo services,
+// authenticates control requests via HTTP digest authentication and keeps the phonebooks and the files of the
+// storage (NAS) in memory. The storage is accessible via the web interface endpoints used for photo transfers:
+//
+//	box := tr064test.NewServer(tr064test.Options{})
+//	defer box.Close()
+//	adapter, err := fritzbox.NewAdapter(ctx, box.URL, tr064test.DefaultPhonebook, tr064test.DefaultUser,
+//		tr064test.DefaultPassword, "", "syncid",
+//		fritzbox.Options{ImageTransport: fritzbox.HTTPTransport, WebURL: box.URL})
+//
+// Faults can be injected per action with FailAction or for arbitrary calls with SetHook.
+// The X_AVM-DE_OnTel service accepts GENA event subscriptions; Notify sends events to the subscribers.
+package tr064test
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// The defaults of the fake.
+const (
+	// DefaultFirmware is the Fritz!OS version reported if Options.Firmware is empty.
+	DefaultFirmware = "154.07.29"
+	// DefaultModel is the model name reported if Options.Model is empty.
+	DefaultModel = "FRITZ!Box 7590"
+	// DefaultPassword is the password accepted if Options.Password is empty.
+	DefaultPassword = "secret"
+	// DefaultPhonebook is the name of the phonebook with ID 0 which every fake provides.
+	DefaultPhonebook = "Telefonbuch"
+	// DefaultUser is the user accepted if Options.User is empty.
+	DefaultUser = "admin"
+)
+
+// digestRealm is the realm of the digest authentication of a Fritz!Box.
+const digestRealm = "F!Box SOAP-Auth"
+
+// Options configures a Server.
+type Options struct {
+	// EndOfListCode is the UPnP error code GetPhonebookEntry returns after the last entry
+	// (default 713, some Fritz!OS versions return 820).
+	EndOfListCode int
+	// Firmware is the Fritz!OS version in the format of the description, e.g. “154.07.29” (default DefaultFirmware).
+	Firmware string
+	// Model is the model name, e.g. “FRITZ!Box 7590” (default DefaultModel).
+	Model string
+	// Password is the password of User (default DefaultPassword).
+	Password string
+	// SubscriptionTimeout limits the durations granted to event subscriptions (default: as requested).
+	SubscriptionTimeout time.Duration
+	// TLS additionally serves HTTPS on the port reported by GetSecurityPort (see SecureURL and Certificate).
+	TLS bool
+	// UnavailableActions are removed from the SCPDs. Calling them fails with UPnP error 401 (Invalid Action).
+	UnavailableActions []string
+	// User is the user accepted by the digest authentication (default DefaultUser).
+	User string
+}
+
+// Server is a fake Fritz!Box. It is safe for concurrent use.
+type Server struct {
+	// URL is the base URL of the fake, e.g. http://127.0.0.1:49152.
+	URL string
+	// SecureURL is the HTTPS base URL of the fake if Options.TLS is set, e.g. https://127.0.0.1:49443.
+	SecureURL string
+
+	httpServer *httptest.Server
+	opts       Options
+	services   []*service
+	tlsServer  *httptest.Server
+
+	mutex         sync.Mutex
+	calls         []Call
+	dirs          map[string]bool
+	eventState    map[string]tr064.ArgumentValues
+	faults        map[string][]Fault
+	files         map[string][]byte
+	hook          Hook
+	nextUniqueID  uint32
+	nonce         string
+	phonebooks    []*phonebook
+	sessions      map[string]bool
+	subscriptions map[string]*subscription
+}
+
+// Call is a TR-064 action or a GENA request (SUBSCRIBE or UNSUBSCRIBE) performed by a client.
+type Call struct {
+	// Action is the name of the action, e.g. “GetPhonebookEntry”, or the method of a GENA request.
+	Action string
+	// Arguments contains the in arguments of the call or the GENA headers (CALLBACK, NT, SID and TIMEOUT).
+	Arguments map[string]string
+	// Service is the service type, e.g. “urn:dslforum-org:service:X_AVM-DE_OnTel:1”.
+	Service string
+	// TLS is true if the call was received via HTTPS.
+	TLS bool
+}
+
+// Fault replaces or delays the regular response to an action.
+type Fault struct {
+	// AfterAction performs the action before the fault replaces the response, e.g. to simulate a lost response.
+	AfterAction bool
+	// Code is the UPnP error code reported in a SOAP fault, e.g. 820.
+	Code int
+	// Delay delays the response, e.g. to provoke client timeouts.
+	// If no other field is set, the action is performed regularly after the delay.
+	Delay time.Duration
+	// Disconnect closes the connection without sending a response.
+	Disconnect bool
+	// HTTPStatus is the status of the response if Code is 0, e.g. 503.
+	HTTPStatus int
+}
+
+// Hook decides about a fault for an authenticated action call. It returns nil for regular processing.
+type Hook func(call Call) *Fault
+
+var digestParam = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// NewServer starts a fake Fritz!Box with an empty phonebook named DefaultPhonebook and an empty internal storage.
+func NewServer(opts Options) *Server {
+	if opts.EndOfListCode == 0 {
+		opts.EndOfListCode = 713
+	}
+	if opts.Firmware == "" {
+		opts.Firmware = DefaultFirmware
+	}
+	if opts.Model == "" {
+		opts.Model = DefaultModel
+	}
+	if opts.Password == "" {
+		opts.Password = DefaultPassword
+	}
+	if opts.User == "" {
+		opts.User = DefaultUser
+	}
+
+	s := &Server{
+		dirs:          map[string]bool{"/": true, "/FRITZ": true, "/FRITZ/fonpix": true},
+		eventState:    map[string]tr064.ArgumentValues{},
+		faults:        map[string][]Fault{},
+		files:         map[string][]byte{},
+		nextUniqueID:  1,
+		nonce:         newToken(),
+		opts:          opts,
+		sessions:      map[string]bool{},
+		subscriptions: map[string]*subscription{},
+	}
+	s.services = newServices(opts.UnavailableActions)
+	s.phonebooks = []*phonebook{{name: DefaultPhonebook}}
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.httpServer.URL
+	if opts.TLS {
+		s.tlsServer = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+		s.SecureURL = s.tlsServer.URL
+	}
+	return s
+}
+
+// AddDir creates a directory of the storage, e.g. “/USB-Stick/FRITZ/fonpix” for a USB storage.
+// Missing parent directories are created, too.
+func (s *Server) AddDir(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.addDir(path)
+}
+
+// AddFile stores a file in the storage, e.g. “/FRITZ/fonpix/1234”.
+func (s *Server) AddFile(path string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.addDir(parentDir(path))
+	s.files[path] = append([]byte(nil), data...)
+}
+
+// Calls returns all action calls received so far in their order.
+func (s *Server) Calls() []Call {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Certificate returns the self-signed certificate of the HTTPS server or nil if Options.TLS is not set.
+func (s *Server) Certificate() *x509.Certificate {
+	if s.tlsServer == nil {
+		return nil
+	}
+	return s.tlsServer.Certificate()
+}
+
+// Close shuts the fake down.
+func (s *Server) Close() {
+	s.httpServer.Close()
+	if s.tlsServer != nil {
+		s.tlsServer.Close()
+	}
+}
+
+// ExpireNonce replaces the nonce of the digest authentication.
+// The next request with the old nonce is rejected as stale.
+func (s *Server) ExpireNonce() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nonce = newToken()
+}
+
+// ExpireSessions invalidates all session IDs of the web interface.
+func (s *Server) ExpireSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions = map[string]bool{}
+}
+
+// FailAction makes the next n calls of the action fail with fault.
+// Faults of FailAction take precedence over the hook.
+func (s *Server) FailAction(action string, n int, fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		s.faults[action] = append(s.faults[action], fault)
+	}
+}
+
+// File returns the content of a file of the storage.
+func (s *Server) File(path string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ok := s.files[path]
+	return append([]byte(nil), data...), ok
+}
+
+// Files returns the paths of all files of the storage in alphabetical order.
+func (s *Server) Files() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// SetHook installs a hook which is called for every authenticated action call (nil removes it).
+// The hook must not block; it may call the methods of the server.
+func (s *Server) SetHook(hook Hook) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hook = hook
+}
+
+func (s *Server) addDir(path string) {
+	for path != "/" && path != "" {
+		s.dirs[path] = true
+		path = parentDir(path)
+	}
+}
+
+// authenticate checks the digest authentication of a request and sends a challenge if it is missing or invalid.
+func (s *Server) authenticate(w http.ResponseWriter, req *http.Request) bool {
+	s.mutex.Lock()
+	nonce := s.nonce
+	s.mutex.Unlock()
+
+	stale := false
+	header := req.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Digest ") {
+		params := map[string]string{}
+		for _, match := range digestParam.FindAllStringSubmatch(header[len("Digest "):], -1) {
+			params[match[1]] = match[2] + match[3]
+		}
+		ha1 := md5Hex(s.opts.User + ":" + digestRealm + ":" + s.opts.Password)
+		ha2 := md5Hex(req.Method + ":" + params["uri"])
+		expected := md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+		if params["qop"] != "" {
+			expected = md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"],
+				params["qop"], ha2}, ":"))
+		}
+		if params["username"] == s.opts.User && params["realm"] == digestRealm && params["response"] == expected {
+			if params["nonce"] == nonce {
+				return true
+			}
+			stale = true
+		}
+	}
+
+	challenge := fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm=MD5, qop="auth"`, digestRealm, nonce)
+	if stale {
+		challenge += ", stale=true"
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == "SUBSCRIBE" || req.Method == "UNSUBSCRIBE":
+		s.serveEvents(w, req)
+	case req.URL.Path == "/tr64desc.xml":
+		s.serveDescription(w)
+	case strings.HasPrefix(req.URL.Path, "/upnp/control/"):
+		s.serveControl(w, req)
+	case req.URL.Path == "/phonebook.lua":
+		s.servePhonebookExport(w, req)
+	case strings.HasPrefix(req.URL.Path, "/nas/"):
+		s.serveNAS(w, req)
+	default:
+		if service := s.findService(func(svc *service) bool { return svc.scpdURL == req.URL.Path }); service != nil {
+			s.serveSCPD(w, service)
+			return
+		}
+		http.NotFound(w, req)
+	}
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random token in the format of the nonces and session IDs of a Fritz!Box.
+func newToken() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func parentDir(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
@@ -0,0 +1,466 @@
+package tr064test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toaster/fritz_sync/tr064"
+)
+
+// The service types provided by the fake.
+const (
+	DeviceConfigService = "urn:dslforum-org:service:DeviceConfig:1"
+	DeviceInfoService   = "urn:dslforum-org:service:DeviceInfo:1"
+	OnTelService        = "urn:dslforum-org:service:X_AVM-DE_OnTel:1"
+)
+
+type service struct {
+	actions        []*action
+	controlURL     string
+	eventSubURL    string
+	id             string
+	scpdURL        string
+	serviceType    string
+	stateVariables []stateVariable
+}
+
+type action struct {
+	// handler performs the action. It is called with the lock of the server held.
+	// Failures are reported as *tr064.Error.
+	handler func(s *Server, args map[string]string) (map[string]string, error)
+	in      []argument
+	name    string
+	out     []argument
+	// public actions may be called without authentication.
+	public bool
+}
+
+type argument struct {
+	name     string
+	variable string
+}
+
+type stateVariable struct {
+	dataType string
+	name     string
+}
+
+type soapEnvelope struct {
+	Body struct {
+		Call soapCall `xml:",any"`
+	} `xml:"Body"`
+}
+
+// soapCall is the action element of a SOAP request.
+type soapCall struct {
+	args tr064.ArgumentValues
+	name string
+}
+
+type descriptionXML struct {
+	XMLName     xml.Name `xml:"urn:dslforum-org:device-1-0 root"`
+	SpecVersion struct {
+		Major int `xml:"major"`
+		Minor int `xml:"minor"`
+	} `xml:"specVersion"`
+	SystemVersion struct {
+		Major   int    `xml:"Major"`
+		Minor   int    `xml:"Minor"`
+		Patch   int    `xml:"Patch"`
+		Display string `xml:"Display"`
+	} `xml:"systemVersion"`
+	Device struct {
+		Type         string       `xml:"deviceType"`
+		FriendlyName string       `xml:"friendlyName"`
+		Manufacturer string       `xml:"manufacturer"`
+		ModelName    string       `xml:"modelName"`
+		Services     []serviceXML `xml:"serviceList>service"`
+	} `xml:"device"`
+}
+
+type serviceXML struct {
+	Type        string `xml:"serviceType"`
+	ID          string `xml:"serviceId"`
+	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
+	SCPDURL     string `xml:"SCPDURL"`
+}
+
+type scpdXML struct {
+	XMLName     xml.Name `xml:"urn:dslforum-org:service-1-0 scpd"`
+	SpecVersion struct {
+		Major int `xml:"major"`
+		Minor int `xml:"minor"`
+	} `xml:"specVersion"`
+	Actions        []actionXML        `xml:"actionList>action"`
+	StateVariables []stateVariableXML `xml:"serviceStateTable>stateVariable"`
+}
+
+type actionXML struct {
+	Name      string        `xml:"name"`
+	Arguments []argumentXML `xml:"argumentList>argument"`
+}
+
+type argumentXML struct {
+	Name          string `xml:"name"`
+	Direction     string `xml:"direction"`
+	StateVariable string `xml:"relatedStateVariable"`
+}
+
+type stateVariableXML struct {
+	SendEvents string `xml:"sendEvents,attr"`
+	Name       string `xml:"name"`
+	DataType   string `xml:"dataType"`
+}
+
+// newServices returns the services of the fake without the unavailable actions.
+func newServices(unavailable []string) []*service {
+	services := []*service{
+		{
+			actions: []*action{
+				{
+					name:    "X_AVM-DE_CreateUrlSID",
+					out:     []argument{{"NewX_AVM-DE_UrlSID", "X_AVM-DE_UrlSID"}},
+					handler: (*Server).createURLSID,
+				},
+			},
+			controlURL:     "/upnp/control/deviceconfig",
+			id:             "urn:DeviceConfig-com:serviceId:DeviceConfig1",
+			scpdURL:        "/deviceconfigSCPD.xml",
+			serviceType:    DeviceConfigService,
+			stateVariables: []stateVariable{{"string", "X_AVM-DE_UrlSID"}},
+		},
+		{
+			actions: []*action{
+				{
+					name:    "GetSecurityPort",
+					out:     []argument{{"NewSecurityPort", "SecurityPort"}},
+					handler: (*Server).getSecurityPort,
+					public:  true,
+				},
+			},
+			controlURL:     "/upnp/control/deviceinfo",
+			id:             "urn:DeviceInfo-com:serviceId:DeviceInfo1",
+			scpdURL:        "/deviceinfoSCPD.xml",
+			serviceType:    DeviceInfoService,
+			stateVariables: []stateVariable{{"ui2", "SecurityPort"}},
+		},
+		{
+			actions: []*action{
+				{
+					name:    "GetPhonebookList",
+					out:     []argument{{"NewPhonebookList", "X_AVM-DE_PhonebookList"}},
+					handler: (*Server).getPhonebookList,
+				},
+				{
+					name: "GetPhonebook",
+					in:   []argument{{"NewPhonebookID", "X_AVM-DE_PhonebookID"}},
+					out: []argument{
+						{"NewPhonebookName", "X_AVM-DE_PhonebookName"},
+						{"NewPhonebookExtraID", "X_AVM-DE_PhonebookExtraID"},
+						{"NewPhonebookURL", "X_AVM-DE_PhonebookURL"},
+					},
+					handler: (*Server).getPhonebook,
+				},
+				{
+					name: "GetPhonebookEntry",
+					in: []argument{
+						{"NewPhonebookID", "X_AVM-DE_PhonebookID"},
+						{"NewPhonebookEntryID", "X_AVM-DE_PhonebookEntryID"},
+					},
+					out:     []argument{{"NewPhonebookEntryData", "X_AVM-DE_PhonebookEntryData"}},
+					handler: (*Server).getPhonebookEntry,
+				},
+				{
+					name: "GetPhonebookEntryUID",
+					in: []argument{
+						{"NewPhonebookID", "X_AVM-DE_PhonebookID"},
+						{"NewPhonebookEntryUniqueID", "X_AVM-DE_PhonebookEntryUniqueID"},
+					},
+					out:     []argument{{"NewPhonebookEntryData", "X_AVM-DE_PhonebookEntryData"}},
+					handler: (*Server).getPhonebookEntryUID,
+				},
+				{
+					name: "SetPhonebookEntryUID",
+					in: []argument{
+						{"NewPhonebookID", "X_AVM-DE_PhonebookID"},
+						{"NewPhonebookEntryData", "X_AVM-DE_PhonebookEntryData"},
+					},
+					out:     []argument{{"NewPhonebookEntryUniqueID", "X_AVM-DE_PhonebookEntryUniqueID"}},
+					handler: (*Server).setPhonebookEntryUID,
+				},
+				{
+					name: "DeletePhonebookEntryUID",
+					in: []argument{
+						{"NewPhonebookID", "X_AVM-DE_PhonebookID"},
+						{"NewPhonebookEntryUniqueID", "X_AVM-DE_PhonebookEntryUniqueID"},
+					},
+					handler: (*Server).deletePhonebookEntryUID,
+				},
+			},
+			controlURL:  "/upnp/control/x_contact",
+			eventSubURL: "/upnp/control/x_contact",
+			id:          "urn:X_AVM-DE_OnTel-com:serviceId:X_AVM-DE_OnTel1",
+			scpdURL:     "/x_contactSCPD.xml",
+			serviceType: OnTelService,
+			stateVariables: []stateVariable{
+				{"string", "X_AVM-DE_PhonebookList"},
+				{"ui2", "X_AVM-DE_PhonebookID"},
+				{"string", "X_AVM-DE_PhonebookName"},
+				{"string", "X_AVM-DE_PhonebookExtraID"},
+				{"string", "X_AVM-DE_PhonebookURL"},
+				{"ui4", "X_AVM-DE_PhonebookEntryID"},
+				{"ui4", "X_AVM-DE_PhonebookEntryUniqueID"},
+				{"string", "X_AVM-DE_PhonebookEntryData"},
+			},
+		},
+	}
+	for _, svc := range services {
+		var actions []*action
+		for _, a := range svc.actions {
+			if !contains(unavailable, a.name) {
+				actions = append(actions, a)
+			}
+		}
+		svc.actions = actions
+	}
+	return services
+}
+
+// UnmarshalXML is part of the xml.Unmarshaler interface.
+func (c *soapCall) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	c.name = start.Name.Local
+	return c.args.UnmarshalXML(d, start)
+}
+
+func (svc *service) findAction(name string) *action {
+	for _, a := range svc.actions {
+		if a.name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+func (s *Server) findService(matches func(*service) bool) *service {
+	for _, svc := range s.services {
+		if matches(svc) {
+			return svc
+		}
+	}
+	return nil
+}
+
+// fault returns the fault for a call: the next one registered with FailAction or the one of the hook.
+func (s *Server) fault(call Call) *Fault {
+	s.mutex.Lock()
+	s.calls = append(s.calls, call)
+	hook := s.hook
+	if faults := s.faults[call.Action]; len(faults) > 0 {
+		s.faults[call.Action] = faults[1:]
+		s.mutex.Unlock()
+		return &faults[0]
+	}
+	s.mutex.Unlock()
+
+	if hook == nil {
+		return nil
+	}
+	return hook(call)
+}
+
+func (s *Server) serveControl(w http.ResponseWriter, req *http.Request) {
+	svc := s.findService(func(svc *service) bool { return svc.controlURL == req.URL.Path })
+	if svc == nil || req.Method != http.MethodPost {
+		http.NotFound(w, req)
+		return
+	}
+	if !isPublic(svc, req) && !s.authenticate(w, req) {
+		return
+	}
+
+	var envelope soapEnvelope
+	if err := xml.NewDecoder(req.Body).Decode(&envelope); err != nil || envelope.Body.Call.name == "" {
+		http.Error(w, "invalid SOAP request", http.StatusBadRequest)
+		return
+	}
+	call := Call{
+		Action:    envelope.Body.Call.name,
+		Arguments: map[string]string{},
+		Service:   svc.serviceType,
+		TLS:       req.TLS != nil,
+	}
+	for _, arg := range envelope.Body.Call.args {
+		call.Arguments[arg.Name] = arg.Value
+	}
+	a := svc.findAction(call.Action)
+	if a == nil || strings.Trim(req.Header.Get("SOAPAction"), `"`) != svc.serviceType+"#"+call.Action {
+		writeFault(w, tr064.ErrInvalidAction)
+		return
+	}
+	for _, arg := range a.in {
+		if _, ok := call.Arguments[arg.name]; !ok {
+			writeFault(w, tr064.ErrInvalidArgs)
+			return
+		}
+	}
+
+	if fault := s.fault(call); fault != nil {
+		if fault.AfterAction {
+			s.mutex.Lock()
+			_, _ = a.handler(s, call.Arguments)
+			s.mutex.Unlock()
+		}
+		time.Sleep(fault.Delay)
+		switch {
+		case fault.Disconnect:
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		case fault.Code != 0:
+			writeFault(w, &tr064.Error{Code: fault.Code, Description: "Injected Fault"})
+			return
+		case fault.HTTPStatus != 0:
+			http.Error(w, http.StatusText(fault.HTTPStatus), fault.HTTPStatus)
+			return
+		}
+	}
+
+	s.mutex.Lock()
+	result, err := a.handler(s, call.Arguments)
+	s.mutex.Unlock()
+	var upnpErr *tr064.Error
+	if errors.As(err, &upnpErr) {
+		writeFault(w, upnpErr)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `<?xml version="1.0"?>`+"\n"+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%sResponse xmlns:u="%s">`,
+		a.name, svc.serviceType)
+	for _, arg := range a.out {
+		fmt.Fprintf(&body, "<%s>", arg.name)
+		_ = xml.EscapeText(&body, []byte(result[arg.name]))
+		fmt.Fprintf(&body, "</%s>", arg.name)
+	}
+	fmt.Fprintf(&body, "</u:%sResponse></s:Body></s:Envelope>", a.name)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	_, _ = w.Write(body.Bytes())
+}
+
+// getSecurityPort reports the port of the HTTPS server.
+func (s *Server) getSecurityPort(map[string]string) (map[string]string, error) {
+	if s.tlsServer == nil {
+		return nil, tr064.ErrActionFailed
+	}
+	u, err := url.Parse(s.SecureURL)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"NewSecurityPort": u.Port()}, nil
+}
+
+func (s *Server) serveDescription(w http.ResponseWriter) {
+	var desc descriptionXML
+	desc.SpecVersion.Major = 1
+	// like a real Fritz!Box, e.g. Major 154 (the hardware), Minor 7 and Patch 29 for “154.07.29”
+	parts := strings.Split(s.opts.Firmware, ".")
+	if len(parts) == 3 {
+		desc.SystemVersion.Major, _ = strconv.Atoi(parts[0])
+		desc.SystemVersion.Minor, _ = strconv.Atoi(parts[1])
+		desc.SystemVersion.Patch, _ = strconv.Atoi(parts[2])
+	}
+	desc.SystemVersion.Display = s.opts.Firmware
+	desc.Device.Type = "urn:dslforum-org:device:InternetGatewayDevice:1"
+	desc.Device.FriendlyName = s.opts.Model
+	desc.Device.Manufacturer = "AVM"
+	desc.Device.ModelName = s.opts.Model
+	for _, svc := range s.services {
+		desc.Device.Services = append(desc.Device.Services, serviceXML{
+			Type:        svc.serviceType,
+			ID:          svc.id,
+			ControlURL:  svc.controlURL,
+			EventSubURL: svc.eventSubURL,
+			SCPDURL:     svc.scpdURL,
+		})
+	}
+	writeXML(w, desc)
+}
+
+func (s *Server) serveSCPD(w http.ResponseWriter, svc *service) {
+	var scpd scpdXML
+	scpd.SpecVersion.Major = 1
+	for _, a := range svc.actions {
+		ax := actionXML{Name: a.name}
+		for _, arg := range a.in {
+			ax.Arguments = append(ax.Arguments, argumentXML{arg.name, "in", arg.variable})
+		}
+		for _, arg := range a.out {
+			ax.Arguments = append(ax.Arguments, argumentXML{arg.name, "out", arg.variable})
+		}
+		scpd.Actions = append(scpd.Actions, ax)
+	}
+	for _, variable := range svc.stateVariables {
+		scpd.StateVariables = append(scpd.StateVariables,
+			stateVariableXML{SendEvents: "no", Name: variable.name, DataType: variable.dataType})
+	}
+	writeXML(w, scpd)
+}
+
+// isPublic reports whether the action requested by req may be called without authentication.
+func isPublic(svc *service, req *http.Request) bool {
+	soapAction := strings.Trim(req.Header.Get("SOAPAction"), `"`)
+	a := svc.findAction(strings.TrimPrefix(soapAction, svc.serviceType+"#"))
+	return a != nil && a.public && strings.HasPrefix(soapAction, svc.serviceType+"#")
+}
+
+func writeFault(w http.ResponseWriter, err *tr064.Error) {
+	var description bytes.Buffer
+	_ = xml.EscapeText(&description, []byte(err.Description))
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?>`+"\n"+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault>`+
+		`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:dslforum-org:control-1-0"><errorCode>%d</errorCode>`+
+		`<errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`,
+		err.Code, description.String())
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(data)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}